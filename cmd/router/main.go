@@ -1,6 +1,9 @@
 // This file contains the launch script for the router service
 // It sets up the RPC server, listens for incoming connections, and serves requests
 // Provide a port number as a command-line argument to specify which port the router should listen on
+// The number of virtual nodes per shard on the hash ring, the failure detection timeouts, and the number of copies of every shard can also be configured
+// Several routers form a replicated router group when each is given the sockets of all of them and its own position in the list
+// Provide a data directory to persist the route table so that it survives restarts
 package main
 
 import (
@@ -9,15 +12,40 @@ import (
 	"log"
 	"net"
 	"net/rpc"
+	"strings"
+	"time"
 )
 
 func main() {
 	// Get command-line arguments
 	port := flag.String("port", "8080", "Port to run the server on")
+	virtualNodes := flag.Int("virtualNodes", 128, "Number of virtual nodes per shard on the hash ring")
+	suspectTimeout := flag.Duration("suspectTimeout", 3*time.Second, "Time without heartbeats after which a server is suspected")
+	downTimeout := flag.Duration("downTimeout", 10*time.Second, "Time without heartbeats after which a server is declared down")
+	replicationFactor := flag.Int("replicationFactor", 1, "Number of servers holding a copy of every shard")
+	peers := flag.String("peers", "", "Socket addresses of every router in the router group, separated by commas (standalone if empty)")
+	me := flag.Int("me", 0, "Position of this router in the list of peers")
+	dataDir := flag.String("dataDir", "", "Directory for the replicated route table (in-memory only if empty)")
 	flag.Parse()
 
+	var peerSockets []string
+	if *peers != "" {
+		peerSockets = strings.Split(*peers, ",")
+	}
+
 	// Register the router with the RPC server
-	routeController := router.NewRouter()
+	routeController, err := router.NewRouter(&router.Config{
+		VirtualNodes:      *virtualNodes,
+		SuspectTimeout:    *suspectTimeout,
+		DownTimeout:       *downTimeout,
+		ReplicationFactor: *replicationFactor,
+		Peers:             peerSockets,
+		Me:                *me,
+		DataDir:           *dataDir,
+	})
+	if err != nil {
+		log.Fatalf("Error initializing router: %v", err)
+	}
 	rpcserver := rpc.NewServer()
 	rpcserver.Register(routeController)
 
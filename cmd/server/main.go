@@ -1,16 +1,36 @@
 // This file contains the launch script for the KVServer service
 // It sets up the RPC server, listens for incoming connections, and serves requests
 // Provide the address, port, number of shards, and router socket as command-line arguments
+// With a replicated router group, list every router socket separated by commas, the server registers with the leader and sends heartbeats to all of them
+// Provide a data directory to persist shards in write-ahead logs and snapshots that are restored on startup
+// In drain mode the server hands its keys off to the remaining servers before exiting on SIGINT or SIGTERM
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"kvstore/pkg/router"
 	"kvstore/pkg/server"
 	"log"
 	"net"
 	"net/rpc"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// leaderRetryInterval is the time between attempts to find the leader of the router group
+	leaderRetryInterval = 500 * time.Millisecond
+	// leaderTimeout bounds how long the server looks for the leader of the router group, for example while the routers elect one
+	leaderTimeout = 30 * time.Second
+	// drainRetryInterval is the time between attempts to drain the server after one failed
+	drainRetryInterval = 5 * time.Second
 )
 
 func main() {
@@ -18,51 +38,222 @@ func main() {
 	address := flag.String("address", "localhost", "Address to bind the server to")
 	port := flag.String("port", "8081", "Port to run the server on")
 	numShards := flag.Int("numShards", 4, "Number of shards to use")
-	routerSocket := flag.String("routerSocket", "", "Socket address of the router")
+	routerSocket := flag.String("routerSocket", "", "Socket addresses of the routers, separated by commas")
+	dataDir := flag.String("dataDir", "", "Directory for shard write-ahead logs (in-memory only if empty)")
+	syncPolicy := flag.String("syncPolicy", "always", "When to flush the write-ahead logs: always, batch, or interval")
+	syncBatchSize := flag.Int("syncBatchSize", 64, "Number of records per flush with the batch sync policy")
+	syncInterval := flag.Duration("syncInterval", 100*time.Millisecond, "Time between flushes with the interval sync policy")
+	snapshotInterval := flag.Duration("snapshotInterval", 5*time.Minute, "Time between shard snapshots that truncate the logs (0 disables snapshots)")
+	snapshotRetention := flag.Int("snapshotRetention", 2, "Number of snapshots to keep per shard")
+	reapInterval := flag.Duration("reapInterval", 100*time.Millisecond, "Time between scans that delete expired keys")
+	reapBatchSize := flag.Int("reapBatchSize", 20, "Number of keys with an expiry sampled per shard and scan")
+	maxValueSize := flag.Int("maxValueSize", 1<<20, "Largest value in bytes accepted by writes (negative for no limit)")
+	txnTimeout := flag.Duration("txnTimeout", 10*time.Second, "Time a distributed transaction may stay prepared before it is resolved without its client")
+	txnRecoveryInterval := flag.Duration("txnRecoveryInterval", time.Second, "Time between scans that resolve timed out distributed transactions")
+	historyRetention := flag.Duration("historyRetention", time.Minute, "Time replaced versions of keys are kept for reads at a point in time")
+	watchBufferSize := flag.Int("watchBufferSize", 1024, "Number of recent changes each shard keeps for watchers to resume from")
+	heartbeatInterval := flag.Duration("heartbeatInterval", time.Second, "Time between heartbeats sent to the router")
+	drain := flag.Bool("drain", false, "Hand all keys off to the remaining servers and deregister before exiting")
 	flag.Parse()
 
+	policy, err := server.ParseSyncPolicy(*syncPolicy)
+	if err != nil {
+		log.Println("Invalid sync policy:", err)
+		return
+	}
+
 	// Register the KVStore service with the RPC server
-	kvserver := server.NewKVServer(*numShards)
+	// Existing snapshots and write-ahead logs are restored before the server starts accepting requests
+	kvserver, err := server.NewKVServer(*numShards, &server.Config{
+		DataDir:             *dataDir,
+		SyncPolicy:          policy,
+		SyncBatchSize:       *syncBatchSize,
+		SyncInterval:        *syncInterval,
+		SnapshotInterval:    *snapshotInterval,
+		SnapshotRetention:   *snapshotRetention,
+		ReapInterval:        *reapInterval,
+		ReapBatchSize:       *reapBatchSize,
+		MaxValueSize:        *maxValueSize,
+		TxnTimeout:          *txnTimeout,
+		TxnRecoveryInterval: *txnRecoveryInterval,
+		HistoryRetention:    *historyRetention,
+		WatchBufferSize:     *watchBufferSize,
+	})
+	if err != nil {
+		log.Println("Error initializing server:", err)
+		return
+	}
 	rpcserver := rpc.NewServer()
 	rpcserver.Register(kvserver)
 
-	// Connect with the router if a socket is provided
 	if *routerSocket == "" {
 		log.Println("Please provide a router socket address using the -routerSocket flag")
 		return
 	}
-	conn, err := rpc.Dial("tcp", *routerSocket)
-	if err != nil {
-		log.Println("Error connecting to router:", err)
-		return
-	}
-
+	routerSockets := strings.Split(*routerSocket, ",")
 	numPort, err := strconv.Atoi(*port)
 	if err != nil {
 		log.Println("Invalid port number:", *port)
 		return
 	}
-	conn.Call("StaticShardRouter.RegisterServer", &router.RegisterServerArgs{
-		Address:   *address,
-		Port:      numPort,
-		NumShards: *numShards,
-	}, nil)
-	conn.Close()
 
 	// Start listening for incoming connections on the specified port
+	// The server has to be serving before it registers since the router migrates keys to it during registration
 	listener, err := net.Listen("tcp", ":"+*port)
 	if err != nil {
 		log.Println("Error starting server: ", err)
+		return
 	}
 	defer listener.Close()
+	go acceptConnections(listener, rpcserver)
+
+	// Register with the router, which returns once the keys routed to this server have been migrated to it
+	err = callLeader(routerSockets, "StaticShardRouter.RegisterServer", &router.RegisterServerArgs{
+		Address:   *address,
+		Port:      numPort,
+		NumShards: *numShards,
+	}, &router.RegisterServerReply{})
+	if err != nil {
+		log.Println("Error registering with router:", err)
+		kvserver.Close()
+		return
+	}
+
+	// Keep telling every router that this server is alive until the process exits
+	for _, socket := range routerSockets {
+		go sendHeartbeats(socket, *address, numPort, *heartbeatInterval)
+	}
 
 	// Print a message indicating that the server is running
 	log.Println("Server is running on port", *port)
 	log.Println("Number of shards:", *numShards)
 
-	// Accept and serve incoming connections
+	// Flush and close the write-ahead logs when the process is asked to stop
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	// In drain mode the server keeps serving until the router has moved every key off it
+	// A failed drain is retried, since the server may still own keys that no other server holds
+	// A second signal skips the hand-off and exits immediately
+	if *drain {
+		log.Println("Draining server")
+		if drainServer(func() error { return deregister(routerSockets, *address, numPort) }, drainRetryInterval, signals) {
+			log.Println("Server drained")
+		} else {
+			log.Println("Drain interrupted")
+		}
+	}
+
+	log.Println("Shutting down server")
+	if err := kvserver.Close(); err != nil {
+		log.Println("Error closing server:", err)
+	}
+}
+
+// sendHeartbeats calls the router's Heartbeat method on a fixed interval
+// The connection to the router is reopened whenever a call fails
+func sendHeartbeats(routerSocket string, address string, port int, interval time.Duration) {
+	var conn *rpc.Client
+	args := &router.HeartbeatArgs{Address: address, Port: port}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if conn == nil {
+			var err error
+			conn, err = rpc.Dial("tcp", routerSocket)
+			if err != nil {
+				log.Println("Error connecting to router for heartbeat:", err)
+				continue
+			}
+		}
+
+		err := conn.Call("StaticShardRouter.Heartbeat", args, &router.HeartbeatReply{})
+		if err == rpc.ErrShutdown || errors.Is(err, io.ErrUnexpectedEOF) {
+			conn.Close()
+			conn = nil
+		}
+		if err != nil {
+			log.Println("Error sending heartbeat:", err)
+		}
+	}
+}
+
+// drainServer calls drain until it succeeds, waiting for the interval after every failure
+// It returns true once the server is drained, and false if a signal arrives first
+func drainServer(drain func() error, interval time.Duration, signals <-chan os.Signal) bool {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			err := drain()
+			if err == nil {
+				return
+			}
+			log.Println("Error draining server, retrying:", err)
+			time.Sleep(interval)
+		}
+	}()
+
+	select {
+	case <-drained:
+		return true
+	case <-signals:
+		return false
+	}
+}
+
+// deregister asks the router to migrate every key off this server and remove its routes
+// It returns once the hand-off is complete
+func deregister(routerSockets []string, address string, port int) error {
+	return callLeader(routerSockets, "StaticShardRouter.DeregisterServer", &router.DeregisterServerArgs{
+		Address: address,
+		Port:    port,
+	}, &router.DeregisterServerReply{})
+}
+
+// callLeader calls a topology method on the leader of the router group
+// The routers are tried in turn until one of them is reachable and does not reply that it is not the leader
+func callLeader(routerSockets []string, method string, args any, reply any) error {
+	var err error
+	deadline := time.Now().Add(leaderTimeout)
+	for time.Now().Before(deadline) {
+		for _, socket := range routerSockets {
+			err = callRouter(socket, method, args, reply)
+			if err == nil {
+				return nil
+			}
+			var serverErr rpc.ServerError
+			if errors.As(err, &serverErr) && !router.IsNotLeader(err) {
+				return err
+			}
+		}
+		time.Sleep(leaderRetryInterval)
+	}
+
+	return fmt.Errorf("no router accepted the call: %v", err)
+}
+
+// callRouter calls a method on a single router over a new connection
+func callRouter(socket string, method string, args any, reply any) error {
+	conn, err := rpc.Dial("tcp", socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to router %s: %v", socket, err)
+	}
+	defer conn.Close()
+
+	return conn.Call(method, args, reply)
+}
+
+// acceptConnections accepts and serves incoming connections until the listener is closed
+func acceptConnections(listener net.Listener, rpcserver *rpc.Server) {
 	for {
 		connection, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err == nil {
 			go rpcserver.ServeConn(connection)
 		} else {
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDrainServerRetries(t *testing.T) {
+	attempts := 0
+	drain := func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("router unavailable")
+		}
+		return nil
+	}
+
+	if !drainServer(drain, time.Millisecond, make(chan os.Signal)) {
+		t.Fatalf("Expected the server to be drained")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected the drain to succeed on the third attempt, got %d attempts", attempts)
+	}
+}
+
+func TestDrainServerInterrupted(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	signals <- os.Interrupt
+
+	// A drain that keeps failing is given up on when a second signal arrives
+	if drainServer(func() error { return errors.New("router unavailable") }, time.Millisecond, signals) {
+		t.Errorf("Expected the drain to be interrupted")
+	}
+}
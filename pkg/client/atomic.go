@@ -0,0 +1,91 @@
+// atomic.go
+// This file contains the client operations that read and write a key in a single step on the server
+// Counters and rate limiters built on Incr and Decr never lose an update to a concurrent client, unlike a Get followed by a Set
+// Increments of keys whose value is not an integer fail with an error that server.IsNotInteger matches
+package client
+
+import (
+	"context"
+	"fmt"
+	"kvstore/pkg/server"
+)
+
+// Incr adds a delta to the integer value of a key and returns the new value
+// Missing keys count as zero
+func (c *Client) Incr(key string, delta int64) (int64, error) {
+	return c.IncrCtx(context.Background(), key, delta)
+}
+
+// IncrCtx is Incr bounded by a context
+func (c *Client) IncrCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	requestID := c.nextRequestID()
+	reply := &server.IncrReply{}
+	err := c.callShard(ctx, key, "KVServer.Incr", func(r routing) any {
+		return &server.IncrArgs{Key: key, Delta: delta, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment key %s: %w", key, err)
+	}
+
+	return reply.Value, nil
+}
+
+// Decr subtracts a delta from the integer value of a key and returns the new value
+// Missing keys count as zero
+func (c *Client) Decr(key string, delta int64) (int64, error) {
+	return c.DecrCtx(context.Background(), key, delta)
+}
+
+// DecrCtx is Decr bounded by a context
+func (c *Client) DecrCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	requestID := c.nextRequestID()
+	reply := &server.DecrReply{}
+	err := c.callShard(ctx, key, "KVServer.Decr", func(r routing) any {
+		return &server.DecrArgs{Key: key, Delta: delta, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrement key %s: %w", key, err)
+	}
+
+	return reply.Value, nil
+}
+
+// Append appends a suffix to the value of a key and returns the length of the new value
+// Missing keys are created with the suffix as their value
+func (c *Client) Append(key string, suffix string) (int, error) {
+	return c.AppendCtx(context.Background(), key, suffix)
+}
+
+// AppendCtx is Append bounded by a context
+func (c *Client) AppendCtx(ctx context.Context, key string, suffix string) (int, error) {
+	requestID := c.nextRequestID()
+	reply := &server.AppendReply{}
+	err := c.callShard(ctx, key, "KVServer.Append", func(r routing) any {
+		return &server.AppendArgs{Key: key, Value: []byte(suffix), ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
+	if err != nil {
+		return 0, fmt.Errorf("failed to append to key %s: %w", key, err)
+	}
+
+	return reply.Length, nil
+}
+
+// GetAndSet sets a key and returns the value it replaced
+// It returns the previous value, a boolean indicating if the key existed, and an error if any occur
+func (c *Client) GetAndSet(key string, value string) (string, bool, error) {
+	return c.GetAndSetCtx(context.Background(), key, value)
+}
+
+// GetAndSetCtx is GetAndSet bounded by a context
+func (c *Client) GetAndSetCtx(ctx context.Context, key string, value string) (string, bool, error) {
+	requestID := c.nextRequestID()
+	reply := &server.GetAndSetReply{}
+	err := c.callShard(ctx, key, "KVServer.GetAndSet", func(r routing) any {
+		return &server.GetAndSetArgs{Key: key, Value: []byte(value), ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to set value for key %s: %w", key, err)
+	}
+
+	return string(reply.Value), reply.Exists, nil
+}
@@ -0,0 +1,218 @@
+// batch.go
+// This file contains the batched client operations MultiGet, MultiSet, and MultiDelete
+// Keys are grouped by the server that owns them, and every server receives a single batched RPC, with all servers called in parallel
+// Each key gets its own result, keys that fail with a retryable error are routed again and retried according to the client's retry policy
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kvstore/pkg/server"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A GetResult is the value of a key read by MultiGet or GetWithVersion along with its version
+// The version is zero if the key does not exist
+type GetResult struct {
+	Value   string
+	Exists  bool
+	Version uint64
+}
+
+// A BatchError is returned by the batched operations when some of their keys failed
+// It holds the error of every failed key, the other keys succeeded
+type BatchError struct {
+	Errors map[string]error
+}
+
+// Error lists the failed keys in order along with their errors
+func (batchErr *BatchError) Error() string {
+	keys := make([]string, 0, len(batchErr.Errors))
+	for key := range batchErr.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	messages := make([]string, len(keys))
+	for i, key := range keys {
+		messages[i] = fmt.Sprintf("%s: %v", key, batchErr.Errors[key])
+	}
+	return fmt.Sprintf("%d keys failed: %s", len(keys), strings.Join(messages, "; "))
+}
+
+// MultiGet retrieves several keys with one RPC per server
+// It returns the value of every key that could be read, and a *BatchError holding the errors of the keys that could not
+func (c *Client) MultiGet(keys []string) (map[string]GetResult, error) {
+	return c.MultiGetCtx(context.Background(), keys)
+}
+
+// MultiGetCtx is MultiGet bounded by a context
+func (c *Client) MultiGetCtx(ctx context.Context, keys []string) (map[string]GetResult, error) {
+	items := make(map[string]server.BatchItem, len(keys))
+	for _, key := range keys {
+		items[key] = server.BatchItem{Key: key}
+	}
+
+	values := make(map[string]GetResult, len(items))
+	var mu sync.Mutex
+	err := callBatch[server.MultiGetReply](ctx, c, items, "KVServer.MultiGet", func(r routing, batch []server.BatchItem) any {
+		return &server.MultiGetArgs{Items: batch, Epoch: r.epoch, Timeout: r.timeout}
+	}, func(reply *server.MultiGetReply) []server.BatchResult {
+		return reply.Results
+	}, func(key string, result server.BatchResult) {
+		mu.Lock()
+		values[key] = GetResult{Value: string(result.Value), Exists: result.Exists, Version: result.Version}
+		mu.Unlock()
+	})
+	return values, err
+}
+
+// MultiSet sets several key-value pairs with one RPC per server
+// It returns a *BatchError holding the errors of the keys that could not be set, the other keys are set
+func (c *Client) MultiSet(entries map[string]string) error {
+	return c.MultiSetCtx(context.Background(), entries)
+}
+
+// MultiSetCtx is MultiSet bounded by a context
+func (c *Client) MultiSetCtx(ctx context.Context, entries map[string]string) error {
+	items := make(map[string]server.BatchItem, len(entries))
+	for key, value := range entries {
+		items[key] = server.BatchItem{Key: key, Value: []byte(value), RequestID: c.nextRequestID()}
+	}
+
+	return callBatch[server.MultiSetReply](ctx, c, items, "KVServer.MultiSet", func(r routing, batch []server.BatchItem) any {
+		return &server.MultiSetArgs{Items: batch, Epoch: r.epoch, Timeout: r.timeout}
+	}, func(reply *server.MultiSetReply) []server.BatchResult {
+		return reply.Results
+	}, nil)
+}
+
+// MultiDelete deletes several keys with one RPC per server
+// It returns a *BatchError holding the errors of the keys that could not be deleted, the other keys are deleted
+func (c *Client) MultiDelete(keys []string) error {
+	return c.MultiDeleteCtx(context.Background(), keys)
+}
+
+// MultiDeleteCtx is MultiDelete bounded by a context
+func (c *Client) MultiDeleteCtx(ctx context.Context, keys []string) error {
+	items := make(map[string]server.BatchItem, len(keys))
+	for _, key := range keys {
+		items[key] = server.BatchItem{Key: key, RequestID: c.nextRequestID()}
+	}
+
+	return callBatch[server.MultiDeleteReply](ctx, c, items, "KVServer.MultiDelete", func(r routing, batch []server.BatchItem) any {
+		return &server.MultiDeleteArgs{Items: batch, Epoch: r.epoch, Timeout: r.timeout}
+	}, func(reply *server.MultiDeleteReply) []server.BatchResult {
+		return reply.Results
+	}, nil)
+}
+
+// A batchCall is the batched RPC of one attempt to a single server
+type batchCall struct {
+	socket string
+	keys   []string
+	items  []server.BatchItem
+}
+
+// callBatch routes every key, calls a batched KVServer method once per server in parallel, and passes the result of every successful key to done
+// The arguments are built by newArgs from the epoch and timeout of the attempt and the items of the server, with their shard indexes filled in
+// Keys that fail with a retryable error are retried, each on the next replica of its shard, after fetching the route table again
+// It returns a *BatchError with the last error of every key that did not succeed
+func callBatch[R any](ctx context.Context, c *Client, items map[string]server.BatchItem, method string, newArgs func(routing, []server.BatchItem) any, results func(*R) []server.BatchResult, done func(string, server.BatchResult)) error {
+	policy := c.config.Retry
+
+	failed := make(map[string]error)
+	replicaOffsets := make(map[string]int)
+	pending := make([]string, 0, len(items))
+	for key := range items {
+		pending = append(pending, key)
+	}
+
+	for attempt := 0; attempt < policy.MaxAttempts && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			if err := policy.wait(ctx, attempt); err != nil {
+				for _, key := range pending {
+					failed[key] = err
+				}
+				break
+			}
+		}
+
+		calls := make(map[string]*batchCall)
+		var epoch int64
+		for i, key := range pending {
+			// Only the first key fetches the table again, the others are routed with the table it fetched
+			replicas, tableEpoch, err := c.getReplicas(ctx, key, attempt > 0 && i == 0)
+			if err != nil {
+				failed[key] = err
+				continue
+			}
+			epoch = tableEpoch
+			replica := replicas[replicaOffsets[key]%len(replicas)]
+			call, exists := calls[replica.Socket]
+			if !exists {
+				call = &batchCall{socket: replica.Socket}
+				calls[replica.Socket] = call
+			}
+			item := items[key]
+			item.ShardIdx = replica.ShardIdx
+			call.keys = append(call.keys, key)
+			call.items = append(call.items, item)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		r := routing{epoch: epoch, timeout: timeoutOf(ctx)}
+		for _, call := range calls {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reply := new(R)
+				err := c.callServer(ctx, call.socket, method, newArgs(r, call.items), reply)
+				if err == nil && len(results(reply)) != len(call.items) {
+					err = fmt.Errorf("expected %d results, got %d", len(call.items), len(results(reply)))
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				for i, key := range call.keys {
+					keyErr := err
+					if err == nil && results(reply)[i].Err != "" {
+						keyErr = errors.New(results(reply)[i].Err)
+					}
+					if keyErr != nil {
+						failed[key] = fmt.Errorf("socket %s and shard index %d: %w", call.socket, call.items[i].ShardIdx, keyErr)
+						continue
+					}
+					delete(failed, key)
+					if done != nil {
+						done(key, results(reply)[i])
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		pending = pending[:0]
+		for key, err := range failed {
+			if ctx.Err() != nil || !policy.Retryable(err) {
+				continue
+			}
+			pending = append(pending, key)
+			// A fresh route table fixes moved keys and stale epochs, other failures mean the replica cannot serve the key
+			if server.IsKeyMoved(err) || server.IsStaleEpoch(err) {
+				replicaOffsets[key] = 0
+			} else {
+				replicaOffsets[key]++
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
@@ -1,63 +1,270 @@
 // client.go
 // This file contains the required internal client structure and methods
 // It provides the basic functionality to connect to a router and initialize a client
+// A client may be given every router of a replicated router group and switches to the next one when its router becomes unreachable
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"kvstore/pkg/router"
+	"kvstore/pkg/server"
 	"net/rpc"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client wraps an RPC client for communication with the router
+// Socket is the address of the router the client is currently connected to, one of the routers it was created with
+// The router mutex guards the connection while the client switches routers
+// The routes are the client's cached copy of the router's route table, fetched on first use and whenever a server reports a stale route
+// Connections to servers are kept in a pool per server, which the pools mutex guards together with the closed flag
+// The ID and the count of requests make up the request IDs of the client's writes
+// The last timestamp keeps the timestamps of the client's writes at a consistency level increasing
 type Client struct {
 	*rpc.Client
-	Socket string
+	Socket        string
+	routers       []string
+	current       int
+	routerMu      sync.Mutex
+	routes        atomic.Pointer[routeTable]
+	config        Config
+	pools         map[string]*connPool
+	closed        bool
+	poolsMu       sync.Mutex
+	healthStop    chan struct{}
+	healthDone    chan struct{}
+	id            string
+	requests      atomic.Uint64
+	lastTimestamp atomic.Int64
 }
 
-// NewClient creates a new Client instance connected to the specified address
-// It returns a pointer to the Client and an error if connection fails
-func NewClient(socket string) (*Client, error) {
-	client, err := rpc.Dial("tcp", socket)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to router at %s: %v", socket, err)
+// Config holds the settings of the connection pools and the retry policy of a Client
+// At most MaxIdleConns connections per server are kept open between operations, and at most MaxOpenConns are open at the same time
+// Idle connections are checked every HealthCheckInterval, and connecting to a server gives up after DialTimeout
+// Zero values select the defaults, except for MaxOpenConns where zero means that the number of open connections is not limited
+// TxnHook, if set, is called at each phase of a distributed commit, and an error from it stops the commit there, which lets tests simulate a crashed coordinator
+type Config struct {
+	MaxIdleConns        int
+	MaxOpenConns        int
+	HealthCheckInterval time.Duration
+	DialTimeout         time.Duration
+	Retry               RetryPolicy
+	TxnHook             func(txnID string, phase TxnPhase) error
+}
+
+const (
+	// defaultMaxIdleConns is the number of idle connections kept per server if the config does not set it
+	defaultMaxIdleConns = 4
+	// defaultHealthCheckInterval is the time between checks of idle connections if the config does not set it
+	defaultHealthCheckInterval = 30 * time.Second
+	// defaultDialTimeout bounds how long connecting to a server may take if the config does not set it
+	defaultDialTimeout = 5 * time.Second
+)
+
+// NewClient creates a new Client instance connected to the first reachable of the specified addresses
+// The addresses should list every router of a router group, so that the client can fail over between them
+// It returns a pointer to the Client and an error if no router can be reached
+func NewClient(sockets ...string) (*Client, error) {
+	return NewClientWithConfig(nil, sockets...)
+}
+
+// NewClientWithConfig creates a new Client instance like NewClient, with the given connection pool settings
+// A nil config uses the defaults
+func NewClientWithConfig(config *Config, sockets ...string) (*Client, error) {
+	if len(sockets) == 0 {
+		return nil, fmt.Errorf("at least one router socket is required")
+	}
+	if config == nil {
+		config = &Config{}
+	}
+	if config.MaxIdleConns < 0 || config.MaxOpenConns < 0 || config.HealthCheckInterval < 0 || config.DialTimeout < 0 {
+		return nil, fmt.Errorf("connection pool settings must not be negative, got: %+v", *config)
 	}
 
 	newClient := &Client{
-		Client: client,
-		Socket: socket,
+		routers:    sockets,
+		config:     *config,
+		pools:      make(map[string]*connPool),
+		healthStop: make(chan struct{}),
+		healthDone: make(chan struct{}),
+		id:         newClientID(),
+	}
+	if newClient.config.MaxIdleConns == 0 {
+		newClient.config.MaxIdleConns = defaultMaxIdleConns
+	}
+	if newClient.config.HealthCheckInterval == 0 {
+		newClient.config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if newClient.config.DialTimeout == 0 {
+		newClient.config.DialTimeout = defaultDialTimeout
+	}
+	newClient.config.Retry = config.Retry.withDefaults()
+	if !newClient.config.Retry.valid() {
+		return nil, fmt.Errorf("retry policy is out of range, got: %+v", config.Retry)
 	}
 
-	return newClient, nil
+	var errs []error
+	for i, socket := range sockets {
+		client, err := rpc.Dial("tcp", socket)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		newClient.Client = client
+		newClient.Socket = socket
+		newClient.current = i
+		go newClient.checkHealth()
+		return newClient, nil
+	}
+
+	return nil, fmt.Errorf("failed to connect to router at %s: %v", strings.Join(sockets, ", "), errors.Join(errs...))
 }
 
-// getShardClient retrieves the shard client for a given key
-// It queries the router and establishes an RPC connection to the appropriate shard server
-// It returns the shard client, the shard index, and an error if any occur
-func (c *Client) getShardClient(key string) (*Client, int, error) {
-	args := &router.GetRouteArgs{Key: key}
-	reply := &router.GetRouteReply{}
-	err := c.Call("StaticShardRouter.GetRoute", args, reply)
-	if err != nil {
-		return nil, 0, fmt.Errorf("route error for key %s: %v", key, err)
+// Close closes the connection to the router and every pooled connection to the servers
+// Connections that are in use by running operations are closed once those operations finish
+func (c *Client) Close() error {
+	c.poolsMu.Lock()
+	if c.closed {
+		c.poolsMu.Unlock()
+		return ErrClientClosed
 	}
+	c.closed = true
+	pools := c.pools
+	c.poolsMu.Unlock()
 
-	shardClient, err := NewClient(reply.Socket)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to create shard client for socket %s: %v", reply.Socket, err)
+	close(c.healthStop)
+	<-c.healthDone
+	for _, pool := range pools {
+		pool.close()
 	}
 
-	return shardClient, reply.ShardIdx, nil
+	c.routerMu.Lock()
+	defer c.routerMu.Unlock()
+
+	return c.Client.Close()
+}
+
+// callRouter calls a router method, switching to the next router whenever the current one cannot be reached
+// Errors returned by a router are passed on as they are, since another router would answer the same
+// Every router is tried once, and the router the call started with is tried again over a fresh connection
+// The call gives up when the context is done
+func (c *Client) callRouter(ctx context.Context, method string, args any, reply any) error {
+	var err error
+	for range len(c.routers) + 1 {
+		c.routerMu.Lock()
+		conn := c.Client
+		c.routerMu.Unlock()
+
+		err = callContext(ctx, conn, method, args, reply)
+		var serverErr rpc.ServerError
+		if err == nil || errors.As(err, &serverErr) || ctx.Err() != nil {
+			return err
+		}
+		c.switchRouter(conn)
+	}
+
+	return fmt.Errorf("%w: no router answered: %v", ErrUnreachable, err)
+}
+
+// switchRouter replaces a failed router connection with a connection to the next reachable router
+// Nothing is done if another call has already replaced the connection
+// If no router can be reached the failed connection is kept, and the next call fails and tries again
+func (c *Client) switchRouter(failed *rpc.Client) {
+	c.routerMu.Lock()
+	defer c.routerMu.Unlock()
+
+	if c.Client != failed {
+		return
+	}
+	failed.Close()
+
+	for i := 1; i <= len(c.routers); i++ {
+		idx := (c.current + i) % len(c.routers)
+		client, err := rpc.Dial("tcp", c.routers[idx])
+		if err != nil {
+			continue
+		}
+		c.Client = client
+		c.Socket = c.routers[idx]
+		c.current = idx
+		return
+	}
+}
+
+// callShard routes a key with the cached route table and calls a KVServer method on the shard that owns it
+// The arguments are built by newArgs for the shard index of the replica being called and the epoch of the table the route came from
+// Replicas are tried in order while they fail with retryable errors, so requests reach the leader of a Raft group even if the route lists a follower first
+// If every replica fails that way, the call is retried according to the client's retry policy, and the route table is fetched again before every retry
+// The context bounds the whole operation, and its error is returned as soon as it is done
+func (c *Client) callShard(ctx context.Context, key string, method string, newArgs func(routing) any, reply any) error {
+	policy := c.config.Retry
+
+	var err error
+	for attempt := range policy.MaxAttempts {
+		if attempt > 0 {
+			if err := policy.wait(ctx, attempt); err != nil {
+				return err
+			}
+		}
+		var replicas []server.ShardLocation
+		var epoch int64
+		replicas, epoch, err = c.getReplicas(ctx, key, attempt > 0)
+		if err != nil {
+			if ctx.Err() != nil || !policy.Retryable(err) {
+				return err
+			}
+			continue
+		}
+
+		err = c.callReplicas(ctx, replicas, epoch, method, newArgs, reply)
+		if err == nil || ctx.Err() != nil || !policy.Retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// callReplicas calls a KVServer method on the replicas of a shard in order until one of them answers or fails with an error that is not retryable
+// The arguments are built by newArgs like for callShard, and the context's error is returned as soon as it is done
+func (c *Client) callReplicas(ctx context.Context, replicas []server.ShardLocation, epoch int64, method string, newArgs func(routing) any, reply any) error {
+	var err error
+	for _, replica := range replicas {
+		args := newArgs(routing{shardIdx: replica.ShardIdx, epoch: epoch, timeout: timeoutOf(ctx)})
+		err = c.callReplica(ctx, replica, method, args, reply)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !c.config.Retry.Retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// callReplica calls a KVServer method on a single shard over a pooled connection
+func (c *Client) callReplica(ctx context.Context, replica server.ShardLocation, method string, args any, reply any) error {
+	if err := c.callServer(ctx, replica.Socket, method, args, reply); err != nil {
+		return fmt.Errorf("socket %s and shard index %d: %w", replica.Socket, replica.ShardIdx, err)
+	}
+	return nil
 }
 
 // getAllSockets retrieves all sockets managed by the router
 // It returns a slice of strings containing the socket addresses and an error if any occur
-func (c *Client) getAllSockets() ([]string, error) {
+func (c *Client) getAllSockets(ctx context.Context) ([]string, error) {
 	args := &router.GetAllSocketsArgs{}
 	reply := &router.GetAllSocketsReply{}
-	err := c.Call("StaticShardRouter.GetAllSockets", args, reply)
+	err := c.callRouter(ctx, "StaticShardRouter.GetAllSockets", args, reply)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get all sockets: %v", err)
+		return nil, fmt.Errorf("unable to get all sockets: %w", err)
 	}
 
 	return reply.Sockets, nil
@@ -0,0 +1,1666 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"kvstore/pkg/client"
+	"kvstore/pkg/router"
+	"kvstore/pkg/server"
+	"math"
+	"net"
+	"net/rpc"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve registers a service on a fresh RPC server listening on a random local port and returns the socket
+func serve(t *testing.T, service any) string {
+	t.Helper()
+	return listen(t, service).Addr().String()
+}
+
+// listen registers a service on a fresh RPC server listening on a random local port and returns the listener
+// Closing the listener also closes every connection it accepted, so that it simulates a crashed server for clients that pool connections
+func listen(t *testing.T, service any) net.Listener {
+	t.Helper()
+
+	rpcserver := rpc.NewServer()
+	if err := rpcserver.Register(service); err != nil {
+		t.Fatalf("Failed to register service: %v", err)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := &crashListener{Listener: inner}
+	t.Cleanup(func() { listener.Close() })
+	go rpcserver.Accept(listener)
+
+	return listener
+}
+
+// A crashListener is a listener that closes every connection it accepted when it is closed
+// It counts the connections it accepted so that tests can check how often clients connect
+type crashListener struct {
+	net.Listener
+	conns    []net.Conn
+	accepted int
+	mu       sync.Mutex
+}
+
+func (listener *crashListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	listener.mu.Lock()
+	listener.conns = append(listener.conns, conn)
+	listener.accepted++
+	listener.mu.Unlock()
+	return conn, nil
+}
+
+func (listener *crashListener) Close() error {
+	err := listener.Listener.Close()
+	listener.dropConns()
+	return err
+}
+
+// dropConns closes every accepted connection while the listener keeps accepting new ones
+func (listener *crashListener) dropConns() {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+
+	for _, conn := range listener.conns {
+		conn.Close()
+	}
+	listener.conns = nil
+}
+
+// acceptedConns returns the number of connections the listener has accepted
+func (listener *crashListener) acceptedConns() int {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+
+	return listener.accepted
+}
+
+// startRouter launches an in-process router and returns its socket
+func startRouter(t *testing.T) string {
+	t.Helper()
+
+	return startRouterWithConfig(t, &router.Config{
+		VirtualNodes:   64,
+		SuspectTimeout: time.Second,
+		DownTimeout:    3 * time.Second,
+	})
+}
+
+// startRouterWithConfig launches an in-process router with the given settings and returns its socket
+func startRouterWithConfig(t *testing.T, config *router.Config) string {
+	t.Helper()
+
+	routeController, err := router.NewRouter(config)
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	t.Cleanup(routeController.Close)
+	return serve(t, routeController)
+}
+
+// startRouterGroup launches n in-process routers that replicate their route table and returns their sockets
+// The returned functions crash a router by closing its listener and every connection to it
+func startRouterGroup(t *testing.T, n int) ([]string, []func()) {
+	t.Helper()
+
+	listeners := make([]*crashListener, n)
+	sockets := make([]string, n)
+	for i := range n {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		listeners[i] = &crashListener{Listener: listener}
+		sockets[i] = listener.Addr().String()
+	}
+
+	stops := make([]func(), n)
+	for i, listener := range listeners {
+		routeController, err := router.NewRouter(&router.Config{
+			VirtualNodes:   64,
+			SuspectTimeout: time.Second,
+			DownTimeout:    time.Minute,
+			Peers:          sockets,
+			Me:             i,
+		})
+		if err != nil {
+			t.Fatalf("NewRouter failed: %v", err)
+		}
+		rpcserver := rpc.NewServer()
+		if err := rpcserver.Register(routeController); err != nil {
+			t.Fatalf("Failed to register service: %v", err)
+		}
+		go rpcserver.Accept(listener)
+
+		var once sync.Once
+		stops[i] = func() {
+			once.Do(func() {
+				listener.Close()
+				routeController.Close()
+			})
+		}
+		t.Cleanup(stops[i])
+	}
+
+	return sockets, stops
+}
+
+// registerWithLeader registers a server with whichever router of a group is the leader and returns the leader's index
+func registerWithLeader(t *testing.T, routerSockets []string, socket string, numShards int) int {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(socket)
+	numPort, _ := strconv.Atoi(port)
+	args := &router.RegisterServerArgs{Address: host, Port: numPort, NumShards: numShards}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, routerSocket := range routerSockets {
+			conn, err := rpc.Dial("tcp", routerSocket)
+			if err != nil {
+				continue
+			}
+			err = conn.Call("StaticShardRouter.RegisterServer", args, &router.RegisterServerReply{})
+			conn.Close()
+			if err == nil {
+				return i
+			}
+			if !router.IsNotLeader(err) {
+				t.Fatalf("RegisterServer failed: %v", err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("No router accepted the registration of %s", socket)
+	return -1
+}
+
+// startServer launches an in-process KVServer and registers it with the router
+func startServer(t *testing.T, routerSocket string, numShards int) (*server.KVServer, string) {
+	t.Helper()
+	return startServerWithConfig(t, routerSocket, numShards, nil)
+}
+
+// startServerWithConfig launches an in-process server with the given settings, registers it with the router, and returns it with its socket
+func startServerWithConfig(t *testing.T, routerSocket string, numShards int, config *server.Config) (*server.KVServer, string) {
+	t.Helper()
+
+	kvserver, err := server.NewKVServer(numShards, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	socket := serve(t, kvserver)
+	registerServer(t, routerSocket, socket, numShards)
+
+	return kvserver, socket
+}
+
+// registerServer registers a server listening on the given socket with the router
+func registerServer(t *testing.T, routerSocket string, socket string, numShards int) {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(socket)
+	numPort, _ := strconv.Atoi(port)
+
+	conn, err := rpc.Dial("tcp", routerSocket)
+	if err != nil {
+		t.Fatalf("Failed to connect to router: %v", err)
+	}
+	defer conn.Close()
+
+	args := &router.RegisterServerArgs{Address: host, Port: numPort, NumShards: numShards}
+	if err := conn.Call("StaticShardRouter.RegisterServer", args, &router.RegisterServerReply{}); err != nil {
+		t.Fatalf("RegisterServer failed: %v", err)
+	}
+}
+
+// sendHeartbeats keeps a server alive on the router until the returned function is called or the test ends
+func sendHeartbeats(t *testing.T, routerSocket string, socket string, interval time.Duration) func() {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(socket)
+	numPort, _ := strconv.Atoi(port)
+	conn, err := rpc.Dial("tcp", routerSocket)
+	if err != nil {
+		t.Fatalf("Failed to connect to router: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				args := &router.HeartbeatArgs{Address: host, Port: numPort}
+				conn.Call("StaticShardRouter.Heartbeat", args, &router.HeartbeatReply{})
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stopHeartbeats := func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+	t.Cleanup(stopHeartbeats)
+	return stopHeartbeats
+}
+
+func TestMigrationOnJoin(t *testing.T) {
+	routerSocket := startRouter(t)
+	first, _ := startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	numKeys := 300
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		if err := c.Set(key, "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	second, _ := startServer(t, routerSocket, 2)
+
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		value, exists, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if !exists || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value 'value%d' for key %s, got '%s' (exists=%v)", i, key, value, exists)
+		}
+	}
+
+	// Every key should live on exactly one server once the migration has finished
+	firstLength, secondLength := &server.LengthReply{}, &server.LengthReply{}
+	first.Length(&server.LengthArgs{}, firstLength)
+	second.Length(&server.LengthArgs{}, secondLength)
+	if firstLength.Length+secondLength.Length != numKeys {
+		t.Errorf("Expected %d keys across both servers, got %d + %d", numKeys, firstLength.Length, secondLength.Length)
+	}
+	if secondLength.Length == 0 {
+		t.Errorf("Expected some keys to move to the new server")
+	}
+}
+
+func TestMigrationOnLeave(t *testing.T) {
+	routerSocket := startRouter(t)
+	first, firstSocket := startServer(t, routerSocket, 2)
+	second, secondSocket := startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	numKeys := 300
+	for i := range numKeys {
+		if err := c.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(secondSocket)
+	numPort, _ := strconv.Atoi(port)
+	conn, err := rpc.Dial("tcp", routerSocket)
+	if err != nil {
+		t.Fatalf("Failed to connect to router: %v", err)
+	}
+	defer conn.Close()
+
+	args := &router.DeregisterServerArgs{Address: host, Port: numPort}
+	if err := conn.Call("StaticShardRouter.DeregisterServer", args, &router.DeregisterServerReply{}); err != nil {
+		t.Fatalf("DeregisterServer failed: %v", err)
+	}
+
+	secondLength := &server.LengthReply{}
+	second.Length(&server.LengthArgs{}, secondLength)
+	if secondLength.Length != 0 {
+		t.Errorf("Expected the deregistered server to be empty, got %d keys", secondLength.Length)
+	}
+	firstLength := &server.LengthReply{}
+	first.Length(&server.LengthArgs{}, firstLength)
+	if firstLength.Length != numKeys {
+		t.Errorf("Expected %d keys on the remaining server, got %d", numKeys, firstLength.Length)
+	}
+
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		value, exists, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if !exists || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value 'value%d' for key %s, got '%s' (exists=%v)", i, key, value, exists)
+		}
+	}
+
+	// The last server cannot be removed since its keys would have nowhere to go
+	host, port, _ = net.SplitHostPort(firstSocket)
+	numPort, _ = strconv.Atoi(port)
+	args = &router.DeregisterServerArgs{Address: host, Port: numPort}
+	if err := conn.Call("StaticShardRouter.DeregisterServer", args, &router.DeregisterServerReply{}); err == nil {
+		t.Errorf("Expected error when deregistering the last server")
+	}
+}
+
+func TestMigrationDestinationCrash(t *testing.T) {
+	source, _ := server.NewKVServer(1, nil)
+	dest, _ := server.NewKVServer(1, nil)
+	listener := listen(t, dest)
+	destSocket := listener.Addr().String()
+
+	source.Set(&server.SetArgs{Key: "copied", Value: []byte("1")}, &server.SetReply{})
+	migrateArgs := &server.MigrateOutArgs{Ranges: []server.HashRange{{Start: 0, End: math.MaxUint64}}, DestSocket: destSocket}
+	if err := source.MigrateOut(migrateArgs, &server.MigrateOutReply{}); err != nil {
+		t.Fatalf("MigrateOut failed: %v", err)
+	}
+
+	// The destination crashes before the routes switch
+	listener.Close()
+	if err := source.Set(&server.SetArgs{Key: "missed", Value: []byte("2")}, &server.SetReply{}); err == nil {
+		t.Errorf("Expected a write the destination did not receive to fail")
+	}
+	if err := source.Set(&server.SetArgs{Key: "rejected", Value: []byte("3")}, &server.SetReply{}); err == nil {
+		t.Errorf("Expected writes to be rejected while the destination is out of sync")
+	}
+	if reply := (&server.GetReply{}); source.Get(&server.GetArgs{Key: "rejected"}, reply) == nil && reply.Exists {
+		t.Errorf("Expected a rejected write not to be applied")
+	}
+
+	// Finishing fails and keeps the keys until the destination has every write the source applied
+	finishArgs := &server.FinishMigrationArgs{DestSocket: destSocket}
+	if err := source.FinishMigration(finishArgs, &server.FinishMigrationReply{}); err == nil {
+		t.Errorf("Expected FinishMigration to fail while the destination is down")
+	}
+	if length := (&server.LengthReply{}); source.Length(&server.LengthArgs{}, length) != nil || length.Length != 2 {
+		t.Errorf("Expected the source to keep its keys, got %d", length.Length)
+	}
+
+	inner, err := net.Listen("tcp", destSocket)
+	if err != nil {
+		t.Fatalf("Failed to restart the destination: %v", err)
+	}
+	restarted := rpc.NewServer()
+	restarted.Register(dest)
+	go restarted.Accept(inner)
+	defer inner.Close()
+
+	if err := source.FinishMigration(finishArgs, &server.FinishMigrationReply{}); err != nil {
+		t.Fatalf("FinishMigration failed after the destination restarted: %v", err)
+	}
+	for _, key := range []string{"copied", "missed"} {
+		if reply := (&server.GetReply{}); dest.Get(&server.GetArgs{Key: key}, reply) != nil || !reply.Exists {
+			t.Errorf("Expected %s to reach the destination", key)
+		}
+	}
+	if length := (&server.LengthReply{}); source.Length(&server.LengthArgs{}, length) != nil || length.Length != 0 {
+		t.Errorf("Expected the source to drop its keys once the migration finished, got %d", length.Length)
+	}
+}
+
+// A StalledServer passes imports on to a KVServer until it is stalled, after which they hang until it is released
+type StalledServer struct {
+	dest    *server.KVServer
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (stalled *StalledServer) Import(args *server.ImportArgs, reply *server.ImportReply) error {
+	select {
+	case <-stalled.stalled:
+		<-stalled.release
+	default:
+	}
+	return stalled.dest.Import(args, reply)
+}
+
+func TestMigrationDestinationStall(t *testing.T) {
+	source, _ := server.NewKVServer(1, nil)
+	dest, _ := server.NewKVServer(1, nil)
+	stalled := &StalledServer{dest: dest, stalled: make(chan struct{}), release: make(chan struct{})}
+
+	rpcserver := rpc.NewServer()
+	rpcserver.RegisterName("KVServer", stalled)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go rpcserver.Accept(listener)
+
+	migrateArgs := &server.MigrateOutArgs{Ranges: []server.HashRange{{Start: 0, End: math.MaxUint64}}, DestSocket: listener.Addr().String()}
+	if err := source.MigrateOut(migrateArgs, &server.MigrateOutReply{}); err != nil {
+		t.Fatalf("MigrateOut failed: %v", err)
+	}
+
+	// A destination that stops answering fails the write instead of holding the source's lock forever
+	close(stalled.stalled)
+	if err := source.Set(&server.SetArgs{Key: "stalled", Value: []byte("1")}, &server.SetReply{}); err == nil {
+		t.Errorf("Expected a write the destination did not answer to fail")
+	}
+	if err := source.Get(&server.GetArgs{Key: "stalled"}, &server.GetReply{}); err != nil {
+		t.Errorf("Expected the source to keep serving reads, got %v", err)
+	}
+
+	// Once the destination answers again, finishing the migration sends it the write it missed
+	close(stalled.release)
+	if err := source.FinishMigration(&server.FinishMigrationArgs{DestSocket: migrateArgs.DestSocket}, &server.FinishMigrationReply{}); err != nil {
+		t.Fatalf("FinishMigration failed: %v", err)
+	}
+	if reply := (&server.GetReply{}); dest.Get(&server.GetArgs{Key: "stalled"}, reply) != nil || !reply.Exists {
+		t.Errorf("Expected the missed write to reach the destination")
+	}
+}
+
+func TestRetryAfterFailedForward(t *testing.T) {
+	// migratingSource returns a server whose migration destination crashed right after the migration started
+	migratingSource := func() *server.KVServer {
+		source, _ := server.NewKVServer(1, nil)
+		dest, _ := server.NewKVServer(1, nil)
+		listener := listen(t, dest)
+
+		migrateArgs := &server.MigrateOutArgs{Ranges: []server.HashRange{{Start: 0, End: math.MaxUint64}}, DestSocket: listener.Addr().String()}
+		if err := source.MigrateOut(migrateArgs, &server.MigrateOutReply{}); err != nil {
+			t.Fatalf("MigrateOut failed: %v", err)
+		}
+		listener.Close()
+		return source
+	}
+
+	// The write is applied on the source before forwarding it fails, so its retry is acknowledged without applying it again
+	source := migratingSource()
+	args := &server.SetArgs{Key: "key", Value: []byte("value"), RequestID: "set-1"}
+	if err := source.Set(args, &server.SetReply{}); err == nil {
+		t.Errorf("Expected the write to fail when it cannot be forwarded")
+	}
+	if err := source.Set(args, &server.SetReply{}); err != nil {
+		t.Errorf("Expected the retry to be acknowledged, got %v", err)
+	}
+	if get := (&server.GetReply{}); source.Get(&server.GetArgs{Key: "key"}, get) != nil || string(get.Value) != "value" {
+		t.Errorf("Expected the write to be applied, got '%s'", get.Value)
+	}
+
+	// The same holds for an increment, whose retry must not apply it again
+	source = migratingSource()
+	incrArgs := &server.IncrArgs{Key: "counter", Delta: 1, RequestID: "incr-1"}
+	if err := source.Incr(incrArgs, &server.IncrReply{}); err == nil {
+		t.Errorf("Expected the increment to fail when it cannot be forwarded")
+	}
+	reply := &server.IncrReply{}
+	if err := source.Incr(incrArgs, reply); err != nil || reply.Value != 1 {
+		t.Errorf("Expected the retry to return 1, got %d (err=%v)", reply.Value, err)
+	}
+	if get := (&server.GetReply{}); source.Get(&server.GetArgs{Key: "counter"}, get) != nil || string(get.Value) != "1" {
+		t.Errorf("Expected the counter to be incremented once, got '%s'", get.Value)
+	}
+}
+
+func TestFailoverToBackup(t *testing.T) {
+	routerSocket := startRouterWithConfig(t, &router.Config{
+		VirtualNodes:      64,
+		SuspectTimeout:    100 * time.Millisecond,
+		DownTimeout:       400 * time.Millisecond,
+		ReplicationFactor: 2,
+	})
+
+	listeners := make([]net.Listener, 3)
+	stops := make([]func(), 3)
+	for i := range listeners {
+		kvserver, err := server.NewKVServer(2, nil)
+		if err != nil {
+			t.Fatalf("NewKVServer failed: %v", err)
+		}
+		listeners[i] = listen(t, kvserver)
+		socket := listeners[i].Addr().String()
+		registerServer(t, routerSocket, socket, 2)
+		stops[i] = sendHeartbeats(t, routerSocket, socket, 20*time.Millisecond)
+	}
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	numKeys := 200
+	for i := range numKeys {
+		if err := c.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// Every shard should have a backup on a different server than its primary
+	route := &router.GetRouteReply{}
+	if err := c.Call("StaticShardRouter.GetRoute", &router.GetRouteArgs{Key: "key0"}, route); err != nil {
+		t.Fatalf("GetRoute failed: %v", err)
+	}
+	if len(route.Replicas) != 2 || route.Replicas[0].Socket == route.Replicas[1].Socket {
+		t.Fatalf("Expected a primary and a backup on two servers, got %v", route.Replicas)
+	}
+
+	// Crash the primary of key0 by closing its listener and stopping its heartbeats
+	failed := slices.IndexFunc(listeners, func(listener net.Listener) bool {
+		return listener.Addr().String() == route.Socket
+	})
+	stops[failed]()
+	listeners[failed].Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		route := &router.GetRouteReply{}
+		if err := c.Call("StaticShardRouter.GetRoute", &router.GetRouteArgs{Key: "key0"}, route); err != nil {
+			t.Fatalf("GetRoute failed: %v", err)
+		}
+		onFailed := slices.ContainsFunc(route.Replicas, func(location server.ShardLocation) bool {
+			return location.Socket == listeners[failed].Addr().String()
+		})
+		if !onFailed && len(route.Replicas) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected key0 to fail over to its backup, got replicas %v", route.Replicas)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		value, exists, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if !exists || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value 'value%d' for key %s after failover, got '%s' (exists=%v)", i, key, value, exists)
+		}
+	}
+
+	if err := c.Set("key0", "updated"); err != nil {
+		t.Fatalf("Set after failover failed: %v", err)
+	}
+}
+
+func TestConsistencyLevels(t *testing.T) {
+	routerSocket := startRouterWithConfig(t, &router.Config{
+		VirtualNodes:      64,
+		SuspectTimeout:    time.Second,
+		DownTimeout:       time.Minute,
+		ReplicationFactor: 3,
+	})
+
+	listeners := make([]net.Listener, 3)
+	for i := range listeners {
+		kvserver, err := server.NewKVServer(1, nil)
+		if err != nil {
+			t.Fatalf("NewKVServer failed: %v", err)
+		}
+		listeners[i] = listen(t, kvserver)
+		socket := listeners[i].Addr().String()
+		registerServer(t, routerSocket, socket, 1)
+		defer sendHeartbeats(t, routerSocket, socket, 20*time.Millisecond)()
+	}
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait until every shard is replicated to all three servers
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		route := &router.GetRouteReply{}
+		if err := c.Call("StaticShardRouter.GetRoute", &router.GetRouteArgs{Key: "key"}, route); err != nil {
+			t.Fatalf("GetRoute failed: %v", err)
+		}
+		if len(route.Replicas) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 replicas of key, got %v", route.Replicas)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := c.SetWithConsistency("key", "first", client.All); err != nil {
+		t.Fatalf("SetWithConsistency failed: %v", err)
+	}
+	for _, level := range []client.ConsistencyLevel{client.One, client.Quorum, client.All} {
+		value, exists, err := c.GetWithConsistency("key", level)
+		if err != nil || !exists || value != "first" {
+			t.Errorf("Expected 'first' at %v, got '%s' (exists=%v, err=%v)", level, value, exists, err)
+		}
+	}
+
+	// With one replica unreachable, ALL fails while QUORUM still succeeds and reads the newest write
+	route := &router.GetRouteReply{}
+	if err := c.Call("StaticShardRouter.GetRoute", &router.GetRouteArgs{Key: "key"}, route); err != nil {
+		t.Fatalf("GetRoute failed: %v", err)
+	}
+	unreachable := slices.IndexFunc(listeners, func(listener net.Listener) bool {
+		return listener.Addr().String() == route.Replicas[2].Socket
+	})
+	listeners[unreachable].Close()
+
+	if err := c.SetWithConsistency("key", "second", client.All); err == nil {
+		t.Errorf("Expected a write at ALL to fail with a replica down")
+	}
+	if err := c.SetWithConsistency("key", "third", client.Quorum); err != nil {
+		t.Fatalf("SetWithConsistency at QUORUM failed: %v", err)
+	}
+	value, exists, err := c.GetWithConsistency("key", client.Quorum)
+	if err != nil || !exists || value != "third" {
+		t.Errorf("Expected 'third' at QUORUM, got '%s' (exists=%v, err=%v)", value, exists, err)
+	}
+
+	if err := c.DeleteWithConsistency("key", client.Quorum); err != nil {
+		t.Fatalf("DeleteWithConsistency failed: %v", err)
+	}
+	if exists, err := c.ExistsWithConsistency("key", client.Quorum); err != nil || exists {
+		t.Errorf("Expected key to be deleted at QUORUM, got exists=%v, err=%v", exists, err)
+	}
+	if _, err := c.ExistsWithConsistency("key", client.All); err == nil {
+		t.Errorf("Expected a read at ALL to fail with a replica down")
+	}
+}
+
+func TestRouterFailover(t *testing.T) {
+	routerSockets, stops := startRouterGroup(t, 3)
+
+	leader := -1
+	for range 2 {
+		kvserver, err := server.NewKVServer(2, nil)
+		if err != nil {
+			t.Fatalf("NewKVServer failed: %v", err)
+		}
+		leader = registerWithLeader(t, routerSockets, serve(t, kvserver), 2)
+	}
+
+	// Wait until every router has applied both registrations
+	deadline := time.Now().Add(5 * time.Second)
+	for _, routerSocket := range routerSockets {
+		conn, err := rpc.Dial("tcp", routerSocket)
+		if err != nil {
+			t.Fatalf("Failed to connect to router: %v", err)
+		}
+		for {
+			reply := &router.GetAllSocketsReply{}
+			if err := conn.Call("StaticShardRouter.GetAllSockets", &router.GetAllSocketsArgs{}, reply); err != nil {
+				t.Fatalf("GetAllSockets failed: %v", err)
+			}
+			if len(reply.Sockets) == 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected router %s to know 2 servers, got %v", routerSocket, reply.Sockets)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		conn.Close()
+	}
+
+	// The client starts on the leader and has to switch to a follower once the leader crashes
+	ordered := append([]string{routerSockets[leader]}, slices.Delete(slices.Clone(routerSockets), leader, leader+1)...)
+	c, err := client.NewClient(ordered...)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	numKeys := 100
+	for i := range numKeys {
+		if err := c.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	stops[leader]()
+
+	// The cached route table keeps the client working without a router
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		value, exists, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("Get after router failover failed: %v", err)
+		}
+		if !exists || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value 'value%d' for key %s after router failover, got '%s' (exists=%v)", i, key, value, exists)
+		}
+	}
+
+	// The remaining routers elect a new leader that accepts topology changes
+	kvserver, err := server.NewKVServer(2, nil)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	if newLeader := registerWithLeader(t, routerSockets, serve(t, kvserver), 2); newLeader == leader {
+		t.Errorf("Expected a new leader after router %d crashed", leader)
+	}
+	// The new table's epoch makes the servers reject the client's cached table, so the client fetches it again from a remaining router
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		if value, exists, err := c.Get(key); err != nil || !exists || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value 'value%d' for key %s after the new server joined, got '%s' (exists=%v, err=%v)", i, key, value, exists, err)
+		}
+	}
+	if c.Socket == routerSockets[leader] {
+		t.Errorf("Expected the client to switch away from the crashed router %s", c.Socket)
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	routerSocket := startRouter(t)
+	kvserver, err := server.NewKVServer(2, nil)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	listener := listen(t, kvserver).(*crashListener)
+	registerServer(t, routerSocket, listener.Addr().String(), 2)
+	routerConns := listener.acceptedConns()
+
+	c, err := client.NewClientWithConfig(&client.Config{MaxIdleConns: 2, MaxOpenConns: 2}, routerSocket)
+	if err != nil {
+		t.Fatalf("NewClientWithConfig failed: %v", err)
+	}
+
+	// Concurrent operations share at most two connections, which stay open for later operations
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Set("key"+strconv.Itoa(i), "value"); err != nil {
+				t.Errorf("Set failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range 50 {
+		if _, _, err := c.Get("key" + strconv.Itoa(i)); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+	if accepted := listener.acceptedConns() - routerConns; accepted > 2 {
+		t.Errorf("Expected at most 2 connections to the server, got %d", accepted)
+	}
+
+	// Pooled connections that the server closed are replaced transparently
+	listener.dropConns()
+	if value, exists, err := c.Get("key0"); err != nil || !exists || value != "value" {
+		t.Errorf("Expected Get to reconnect, got '%s' (exists=%v, err=%v)", value, exists, err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := c.Set("key0", "closed"); err == nil {
+		t.Errorf("Expected Set on a closed client to fail")
+	}
+}
+
+// A hungServer is a KVServer stand-in whose writes never finish
+type hungServer struct{}
+
+func (hungServer) Set(args *server.SetArgs, reply *server.SetReply) error {
+	select {}
+}
+
+func (hungServer) AdvanceEpoch(args *server.AdvanceEpochArgs, reply *server.AdvanceEpochReply) error {
+	return nil
+}
+
+func TestContextDeadline(t *testing.T) {
+	routerSocket := startRouter(t)
+
+	rpcserver := rpc.NewServer()
+	if err := rpcserver.RegisterName("KVServer", hungServer{}); err != nil {
+		t.Fatalf("Failed to register service: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go rpcserver.Accept(listener)
+	registerServer(t, routerSocket, listener.Addr().String(), 1)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.SetCtx(ctx, "key", "value")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected SetCtx to return at its deadline, took %v", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := c.SetCtx(ctx, "key", "value"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the call to be canceled, got %v", err)
+	}
+}
+
+// A flakyServer is a KVServer stand-in that rejects the first writes as moved and records the request ID of every write it receives
+type flakyServer struct {
+	failures   int
+	requestIDs []string
+	mu         sync.Mutex
+}
+
+func (s *flakyServer) Set(args *server.SetArgs, reply *server.SetReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requestIDs = append(s.requestIDs, args.RequestID)
+	if len(s.requestIDs) <= s.failures {
+		return fmt.Errorf("%v: %s", server.ErrKeyMoved, args.Key)
+	}
+	return nil
+}
+
+func (s *flakyServer) AdvanceEpoch(args *server.AdvanceEpochArgs, reply *server.AdvanceEpochReply) error {
+	return nil
+}
+
+func TestRetryPolicy(t *testing.T) {
+	routerSocket := startRouter(t)
+
+	flaky := &flakyServer{failures: 2}
+	rpcserver := rpc.NewServer()
+	if err := rpcserver.RegisterName("KVServer", flaky); err != nil {
+		t.Fatalf("Failed to register service: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go rpcserver.Accept(listener)
+	registerServer(t, routerSocket, listener.Addr().String(), 1)
+
+	policy := client.RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	c, err := client.NewClientWithConfig(&client.Config{Retry: policy}, routerSocket)
+	if err != nil {
+		t.Fatalf("NewClientWithConfig failed: %v", err)
+	}
+	defer c.Close()
+
+	// Every attempt of a write carries the same request ID, so the server can tell retries apart from new writes
+	if err := c.Set("key", "value"); err != nil {
+		t.Fatalf("Expected Set to succeed on its third attempt, got %v", err)
+	}
+	if len(flaky.requestIDs) != 3 || flaky.requestIDs[0] == "" || flaky.requestIDs[1] != flaky.requestIDs[0] || flaky.requestIDs[2] != flaky.requestIDs[0] {
+		t.Errorf("Expected three attempts with the same request ID, got %q", flaky.requestIDs)
+	}
+
+	// Errors the policy does not consider retryable are returned after the first attempt
+	flaky.mu.Lock()
+	flaky.failures, flaky.requestIDs = 1, nil
+	flaky.mu.Unlock()
+	policy.Retryable = func(error) bool { return false }
+	noRetry, err := client.NewClientWithConfig(&client.Config{Retry: policy}, routerSocket)
+	if err != nil {
+		t.Fatalf("NewClientWithConfig failed: %v", err)
+	}
+	defer noRetry.Close()
+	if err := noRetry.Set("key", "value"); !server.IsKeyMoved(err) {
+		t.Errorf("Expected the moved key error, got %v", err)
+	}
+	if len(flaky.requestIDs) != 1 {
+		t.Errorf("Expected a single attempt, got %d", len(flaky.requestIDs))
+	}
+
+	if _, err := client.NewClientWithConfig(&client.Config{Retry: client.RetryPolicy{Jitter: 2}}, routerSocket); err == nil {
+		t.Errorf("Expected a jitter above 1 to be rejected")
+	}
+}
+
+func TestBatchOperations(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	numKeys := 100
+	entries := make(map[string]string, numKeys)
+	keys := make([]string, 0, numKeys)
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		entries[key] = "value" + strconv.Itoa(i)
+		keys = append(keys, key)
+	}
+	if err := c.MultiSet(entries); err != nil {
+		t.Fatalf("MultiSet failed: %v", err)
+	}
+
+	results, err := c.MultiGet(append(keys, "missing"))
+	if err != nil {
+		t.Fatalf("MultiGet failed: %v", err)
+	}
+	for key, value := range entries {
+		if result := results[key]; !result.Exists || result.Value != value {
+			t.Errorf("Expected value '%s' for key %s, got '%s' (exists=%v)", value, key, result.Value, result.Exists)
+		}
+	}
+	if result, ok := results["missing"]; !ok || result.Exists {
+		t.Errorf("Expected a result reporting that the missing key does not exist, got %+v (present=%v)", result, ok)
+	}
+
+	if err := c.MultiDelete(keys[:numKeys/2]); err != nil {
+		t.Fatalf("MultiDelete failed: %v", err)
+	}
+	results, err = c.MultiGet(keys)
+	if err != nil {
+		t.Fatalf("MultiGet failed: %v", err)
+	}
+	for i, key := range keys {
+		if deleted := i < numKeys/2; results[key].Exists == deleted {
+			t.Errorf("Expected key %s to exist=%v, got %v", key, !deleted, results[key].Exists)
+		}
+	}
+	if length, err := c.Length(); err != nil || length != numKeys/2 {
+		t.Errorf("Expected %d keys, got %d (err=%v)", numKeys/2, length, err)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	if set, err := c.SetIfNotExists("counter", "0"); err != nil || !set {
+		t.Fatalf("Expected SetIfNotExists to set the missing key, got set=%v err=%v", set, err)
+	}
+	if set, err := c.SetIfNotExists("counter", "9"); err != nil || set {
+		t.Errorf("Expected SetIfNotExists to leave the existing key, got set=%v err=%v", set, err)
+	}
+
+	// Concurrent increments with optimistic concurrency lose no updates
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				current, err := c.GetWithVersion("counter")
+				if err != nil {
+					t.Errorf("GetWithVersion failed: %v", err)
+					return
+				}
+				n, _ := strconv.Atoi(current.Value)
+				swapped, err := c.CompareAndSwap("counter", current.Version, strconv.Itoa(n+1))
+				if err != nil {
+					t.Errorf("CompareAndSwap failed: %v", err)
+					return
+				}
+				if swapped {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	current, err := c.GetWithVersion("counter")
+	if err != nil || current.Value != "5" {
+		t.Fatalf("Expected the counter to reach 5, got '%s' (err=%v)", current.Value, err)
+	}
+	if deleted, err := c.DeleteIfVersion("counter", current.Version-1); err != nil || deleted {
+		t.Errorf("Expected DeleteIfVersion at a stale version to fail, got deleted=%v err=%v", deleted, err)
+	}
+	if deleted, err := c.DeleteIfVersion("counter", current.Version); err != nil || !deleted {
+		t.Errorf("Expected DeleteIfVersion at the current version to succeed, got deleted=%v err=%v", deleted, err)
+	}
+}
+
+func TestKeyExpiry(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.SetWithTTL("session", "data", 100*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+	if err := c.SetWithTTL("cache", "data", 100*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+	if err := c.SetWithTTL("invalid", "data", 0); err == nil {
+		t.Errorf("Expected SetWithTTL to reject a zero TTL")
+	}
+	if ttl, exists, err := c.TTL("session"); err != nil || !exists || ttl <= 0 {
+		t.Errorf("Expected a positive TTL, got %v (exists=%v, err=%v)", ttl, exists, err)
+	}
+	if exists, err := c.Persist("cache"); err != nil || !exists {
+		t.Errorf("Expected Persist to find the key, got exists=%v err=%v", exists, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, exists, err := c.Get("session"); err != nil || exists {
+		t.Errorf("Expected the expired key to be missing, got exists=%v err=%v", exists, err)
+	}
+	if ttl, exists, err := c.TTL("cache"); err != nil || !exists || ttl != 0 {
+		t.Errorf("Expected the persisted key to exist without a TTL, got %v (exists=%v, err=%v)", ttl, exists, err)
+	}
+	if exists, err := c.Expire("session", time.Second); err != nil || exists {
+		t.Errorf("Expected Expire to report the expired key as missing, got exists=%v err=%v", exists, err)
+	}
+}
+
+func TestScanAndPrefix(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	entries := make(map[string]string)
+	for i := range 30 {
+		entries[fmt.Sprintf("user/%02d", i)] = strconv.Itoa(i)
+		entries[fmt.Sprintf("order/%02d", i)] = strconv.Itoa(i)
+	}
+	if err := c.MultiSet(entries); err != nil {
+		t.Fatalf("MultiSet failed: %v", err)
+	}
+
+	// Paging through the whole key space lists every key once, in order
+	var keys []string
+	start := ""
+	for pages := 0; ; pages++ {
+		page, err := c.Scan(start, "", 7)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(page.Entries) > 7 || pages > 20 {
+			t.Fatalf("Expected pages of at most 7 keys, got %d keys on page %d", len(page.Entries), pages)
+		}
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		start = page.Cursor
+	}
+	if len(keys) != len(entries) || !slices.IsSorted(keys) {
+		t.Errorf("Expected %d sorted keys, got %d (sorted=%v)", len(entries), len(keys), slices.IsSorted(keys))
+	}
+
+	users, err := c.Prefix("user/")
+	if err != nil {
+		t.Fatalf("Prefix failed: %v", err)
+	}
+	if len(users) != 30 || users[0].Key != "user/00" || users[29].Key != "user/29" || users[29].Value != "29" {
+		t.Errorf("Expected user/00 through user/29, got %d keys", len(users))
+	}
+	if end := client.PrefixEnd("user/"); end != "user0" {
+		t.Errorf("Expected the prefix to end at user0, got %q", end)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	value := []byte{0, 1, 0xfe, 0xff, 0}
+	if err := c.SetBytes("binary", value); err != nil {
+		t.Fatalf("SetBytes failed: %v", err)
+	}
+	got, exists, err := c.GetBytes("binary")
+	if err != nil || !exists || !bytes.Equal(got, value) {
+		t.Errorf("Expected %x, got %x (exists=%v, err=%v)", value, got, exists, err)
+	}
+	if text, _, err := c.Get("binary"); err != nil || text != string(value) {
+		t.Errorf("Expected Get to return the same bytes, got %q (err=%v)", text, err)
+	}
+	if got, exists, err := c.GetBytes("missing"); err != nil || exists || got != nil {
+		t.Errorf("Expected a missing key, got %x (exists=%v, err=%v)", got, exists, err)
+	}
+
+	// Values over the server's default limit are rejected without being retried
+	err = c.SetBytes("large", make([]byte, 1<<20+1))
+	if !server.IsValueTooLarge(err) || client.IsRetryable(err) {
+		t.Errorf("Expected a non-retryable ErrValueTooLarge, got %v", err)
+	}
+}
+
+type profile struct {
+	Name string
+	Age  int
+}
+
+// point is encoded by hand, like a generated protobuf-style message
+type point struct {
+	X, Y byte
+}
+
+func (p *point) MarshalBinary() ([]byte, error) {
+	return []byte{p.X, p.Y}, nil
+}
+
+func (p *point) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return fmt.Errorf("expected 2 bytes, got %d", len(data))
+	}
+	p.X, p.Y = data[0], data[1]
+	return nil
+}
+
+func TestTypedMap(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	profiles := client.NewMap[int, profile](c, client.JSONCodec[int]{}, client.JSONCodec[profile]{})
+	if err := profiles.Set(42, profile{Name: "ada", Age: 36}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got, exists, err := profiles.Get(42); err != nil || !exists || got != (profile{Name: "ada", Age: 36}) {
+		t.Errorf("Expected the stored profile, got %+v (exists=%v, err=%v)", got, exists, err)
+	}
+	if _, exists, err := profiles.Get(7); err != nil || exists {
+		t.Errorf("Expected a missing key, got exists=%v err=%v", exists, err)
+	}
+
+	gobs := client.NewMap[string, []string](c, client.StringCodec{}, client.GobCodec[[]string]{})
+	if err := gobs.Set("tags", []string{"a", "b"}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got, _, err := gobs.Get("tags"); err != nil || !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("Expected [a b], got %v (err=%v)", got, err)
+	}
+
+	points := client.NewMap[string, point](c, client.StringCodec{}, client.NewBinaryCodec[point]())
+	if err := points.Set("origin", point{X: 1, Y: 2}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got, _, err := points.Get("origin"); err != nil || got != (point{X: 1, Y: 2}) {
+		t.Errorf("Expected {1 2}, got %+v (err=%v)", got, err)
+	}
+
+	// Values that do not decode fail with a codec error, transport failures do not
+	c.Set("broken", "not a point")
+	_, exists, err := points.Get("broken")
+	if !client.IsCodecError(err) || !exists || client.IsRetryable(err) {
+		t.Errorf("Expected a codec error for an existing key, got exists=%v err=%v", exists, err)
+	}
+	invalid := client.NewMap[string, func()](c, client.StringCodec{}, client.JSONCodec[func()]{})
+	if err := invalid.Set("func", func() {}); !client.IsCodecError(err) {
+		t.Errorf("Expected a codec error for an unencodable value, got %v", err)
+	}
+	c.Close()
+	if err := profiles.Set(1, profile{}); err == nil || client.IsCodecError(err) {
+		t.Errorf("Expected a transport error from a closed client, got %v", err)
+	}
+}
+
+func TestAtomicOperations(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Incr("hits", 5); err != nil {
+				t.Errorf("Incr failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, err := c.Decr("hits", 10); err != nil || value != 90 {
+		t.Errorf("Expected 90 after the decrement, got %d (err=%v)", value, err)
+	}
+
+	c.Set("name", "kv")
+	if _, err := c.Incr("name", 1); !server.IsNotInteger(err) || client.IsRetryable(err) {
+		t.Errorf("Expected a non-retryable ErrNotInteger, got %v", err)
+	}
+	if length, err := c.Append("name", "store"); err != nil || length != 7 {
+		t.Errorf("Expected a length of 7, got %d (err=%v)", length, err)
+	}
+	if previous, exists, err := c.GetAndSet("name", "reset"); err != nil || !exists || previous != "kvstore" {
+		t.Errorf("Expected the previous value 'kvstore', got %q (exists=%v, err=%v)", previous, exists, err)
+	}
+	if value, _, err := c.Get("name"); err != nil || value != "reset" {
+		t.Errorf("Expected 'reset', got %q (err=%v)", value, err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 4)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	ok, err := c.Txn().IfMissing("{user:42}:profile").Set("{user:42}:profile", "ada").Set("{user:42}:settings", "dark").Commit()
+	if err != nil || !ok {
+		t.Fatalf("Expected the first transaction to apply, got ok=%v err=%v", ok, err)
+	}
+	ok, err = c.Txn().IfMissing("{user:42}:profile").Set("{user:42}:settings", "light").Commit()
+	if err != nil || ok {
+		t.Errorf("Expected the second transaction to fail its compare, got ok=%v err=%v", ok, err)
+	}
+
+	current, _ := c.GetWithVersion("{user:42}:settings")
+	ok, err = c.Txn().IfVersion("{user:42}:settings", current.Version).IfValue("{user:42}:profile", "ada").Delete("{user:42}:profile").Commit()
+	if err != nil || !ok {
+		t.Errorf("Expected the third transaction to apply, got ok=%v err=%v", ok, err)
+	}
+	if exists, _ := c.Exists("{user:42}:profile"); exists {
+		t.Errorf("Expected the profile to be deleted")
+	}
+
+	if _, err := c.Txn().Set("{a}x", "1").Set("{b}x", "2").Commit(); !server.IsCrossShardTxn(err) {
+		t.Errorf("Expected ErrCrossShardTxn, got %v", err)
+	}
+}
+
+func TestDistributedTransactions(t *testing.T) {
+	routerSocket := startRouter(t)
+	config := &server.Config{TxnTimeout: 200 * time.Millisecond, TxnRecoveryInterval: 20 * time.Millisecond}
+	startServerWithConfig(t, routerSocket, 2, config)
+	startServerWithConfig(t, routerSocket, 2, config)
+
+	c, err := client.NewClientWithConfig(&client.Config{Retry: client.RetryPolicy{MaxAttempts: 1}}, routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	// Enough keys to span every shard of both servers
+	keys := make([]string, 8)
+	for i := range keys {
+		keys[i] = "account:" + strconv.Itoa(i)
+		c.Set(keys[i], "10")
+	}
+	transfer := func(c *client.Client, from string, to string) *client.Txn {
+		txn := c.Transaction()
+		for _, key := range keys {
+			txn.IfValue(key, from)
+		}
+		for _, key := range keys {
+			txn.Set(key, to)
+		}
+		return txn
+	}
+	expectAll := func(value string) bool {
+		for _, key := range keys {
+			if current, _, err := c.Get(key); err != nil || current != value {
+				return false
+			}
+		}
+		return true
+	}
+
+	if ok, err := transfer(c, "10", "20").Commit(); err != nil || !ok {
+		t.Fatalf("Expected the transaction to commit, got ok=%v err=%v", ok, err)
+	}
+	if !expectAll("20") {
+		t.Fatalf("Expected every key to be committed")
+	}
+	if ok, err := transfer(c, "10", "30").Commit(); err != nil || ok {
+		t.Errorf("Expected the transaction to fail its compares, got ok=%v err=%v", ok, err)
+	}
+
+	// A coordinator that crashes after preparing leaves the keys locked until the servers abort the transaction
+	crash := func(phase client.TxnPhase) *client.Client {
+		crashing, err := client.NewClientWithConfig(&client.Config{TxnHook: func(txnID string, reached client.TxnPhase) error {
+			if reached == phase {
+				return errors.New("coordinator crashed")
+			}
+			return nil
+		}}, routerSocket)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		t.Cleanup(func() { crashing.Close() })
+		return crashing
+	}
+	if _, err := transfer(crash(client.TxnPrepared), "20", "40").Commit(); err == nil {
+		t.Fatalf("Expected the hook to stop the commit")
+	}
+	if err := c.Set(keys[0], "0"); !server.IsKeyLocked(err) || !client.IsRetryable(err) {
+		t.Errorf("Expected a retryable ErrKeyLocked for a prepared key, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Set(keys[0], "20") != nil && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !expectAll("20") {
+		t.Errorf("Expected the interrupted transaction to be aborted")
+	}
+
+	// A coordinator that crashes after committing the primary leaves the other participants to commit on their own
+	if ok, err := transfer(crash(client.TxnCommitted), "20", "50").Commit(); err == nil || !ok {
+		t.Fatalf("Expected the hook to stop a committed transaction, got ok=%v err=%v", ok, err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for !expectAll("50") && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !expectAll("50") {
+		t.Errorf("Expected the interrupted transaction to be committed on every participant")
+	}
+}
+
+func TestSnapshotReads(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServerWithConfig(t, routerSocket, 2, &server.Config{HistoryRetention: 300 * time.Millisecond})
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	c.Set("account:checking", "100")
+	c.Set("account:savings", "0")
+	snapshot := c.Snapshot()
+	c.Set("account:checking", "40")
+	c.Set("account:savings", "60")
+	c.Delete("account:checking")
+
+	for key, expected := range map[string]string{"account:checking": "100", "account:savings": "0"} {
+		if value, exists, err := snapshot.Get(key); err != nil || !exists || value != expected {
+			t.Errorf("Expected '%s' for %s in the snapshot, got %q (exists=%v, err=%v)", expected, key, value, exists, err)
+		}
+	}
+	if _, exists, err := c.GetAt("account:checking", time.Now()); err != nil || exists {
+		t.Errorf("Expected the deleted key to be missing now, got exists=%v err=%v", exists, err)
+	}
+
+	// Once the servers collect its versions, the snapshot can no longer be read
+	time.Sleep(time.Second)
+	if _, _, err := snapshot.Get("account:savings"); !server.IsCompacted(err) || client.IsRetryable(err) {
+		t.Errorf("Expected a non-retryable ErrCompacted, got %v", err)
+	}
+}
+
+func TestSnapshotOfDistributedTransaction(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	// Enough keys to span every shard of both servers
+	keys := make([]string, 8)
+	for i := range keys {
+		keys[i] = "balance:" + strconv.Itoa(i)
+		c.Set(keys[i], "0")
+	}
+	readAll := func(snapshot *client.Snapshot) []string {
+		values := make([]string, len(keys))
+		for i, key := range keys {
+			value, _, err := snapshot.Get(key)
+			if err != nil {
+				t.Errorf("Snapshot read of %s failed: %v", key, err)
+			}
+			values[i] = value
+		}
+		return values
+	}
+	expectAtomic := func(values []string) {
+		t.Helper()
+		for _, value := range values[1:] {
+			if value != values[0] {
+				t.Errorf("Expected the snapshot to see all of the transaction's writes or none, got %v", values)
+				return
+			}
+		}
+	}
+
+	// A snapshot taken once the primary has committed reads the other participants while they are still prepared
+	reads := make(chan []string, 1)
+	coordinator, err := client.NewClientWithConfig(&client.Config{TxnHook: func(txnID string, phase client.TxnPhase) error {
+		if phase == client.TxnCommitted {
+			snapshot := c.Snapshot()
+			go func() { reads <- readAll(snapshot) }()
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}}, routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer coordinator.Close()
+
+	txn := coordinator.Transaction()
+	for _, key := range keys {
+		txn.Set(key, "1")
+	}
+	if ok, err := txn.Commit(); err != nil || !ok {
+		t.Fatalf("Expected the transaction to commit, got ok=%v err=%v", ok, err)
+	}
+	expectAtomic(<-reads)
+
+	// Snapshots racing transactions never see part of one
+	for round := 2; round < 12; round++ {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			txn := c.Transaction()
+			for _, key := range keys {
+				txn.Set(key, strconv.Itoa(round))
+			}
+			if ok, err := txn.Commit(); err != nil || !ok {
+				t.Errorf("Expected the transaction to commit, got ok=%v err=%v", ok, err)
+			}
+		}()
+		expectAtomic(readAll(c.Snapshot()))
+		<-done
+	}
+}
+
+func TestWatch(t *testing.T) {
+	routerSocket := startRouter(t)
+	config := &server.Config{WatchBufferSize: 8}
+	startServerWithConfig(t, routerSocket, 2, config)
+	startServerWithConfig(t, routerSocket, 2, config)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	next := func(events <-chan client.WatchEvent) client.WatchEvent {
+		t.Helper()
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("Expected an event, the watch was closed")
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for an event")
+		}
+		return client.WatchEvent{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prefixEvents := c.WatchPrefixCtx(ctx, "config:")
+	keyEvents := c.WatchCtx(ctx, "config:mode")
+
+	c.Set("config:mode", "dark")
+	c.Set("config:level", "3")
+	c.Set("other", "1")
+	c.Delete("config:mode")
+
+	put, deleted := next(keyEvents), next(keyEvents)
+	if put.Type != client.EventPut || put.Value != "dark" || put.PrevVersion != 0 {
+		t.Errorf("Expected a put of 'dark' to a new key, got %+v", put)
+	}
+	if deleted.Type != client.EventDelete || deleted.PrevValue != "dark" || deleted.PrevVersion != put.Version {
+		t.Errorf("Expected a delete of 'dark', got %+v", deleted)
+	}
+
+	// Changes of keys on different shards may arrive in any order, but every one of them arrives
+	seen := make(map[string][]client.EventType)
+	for range 3 {
+		event := next(prefixEvents)
+		if event.Err != nil {
+			t.Fatalf("Prefix watch failed: %v", event.Err)
+		}
+		seen[event.Key] = append(seen[event.Key], event.Type)
+	}
+	if !slices.Equal(seen["config:mode"], []client.EventType{client.EventPut, client.EventDelete}) || !slices.Equal(seen["config:level"], []client.EventType{client.EventPut}) {
+		t.Errorf("Expected the changes of both config keys, got %v", seen)
+	}
+
+	cancel()
+	for range keyEvents {
+	}
+	for range prefixEvents {
+	}
+
+	// A watch resumes after the version of the last event it delivered
+	resumed := c.WatchFrom("config:mode", put.Version)
+	if event := next(resumed); event.Type != client.EventDelete || event.Version != deleted.Version {
+		t.Errorf("Expected the resumed watch to deliver the delete again, got %+v", event)
+	}
+
+	// A watch that resumes from a change the shard no longer holds fails
+	for i := range 10 {
+		c.Set("config:mode", strconv.Itoa(i))
+	}
+	stale := c.WatchFrom("config:mode", put.Version)
+	if event := next(stale); !server.IsRevisionCompacted(event.Err) {
+		t.Errorf("Expected ErrRevisionCompacted, got %+v", event)
+	}
+	if _, ok := <-stale; ok {
+		t.Errorf("Expected the failed watch to be closed")
+	}
+}
+
+func TestWatchMovedKey(t *testing.T) {
+	routerSocket := startRouter(t)
+	startServer(t, routerSocket, 2)
+
+	c, err := client.NewClient(routerSocket)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Close()
+
+	// Rewriting a few other keys takes the shards' revisions far past the versions of the watched keys
+	numKeys := 20
+	for i := range numKeys {
+		c.Set("watched"+strconv.Itoa(i), "before")
+	}
+	for i := range 100 {
+		c.Set("other"+strconv.Itoa(i%4), strconv.Itoa(i))
+	}
+	watches := make([]<-chan client.WatchEvent, numKeys)
+	for i := range numKeys {
+		watches[i] = c.Watch("watched" + strconv.Itoa(i))
+	}
+
+	// Keys that move to the new server are on a shard that counts revisions of its own, so their watches end instead of missing changes
+	startServer(t, routerSocket, 2)
+	for i := range numKeys {
+		c.Set("watched"+strconv.Itoa(i), "after")
+	}
+	moved := 0
+	for i, events := range watches {
+		select {
+		case event := <-events:
+			switch {
+			case server.IsRevisionCompacted(event.Err):
+				moved++
+			case event.Err != nil || event.Value != "after":
+				t.Errorf("Expected a put of 'after' to watched%d or ErrRevisionCompacted, got %+v", i, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("The change of watched%d was lost", i)
+		}
+	}
+	if moved == 0 {
+		t.Errorf("Expected some watched keys to move to the new server")
+	}
+}
@@ -0,0 +1,119 @@
+// codec.go
+// This file contains the codecs a Map uses to turn its keys and values into the bytes the store holds
+// JSONCodec and GobCodec handle most Go types, BinaryCodec uses the types' own binary encoding, such as the one of generated protobuf-style messages
+// Key codecs must encode equal keys to the same bytes, which gob does not guarantee for maps, so keys should be strings, numbers, or structs of them
+package client
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A Codec encodes values of a type to bytes and decodes them back
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// A CodecError is returned by a Map when a key or value could not be encoded or decoded
+// It is never retried, and since the store was either not called or answered, it tells codec failures apart from transport errors
+type CodecError struct {
+	Op  string
+	Key string
+	Err error
+}
+
+// Error describes the failed operation along with the key it failed for
+func (codecErr *CodecError) Error() string {
+	return fmt.Sprintf("failed to %s key %s: %v", codecErr.Op, codecErr.Key, codecErr.Err)
+}
+
+// Unwrap returns the error of the codec
+func (codecErr *CodecError) Unwrap() error {
+	return codecErr.Err
+}
+
+// IsCodecError reports whether an error returned by a Map means that a key or value could not be encoded or decoded
+func IsCodecError(err error) bool {
+	var codecErr *CodecError
+	return errors.As(err, &codecErr)
+}
+
+// StringCodec stores strings as their bytes, it is the natural codec for string keys
+type StringCodec struct{}
+
+// Encode returns the bytes of the string
+func (StringCodec) Encode(value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+// Decode returns the bytes as a string
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// JSONCodec stores values as JSON
+type JSONCodec[T any] struct{}
+
+// Encode marshals the value to JSON
+func (JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// Decode unmarshals JSON into a new value
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// GobCodec stores values with encoding/gob, every value carries its own type description
+type GobCodec[T any] struct{}
+
+// Encode encodes the value with a new gob encoder
+func (GobCodec[T]) Encode(value T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes a gob stream into a new value
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// A BinaryMessage is a pointer to a type that encodes itself to bytes, like a generated protobuf-style message
+type BinaryMessage[T any] interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// BinaryCodec stores values with their MarshalBinary and UnmarshalBinary methods
+// NewBinaryCodec creates one without spelling out the pointer type
+type BinaryCodec[T any, PT BinaryMessage[T]] struct{}
+
+// NewBinaryCodec returns the binary codec of a type whose pointer implements BinaryMessage
+func NewBinaryCodec[T any, PT BinaryMessage[T]]() BinaryCodec[T, PT] {
+	return BinaryCodec[T, PT]{}
+}
+
+// Encode calls the value's MarshalBinary
+func (BinaryCodec[T, PT]) Encode(value T) ([]byte, error) {
+	return PT(&value).MarshalBinary()
+}
+
+// Decode calls UnmarshalBinary on a new value
+func (BinaryCodec[T, PT]) Decode(data []byte) (T, error) {
+	var value T
+	err := PT(&value).UnmarshalBinary(data)
+	return value, err
+}
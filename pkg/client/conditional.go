@@ -0,0 +1,84 @@
+// conditional.go
+// This file contains the client operations that read versions and write conditionally
+// Every key has a version that changes with each write, and conditional writes only apply if the key still has the version the caller read
+// A typical read-modify-write reads the key with GetWithVersion and writes it back with CompareAndSwap, starting over if the swap fails
+package client
+
+import (
+	"context"
+	"fmt"
+	"kvstore/pkg/server"
+)
+
+// GetWithVersion retrieves the value of a key together with its current version
+func (c *Client) GetWithVersion(key string) (GetResult, error) {
+	return c.GetWithVersionCtx(context.Background(), key)
+}
+
+// GetWithVersionCtx is GetWithVersion bounded by a context
+func (c *Client) GetWithVersionCtx(ctx context.Context, key string) (GetResult, error) {
+	reply := &server.GetReply{}
+	err := c.callShard(ctx, key, "KVServer.Get", func(r routing) any {
+		return &server.GetArgs{Key: key, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+	}, reply)
+	if err != nil {
+		return GetResult{}, fmt.Errorf("failed to get value for key %s: %w", key, err)
+	}
+
+	return GetResult{Value: string(reply.Value), Exists: reply.Exists, Version: reply.Version}, nil
+}
+
+// CompareAndSwap sets a key to a new value only if its current version is the expected one
+// An expected version of zero means that the key must not exist
+// It returns whether the value was swapped, a false result with a nil error means the key had another version
+func (c *Client) CompareAndSwap(key string, expectedVersion uint64, newValue string) (bool, error) {
+	return c.CompareAndSwapCtx(context.Background(), key, expectedVersion, newValue)
+}
+
+// CompareAndSwapCtx is CompareAndSwap bounded by a context
+func (c *Client) CompareAndSwapCtx(ctx context.Context, key string, expectedVersion uint64, newValue string) (bool, error) {
+	requestID := c.nextRequestID()
+	reply := &server.CompareAndSwapReply{}
+	err := c.callShard(ctx, key, "KVServer.CompareAndSwap", func(r routing) any {
+		return &server.CompareAndSwapArgs{
+			Key: key, ExpectedVersion: expectedVersion, Value: []byte(newValue),
+			ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID,
+		}
+	}, reply)
+	if err != nil {
+		return false, fmt.Errorf("failed to swap value for key %s: %w", key, err)
+	}
+
+	return reply.Swapped, nil
+}
+
+// SetIfNotExists sets a key only if it does not exist
+// It returns whether the value was set
+func (c *Client) SetIfNotExists(key string, value string) (bool, error) {
+	return c.SetIfNotExistsCtx(context.Background(), key, value)
+}
+
+// SetIfNotExistsCtx is SetIfNotExists bounded by a context
+func (c *Client) SetIfNotExistsCtx(ctx context.Context, key string, value string) (bool, error) {
+	return c.CompareAndSwapCtx(ctx, key, 0, value)
+}
+
+// DeleteIfVersion deletes a key only if it exists with the given version
+// It returns whether the key was deleted
+func (c *Client) DeleteIfVersion(key string, version uint64) (bool, error) {
+	return c.DeleteIfVersionCtx(context.Background(), key, version)
+}
+
+// DeleteIfVersionCtx is DeleteIfVersion bounded by a context
+func (c *Client) DeleteIfVersionCtx(ctx context.Context, key string, version uint64) (bool, error) {
+	requestID := c.nextRequestID()
+	reply := &server.DeleteIfVersionReply{}
+	err := c.callShard(ctx, key, "KVServer.DeleteIfVersion", func(r routing) any {
+		return &server.DeleteIfVersionArgs{Key: key, Version: version, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+
+	return reply.Deleted, nil
+}
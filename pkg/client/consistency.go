@@ -0,0 +1,228 @@
+// consistency.go
+// This file contains client operations with a tunable consistency level, in the style of Cassandra
+// The client coordinates these operations itself: it sends them to every replica of the key's shard and waits for as many acknowledgements as the level requires
+// Writes are stamped with the client's clock, and reads resolve conflicting replies in favour of the newest write
+// With N replicas, reads and writes see each other whenever R + W > N, for example when both use Quorum
+// Like the other operations, each has a variant bounded by a context
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kvstore/pkg/server"
+	"time"
+)
+
+// A ConsistencyLevel is the number of replicas that must acknowledge an operation before it returns
+// Lower levels answer faster and tolerate more failed replicas, higher levels return more recent data
+type ConsistencyLevel int
+
+const (
+	// One waits for a single replica
+	One ConsistencyLevel = iota + 1
+	// Quorum waits for a majority of the replicas
+	Quorum
+	// All waits for every replica
+	All
+)
+
+// String returns the name of the consistency level
+func (level ConsistencyLevel) String() string {
+	switch level {
+	case One:
+		return "ONE"
+	case Quorum:
+		return "QUORUM"
+	case All:
+		return "ALL"
+	default:
+		return fmt.Sprintf("ConsistencyLevel(%d)", int(level))
+	}
+}
+
+// required returns how many of n replicas must acknowledge an operation at the level
+func (level ConsistencyLevel) required(n int) (int, error) {
+	switch level {
+	case One:
+		return 1, nil
+	case Quorum:
+		return n/2 + 1, nil
+	case All:
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unknown consistency level: %d", int(level))
+	}
+}
+
+// SetWithConsistency sets a key on every replica of its shard and returns once the level's number of replicas have applied it
+// Writes made with Set are ordered by the primary instead of by timestamp, so keys should be written with one kind of operation only
+func (c *Client) SetWithConsistency(key string, value string, level ConsistencyLevel) error {
+	return c.SetWithConsistencyCtx(context.Background(), key, value, level)
+}
+
+// SetWithConsistencyCtx is SetWithConsistency bounded by a context
+func (c *Client) SetWithConsistencyCtx(ctx context.Context, key string, value string, level ConsistencyLevel) error {
+	timestamp := c.nextTimestamp()
+	_, err := callReplicas[server.ReplicaSetReply](ctx, c, key, "KVServer.ReplicaSet", func(r routing) any {
+		return &server.ReplicaSetArgs{ShardIdx: r.shardIdx, Key: key, Value: []byte(value), Timestamp: timestamp, Epoch: r.epoch, Timeout: r.timeout}
+	}, level)
+	if err != nil {
+		return fmt.Errorf("failed to set value for key %s at consistency %v: %w", key, level, err)
+	}
+
+	return nil
+}
+
+// GetWithConsistency reads a key from the replicas of its shard and returns the newest value among the level's number of replies
+// It returns the value, a boolean indicating if the key exists, and an error if too few replicas reply
+func (c *Client) GetWithConsistency(key string, level ConsistencyLevel) (string, bool, error) {
+	return c.GetWithConsistencyCtx(context.Background(), key, level)
+}
+
+// GetWithConsistencyCtx is GetWithConsistency bounded by a context
+func (c *Client) GetWithConsistencyCtx(ctx context.Context, key string, level ConsistencyLevel) (string, bool, error) {
+	reply, err := c.getNewest(ctx, key, level)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get value for key %s at consistency %v: %w", key, level, err)
+	}
+
+	return string(reply.Value), reply.Exists, nil
+}
+
+// DeleteWithConsistency deletes a key on every replica of its shard and returns once the level's number of replicas have applied it
+func (c *Client) DeleteWithConsistency(key string, level ConsistencyLevel) error {
+	return c.DeleteWithConsistencyCtx(context.Background(), key, level)
+}
+
+// DeleteWithConsistencyCtx is DeleteWithConsistency bounded by a context
+func (c *Client) DeleteWithConsistencyCtx(ctx context.Context, key string, level ConsistencyLevel) error {
+	timestamp := c.nextTimestamp()
+	_, err := callReplicas[server.ReplicaSetReply](ctx, c, key, "KVServer.ReplicaSet", func(r routing) any {
+		return &server.ReplicaSetArgs{ShardIdx: r.shardIdx, Key: key, Delete: true, Timestamp: timestamp, Epoch: r.epoch, Timeout: r.timeout}
+	}, level)
+	if err != nil {
+		return fmt.Errorf("failed to delete key %s at consistency %v: %w", key, level, err)
+	}
+
+	return nil
+}
+
+// ExistsWithConsistency checks if a key exists according to the newest of the level's number of replies
+func (c *Client) ExistsWithConsistency(key string, level ConsistencyLevel) (bool, error) {
+	return c.ExistsWithConsistencyCtx(context.Background(), key, level)
+}
+
+// ExistsWithConsistencyCtx is ExistsWithConsistency bounded by a context
+func (c *Client) ExistsWithConsistencyCtx(ctx context.Context, key string, level ConsistencyLevel) (bool, error) {
+	reply, err := c.getNewest(ctx, key, level)
+	if err != nil {
+		return false, fmt.Errorf("failed to check existence of key %s at consistency %v: %w", key, level, err)
+	}
+
+	return reply.Exists, nil
+}
+
+// getNewest reads a key from the level's number of replicas and returns the reply holding the newest write
+func (c *Client) getNewest(ctx context.Context, key string, level ConsistencyLevel) (*server.ReplicaGetReply, error) {
+	replies, err := callReplicas[server.ReplicaGetReply](ctx, c, key, "KVServer.ReplicaGet", func(r routing) any {
+		return &server.ReplicaGetArgs{ShardIdx: r.shardIdx, Key: key, Epoch: r.epoch, Timeout: r.timeout}
+	}, level)
+	if err != nil {
+		return nil, err
+	}
+
+	newest := replies[0]
+	for _, reply := range replies[1:] {
+		if reply.Newer(newest) {
+			newest = reply
+		}
+	}
+	return newest, nil
+}
+
+// nextTimestamp returns the current time in nanoseconds, increased if needed so that every write of the client gets a later timestamp than the previous one
+func (c *Client) nextTimestamp() int64 {
+	for {
+		last := c.lastTimestamp.Load()
+		next := max(time.Now().UnixNano(), last+1)
+		if c.lastTimestamp.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// A replicaResult is the reply or error of a single replica
+type replicaResult[R any] struct {
+	reply *R
+	err   error
+}
+
+// callReplicas calls a KVServer method on every replica of the key's shard in parallel and returns the first replies once the level's number have arrived
+// Calls to the remaining replicas continue in the background and their results are discarded
+// If too few replicas succeed and one of them failed with a retryable error, the call is retried according to the client's retry policy with a freshly fetched route table
+// The context bounds the whole operation, the background calls included
+func callReplicas[R any](ctx context.Context, c *Client, key string, method string, newArgs func(routing) any, level ConsistencyLevel) ([]*R, error) {
+	policy := c.config.Retry
+
+	var err error
+	for attempt := range policy.MaxAttempts {
+		if attempt > 0 {
+			if err := policy.wait(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+		var replicas []server.ShardLocation
+		var epoch int64
+		replicas, epoch, err = c.getReplicas(ctx, key, attempt > 0)
+		if err != nil {
+			if ctx.Err() != nil || !policy.Retryable(err) {
+				return nil, err
+			}
+			continue
+		}
+		required, levelErr := level.required(len(replicas))
+		if levelErr != nil {
+			return nil, levelErr
+		}
+
+		results := make(chan replicaResult[R], len(replicas))
+		for _, replica := range replicas {
+			go func() {
+				reply := new(R)
+				args := newArgs(routing{shardIdx: replica.ShardIdx, epoch: epoch, timeout: timeoutOf(ctx)})
+				err := c.callReplica(ctx, replica, method, args, reply)
+				results <- replicaResult[R]{reply: reply, err: err}
+			}()
+		}
+
+		replies := make([]*R, 0, required)
+		var errs []error
+		retryable := false
+		for range replicas {
+			result := <-results
+			if result.err != nil {
+				errs = append(errs, result.err)
+				retryable = retryable || policy.Retryable(result.err)
+				if len(errs) > len(replicas)-required {
+					break
+				}
+				continue
+			}
+			replies = append(replies, result.reply)
+			if len(replies) == required {
+				return replies, nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		err = fmt.Errorf("%d of %d replicas failed, %d acknowledgements required: %v", len(errs), len(replicas), required, errors.Join(errs...))
+		if !retryable {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,54 @@
+// context.go
+// This file contains the helpers that make client operations honor the cancellation and deadline of a context
+// Every operation has a variant taking a context, which bounds routing, waiting for a connection, and the shard RPC itself
+// The time left until the deadline is sent along with routed requests, so that servers give up on requests whose caller has stopped waiting
+package client
+
+import (
+	"context"
+	"net/rpc"
+	"time"
+)
+
+// A routing holds what a routed request tells the shard besides its own arguments
+// It is the index of the shard, the epoch of the route table the route came from, and the time left until the caller's deadline, which is zero without one
+type routing struct {
+	shardIdx int
+	epoch    int64
+	timeout  time.Duration
+}
+
+// callContext makes an RPC call on a connection and waits for it until the context is done
+// If the context ends first its error is returned while the call is still outstanding, so the connection must not be reused
+func callContext(ctx context.Context, conn *rpc.Client, method string, args any, reply any) error {
+	call := conn.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// timeoutOf returns the time left until the context's deadline, or zero if the context has no deadline
+// A deadline that has already passed yields the smallest positive timeout, since zero means that there is no deadline
+func timeoutOf(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	return max(time.Until(deadline), 1)
+}
+
+// sleepContext pauses for the given duration or until the context is done, in which case it returns the context's error
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,20 +2,49 @@
 //
 // It exposes two main functionalities:
 //  1. Routing: Abstracts the connection to the central router
+//     The route table is cached and refreshed whenever a server reports that it is out of date
 //  2. Operations: Provides methods to perform CRUD operations on the key-value store including:
 //     - Set
 //     - Get
 //     - Delete
 //     - Exists
 //     - Length
+//  3. Consistency levels: SetWithConsistency, GetWithConsistency, DeleteWithConsistency, and ExistsWithConsistency
+//     wait for One, Quorum, or All replicas of a key and resolve conflicting replies by timestamp
+//  4. Contexts: every operation has a variant with a Ctx suffix, such as SetCtx and GetCtx, that takes a context.Context
+//     and gives up when it is canceled or its deadline passes, servers drop requests whose deadline has passed
+//  5. Retries: operations that fail because a server is unreachable or the route was stale are retried with exponential backoff,
+//     Config.Retry sets the attempts, the backoff, and which errors are retried, and retried writes are applied once by the server
+//  6. Batches: MultiGet, MultiSet, and MultiDelete send one RPC per server for many keys and report an error per key in a BatchError
+//  7. Versions: GetWithVersion returns a key's version, and CompareAndSwap, SetIfNotExists, and DeleteIfVersion
+//     only write if the key still has the expected version
+//  8. Expiry: SetWithTTL sets keys that expire, Expire and Persist change the expiry of a key, and TTL reads it
+//  9. Scans: Scan lists a key range in order one page at a time, and Prefix lists every key with a prefix
+//  10. Bytes: keys and values may hold arbitrary bytes, SetBytes and GetBytes pass values as []byte without converting them,
+//     and servers reject values larger than their maximum value size with an error that server.IsValueTooLarge matches
+//  11. Typed maps: NewMap wraps a client in a Map[K, V] that encodes keys and values with a JSONCodec, GobCodec, or BinaryCodec,
+//     and reports codec failures as a *CodecError that IsCodecError tells apart from transport errors
+//  12. Atomic updates: Incr, Decr, Append, and GetAndSet read and write a key in one step on the server,
+//     and increments of values that are not integers fail with an error that server.IsNotInteger matches
+//  13. Transactions: Txn builds a transaction of compares and writes that is applied all or nothing by Commit,
+//     its keys must share a hash tag such as {user:42}, which places them on the same shard
+//  14. Distributed transactions: Transaction builds the same kind of transaction for keys on any shards and commits it with two-phase commit,
+//     keys stay locked while it is prepared, and servers resolve transactions whose client stopped partway once their timeout passes
+//  15. Snapshots: GetAt reads the value a key had at a point in time, and Snapshot pins a time so that reads of many keys see one consistent state,
+//     servers keep older versions for their history retention, and reads before it fail with an error that server.IsCompacted matches
+//  16. Watches: Watch and WatchPrefix deliver the changes of a key or of every key with a prefix on a channel as they are applied,
+//     WatchFrom resumes after the version of an earlier event, and watches that fall too far behind end with an error that server.IsRevisionCompacted matches
 //
-// # Clients are created using NewClient(address) which connects to the specified router address
+// # Clients are created using NewClient(addresses...) which connects to the first reachable of the specified router addresses
 //
 // Example usage:
 //
-//	client, err := client.NewClient("localhost:1234")
+//	client, err := client.NewClient("localhost:1234", "localhost:1235", "localhost:1236")
 //	client.Set("key1", "value1")
 //	value, exists, err := client.Get("key1")
+//	client.Close()
 //
+// With a replicated router group every router should be listed, so that the client can switch routers when one fails
+// Connections to the servers are pooled, NewClientWithConfig sets the pool limits and Close releases every connection
 // The client is designed to be hardly differentiated from a standard Go map
 package client
@@ -0,0 +1,92 @@
+// expiry.go
+// This file contains the client operations for keys with a time to live
+// Keys that have expired are reported as missing by every read, and the servers delete them in the background
+package client
+
+import (
+	"context"
+	"fmt"
+	"kvstore/pkg/server"
+	"time"
+)
+
+// SetWithTTL sets a key that expires once the time to live has passed
+// Setting the key again with Set removes the expiry
+func (c *Client) SetWithTTL(key string, value string, ttl time.Duration) error {
+	return c.SetWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLCtx is SetWithTTL bounded by a context
+func (c *Client) SetWithTTLCtx(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("time to live of key %s must be positive, got: %v", key, ttl)
+	}
+
+	requestID := c.nextRequestID()
+	reply := &server.SetReply{}
+	err := c.callShard(ctx, key, "KVServer.Set", func(r routing) any {
+		return &server.SetArgs{Key: key, Value: []byte(value), ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID, TTL: ttl}
+	}, reply)
+	if err != nil {
+		return fmt.Errorf("failed to set value for key %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Expire sets the time to live of an existing key
+// It returns whether the key exists, keys that do not are left alone
+func (c *Client) Expire(key string, ttl time.Duration) (bool, error) {
+	return c.ExpireCtx(context.Background(), key, ttl)
+}
+
+// ExpireCtx is Expire bounded by a context
+func (c *Client) ExpireCtx(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("time to live of key %s must be positive, got: %v", key, ttl)
+	}
+	return c.expire(ctx, key, ttl)
+}
+
+// Persist removes the expiry of a key so that it never expires
+// It returns whether the key exists
+func (c *Client) Persist(key string) (bool, error) {
+	return c.PersistCtx(context.Background(), key)
+}
+
+// PersistCtx is Persist bounded by a context
+func (c *Client) PersistCtx(ctx context.Context, key string) (bool, error) {
+	return c.expire(ctx, key, 0)
+}
+
+// expire sets the time to live of a key, a zero TTL removes its expiry
+func (c *Client) expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	reply := &server.ExpireReply{}
+	err := c.callShard(ctx, key, "KVServer.Expire", func(r routing) any {
+		return &server.ExpireArgs{Key: key, TTL: ttl, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+	}, reply)
+	if err != nil {
+		return false, fmt.Errorf("failed to set expiry of key %s: %w", key, err)
+	}
+
+	return reply.Exists, nil
+}
+
+// TTL returns the time a key has left to live and whether the key exists
+// Keys that never expire have a TTL of zero
+func (c *Client) TTL(key string) (time.Duration, bool, error) {
+	return c.TTLCtx(context.Background(), key)
+}
+
+// TTLCtx is TTL bounded by a context
+func (c *Client) TTLCtx(ctx context.Context, key string) (time.Duration, bool, error) {
+	reply := &server.TTLReply{}
+	err := c.callShard(ctx, key, "KVServer.TTL", func(r routing) any {
+		return &server.TTLArgs{Key: key, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+	}, reply)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get time to live of key %s: %w", key, err)
+	}
+
+	return reply.TTL, reply.Exists, nil
+}
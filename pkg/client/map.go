@@ -0,0 +1,102 @@
+// map.go
+// This file contains Map, a typed view of the store that reads and writes Go values instead of strings
+// A Map encodes its keys and values with codecs and stores them through a Client, so maps with different codecs can share a client
+// Keys of different maps share the store's key space, maps over the same keys should use different key codecs or prefixes
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// A Map stores values of type V under keys of type K
+// Failures of the codecs are returned as a *CodecError, every other error comes from the client unchanged
+type Map[K, V any] struct {
+	client *Client
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewMap returns a Map that stores its keys and values through the client with the given codecs
+func NewMap[K, V any](client *Client, keys Codec[K], values Codec[V]) *Map[K, V] {
+	return &Map[K, V]{client: client, keys: keys, values: values}
+}
+
+// Set encodes the key and value and sets the value in the store
+func (m *Map[K, V]) Set(key K, value V) error {
+	return m.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx is Set bounded by a context
+func (m *Map[K, V]) SetCtx(ctx context.Context, key K, value V) error {
+	encodedKey, err := m.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := m.values.Encode(value)
+	if err != nil {
+		return &CodecError{Op: "encode value of", Key: encodedKey, Err: err}
+	}
+	return m.client.SetBytesCtx(ctx, encodedKey, data)
+}
+
+// Get retrieves the value of a key and decodes it
+// It returns the value, a boolean indicating if the key exists, and an error if any occur, the value is the zero value if the key is missing
+func (m *Map[K, V]) Get(key K) (V, bool, error) {
+	return m.GetCtx(context.Background(), key)
+}
+
+// GetCtx is Get bounded by a context
+func (m *Map[K, V]) GetCtx(ctx context.Context, key K) (V, bool, error) {
+	var value V
+	encodedKey, err := m.encodeKey(key)
+	if err != nil {
+		return value, false, err
+	}
+	data, exists, err := m.client.GetBytesCtx(ctx, encodedKey)
+	if err != nil || !exists {
+		return value, false, err
+	}
+	value, err = m.values.Decode(data)
+	if err != nil {
+		return value, true, &CodecError{Op: "decode value of", Key: encodedKey, Err: err}
+	}
+	return value, true, nil
+}
+
+// Delete removes a key from the store
+func (m *Map[K, V]) Delete(key K) error {
+	return m.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is Delete bounded by a context
+func (m *Map[K, V]) DeleteCtx(ctx context.Context, key K) error {
+	encodedKey, err := m.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return m.client.DeleteCtx(ctx, encodedKey)
+}
+
+// Exists checks if a key exists in the store
+func (m *Map[K, V]) Exists(key K) (bool, error) {
+	return m.ExistsCtx(context.Background(), key)
+}
+
+// ExistsCtx is Exists bounded by a context
+func (m *Map[K, V]) ExistsCtx(ctx context.Context, key K) (bool, error) {
+	encodedKey, err := m.encodeKey(key)
+	if err != nil {
+		return false, err
+	}
+	return m.client.ExistsCtx(ctx, encodedKey)
+}
+
+// encodeKey returns the store key of a key
+func (m *Map[K, V]) encodeKey(key K) (string, error) {
+	data, err := m.keys.Encode(key)
+	if err != nil {
+		return "", &CodecError{Op: "encode", Key: fmt.Sprint(key), Err: err}
+	}
+	return string(data), nil
+}
@@ -1,9 +1,12 @@
 // operations.go
 // This file contains the implementation of client-side operations such as Set, Get, Delete, Exists, and Length
+// Values are bytes on the wire, Set and Get convert them from and to strings while SetBytes and GetBytes pass them through
 // It uses the server package for RPC calls to the appropriate shard based on the key's routing
+// Every operation has a variant taking a context, the variants without one never time out
 package client
 
 import (
+	"context"
 	"fmt"
 	"kvstore/pkg/server"
 )
@@ -11,17 +14,31 @@ import (
 // Set routes a key to the appropriate shard and sets its value
 // It returns an error if routing or set RPC call fails
 func (c *Client) Set(key string, value string) error {
-	shardClient, shardIdx, err := c.getShardClient(key)
-	if err != nil {
-		return fmt.Errorf("failed to get shard client for key %s: %v", key, err)
-	}
+	return c.SetCtx(context.Background(), key, value)
+}
 
-	args := &server.SetArgs{Key: key, Value: value, ShardIdx: shardIdx}
-	reply := &server.SetReply{}
+// SetCtx is Set bounded by a context
+// It returns the context's error, wrapped, if the context is done before the value is set
+func (c *Client) SetCtx(ctx context.Context, key string, value string) error {
+	return c.SetBytesCtx(ctx, key, []byte(value))
+}
+
+// SetBytes routes a key to the appropriate shard and sets its value to arbitrary bytes
+// The slice is sent as is and may be reused once SetBytes returns
+func (c *Client) SetBytes(key string, value []byte) error {
+	return c.SetBytesCtx(context.Background(), key, value)
+}
 
-	err = shardClient.Call("KVServer.Set", args, reply)
+// SetBytesCtx is SetBytes bounded by a context
+// Values larger than the server's maximum value size are rejected with an error that IsValueTooLarge matches
+func (c *Client) SetBytesCtx(ctx context.Context, key string, value []byte) error {
+	requestID := c.nextRequestID()
+	reply := &server.SetReply{}
+	err := c.callShard(ctx, key, "KVServer.Set", func(r routing) any {
+		return &server.SetArgs{Key: key, Value: value, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
 	if err != nil {
-		return fmt.Errorf("failed to set value for key %s at socket %s and shard index %d: %v", key, shardClient.Socket, shardIdx, err)
+		return fmt.Errorf("failed to set value for key %s: %w", key, err)
 	}
 
 	return nil
@@ -30,17 +47,29 @@ func (c *Client) Set(key string, value string) error {
 // Get retrieves the value for a given key from the appropriate shard
 // It returns the value, a boolean indicating if the key exists, and an error if any occur
 func (c *Client) Get(key string) (string, bool, error) {
-	shardClient, shardIdx, err := c.getShardClient(key)
-	if err != nil {
-		return "", false, fmt.Errorf("failed to get shard client for key %s: %v", key, err)
-	}
+	return c.GetCtx(context.Background(), key)
+}
 
-	args := &server.GetArgs{Key: key, ShardIdx: shardIdx}
-	reply := &server.GetReply{}
+// GetCtx is Get bounded by a context
+func (c *Client) GetCtx(ctx context.Context, key string) (string, bool, error) {
+	value, exists, err := c.GetBytesCtx(ctx, key)
+	return string(value), exists, err
+}
+
+// GetBytes retrieves the value for a given key as bytes
+// The returned slice is the one decoded from the server's reply and belongs to the caller, so it is not copied again
+func (c *Client) GetBytes(key string) ([]byte, bool, error) {
+	return c.GetBytesCtx(context.Background(), key)
+}
 
-	err = shardClient.Call("KVServer.Get", args, reply)
+// GetBytesCtx is GetBytes bounded by a context
+func (c *Client) GetBytesCtx(ctx context.Context, key string) ([]byte, bool, error) {
+	reply := &server.GetReply{}
+	err := c.callShard(ctx, key, "KVServer.Get", func(r routing) any {
+		return &server.GetArgs{Key: key, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+	}, reply)
 	if err != nil {
-		return "", false, fmt.Errorf("failed to get value for key %s at socket %s and shard index %d: %v", key, shardClient.Socket, shardIdx, err)
+		return nil, false, fmt.Errorf("failed to get value for key %s: %w", key, err)
 	}
 
 	return reply.Value, reply.Exists, nil
@@ -49,17 +78,18 @@ func (c *Client) Get(key string) (string, bool, error) {
 // Delete removes a key from the appropriate shard
 // It returns an error if the delete RPC call fails
 func (c *Client) Delete(key string) error {
-	shardClient, shardIdx, err := c.getShardClient(key)
-	if err != nil {
-		return fmt.Errorf("failed to get shard client for key %s: %v", key, err)
-	}
+	return c.DeleteCtx(context.Background(), key)
+}
 
-	args := &server.DeleteArgs{Key: key, ShardIdx: shardIdx}
+// DeleteCtx is Delete bounded by a context
+func (c *Client) DeleteCtx(ctx context.Context, key string) error {
+	requestID := c.nextRequestID()
 	reply := &server.DeleteReply{}
-
-	err = shardClient.Call("KVServer.Delete", args, reply)
+	err := c.callShard(ctx, key, "KVServer.Delete", func(r routing) any {
+		return &server.DeleteArgs{Key: key, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
 	if err != nil {
-		return fmt.Errorf("failed to delete key %s at socket %s and shard index %d: %v", key, shardClient.Socket, shardIdx, err)
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
 	}
 
 	return nil
@@ -68,17 +98,17 @@ func (c *Client) Delete(key string) error {
 // Exists checks if a key exists in the appropriate shard
 // It returns a boolean indicating if the key exists and an error if any occur
 func (c *Client) Exists(key string) (bool, error) {
-	shardClient, shardIdx, err := c.getShardClient(key)
-	if err != nil {
-		return false, fmt.Errorf("failed to get shard client for key %s: %v", key, err)
-	}
+	return c.ExistsCtx(context.Background(), key)
+}
 
-	args := &server.ExistsArgs{Key: key, ShardIdx: shardIdx}
+// ExistsCtx is Exists bounded by a context
+func (c *Client) ExistsCtx(ctx context.Context, key string) (bool, error) {
 	reply := &server.ExistsReply{}
-
-	err = shardClient.Call("KVServer.Exists", args, reply)
+	err := c.callShard(ctx, key, "KVServer.Exists", func(r routing) any {
+		return &server.ExistsArgs{Key: key, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+	}, reply)
 	if err != nil {
-		return false, fmt.Errorf("failed to check existence of key %s at socket %s and shard index %d: %v", key, shardClient.Socket, shardIdx, err)
+		return false, fmt.Errorf("failed to check existence of key %s: %w", key, err)
 	}
 
 	return reply.Exists, nil
@@ -88,28 +118,27 @@ func (c *Client) Exists(key string) (bool, error) {
 // Shards that are unreachable or return an error are logged but do not affect the total count
 // Errors encountered during the Length operation are aggregated and returned without stopping the operation
 func (c *Client) Length() (int, error) {
+	return c.LengthCtx(context.Background())
+}
+
+// LengthCtx is Length bounded by a context
+// Servers that have not answered when the context is done are counted as errors
+func (c *Client) LengthCtx(ctx context.Context) (int, error) {
 	length := 0
 
-	sockets, err := c.getAllSockets()
+	sockets, err := c.getAllSockets(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to retrieve sockets: %v", err)
+		return 0, fmt.Errorf("failed to retrieve sockets: %w", err)
 	}
 
 	overallErr := fmt.Errorf("errors encountered during Length operation: ")
 	errFlag := false
 
 	for _, socket := range sockets {
-		serverClient, err := NewClient(socket)
-		if err != nil {
-			overallErr = fmt.Errorf("%w\nSocket=%s, SubError=%v", overallErr, socket, err)
-			errFlag = true
-			continue
-		}
-
 		args := &server.LengthArgs{}
 		reply := &server.LengthReply{}
 
-		err = serverClient.Call("KVServer.Length", args, reply)
+		err = c.callServer(ctx, socket, "KVServer.Length", args, reply)
 		if err != nil {
 			overallErr = fmt.Errorf("%w\nSocket=%s, SubError=%v", overallErr, socket, err)
 			errFlag = true
@@ -117,7 +146,6 @@ func (c *Client) Length() (int, error) {
 		}
 
 		length += reply.Length
-		serverClient.Close()
 	}
 
 	if errFlag {
@@ -0,0 +1,223 @@
+// pool.go
+// This file contains the pools of connections the client keeps to every server it talks to
+// Connections are reused across operations instead of being dialed for every call, and at most a configured number of them are kept idle
+// The number of connections open to a server at the same time can be limited, in which case callers wait for a connection to be returned
+// Broken connections are discarded and replaced, and a background loop checks idle connections so that dead ones are not handed out
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kvstore/pkg/server"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ErrClientClosed is returned for operations on a client after Close has been called
+var ErrClientClosed = errors.New("client is closed")
+
+// A connPool holds the connections to a single server
+// The slots channel has one token per connection that may be open, and is nil if the number of open connections is not limited
+type connPool struct {
+	socket      string
+	dialTimeout time.Duration
+	maxIdle     int
+	slots       chan struct{}
+	idle        []*rpc.Client
+	closed      bool
+	mu          sync.Mutex
+}
+
+// newConnPool creates an empty pool for the server at the given socket
+func newConnPool(socket string, config *Config) *connPool {
+	pool := &connPool{
+		socket:      socket,
+		dialTimeout: config.DialTimeout,
+		maxIdle:     config.MaxIdleConns,
+	}
+	if config.MaxOpenConns > 0 {
+		pool.slots = make(chan struct{}, config.MaxOpenConns)
+	}
+	return pool
+}
+
+// call makes an RPC call on a connection from the pool
+// A reused connection that turns out to be broken is replaced by a new one and the call is made again, since the server may have closed it while it was idle
+// A call abandoned because the context is done leaves its reply outstanding, so its connection is closed instead of being reused
+// Calls that got no reply return an error wrapping ErrUnreachable
+func (pool *connPool) call(ctx context.Context, method string, args any, reply any) error {
+	for {
+		conn, reused, err := pool.get(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = callContext(ctx, conn, method, args, reply)
+		var serverErr rpc.ServerError
+		broken := err != nil && !errors.As(err, &serverErr)
+		pool.put(conn, broken)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if broken && reused {
+			continue
+		}
+		if broken {
+			return fmt.Errorf("%w: connection to %s broke: %v", ErrUnreachable, pool.socket, err)
+		}
+		return err
+	}
+}
+
+// get takes an idle connection from the pool or dials a new one, waiting for a free slot if the number of open connections is limited
+// It reports whether the connection was reused, and gives up when the context is done
+func (pool *connPool) get(ctx context.Context) (*rpc.Client, bool, error) {
+	if pool.slots != nil {
+		select {
+		case pool.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		pool.release()
+		return nil, false, ErrClientClosed
+	}
+	if n := len(pool.idle); n > 0 {
+		conn := pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+		pool.mu.Unlock()
+		return conn, true, nil
+	}
+	pool.mu.Unlock()
+
+	dialer := &net.Dialer{Timeout: pool.dialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", pool.socket)
+	if err != nil {
+		pool.release()
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		return nil, false, fmt.Errorf("%w: failed to connect to server at %s: %v", ErrUnreachable, pool.socket, err)
+	}
+	return rpc.NewClient(netConn), false, nil
+}
+
+// put returns a connection to the pool
+// Broken connections, and connections beyond the idle limit or returned after the pool was closed, are closed instead
+func (pool *connPool) put(conn *rpc.Client, broken bool) {
+	pool.mu.Lock()
+	keep := !broken && !pool.closed && len(pool.idle) < pool.maxIdle
+	if keep {
+		pool.idle = append(pool.idle, conn)
+	}
+	pool.mu.Unlock()
+
+	if !keep {
+		conn.Close()
+	}
+	pool.release()
+}
+
+// release frees the slot of a connection that was taken from the pool
+func (pool *connPool) release() {
+	if pool.slots != nil {
+		<-pool.slots
+	}
+}
+
+// checkIdle pings every idle connection and closes the ones that no longer reach the server
+// Connections are checked outside the pool's lock, and the ones that pass are put back if there is still room
+func (pool *connPool) checkIdle() {
+	pool.mu.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.mu.Unlock()
+
+	for _, conn := range idle {
+		err := conn.Call("KVServer.Ping", &server.PingArgs{}, &server.PingReply{})
+		var serverErr rpc.ServerError
+		broken := err != nil && !errors.As(err, &serverErr)
+
+		pool.mu.Lock()
+		keep := !broken && !pool.closed && len(pool.idle) < pool.maxIdle
+		if keep {
+			pool.idle = append(pool.idle, conn)
+		}
+		pool.mu.Unlock()
+
+		if !keep {
+			conn.Close()
+		}
+	}
+}
+
+// close closes every idle connection and makes the pool close connections as they are returned
+func (pool *connPool) close() {
+	pool.mu.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.closed = true
+	pool.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// pool returns the connection pool of a server, creating it on first use
+func (c *Client) pool(socket string) (*connPool, error) {
+	c.poolsMu.Lock()
+	defer c.poolsMu.Unlock()
+
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	pool, exists := c.pools[socket]
+	if !exists {
+		pool = newConnPool(socket, &c.config)
+		c.pools[socket] = pool
+	}
+	return pool, nil
+}
+
+// callServer calls a KVServer method on a server over a pooled connection
+func (c *Client) callServer(ctx context.Context, socket string, method string, args any, reply any) error {
+	pool, err := c.pool(socket)
+	if err != nil {
+		return err
+	}
+	return pool.call(ctx, method, args, reply)
+}
+
+// checkHealth checks the idle connections of every pool on the configured interval until the client is closed
+func (c *Client) checkHealth() {
+	defer close(c.healthDone)
+
+	ticker := time.NewTicker(c.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.poolsMu.Lock()
+			pools := make([]*connPool, 0, len(c.pools))
+			for _, pool := range c.pools {
+				pools = append(pools, pool)
+			}
+			c.poolsMu.Unlock()
+
+			for _, pool := range pools {
+				pool.checkIdle()
+			}
+		case <-c.healthStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// retry.go
+// This file contains the retry policy of the client
+// Operations that fail with a retryable error are attempted again after an exponentially growing, randomly shortened pause, and the key is routed again before every new attempt
+// Writes carry a request ID that stays the same across attempts, so a server that already applied a write acknowledges its retry without applying it twice
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"kvstore/pkg/server"
+	mathrand "math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// ErrUnreachable is wrapped by the errors of calls that did not get a reply, because the server or router could not be reached or the connection broke
+var ErrUnreachable = errors.New("server is unreachable")
+
+// A RetryPolicy decides how often and how quickly an operation is retried
+// Attempt n waits InitialBackoff * Multiplier^(n-1), capped at MaxBackoff and shortened by a random fraction of up to Jitter
+// Retryable decides which errors are retried, IsRetryable is used if it is nil
+// Zero values select the defaults, a MaxAttempts of 1 disables retries
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	Retryable      func(error) bool
+}
+
+const (
+	// defaultMaxAttempts is the number of attempts of an operation if the policy does not set it
+	defaultMaxAttempts = 3
+	// defaultInitialBackoff is the pause before the first retry if the policy does not set it
+	// A router that is not the leader of its group learns about a new route table shortly after the leader, so retrying immediately could use the same stale table
+	defaultInitialBackoff = 100 * time.Millisecond
+	// defaultMaxBackoff caps the pause between attempts if the policy does not set it
+	defaultMaxBackoff = 2 * time.Second
+	// defaultMultiplier is the growth of the pause from one attempt to the next if the policy does not set it
+	defaultMultiplier = 2
+	// defaultJitter is the largest fraction the pause is randomly shortened by if the policy does not set it
+	defaultJitter = 0.5
+)
+
+// IsRetryable reports whether an operation that failed with the error may succeed if it is attempted again
+// This is the case when a server or router could not be reached, when the route of the key was stale, and when the key was locked by a distributed transaction
+// Errors returned by the operation itself, expired deadlines, and canceled contexts are not retried
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrClientClosed) {
+		return false
+	}
+	return errors.Is(err, ErrUnreachable) || server.IsStaleRoute(err) || server.IsKeyLocked(err)
+}
+
+// withDefaults returns the policy with every zero value replaced by its default
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = defaultMaxAttempts
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = defaultInitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaultMaxBackoff
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = defaultMultiplier
+	}
+	if policy.Jitter == 0 {
+		policy.Jitter = defaultJitter
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = IsRetryable
+	}
+	return policy
+}
+
+// valid reports whether every setting of a policy with defaults is in range
+func (policy RetryPolicy) valid() bool {
+	return policy.MaxAttempts > 0 && policy.InitialBackoff > 0 && policy.MaxBackoff >= policy.InitialBackoff &&
+		policy.Multiplier >= 1 && policy.Jitter >= 0 && policy.Jitter <= 1
+}
+
+// backoff returns the pause before the given retry, where retry 1 follows the first attempt
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	pause := float64(policy.InitialBackoff)
+	for range retry - 1 {
+		pause *= policy.Multiplier
+		if pause >= float64(policy.MaxBackoff) {
+			pause = float64(policy.MaxBackoff)
+			break
+		}
+	}
+	return time.Duration(pause * (1 - policy.Jitter*mathrand.Float64()))
+}
+
+// wait pauses before the given retry, or returns the context's error if it is done first
+func (policy RetryPolicy) wait(ctx context.Context, retry int) error {
+	return sleepContext(ctx, policy.backoff(retry))
+}
+
+// newClientID returns a random ID that prefixes the request IDs of a client
+func newClientID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// nextRequestID returns an ID for a write that no other write of any client uses
+func (c *Client) nextRequestID() string {
+	return c.id + "-" + strconv.FormatUint(c.requests.Add(1), 10)
+}
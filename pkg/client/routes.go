@@ -0,0 +1,76 @@
+// routes.go
+// This file contains the client's cache of the router's route table
+// The client fetches the whole table once and routes keys on a hash ring of its own, so operations do not wait for the router
+// Requests carry the epoch of the cached table, servers reject them once the router has announced a newer one, and the client then fetches the table again
+package client
+
+import (
+	"context"
+	"fmt"
+	"kvstore/pkg/router"
+	"kvstore/pkg/server"
+)
+
+// A routeTable is a cached copy of the router's route table, with the routes placed on a hash ring like the router's
+type routeTable struct {
+	epoch int64
+	ring  *router.HashRing
+}
+
+// getReplicas retrieves the replicas of the shard that owns a given key, primary first, along with the epoch of the route table they came from
+// The cached route table is used unless refresh is set or the cache is empty, in which case the table is fetched from the router first
+func (c *Client) getReplicas(ctx context.Context, key string, refresh bool) ([]server.ShardLocation, int64, error) {
+	route, epoch, err := c.getRoute(ctx, key, refresh)
+	if err != nil {
+		return nil, 0, err
+	}
+	return replicasOf(route), epoch, nil
+}
+
+// getRoute retrieves the route of the shard that owns a given key along with the epoch of the route table it came from, like getReplicas
+func (c *Client) getRoute(ctx context.Context, key string, refresh bool) (*router.ShardRoute, int64, error) {
+	table := c.routes.Load()
+	if refresh || table == nil || table.ring.Len() == 0 {
+		var err error
+		table, err = c.refreshRoutes(ctx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("route error for key %s: %w", key, err)
+		}
+	}
+
+	route := table.ring.Get(key)
+	if route == nil {
+		return nil, 0, fmt.Errorf("route error for key %s: no route found", key)
+	}
+	return route, table.epoch, nil
+}
+
+// replicasOf returns the replicas of a route, primary first
+func replicasOf(route *router.ShardRoute) []server.ShardLocation {
+	return append([]server.ShardLocation{{Socket: route.Socket, ShardIdx: route.ShardIdx}}, route.Backups...)
+}
+
+// refreshRoutes fetches the route table from the router and caches it
+// A table older than the cached one, which a router that is not the leader may still serve, does not replace it
+func (c *Client) refreshRoutes(ctx context.Context) (*routeTable, error) {
+	reply := &router.GetRouteTableReply{}
+	if err := c.callRouter(ctx, "StaticShardRouter.GetRouteTable", &router.GetRouteTableArgs{}, reply); err != nil {
+		return nil, err
+	}
+
+	ring := router.NewHashRing(reply.VirtualNodes)
+	for _, route := range reply.Routes {
+		ring.Add(route)
+	}
+	fetched := &routeTable{epoch: reply.Epoch, ring: ring}
+
+	for {
+		cached := c.routes.Load()
+		if cached != nil && cached.epoch > fetched.epoch {
+			return cached, nil
+		}
+		if c.routes.CompareAndSwap(cached, fetched) {
+			return fetched, nil
+		}
+	}
+}
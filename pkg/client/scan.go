@@ -0,0 +1,173 @@
+// scan.go
+// This file contains the client operations that list keys in order
+// Keys are spread over every server by their hash, so each page of a scan asks every server for its first keys in the range and merges the sorted replies
+// Pages end with a cursor that the next page starts from, so a scan of any size is listed a bounded number of keys at a time
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kvstore/pkg/server"
+	"strings"
+	"sync"
+)
+
+// A KeyValue is a key listed by a scan along with its value and version
+type KeyValue struct {
+	Key     string
+	Value   string
+	Version uint64
+}
+
+// A ScanPage is one page of a scan in ascending key order
+// The cursor is the start of the next page, and it is empty once the range has been listed completely
+type ScanPage struct {
+	Entries []KeyValue
+	Cursor  string
+}
+
+// Scan lists up to limit keys from start up to but excluding end in ascending order, an empty end leaves the range unbounded
+// The next page is listed by calling Scan again with the page's cursor as the start
+// Keys written or deleted while a scan is paginated may or may not be listed
+func (c *Client) Scan(start string, end string, limit int) (ScanPage, error) {
+	return c.ScanCtx(context.Background(), start, end, limit)
+}
+
+// ScanCtx is Scan bounded by a context
+func (c *Client) ScanCtx(ctx context.Context, start string, end string, limit int) (ScanPage, error) {
+	if limit <= 0 {
+		return ScanPage{}, fmt.Errorf("scan limit must be positive, got: %d", limit)
+	}
+
+	policy := c.config.Retry
+	var err error
+	for attempt := range policy.MaxAttempts {
+		if attempt > 0 {
+			if err := policy.wait(ctx, attempt); err != nil {
+				return ScanPage{}, err
+			}
+		}
+		var page ScanPage
+		page, err = c.scanPage(ctx, start, end, limit)
+		if err == nil {
+			return page, nil
+		}
+		if ctx.Err() != nil || !policy.Retryable(err) {
+			break
+		}
+	}
+
+	return ScanPage{}, fmt.Errorf("failed to scan keys from %q to %q: %w", start, end, err)
+}
+
+// Prefix lists every key that starts with the prefix in ascending order
+// It pages through the keys internally, so callers that expect many keys should use Scan with PrefixEnd instead
+func (c *Client) Prefix(prefix string) ([]KeyValue, error) {
+	return c.PrefixCtx(context.Background(), prefix)
+}
+
+// PrefixCtx is Prefix bounded by a context
+func (c *Client) PrefixCtx(ctx context.Context, prefix string) ([]KeyValue, error) {
+	var entries []KeyValue
+	start, end := prefix, PrefixEnd(prefix)
+	for {
+		page, err := c.ScanCtx(ctx, start, end, prefixPageSize)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page.Entries...)
+		if page.Cursor == "" {
+			return entries, nil
+		}
+		start = page.Cursor
+	}
+}
+
+// prefixPageSize is the number of keys Prefix lists per page
+const prefixPageSize = 500
+
+// PrefixEnd returns the end of the key range holding every key that starts with the prefix
+// It is empty, meaning unbounded, if there is no such end because the prefix is empty or consists of 0xff bytes only
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// scanPage asks every server for its first keys in the range and merges the replies into one page
+// Each server's reply holds every one of its keys up to its last returned key, so the first limit keys of the merge are complete
+func (c *Client) scanPage(ctx context.Context, start string, end string, limit int) (ScanPage, error) {
+	sockets, err := c.getAllSockets(ctx)
+	if err != nil {
+		return ScanPage{}, err
+	}
+
+	replies := make([]*server.ScanReply, len(sockets))
+	errs := make([]error, len(sockets))
+	var wg sync.WaitGroup
+	for i, socket := range sockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i] = &server.ScanReply{}
+			args := &server.ScanArgs{Start: start, End: end, Limit: limit, Timeout: timeoutOf(ctx)}
+			if err := c.callServer(ctx, socket, "KVServer.Scan", args, replies[i]); err != nil {
+				errs[i] = fmt.Errorf("socket %s: %w", socket, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return ScanPage{}, err
+	}
+
+	return mergeScanReplies(replies, limit), nil
+}
+
+// mergeScanReplies merges sorted server replies into a page of at most limit keys
+// A key held by two servers, which happens while its range is migrated, is listed once
+func mergeScanReplies(replies []*server.ScanReply, limit int) ScanPage {
+	more := false
+	positions := make([]int, len(replies))
+	for _, reply := range replies {
+		more = more || reply.More
+	}
+
+	var page ScanPage
+	for len(page.Entries) < limit {
+		next := -1
+		for i, reply := range replies {
+			if positions[i] == len(reply.Entries) {
+				continue
+			}
+			if next == -1 || strings.Compare(reply.Entries[positions[i]].Key, replies[next].Entries[positions[next]].Key) < 0 {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+
+		entry := replies[next].Entries[positions[next]]
+		positions[next]++
+		if n := len(page.Entries); n > 0 && page.Entries[n-1].Key == entry.Key {
+			continue
+		}
+		page.Entries = append(page.Entries, KeyValue{Key: entry.Key, Value: string(entry.Value), Version: entry.Version})
+	}
+
+	for i, reply := range replies {
+		more = more || positions[i] < len(reply.Entries)
+	}
+	if more && len(page.Entries) > 0 {
+		// The smallest key after the last listed one
+		page.Cursor = page.Entries[len(page.Entries)-1].Key + "\x00"
+	}
+	return page
+}
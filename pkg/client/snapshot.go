@@ -0,0 +1,88 @@
+// snapshot.go
+// This file contains reads of the store as it was at a point in time
+// Servers keep the older versions of every key for a while, so reading many keys at the same time gives a view of them that no concurrent write can tear
+// A Snapshot pins the time of its reads, which makes it a consistent view of the whole store across keys and shards for as long as the servers keep its versions
+// Reads at a time whose versions the servers have already collected fail with an error that server.IsCompacted matches
+//
+// Example usage:
+//
+//	snapshot := client.Snapshot()
+//	checking, _, err := snapshot.Get("account:alice:checking")
+//	savings, _, err := snapshot.Get("account:alice:savings")
+package client
+
+import (
+	"context"
+	"fmt"
+	"kvstore/pkg/server"
+	"time"
+)
+
+// A Snapshot reads the store as it was at a fixed time
+// It holds no resources on the servers and is safe for concurrent use
+type Snapshot struct {
+	client    *Client
+	timestamp time.Time
+}
+
+// Snapshot returns a snapshot pinned to the current time
+func (c *Client) Snapshot() *Snapshot {
+	return c.SnapshotAt(time.Now())
+}
+
+// SnapshotAt returns a snapshot pinned to the given time
+func (c *Client) SnapshotAt(timestamp time.Time) *Snapshot {
+	return &Snapshot{client: c, timestamp: timestamp}
+}
+
+// Timestamp returns the time the snapshot reads at
+func (snapshot *Snapshot) Timestamp() time.Time {
+	return snapshot.timestamp
+}
+
+// Get retrieves the value a key had at the snapshot's time
+// It returns the value, a boolean indicating if the key existed then, and an error if any occur
+func (snapshot *Snapshot) Get(key string) (string, bool, error) {
+	return snapshot.GetCtx(context.Background(), key)
+}
+
+// GetCtx is Get bounded by a context
+func (snapshot *Snapshot) GetCtx(ctx context.Context, key string) (string, bool, error) {
+	return snapshot.client.GetAtCtx(ctx, key, snapshot.timestamp)
+}
+
+// GetBytes is Get for values that are not text
+func (snapshot *Snapshot) GetBytes(key string) ([]byte, bool, error) {
+	return snapshot.GetBytesCtx(context.Background(), key)
+}
+
+// GetBytesCtx is GetBytes bounded by a context
+func (snapshot *Snapshot) GetBytesCtx(ctx context.Context, key string) ([]byte, bool, error) {
+	return snapshot.client.getAt(ctx, key, snapshot.timestamp)
+}
+
+// GetAt retrieves the value a key had at a point in time
+// It returns the value, a boolean indicating if the key existed then, and an error if any occur
+// Times more than a second past the shard's safe time are rejected, and reads wait until the safe time has passed their time, so that no write at or before it is committed afterwards
+func (c *Client) GetAt(key string, timestamp time.Time) (string, bool, error) {
+	return c.GetAtCtx(context.Background(), key, timestamp)
+}
+
+// GetAtCtx is GetAt bounded by a context
+func (c *Client) GetAtCtx(ctx context.Context, key string, timestamp time.Time) (string, bool, error) {
+	value, exists, err := c.getAt(ctx, key, timestamp)
+	return string(value), exists, err
+}
+
+// getAt retrieves the value a key had at a point in time as bytes
+func (c *Client) getAt(ctx context.Context, key string, timestamp time.Time) ([]byte, bool, error) {
+	reply := &server.GetAtReply{}
+	err := c.callShard(ctx, key, "KVServer.GetAt", func(r routing) any {
+		return &server.GetAtArgs{Key: key, Timestamp: timestamp.UnixNano(), ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+	}, reply)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get value for key %s at %v: %w", key, timestamp, err)
+	}
+
+	return reply.Value, reply.Exists, nil
+}
@@ -0,0 +1,285 @@
+// twopc.go
+// This file contains the client's coordination of distributed transactions, whose keys may live on different shards
+// The client prepares the shard of the first key, the transaction's primary, and then every other participant shard, which check their compares and lock their keys
+// If every participant prepared, the client commits the primary, which is the point at which the transaction commits, and then the other participants
+// Every participant commits at the latest time any of them prepared at, so that reads at a point in time see all of the transaction's writes or none
+// Otherwise every participant is aborted, and attempts that failed with a retryable error, such as a locked key, start over with a new transaction
+// A coordinator that stops partway leaves its participants prepared, and they resolve the transaction with the primary once the servers' transaction timeout has passed
+//
+// Example usage:
+//
+//	ok, err := client.Transaction().
+//		IfValue("account:alice", "100").
+//		IfValue("account:bob", "20").
+//		Set("account:alice", "70").
+//		Set("account:bob", "50").
+//		Commit()
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kvstore/pkg/server"
+	"sync"
+)
+
+// A TxnPhase is a step of a distributed commit at which Config.TxnHook is called
+type TxnPhase int
+
+const (
+	// TxnPrepared is reached once every participant has prepared, before the primary commits
+	TxnPrepared TxnPhase = iota
+	// TxnCommitted is reached once the primary has committed, before the other participants commit
+	TxnCommitted
+)
+
+// String returns the name of the phase
+func (phase TxnPhase) String() string {
+	switch phase {
+	case TxnPrepared:
+		return "prepared"
+	case TxnCommitted:
+		return "committed"
+	default:
+		return fmt.Sprintf("TxnPhase(%d)", int(phase))
+	}
+}
+
+// A participant is a shard taking part in a distributed transaction along with its share of the compares and operations
+type participant struct {
+	location server.ShardLocation
+	epoch    int64
+	compares []server.TxnCompare
+	ops      []server.TxnOp
+}
+
+// Transaction starts an empty transaction whose keys may live on different shards
+// It is committed with two-phase commit, which takes more round trips than a transaction started with Txn
+func (c *Client) Transaction() *Txn {
+	return &Txn{client: c, distributed: true}
+}
+
+// commitDistributed commits the transaction with two-phase commit across the shards of its keys
+// Prepares that fail with a retryable error abort the attempt, and the transaction is attempted again with a new ID according to the client's retry policy
+func (txn *Txn) commitDistributed(ctx context.Context) (bool, error) {
+	policy := txn.client.config.Retry
+
+	var err error
+	for attempt := range policy.MaxAttempts {
+		if attempt > 0 {
+			if err := policy.wait(ctx, attempt); err != nil {
+				return false, err
+			}
+		}
+		var participants []*participant
+		participants, err = txn.participants(ctx, attempt > 0)
+		if err != nil {
+			if ctx.Err() != nil || !policy.Retryable(err) {
+				return false, err
+			}
+			continue
+		}
+
+		txnID := txn.client.nextRequestID()
+		var prepared bool
+		var committedAt int64
+		prepared, committedAt, err = txn.prepare(ctx, txnID, participants)
+		if err == nil && prepared {
+			return txn.commitPrepared(ctx, txnID, participants, committedAt)
+		}
+		txn.abort(ctx, txnID, participants)
+		if err == nil {
+			return false, nil
+		}
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if !policy.Retryable(err) {
+			return false, err
+		}
+	}
+
+	return false, err
+}
+
+// participants groups the compares and operations of the transaction by the primary replica of their keys' shards
+// The shard of the first key comes first and is the transaction's primary
+func (txn *Txn) participants(ctx context.Context, refresh bool) ([]*participant, error) {
+	var participants []*participant
+	find := func(key string) (*participant, error) {
+		replicas, epoch, err := txn.client.getReplicas(ctx, key, refresh)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range participants {
+			if p.location == replicas[0] {
+				return p, nil
+			}
+		}
+		p := &participant{location: replicas[0], epoch: epoch}
+		participants = append(participants, p)
+		return p, nil
+	}
+
+	for _, compare := range txn.compares {
+		p, err := find(compare.Key)
+		if err != nil {
+			return nil, err
+		}
+		p.compares = append(p.compares, compare)
+	}
+	for _, op := range txn.ops {
+		p, err := find(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		p.ops = append(p.ops, op)
+	}
+	return participants, nil
+}
+
+// prepare prepares the primary and then every other participant in parallel
+// It returns whether every participant prepared along with the commit time, the latest time any of them prepared at, and stops at the primary if it did not prepare
+func (txn *Txn) prepare(ctx context.Context, txnID string, participants []*participant) (bool, int64, error) {
+	primary := participants[0].location
+	locations := make([]server.ShardLocation, len(participants))
+	for i, p := range participants {
+		locations[i] = p.location
+	}
+
+	call := func(p *participant, all []server.ShardLocation) (*server.PrepareTxnReply, error) {
+		args := &server.PrepareTxnArgs{
+			TxnID:        txnID,
+			Compares:     p.compares,
+			Ops:          p.ops,
+			ShardIdx:     p.location.ShardIdx,
+			Self:         p.location,
+			Primary:      primary,
+			Participants: all,
+			Epoch:        p.epoch,
+			Timeout:      timeoutOf(ctx),
+		}
+		reply := &server.PrepareTxnReply{}
+		if err := txn.client.callReplica(ctx, p.location, "KVServer.PrepareTxn", args, reply); err != nil {
+			return nil, fmt.Errorf("failed to prepare transaction %s: %w", txnID, err)
+		}
+		return reply, nil
+	}
+
+	vote, err := call(participants[0], locations)
+	if err != nil || !vote.Prepared {
+		return false, 0, err
+	}
+
+	votes := make([]*server.PrepareTxnReply, len(participants))
+	errs := make([]error, len(participants))
+	votes[0] = vote
+	var wg sync.WaitGroup
+	for i, p := range participants[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			votes[i+1], errs[i+1] = call(p, nil)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return false, 0, err
+	}
+	var committedAt int64
+	for _, vote := range votes {
+		if !vote.Prepared {
+			return false, 0, nil
+		}
+		committedAt = max(committedAt, vote.PreparedAt)
+	}
+	return true, committedAt, nil
+}
+
+// commitPrepared commits the primary and then every other participant in parallel, all of them at the given commit time
+// Once the primary has committed the transaction has committed, participants that fail to commit afterwards resolve it with the primary later
+// The hook of the client's config is called before each step, and an error from it stops the commit there as if the client had crashed
+func (txn *Txn) commitPrepared(ctx context.Context, txnID string, participants []*participant, committedAt int64) (bool, error) {
+	// Once prepared, the transaction is finished even if the caller stops waiting, so that its keys are not left locked
+	ctx = context.WithoutCancel(ctx)
+	if err := txn.hook(txnID, TxnPrepared); err != nil {
+		return false, err
+	}
+
+	primary := participants[0].location
+	args := &server.CommitTxnArgs{TxnID: txnID, ShardIdx: primary.ShardIdx, CommittedAt: committedAt}
+	if err := txn.client.callReplica(ctx, primary, "KVServer.CommitTxn", args, &server.CommitTxnReply{}); err != nil {
+		if server.IsTxnAborted(err) {
+			txn.abort(ctx, txnID, participants)
+		}
+		return false, fmt.Errorf("failed to commit transaction %s: %w", txnID, err)
+	}
+	if err := txn.hook(txnID, TxnCommitted); err != nil {
+		return true, err
+	}
+
+	txn.finish(ctx, txnID, participants, true, committedAt)
+	return true, nil
+}
+
+// abort aborts the transaction on every participant, which also aborts it on the primary if it was never prepared there
+// The other participants are aborted even if the primary could not be reached, since a transaction the client does not commit can never commit
+func (txn *Txn) abort(ctx context.Context, txnID string, participants []*participant) {
+	ctx = context.WithoutCancel(ctx)
+	primary := participants[0].location
+	args := &server.AbortTxnArgs{TxnID: txnID, ShardIdx: primary.ShardIdx, Primary: true}
+	txn.client.callReplica(ctx, primary, "KVServer.AbortTxn", args, &server.AbortTxnReply{})
+	txn.finish(ctx, txnID, participants, false, 0)
+}
+
+// finish commits the transaction at the given commit time or aborts it on participants other than the primary in parallel
+// The primary is then told which of them have resolved the transaction, the others resolve it with the primary themselves later
+func (txn *Txn) finish(ctx context.Context, txnID string, participants []*participant, commit bool, committedAt int64) {
+	if len(participants) <= 1 {
+		return
+	}
+
+	var resolved []server.ShardLocation
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range participants[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if commit {
+				args := &server.CommitTxnArgs{TxnID: txnID, ShardIdx: p.location.ShardIdx, CommittedAt: committedAt}
+				err = txn.client.callReplica(ctx, p.location, "KVServer.CommitTxn", args, &server.CommitTxnReply{})
+			} else {
+				args := &server.AbortTxnArgs{TxnID: txnID, ShardIdx: p.location.ShardIdx}
+				err = txn.client.callReplica(ctx, p.location, "KVServer.AbortTxn", args, &server.AbortTxnReply{})
+			}
+			if err == nil {
+				mu.Lock()
+				resolved = append(resolved, p.location)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(resolved) == 0 {
+		return
+	}
+	primary := participants[0].location
+	args := &server.ForgetTxnArgs{TxnID: txnID, ShardIdx: primary.ShardIdx, Participants: resolved}
+	txn.client.callReplica(ctx, primary, "KVServer.ForgetTxn", args, &server.ForgetTxnReply{})
+}
+
+// hook calls the transaction hook of the client's config, if it has one, at a step of a distributed commit
+func (txn *Txn) hook(txnID string, phase TxnPhase) error {
+	if txn.client.config.TxnHook == nil {
+		return nil
+	}
+	if err := txn.client.config.TxnHook(txnID, phase); err != nil {
+		return fmt.Errorf("transaction %s stopped once %v: %w", txnID, phase, err)
+	}
+	return nil
+}
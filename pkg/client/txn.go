@@ -0,0 +1,104 @@
+// txn.go
+// This file contains the transaction builder of the client
+// A transaction collects compares and writes, and Commit sends them to the shard of their keys, which applies every write if every compare holds
+// All keys of a transaction must share a hash tag, such as "{user:42}:profile" and "{user:42}:settings", so that they live on the same shard
+//
+// Example usage:
+//
+//	ok, err := client.Txn().
+//		IfVersion("{user:42}:profile", version).
+//		Set("{user:42}:profile", profile).
+//		Delete("{user:42}:session").
+//		Commit()
+package client
+
+import (
+	"context"
+	"fmt"
+	"kvstore/pkg/server"
+)
+
+// A Txn is a transaction being built, its methods add to it and return it so that calls can be chained
+// A Txn is not safe for concurrent use and should be committed once
+// Transactions started with Transaction are distributed and committed across shards
+type Txn struct {
+	client      *Client
+	compares    []server.TxnCompare
+	ops         []server.TxnOp
+	distributed bool
+}
+
+// Txn starts an empty transaction
+func (c *Client) Txn() *Txn {
+	return &Txn{client: c}
+}
+
+// IfVersion makes the transaction apply only if the key has the given version
+func (txn *Txn) IfVersion(key string, version uint64) *Txn {
+	txn.compares = append(txn.compares, server.TxnCompare{Key: key, Target: server.CompareVersion, Version: version})
+	return txn
+}
+
+// IfMissing makes the transaction apply only if the key does not exist
+func (txn *Txn) IfMissing(key string) *Txn {
+	return txn.IfVersion(key, 0)
+}
+
+// IfValue makes the transaction apply only if the key exists with the given value
+func (txn *Txn) IfValue(key string, value string) *Txn {
+	txn.compares = append(txn.compares, server.TxnCompare{Key: key, Target: server.CompareValue, Value: []byte(value)})
+	return txn
+}
+
+// Set adds a write of a key to the transaction
+func (txn *Txn) Set(key string, value string) *Txn {
+	txn.ops = append(txn.ops, server.TxnOp{Key: key, Value: []byte(value)})
+	return txn
+}
+
+// Delete adds a delete of a key to the transaction
+func (txn *Txn) Delete(key string) *Txn {
+	txn.ops = append(txn.ops, server.TxnOp{Key: key, Delete: true})
+	return txn
+}
+
+// Commit sends the transaction to the shard of its keys
+// It returns whether every compare held, in which case every write was applied, and nothing was applied otherwise
+// Transactions started with Txn whose keys do not share a hash tag fail with an error that server.IsCrossShardTxn matches
+// Transactions started with Transaction may use any keys, an error may then leave the outcome unknown until the servers resolve the transaction
+func (txn *Txn) Commit() (bool, error) {
+	return txn.CommitCtx(context.Background())
+}
+
+// CommitCtx is Commit bounded by a context
+func (txn *Txn) CommitCtx(ctx context.Context) (bool, error) {
+	key, ok := txn.firstKey()
+	if !ok {
+		return true, nil
+	}
+	if txn.distributed {
+		return txn.commitDistributed(ctx)
+	}
+
+	requestID := txn.client.nextRequestID()
+	reply := &server.TxnReply{}
+	err := txn.client.callShard(ctx, key, "KVServer.Txn", func(r routing) any {
+		return &server.TxnArgs{Compares: txn.compares, Ops: txn.ops, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout, RequestID: requestID}
+	}, reply)
+	if err != nil {
+		return false, fmt.Errorf("failed to commit transaction on key %s: %w", key, err)
+	}
+
+	return reply.Succeeded, nil
+}
+
+// firstKey returns the first key of the transaction, which routes it, and false if the transaction is empty
+func (txn *Txn) firstKey() (string, bool) {
+	if len(txn.compares) > 0 {
+		return txn.compares[0].Key, true
+	}
+	if len(txn.ops) > 0 {
+		return txn.ops[0].Key, true
+	}
+	return "", false
+}
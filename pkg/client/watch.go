@@ -0,0 +1,296 @@
+// watch.go
+// This file contains watches, which deliver the changes of a key or of every key with a prefix on a channel as they are applied
+// A watch long-polls the shards of its keys for the changes after the last revision it has seen, so no change is lost or repeated when it reconnects
+// Revisions count the writes of a single replica group, so a watch of a key whose route moves to another group ends with an error rather than miss changes
+// Watches outlast unreachable servers and stale routes by retrying according to the client's retry policy for as long as it takes
+// A watch that falls so far behind that a shard no longer holds the changes it missed ends with an error that server.IsRevisionCompacted matches
+//
+// Example usage:
+//
+//	for event := range client.WatchPrefix("config:") {
+//		if event.Err != nil {
+//			return event.Err
+//		}
+//		apply(event.Key, event.Value)
+//	}
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kvstore/pkg/server"
+	"sync"
+	"time"
+)
+
+const (
+	// watchPollWait is how long a single poll of a watch waits on the server for a change
+	watchPollWait = 10 * time.Second
+	// watchBufferSize is the number of changes a watch buffers for a reader that falls behind before it stops polling
+	watchBufferSize = 64
+)
+
+// An EventType tells whether a change set or deleted its key
+type EventType int
+
+const (
+	// EventPut is a change that set its key
+	EventPut EventType = iota
+	// EventDelete is a change that deleted its key
+	EventDelete
+)
+
+// String returns the name of the event type
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(eventType))
+	}
+}
+
+// A WatchEvent is a change of a watched key along with its value and version before and after the change
+// The version is the revision the change was applied at on its shard, which WatchFrom resumes from, and the previous version is zero if the key did not exist
+// The last event of a watch that ended because of an error holds only the error
+type WatchEvent struct {
+	Type        EventType
+	Key         string
+	Value       string
+	Version     uint64
+	PrevValue   string
+	PrevVersion uint64
+	Err         error
+}
+
+// Watch delivers every change of a key from now on, in the order the changes were applied
+// It returns once the shard has been asked for its current revision, so every change applied after it returns is delivered
+// The channel is closed once the client is closed, after an event holding the error if the watch failed otherwise
+// Changes are buffered only up to a small limit, so the channel should be read until it is closed
+func (c *Client) Watch(key string) <-chan WatchEvent {
+	return c.WatchCtx(context.Background(), key)
+}
+
+// WatchCtx is Watch until the context is done, which closes the channel
+func (c *Client) WatchCtx(ctx context.Context, key string) <-chan WatchEvent {
+	return c.WatchFromCtx(ctx, key, 0)
+}
+
+// WatchFrom delivers every change of a key after the given version, such as the version of the last event of an earlier watch
+// A version of zero watches from now on like Watch
+func (c *Client) WatchFrom(key string, version uint64) <-chan WatchEvent {
+	return c.WatchFromCtx(context.Background(), key, version)
+}
+
+// WatchFromCtx is WatchFrom until the context is done, which closes the channel
+func (c *Client) WatchFromCtx(ctx context.Context, key string, version uint64) <-chan WatchEvent {
+	return c.watch(ctx, func(events chan<- WatchEvent, started func()) error {
+		if err := c.watchKey(ctx, key, version, events, started); err != nil {
+			return fmt.Errorf("failed to watch key %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// WatchPrefix delivers every change of the keys that start with the prefix from now on
+// Keys are spread over every shard, so changes of the same key arrive in order but changes of keys on different shards may arrive in any order
+// Shards that join while the prefix is watched are watched from the moment the client learns about them
+func (c *Client) WatchPrefix(prefix string) <-chan WatchEvent {
+	return c.WatchPrefixCtx(context.Background(), prefix)
+}
+
+// WatchPrefixCtx is WatchPrefix until the context is done, which closes the channel
+func (c *Client) WatchPrefixCtx(ctx context.Context, prefix string) <-chan WatchEvent {
+	return c.watch(ctx, func(events chan<- WatchEvent, started func()) error {
+		if err := c.watchPrefix(ctx, prefix, events, started); err != nil {
+			return fmt.Errorf("failed to watch prefix %q: %w", prefix, err)
+		}
+		return nil
+	})
+}
+
+// watch runs a watch in the background and returns the channel it delivers to once the watch calls started or returns
+// The channel is closed when the watch returns, and an error other than the end of the context or of the client is delivered first
+func (c *Client) watch(ctx context.Context, run func(events chan<- WatchEvent, started func()) error) <-chan WatchEvent {
+	events := make(chan WatchEvent, watchBufferSize)
+	ready := make(chan struct{})
+	var once sync.Once
+	started := func() { once.Do(func() { close(ready) }) }
+
+	go func() {
+		defer close(events)
+		defer started()
+		err := run(events, started)
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrClientClosed) {
+			return
+		}
+		select {
+		case events <- WatchEvent{Err: err}:
+		case <-ctx.Done():
+		}
+	}()
+	<-ready
+	return events
+}
+
+// watchKey polls the replica group that owns a key for its changes after a revision until the context is done or a poll fails with an error that is not retryable
+// Once a group has answered, the revision is one of its own, so if the key is routed to another group later the watch fails with ErrRevisionCompacted
+// The watch has started once the first poll has been answered or has failed
+// A zero revision starts the watch at the group's current revision
+func (c *Client) watchKey(ctx context.Context, key string, revision uint64, events chan<- WatchEvent, started func()) error {
+	policy := c.config.Retry
+	latest := revision == 0
+	group := ""
+	for retry := 0; ; {
+		reply := &server.WatchReply{}
+		route, epoch, err := c.getRoute(ctx, key, retry > 0)
+		if err == nil && group != "" && route.GroupID() != group {
+			return fmt.Errorf("%w: key %s moved from group %s to group %s", server.ErrRevisionCompacted, key, group, route.GroupID())
+		}
+		if err == nil {
+			err = c.callReplicas(ctx, replicasOf(route), epoch, "KVServer.Watch", func(r routing) any {
+				return &server.WatchArgs{Key: key, Revision: revision, Latest: latest, Wait: watchPollWait, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+			}, reply)
+		}
+		started()
+		if err != nil {
+			if ctx.Err() != nil || !policy.Retryable(err) {
+				return err
+			}
+			retry++
+			if err := policy.wait(ctx, retry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		retry, group = 0, route.GroupID()
+		if err := deliver(ctx, reply.Events, events, &revision); err != nil {
+			return err
+		}
+		revision, latest = reply.Revision, false
+	}
+}
+
+// watchPrefix polls every shard of the route table for the changes of keys with the prefix
+// When a poll fails with a retryable error the route table is fetched again, and shards that are still routed resume from the revision they reached
+// The watch has started once the first poll of every shard has been answered or has failed
+func (c *Client) watchPrefix(ctx context.Context, prefix string, events chan<- WatchEvent, started func()) error {
+	policy := c.config.Retry
+	revisions := make(map[string]uint64)
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			if err := policy.wait(ctx, retry); err != nil {
+				return err
+			}
+		}
+
+		table := c.routes.Load()
+		if retry > 0 || table == nil || table.ring.Len() == 0 {
+			var err error
+			table, err = c.refreshRoutes(ctx)
+			if err != nil {
+				started()
+				if ctx.Err() != nil || !policy.Retryable(err) {
+					return err
+				}
+				continue
+			}
+		}
+
+		err := c.watchRoutes(ctx, prefix, table, revisions, events, started)
+		if ctx.Err() != nil || !policy.Retryable(err) {
+			return err
+		}
+	}
+}
+
+// watchRoutes polls the replica group of every route in the table in parallel until one of the polls fails, and returns its error
+// The revisions map holds the revision every group has been watched up to by the group's ID, and it is updated as changes are delivered
+// Groups that are not in the map yet are watched from their current revision
+// Started is called once the first poll of every group has been answered or has failed
+func (c *Client) watchRoutes(ctx context.Context, prefix string, table *routeTable, revisions map[string]uint64, events chan<- WatchEvent, started func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	routes := table.ring.Routes()
+	if len(routes) == 0 {
+		return fmt.Errorf("route error for prefix %q: no route found", prefix)
+	}
+	errs := make(chan error, len(routes))
+	pending := len(routes)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, route := range routes {
+		group := route.GroupID()
+		replicas := replicasOf(route)
+		mu.Lock()
+		revision, known := revisions[group]
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for first := true; ; first = false {
+				reply := &server.WatchReply{}
+				err := c.callReplicas(ctx, replicas, table.epoch, "KVServer.Watch", func(r routing) any {
+					return &server.WatchArgs{Key: prefix, Prefix: true, Revision: revision, Latest: !known, Wait: watchPollWait, ShardIdx: r.shardIdx, Epoch: r.epoch, Timeout: r.timeout}
+				}, reply)
+				if err == nil {
+					err = deliver(ctx, reply.Events, events, &revision)
+				}
+				if err == nil {
+					revision, known = max(revision, reply.Revision), true
+				}
+				mu.Lock()
+				if known {
+					revisions[group] = revision
+				}
+				if first {
+					pending--
+					if pending == 0 {
+						started()
+					}
+				}
+				mu.Unlock()
+				if err != nil {
+					errs <- fmt.Errorf("group %s: %w", group, err)
+					return
+				}
+			}
+		}()
+	}
+
+	err := <-errs
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// deliver sends the changes a shard reported to a watch's channel, advancing the revision past every change once it is sent
+// It gives up when the context is done, in which case the revision is that of the last change sent
+func deliver(ctx context.Context, changes []server.ChangeEvent, events chan<- WatchEvent, revision *uint64) error {
+	for _, change := range changes {
+		event := WatchEvent{
+			Type:        EventPut,
+			Key:         change.Key,
+			Value:       string(change.Value),
+			Version:     change.Version,
+			PrevValue:   string(change.PrevValue),
+			PrevVersion: change.PrevVersion,
+		}
+		if change.Delete {
+			event.Type = EventDelete
+		}
+		select {
+		case events <- event:
+			*revision = max(*revision, change.Version)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
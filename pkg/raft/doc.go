@@ -0,0 +1,9 @@
+// Package raft provides an implementation of the Raft consensus algorithm used to replicate shard operations
+//
+// A Raft peer is created with Make from the list of peers in its group, its own index, a persister, and an apply channel
+// Commands are proposed with Start and are delivered on the apply channel in the same order on every peer once they are committed
+// Services compact the log by handing a snapshot of their state to Snapshot, and lagging peers are sent the snapshot instead of the log
+//
+// Peers talk to each other through the Peer interface
+// The Network type is an in-process network that can drop, delay, and partition messages for testing
+package raft
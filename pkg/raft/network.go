@@ -0,0 +1,234 @@
+// network.go
+// This file contains a simulated network for testing Raft groups inside a single process
+// Every peer is registered under an id, and messages between peers can be dropped, delayed, or blocked by partitions
+// Arguments and replies are copied through gob as they would be on a real network, so peers never share memory
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errUnreachable is returned for messages to or from a disconnected or partitioned peer
+var errUnreachable = errors.New("peer is unreachable")
+
+// errDropped is returned for messages lost by an unreliable network
+var errDropped = errors.New("message was dropped")
+
+const (
+	// unreliableDropRate is the fraction of requests and of replies lost on an unreliable network
+	unreliableDropRate = 0.1
+	// unreliableMaxDelay bounds the delay added to every message on an unreliable network
+	unreliableMaxDelay = 27 * time.Millisecond
+	// unreachableDelay and unreachableLongDelay bound how long a message to an unreachable peer takes to fail
+	unreachableDelay     = 100 * time.Millisecond
+	unreachableLongDelay = 2 * time.Second
+)
+
+// The Network struct routes messages between registered peers
+// A message is delivered only if both peers are connected and in the same partition, both when it is sent and when its reply returns
+type Network struct {
+	handlers   map[int]Peer
+	connected  map[int]bool
+	partitions map[int]int
+	reliable   bool
+	longDelays bool
+	rpcCount   atomic.Int64
+	mu         sync.Mutex
+}
+
+// NewNetwork initializes a reliable network without any peers
+func NewNetwork() *Network {
+	return &Network{
+		handlers:   make(map[int]Peer),
+		connected:  make(map[int]bool),
+		partitions: make(map[int]int),
+		reliable:   true,
+	}
+}
+
+// Register connects a peer to the network under the given id, replacing any peer previously registered under it
+func (network *Network) Register(id int, handler Peer) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	network.handlers[id] = handler
+	network.connected[id] = true
+}
+
+// Peer returns the interface the peer with id from uses to send messages to the peer with id to
+func (network *Network) Peer(from int, to int) Peer {
+	return &networkPeer{network: network, from: from, to: to}
+}
+
+// Peers returns the peer list of the given member of a group of n peers with ids 0 to n-1
+func (network *Network) Peers(me int, n int) []Peer {
+	peers := make([]Peer, n)
+	for i := range n {
+		peers[i] = network.Peer(me, i)
+	}
+	return peers
+}
+
+// Connect reconnects a peer to the network
+func (network *Network) Connect(id int) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	network.connected[id] = true
+}
+
+// Disconnect cuts a peer off from every other peer
+func (network *Network) Disconnect(id int) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	network.connected[id] = false
+}
+
+// IsConnected reports whether a peer is connected to the network
+func (network *Network) IsConnected(id int) bool {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	return network.connected[id]
+}
+
+// Partition splits the peers into groups that can only reach peers in their own group
+// Peers not listed in any group form a group of their own
+func (network *Network) Partition(groups ...[]int) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	clear(network.partitions)
+	for i, group := range groups {
+		for _, id := range group {
+			network.partitions[id] = i + 1
+		}
+	}
+}
+
+// Heal removes every partition
+func (network *Network) Heal() {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	clear(network.partitions)
+}
+
+// SetReliable sets whether messages are delivered promptly and without loss
+func (network *Network) SetReliable(reliable bool) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	network.reliable = reliable
+}
+
+// SetLongDelays sets whether messages to unreachable peers take a long time to fail
+func (network *Network) SetLongDelays(longDelays bool) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	network.longDelays = longDelays
+}
+
+// RPCCount returns the number of messages sent so far
+func (network *Network) RPCCount() int {
+	return int(network.rpcCount.Load())
+}
+
+// reachable reports whether a message can currently travel between two peers and returns the receiving handler
+func (network *Network) reachable(from int, to int) (Peer, bool) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	handler := network.handlers[to]
+	ok := handler != nil && network.connected[from] && network.connected[to] &&
+		network.partitions[from] == network.partitions[to]
+	return handler, ok
+}
+
+// conditions returns the current reliability settings
+func (network *Network) conditions() (bool, bool) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	return network.reliable, network.longDelays
+}
+
+// A networkPeer sends messages from one registered peer to another through the network
+type networkPeer struct {
+	network *Network
+	from    int
+	to      int
+}
+
+// RequestVote delivers a RequestVote message
+func (peer *networkPeer) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return deliver(peer, args, reply, Peer.RequestVote)
+}
+
+// AppendEntries delivers an AppendEntries message
+func (peer *networkPeer) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return deliver(peer, args, reply, Peer.AppendEntries)
+}
+
+// InstallSnapshot delivers an InstallSnapshot message
+func (peer *networkPeer) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return deliver(peer, args, reply, Peer.InstallSnapshot)
+}
+
+// deliver sends a message through the network and copies the reply back if it survives the trip
+func deliver[A any, R any](peer *networkPeer, args *A, reply *R, method func(Peer, *A, *R) error) error {
+	network := peer.network
+	network.rpcCount.Add(1)
+
+	reliable, longDelays := network.conditions()
+	if !reliable {
+		time.Sleep(rand.N(unreliableMaxDelay))
+		if rand.Float64() < unreliableDropRate {
+			return errDropped
+		}
+	}
+
+	handler, ok := network.reachable(peer.from, peer.to)
+	if !ok {
+		if longDelays {
+			time.Sleep(rand.N(unreachableLongDelay))
+		} else {
+			time.Sleep(rand.N(unreachableDelay))
+		}
+		return errUnreachable
+	}
+
+	var remoteArgs A
+	var remoteReply R
+	if err := copyThroughGob(args, &remoteArgs); err != nil {
+		return err
+	}
+	if err := method(handler, &remoteArgs, &remoteReply); err != nil {
+		return err
+	}
+
+	if !reliable && rand.Float64() < unreliableDropRate {
+		return errDropped
+	}
+	if _, ok := network.reachable(peer.from, peer.to); !ok {
+		return errUnreachable
+	}
+	return copyThroughGob(&remoteReply, reply)
+}
+
+// copyThroughGob copies src into dst by encoding and decoding it
+func copyThroughGob(src any, dst any) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		return err
+	}
+	return gob.NewDecoder(&buf).Decode(dst)
+}
@@ -0,0 +1,235 @@
+// persister.go
+// This file contains the storage Raft uses for its durable state and the service's latest snapshot
+// The memory persister keeps both in memory and can be copied to simulate a restart in tests
+// The file persister writes every change to disk before returning, so a peer restarted from it keeps its votes and log
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// A Persister stores a Raft peer's durable state and the latest snapshot of its service
+// Save replaces both at once, so the state never refers to a snapshot that was not stored
+type Persister interface {
+	SaveState(state []byte) error
+	Save(state []byte, snapshot []byte) error
+	ReadState() []byte
+	ReadSnapshot() []byte
+	StateSize() int
+}
+
+// The MemoryPersister keeps the state and snapshot in memory
+type MemoryPersister struct {
+	state    []byte
+	snapshot []byte
+	mu       sync.Mutex
+}
+
+// NewMemoryPersister initializes an empty in-memory persister
+func NewMemoryPersister() *MemoryPersister {
+	return &MemoryPersister{}
+}
+
+// Copy returns a new persister with the same contents
+// Tests use it to restart a peer from the state it had persisted when it crashed
+func (persister *MemoryPersister) Copy() *MemoryPersister {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	return &MemoryPersister{state: persister.state, snapshot: persister.snapshot}
+}
+
+// SaveState replaces the Raft state and keeps the snapshot
+func (persister *MemoryPersister) SaveState(state []byte) error {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	persister.state = slices.Clone(state)
+	return nil
+}
+
+// Save replaces the Raft state and the snapshot
+func (persister *MemoryPersister) Save(state []byte, snapshot []byte) error {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	persister.state = slices.Clone(state)
+	persister.snapshot = slices.Clone(snapshot)
+	return nil
+}
+
+// ReadState returns the last saved Raft state
+func (persister *MemoryPersister) ReadState() []byte {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	return slices.Clone(persister.state)
+}
+
+// ReadSnapshot returns the last saved snapshot
+func (persister *MemoryPersister) ReadSnapshot() []byte {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	return slices.Clone(persister.snapshot)
+}
+
+// StateSize returns the size of the Raft state in bytes, services use it to decide when to snapshot
+func (persister *MemoryPersister) StateSize() int {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	return len(persister.state)
+}
+
+// The FilePersister stores the state and snapshot as files in a directory
+// Snapshots are written to a new numbered file before the state that refers to them, so a crash in between leaves the old pair intact
+type FilePersister struct {
+	dir        string
+	generation uint64
+	state      []byte
+	snapshot   []byte
+	mu         sync.Mutex
+}
+
+const (
+	stateFile      = "state"
+	snapshotPrefix = "snapshot-"
+)
+
+// NewFilePersister opens the persister stored in a directory, creating the directory if needed
+func NewFilePersister(dir string) (*FilePersister, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory %s: %v", dir, err)
+	}
+
+	persister := &FilePersister{dir: dir}
+	contents, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return persister, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read raft state: %v", err)
+	}
+	if len(contents) < 8 {
+		return nil, fmt.Errorf("raft state in %s is truncated", dir)
+	}
+
+	persister.generation = binary.LittleEndian.Uint64(contents[:8])
+	persister.state = contents[8:]
+	if persister.generation > 0 {
+		persister.snapshot, err = os.ReadFile(persister.snapshotPath(persister.generation))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read raft snapshot: %v", err)
+		}
+	}
+
+	return persister, nil
+}
+
+// SaveState durably replaces the Raft state and keeps the snapshot
+func (persister *FilePersister) SaveState(state []byte) error {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	if err := persister.writeState(persister.generation, state); err != nil {
+		return err
+	}
+	persister.state = slices.Clone(state)
+	return nil
+}
+
+// Save durably replaces the Raft state and the snapshot
+func (persister *FilePersister) Save(state []byte, snapshot []byte) error {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	generation := persister.generation + 1
+	if err := writeFileAtomic(persister.snapshotPath(generation), snapshot); err != nil {
+		return err
+	}
+	if err := persister.writeState(generation, state); err != nil {
+		return err
+	}
+
+	if persister.generation > 0 {
+		os.Remove(persister.snapshotPath(persister.generation))
+	}
+	persister.generation = generation
+	persister.state = slices.Clone(state)
+	persister.snapshot = slices.Clone(snapshot)
+	return nil
+}
+
+// ReadState returns the last saved Raft state
+func (persister *FilePersister) ReadState() []byte {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	return slices.Clone(persister.state)
+}
+
+// ReadSnapshot returns the last saved snapshot
+func (persister *FilePersister) ReadSnapshot() []byte {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	return slices.Clone(persister.snapshot)
+}
+
+// StateSize returns the size of the Raft state in bytes
+func (persister *FilePersister) StateSize() int {
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+
+	return len(persister.state)
+}
+
+// writeState writes the state file, prefixed with the generation of the snapshot it belongs to
+func (persister *FilePersister) writeState(generation uint64, state []byte) error {
+	contents := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+len(state)), generation)
+	return writeFileAtomic(filepath.Join(persister.dir, stateFile), append(contents, state...))
+}
+
+// snapshotPath returns the path of a numbered snapshot file
+func (persister *FilePersister) snapshotPath(generation uint64) string {
+	return filepath.Join(persister.dir, snapshotPrefix+strconv.FormatUint(generation, 10))
+}
+
+// writeFileAtomic writes a file under a temporary name, syncs it, and renames it into place
+func writeFileAtomic(path string, contents []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %v", tmpPath, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename %s: %v", tmpPath, err)
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,647 @@
+// raft.go
+// This file contains a Raft peer: leader election, log replication, persistence, and log compaction
+// Every peer starts as a follower and becomes a candidate if it hears nothing from a leader for a randomized election timeout
+// The leader appends commands to its log and replicates them, and an entry is committed once a majority stores it
+// Committed entries are handed to the service in log order through the apply channel
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// role is the part a peer currently plays in its group
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+const (
+	// heartbeatInterval is how often the leader contacts followers when it has nothing new to send
+	heartbeatInterval = 50 * time.Millisecond
+	// electionTimeoutMin and electionTimeoutMax bound the randomized time a follower waits for a leader
+	electionTimeoutMin = 300 * time.Millisecond
+	electionTimeoutMax = 600 * time.Millisecond
+	// tickInterval is how often the background loop checks the election and heartbeat timers
+	tickInterval = 10 * time.Millisecond
+)
+
+// The Raft struct is a single peer of a Raft group
+// The log always starts with a sentinel entry holding the index and term of the last entry covered by the snapshot
+// Durable state is the current term, the vote, the log, and the snapshot, and it is persisted before any reply depends on it
+type Raft struct {
+	peers     []Peer
+	me        int
+	persister Persister
+	applyCh   chan<- ApplyMsg
+	applyCond *sync.Cond
+	dead      atomic.Bool
+	killCh    chan struct{}
+	killOnce  sync.Once
+
+	currentTerm int
+	votedFor    int
+	log         []LogEntry
+	snapshot    []byte
+
+	role             role
+	commitIndex      int
+	lastApplied      int
+	pendingSnapshot  bool
+	nextIndex        []int
+	matchIndex       []int
+	electionDeadline time.Time
+	heartbeatDue     time.Time
+
+	mu sync.Mutex
+}
+
+// persistentState is the part of a peer's state that survives restarts
+type persistentState struct {
+	CurrentTerm int
+	VotedFor    int
+	Log         []LogEntry
+}
+
+// Make creates a Raft peer and starts its background loops
+// peers holds every member of the group in the same order on every member, and the entry at index me is never called
+// Any state saved in the persister is restored, and a saved snapshot is delivered on the apply channel before any command
+func Make(peers []Peer, me int, persister Persister, applyCh chan<- ApplyMsg) *Raft {
+	rf := &Raft{
+		peers:     peers,
+		me:        me,
+		persister: persister,
+		applyCh:   applyCh,
+		killCh:    make(chan struct{}),
+		votedFor:  -1,
+		log:       []LogEntry{{}},
+	}
+	rf.applyCond = sync.NewCond(&rf.mu)
+
+	rf.readPersist(persister.ReadState())
+	rf.snapshot = persister.ReadSnapshot()
+	rf.commitIndex = rf.firstIndex()
+	rf.lastApplied = rf.firstIndex()
+	rf.pendingSnapshot = len(rf.snapshot) > 0
+	rf.resetElectionTimer()
+
+	go rf.ticker()
+	go rf.applier()
+
+	return rf
+}
+
+// Start proposes a command for the replicated log
+// It returns immediately with the index the command will have if it is committed, the current term, and whether this peer is the leader
+// There is no guarantee the command is ever committed, the service has to watch the apply channel for it
+func (rf *Raft) Start(command []byte) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.role != leader || rf.killed() {
+		return -1, rf.currentTerm, false
+	}
+
+	index := rf.lastIndex() + 1
+	rf.log = append(rf.log, LogEntry{Index: index, Term: rf.currentTerm, Command: command})
+	rf.persist()
+	rf.matchIndex[rf.me] = index
+	rf.advanceCommit()
+	rf.broadcast()
+
+	return index, rf.currentTerm, true
+}
+
+// GetState returns the current term and whether this peer believes it is the leader
+func (rf *Raft) GetState() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.currentTerm, rf.role == leader
+}
+
+// Snapshot tells the peer that the service has captured its state up to and including the given index
+// The log up to the index is discarded, and the snapshot is sent to followers that need those entries
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if index <= rf.firstIndex() || index > rf.lastApplied {
+		return
+	}
+
+	rf.log = append([]LogEntry(nil), rf.log[index-rf.firstIndex():]...)
+	rf.log[0].Command = nil
+	rf.snapshot = snapshot
+	rf.persistWithSnapshot()
+}
+
+// Kill stops the peer's background loops
+// A killed peer rejects new commands and stops delivering messages on the apply channel, even one the service has stopped reading
+func (rf *Raft) Kill() {
+	rf.stop()
+
+	rf.mu.Lock()
+	rf.applyCond.Broadcast()
+	rf.mu.Unlock()
+}
+
+// RequestVote is the RPC handler candidates call to ask for this peer's vote
+// A vote is granted at most once per term, and only to candidates whose log is at least as up to date as this peer's
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+
+	upToDate := args.LastLogTerm > rf.lastTerm() ||
+		(args.LastLogTerm == rf.lastTerm() && args.LastLogIndex >= rf.lastIndex())
+	if (rf.votedFor == -1 || rf.votedFor == args.CandidateID) && upToDate {
+		rf.votedFor = args.CandidateID
+		rf.persist()
+		rf.resetElectionTimer()
+		reply.VoteGranted = true
+	}
+
+	return nil
+}
+
+// AppendEntries is the RPC handler the leader calls to replicate entries and to assert its leadership
+// Entries that conflict with the leader's log are discarded along with everything after them
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm || (args.Term == rf.currentTerm && rf.role == candidate) {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.resetElectionTimer()
+
+	// Entries covered by the snapshot are committed and cannot conflict, so the leader can continue after the commit index
+	if args.PrevLogIndex < rf.firstIndex() {
+		reply.ConflictTerm = -1
+		reply.ConflictIndex = rf.commitIndex + 1
+		return nil
+	}
+	if args.PrevLogIndex > rf.lastIndex() {
+		reply.ConflictTerm = -1
+		reply.ConflictIndex = rf.lastIndex() + 1
+		return nil
+	}
+	if term := rf.entry(args.PrevLogIndex).Term; term != args.PrevLogTerm {
+		reply.ConflictTerm = term
+		reply.ConflictIndex = args.PrevLogIndex
+		for reply.ConflictIndex > rf.firstIndex()+1 && rf.entry(reply.ConflictIndex-1).Term == term {
+			reply.ConflictIndex--
+		}
+		return nil
+	}
+
+	for i, entry := range args.Entries {
+		if entry.Index <= rf.lastIndex() && rf.entry(entry.Index).Term == entry.Term {
+			continue
+		}
+		rf.log = append(rf.log[:entry.Index-rf.firstIndex()], args.Entries[i:]...)
+		rf.persist()
+		break
+	}
+
+	// Only the entries this request proved to match the leader's log can be committed
+	if commit := min(args.LeaderCommit, args.PrevLogIndex+len(args.Entries)); commit > rf.commitIndex {
+		rf.commitIndex = commit
+		rf.applyCond.Broadcast()
+	}
+	reply.Success = true
+
+	return nil
+}
+
+// InstallSnapshot is the RPC handler the leader calls when this peer needs entries the leader has already compacted
+// The snapshot replaces the log up to its last included entry and is passed on to the service
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm || (args.Term == rf.currentTerm && rf.role == candidate) {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.resetElectionTimer()
+
+	if args.LastIncludedIndex <= rf.commitIndex {
+		return nil
+	}
+
+	sentinel := LogEntry{Index: args.LastIncludedIndex, Term: args.LastIncludedTerm}
+	if args.LastIncludedIndex < rf.lastIndex() && rf.entry(args.LastIncludedIndex).Term == args.LastIncludedTerm {
+		rf.log = append([]LogEntry{sentinel}, rf.log[args.LastIncludedIndex-rf.firstIndex()+1:]...)
+	} else {
+		rf.log = []LogEntry{sentinel}
+	}
+	rf.snapshot = args.Data
+	rf.commitIndex = args.LastIncludedIndex
+	rf.lastApplied = args.LastIncludedIndex
+	rf.pendingSnapshot = true
+	rf.persistWithSnapshot()
+	rf.applyCond.Broadcast()
+
+	return nil
+}
+
+// ticker starts elections when the election timer expires and sends heartbeats while the peer is the leader
+func (rf *Raft) ticker() {
+	for !rf.killed() {
+		time.Sleep(tickInterval)
+
+		rf.mu.Lock()
+		now := time.Now()
+		switch {
+		case rf.role == leader && now.After(rf.heartbeatDue):
+			rf.broadcast()
+		case rf.role != leader && now.After(rf.electionDeadline):
+			rf.startElection()
+		}
+		rf.mu.Unlock()
+	}
+}
+
+// startElection becomes a candidate for the next term and asks every other peer for its vote
+// The caller must hold the mutex
+func (rf *Raft) startElection() {
+	rf.role = candidate
+	rf.currentTerm++
+	rf.votedFor = rf.me
+	rf.persist()
+	rf.resetElectionTimer()
+
+	args := &RequestVoteArgs{
+		Term:         rf.currentTerm,
+		CandidateID:  rf.me,
+		LastLogIndex: rf.lastIndex(),
+		LastLogTerm:  rf.lastTerm(),
+	}
+	votes := 1
+	if votes > len(rf.peers)/2 {
+		rf.becomeLeader()
+		return
+	}
+
+	for i, peer := range rf.peers {
+		if i == rf.me {
+			continue
+		}
+		go func() {
+			reply := &RequestVoteReply{}
+			if err := peer.RequestVote(args, reply); err != nil {
+				return
+			}
+
+			rf.mu.Lock()
+			defer rf.mu.Unlock()
+
+			if reply.Term > rf.currentTerm {
+				rf.becomeFollower(reply.Term)
+				return
+			}
+			if rf.role != candidate || rf.currentTerm != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(rf.peers)/2 {
+				rf.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over as leader for the current term and immediately asserts leadership
+// The caller must hold the mutex
+func (rf *Raft) becomeLeader() {
+	rf.role = leader
+	rf.nextIndex = make([]int, len(rf.peers))
+	rf.matchIndex = make([]int, len(rf.peers))
+	for i := range rf.peers {
+		rf.nextIndex[i] = rf.lastIndex() + 1
+	}
+	rf.matchIndex[rf.me] = rf.lastIndex()
+	rf.broadcast()
+}
+
+// becomeFollower steps down to follower, starting a new term without a vote if the term is newer
+// The caller must hold the mutex
+func (rf *Raft) becomeFollower(term int) {
+	rf.role = follower
+	if term > rf.currentTerm {
+		rf.currentTerm = term
+		rf.votedFor = -1
+		rf.persist()
+	}
+}
+
+// broadcast sends every follower the entries it is missing, or a heartbeat if it has all of them
+// The caller must hold the mutex
+func (rf *Raft) broadcast() {
+	rf.heartbeatDue = time.Now().Add(heartbeatInterval)
+	for i := range rf.peers {
+		if i != rf.me {
+			rf.replicate(i)
+		}
+	}
+}
+
+// replicate sends a single follower the next entries it needs, or the snapshot if those entries were compacted
+// The request is built under the mutex and sent in the background
+// The caller must hold the mutex
+func (rf *Raft) replicate(peer int) {
+	if rf.nextIndex[peer] <= rf.firstIndex() {
+		args := &InstallSnapshotArgs{
+			Term:              rf.currentTerm,
+			LeaderID:          rf.me,
+			LastIncludedIndex: rf.firstIndex(),
+			LastIncludedTerm:  rf.log[0].Term,
+			Data:              rf.snapshot,
+		}
+		go rf.sendSnapshot(peer, args)
+		return
+	}
+
+	prevLogIndex := rf.nextIndex[peer] - 1
+	args := &AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderID:     rf.me,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  rf.entry(prevLogIndex).Term,
+		Entries:      append([]LogEntry(nil), rf.log[prevLogIndex-rf.firstIndex()+1:]...),
+		LeaderCommit: rf.commitIndex,
+	}
+	go rf.sendEntries(peer, args)
+}
+
+// sendEntries sends an AppendEntries request and updates the follower's progress from the reply
+// On a mismatch the next index is moved back past the conflicting term and the follower is retried immediately
+func (rf *Raft) sendEntries(peer int, args *AppendEntriesArgs) {
+	reply := &AppendEntriesReply{}
+	if err := rf.peers[peer].AppendEntries(args, reply); err != nil {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollower(reply.Term)
+		return
+	}
+	if rf.role != leader || rf.currentTerm != args.Term {
+		return
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[peer] {
+			rf.matchIndex[peer] = match
+			rf.nextIndex[peer] = match + 1
+			rf.advanceCommit()
+		}
+		return
+	}
+
+	// A stale reply must not move the next index backwards past entries the follower has since confirmed
+	next := reply.ConflictIndex
+	if reply.ConflictTerm >= 0 {
+		for i := rf.lastIndex(); i > rf.firstIndex(); i-- {
+			if rf.entry(i).Term == reply.ConflictTerm {
+				next = i + 1
+				break
+			}
+		}
+	}
+	rf.nextIndex[peer] = max(min(next, rf.lastIndex()+1), rf.matchIndex[peer]+1, 1)
+	rf.replicate(peer)
+}
+
+// sendSnapshot sends an InstallSnapshot request and records that the follower now has everything the snapshot covers
+func (rf *Raft) sendSnapshot(peer int, args *InstallSnapshotArgs) {
+	reply := &InstallSnapshotReply{}
+	if err := rf.peers[peer].InstallSnapshot(args, reply); err != nil {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollower(reply.Term)
+		return
+	}
+	if rf.role != leader || rf.currentTerm != args.Term {
+		return
+	}
+
+	if args.LastIncludedIndex > rf.matchIndex[peer] {
+		rf.matchIndex[peer] = args.LastIncludedIndex
+		rf.nextIndex[peer] = args.LastIncludedIndex + 1
+	}
+}
+
+// advanceCommit commits the highest entry of the current term that a majority of the group stores
+// Entries from earlier terms are committed along with it, never on their own
+// The caller must hold the mutex
+func (rf *Raft) advanceCommit() {
+	for index := rf.lastIndex(); index > rf.commitIndex && index > rf.firstIndex(); index-- {
+		if rf.entry(index).Term != rf.currentTerm {
+			return
+		}
+
+		count := 0
+		for _, match := range rf.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count > len(rf.peers)/2 {
+			rf.commitIndex = index
+			rf.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// applier delivers pending snapshots and committed entries to the service in order
+// The mutex is released while sending so that a slow service does not block the peer
+func (rf *Raft) applier() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for {
+		for !rf.killed() && !rf.pendingSnapshot && rf.lastApplied >= rf.commitIndex {
+			rf.applyCond.Wait()
+		}
+		if rf.killed() {
+			return
+		}
+
+		if rf.pendingSnapshot {
+			msg := ApplyMsg{
+				SnapshotValid: true,
+				Snapshot:      rf.snapshot,
+				SnapshotIndex: rf.firstIndex(),
+				SnapshotTerm:  rf.log[0].Term,
+			}
+			rf.pendingSnapshot = false
+			rf.lastApplied = max(rf.lastApplied, msg.SnapshotIndex)
+
+			rf.mu.Unlock()
+			sent := rf.send(msg)
+			rf.mu.Lock()
+			if !sent {
+				return
+			}
+			continue
+		}
+
+		entries := append([]LogEntry(nil), rf.log[rf.lastApplied-rf.firstIndex()+1:rf.commitIndex-rf.firstIndex()+1]...)
+		rf.lastApplied = rf.commitIndex
+
+		rf.mu.Unlock()
+		for _, entry := range entries {
+			msg := ApplyMsg{
+				CommandValid: true,
+				Command:      entry.Command,
+				CommandIndex: entry.Index,
+				CommandTerm:  entry.Term,
+			}
+			if !rf.send(msg) {
+				rf.mu.Lock()
+				return
+			}
+		}
+		rf.mu.Lock()
+	}
+}
+
+// send delivers a message on the apply channel and reports whether it was delivered before the peer was killed
+// The caller must not hold the mutex
+func (rf *Raft) send(msg ApplyMsg) bool {
+	select {
+	case rf.applyCh <- msg:
+		return true
+	case <-rf.killCh:
+		return false
+	}
+}
+
+// persist saves the durable state, leaving the stored snapshot as it is
+// A peer that cannot persist its state must not answer any more requests, so it stops itself
+// The caller must hold the mutex
+func (rf *Raft) persist() {
+	state, ok := rf.encodeState()
+	if !ok {
+		return
+	}
+	if err := rf.persister.SaveState(state); err != nil {
+		log.Printf("Raft peer %d failed to persist its state: %v", rf.me, err)
+		rf.stop()
+	}
+}
+
+// persistWithSnapshot saves the durable state together with a new snapshot
+// The caller must hold the mutex
+func (rf *Raft) persistWithSnapshot() {
+	state, ok := rf.encodeState()
+	if !ok {
+		return
+	}
+	if err := rf.persister.Save(state, rf.snapshot); err != nil {
+		log.Printf("Raft peer %d failed to persist its snapshot: %v", rf.me, err)
+		rf.stop()
+	}
+}
+
+// encodeState serializes the current term, vote, and log
+// The caller must hold the mutex
+func (rf *Raft) encodeState() ([]byte, bool) {
+	var buf bytes.Buffer
+	state := persistentState{CurrentTerm: rf.currentTerm, VotedFor: rf.votedFor, Log: rf.log}
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		log.Printf("Raft peer %d failed to encode its state: %v", rf.me, err)
+		rf.stop()
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// readPersist restores the durable state saved by persist
+func (rf *Raft) readPersist(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	var state persistentState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		log.Printf("Raft peer %d failed to decode its persisted state: %v", rf.me, err)
+		return
+	}
+	rf.currentTerm = state.CurrentTerm
+	rf.votedFor = state.VotedFor
+	rf.log = state.Log
+}
+
+// resetElectionTimer picks a new random election deadline
+// The caller must hold the mutex
+func (rf *Raft) resetElectionTimer() {
+	timeout := electionTimeoutMin + rand.N(electionTimeoutMax-electionTimeoutMin)
+	rf.electionDeadline = time.Now().Add(timeout)
+}
+
+// stop marks the peer as dead and wakes an applier waiting to deliver a message
+func (rf *Raft) stop() {
+	rf.dead.Store(true)
+	rf.killOnce.Do(func() { close(rf.killCh) })
+}
+
+// killed reports whether Kill has been called
+func (rf *Raft) killed() bool {
+	return rf.dead.Load()
+}
+
+// firstIndex returns the index of the log's sentinel entry, which is the last index covered by the snapshot
+func (rf *Raft) firstIndex() int {
+	return rf.log[0].Index
+}
+
+// lastIndex returns the index of the last entry in the log
+func (rf *Raft) lastIndex() int {
+	return rf.log[len(rf.log)-1].Index
+}
+
+// lastTerm returns the term of the last entry in the log
+func (rf *Raft) lastTerm() int {
+	return rf.log[len(rf.log)-1].Term
+}
+
+// entry returns the log entry with the given index, which must not be older than the sentinel
+func (rf *Raft) entry(index int) LogEntry {
+	return rf.log[index-rf.firstIndex()]
+}
@@ -0,0 +1,438 @@
+package raft_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"kvstore/pkg/raft"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snapshotEvery is how often the test service snapshots when snapshots are enabled
+const snapshotEvery = 10
+
+// A cluster is a Raft group on a simulated network whose peers apply commands to a log of strings
+// Every applied command is checked against the commands the other peers applied at the same index
+type cluster struct {
+	t          *testing.T
+	network    *raft.Network
+	rafts      []*raft.Raft
+	persisters []*raft.MemoryPersister
+	applied    []map[int]string
+	stops      []chan struct{}
+	snapshots  bool
+	mu         sync.Mutex
+}
+
+// newCluster starts a group of n peers
+func newCluster(t *testing.T, n int, snapshots bool) *cluster {
+	c := &cluster{
+		t:          t,
+		network:    raft.NewNetwork(),
+		rafts:      make([]*raft.Raft, n),
+		persisters: make([]*raft.MemoryPersister, n),
+		applied:    make([]map[int]string, n),
+		stops:      make([]chan struct{}, n),
+		snapshots:  snapshots,
+	}
+	for i := range n {
+		c.persisters[i] = raft.NewMemoryPersister()
+		c.start(i)
+	}
+	t.Cleanup(func() {
+		for i := range n {
+			c.crash(i)
+		}
+	})
+	return c
+}
+
+// start launches peer i from its persisted state
+func (c *cluster) start(i int) {
+	applyCh := make(chan raft.ApplyMsg)
+	stop := make(chan struct{})
+	rf := raft.Make(c.network.Peers(i, len(c.rafts)), i, c.persisters[i], applyCh)
+
+	c.mu.Lock()
+	c.rafts[i] = rf
+	c.applied[i] = make(map[int]string)
+	c.stops[i] = stop
+	c.mu.Unlock()
+
+	c.network.Register(i, rf)
+	go c.apply(i, rf, applyCh, stop)
+}
+
+// crash disconnects and stops peer i, keeping only what it persisted
+func (c *cluster) crash(i int) {
+	c.network.Disconnect(i)
+
+	c.mu.Lock()
+	rf, stop := c.rafts[i], c.stops[i]
+	c.rafts[i] = nil
+	c.mu.Unlock()
+
+	if rf != nil {
+		rf.Kill()
+		close(stop)
+	}
+	c.persisters[i] = c.persisters[i].Copy()
+}
+
+// apply consumes the apply channel of peer i
+func (c *cluster) apply(i int, rf *raft.Raft, applyCh chan raft.ApplyMsg, stop chan struct{}) {
+	lastApplied := 0
+	for {
+		var msg raft.ApplyMsg
+		select {
+		case msg = <-applyCh:
+		case <-stop:
+			return
+		}
+
+		if msg.SnapshotValid {
+			var log map[int]string
+			if err := gob.NewDecoder(bytes.NewReader(msg.Snapshot)).Decode(&log); err != nil {
+				c.t.Errorf("Peer %d failed to decode snapshot: %v", i, err)
+				return
+			}
+			c.mu.Lock()
+			c.applied[i] = log
+			c.mu.Unlock()
+			lastApplied = msg.SnapshotIndex
+			continue
+		}
+
+		if msg.CommandIndex != lastApplied+1 {
+			c.t.Errorf("Peer %d applied index %d after %d", i, msg.CommandIndex, lastApplied)
+		}
+		lastApplied = msg.CommandIndex
+
+		c.mu.Lock()
+		command := string(msg.Command)
+		for j, log := range c.applied {
+			if previous, exists := log[msg.CommandIndex]; exists && previous != command {
+				c.t.Errorf("Peer %d applied %q at index %d but peer %d applied %q", i, command, msg.CommandIndex, j, previous)
+			}
+		}
+		c.applied[i][msg.CommandIndex] = command
+
+		var snapshot []byte
+		if c.snapshots && msg.CommandIndex%snapshotEvery == 0 {
+			var buf bytes.Buffer
+			gob.NewEncoder(&buf).Encode(c.applied[i])
+			snapshot = buf.Bytes()
+		}
+		c.mu.Unlock()
+
+		if snapshot != nil {
+			rf.Snapshot(msg.CommandIndex, snapshot)
+		}
+	}
+}
+
+// checkOneLeader waits for exactly one connected peer to claim leadership of the newest term and returns it
+func (c *cluster) checkOneLeader() int {
+	for range 10 {
+		time.Sleep(500 * time.Millisecond)
+
+		leaders := make(map[int][]int)
+		for i, rf := range c.liveRafts() {
+			if rf == nil || !c.network.IsConnected(i) {
+				continue
+			}
+			if term, isLeader := rf.GetState(); isLeader {
+				leaders[term] = append(leaders[term], i)
+			}
+		}
+
+		newest := -1
+		for term, ids := range leaders {
+			if len(ids) > 1 {
+				c.t.Fatalf("Term %d has %d leaders: %v", term, len(ids), ids)
+			}
+			newest = max(newest, term)
+		}
+		if newest >= 0 {
+			return leaders[newest][0]
+		}
+	}
+
+	c.t.Fatalf("Expected a leader to be elected")
+	return -1
+}
+
+// nCommitted returns how many peers applied a command at the index and the command itself
+func (c *cluster) nCommitted(index int) (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	command := ""
+	for _, log := range c.applied {
+		if applied, exists := log[index]; exists {
+			count++
+			command = applied
+		}
+	}
+	return count, command
+}
+
+// one submits a command until a leader accepts it and at least expected peers apply it, and returns its index
+func (c *cluster) one(command string, expected int) int {
+	deadline := time.Now().Add(10 * time.Second)
+	// The first peer asked rotates so that a stale leader cut off from the majority is not asked every time
+	for attempt := 0; time.Now().Before(deadline); attempt++ {
+		index := -1
+		rafts := c.liveRafts()
+		for j := range rafts {
+			rf := rafts[(attempt+j)%len(rafts)]
+			if rf == nil {
+				continue
+			}
+			if i, _, isLeader := rf.Start([]byte(command)); isLeader {
+				index = i
+				break
+			}
+		}
+
+		if index >= 0 {
+			for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(20 * time.Millisecond) {
+				count, applied := c.nCommitted(index)
+				if count >= expected && applied == command {
+					return index
+				}
+			}
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	c.t.Fatalf("Command %q was not committed by %d peers", command, expected)
+	return -1
+}
+
+// liveRafts returns the running peers, with nil entries for crashed ones
+func (c *cluster) liveRafts() []*raft.Raft {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*raft.Raft(nil), c.rafts...)
+}
+
+func TestInitialElection(t *testing.T) {
+	c := newCluster(t, 3, false)
+	leader := c.checkOneLeader()
+
+	term, _ := c.rafts[leader].GetState()
+	time.Sleep(time.Second)
+	if newTerm, _ := c.rafts[leader].GetState(); newTerm != term {
+		t.Errorf("Expected the term to stay at %d without failures, got %d", term, newTerm)
+	}
+}
+
+func TestReElection(t *testing.T) {
+	c := newCluster(t, 3, false)
+	leader := c.checkOneLeader()
+
+	// The remaining majority elects a new leader, and the old leader rejoining does not disturb it
+	c.network.Disconnect(leader)
+	newLeader := c.checkOneLeader()
+	if newLeader == leader {
+		t.Fatalf("Expected a new leader after disconnecting peer %d", leader)
+	}
+	c.network.Connect(leader)
+	leader = c.checkOneLeader()
+
+	// Without a majority the remaining peer cannot be elected
+	remaining := (leader + 2) % 3
+	c.network.Disconnect(leader)
+	c.network.Disconnect((leader + 1) % 3)
+	time.Sleep(2 * time.Second)
+	if _, isLeader := c.rafts[remaining].GetState(); isLeader {
+		t.Errorf("Expected no leader without a majority, peer %d claims leadership", remaining)
+	}
+
+	c.network.Connect(leader)
+	c.network.Connect((leader + 1) % 3)
+	c.checkOneLeader()
+}
+
+func TestBasicAgree(t *testing.T) {
+	c := newCluster(t, 5, false)
+	for i := 1; i <= 3; i++ {
+		if count, _ := c.nCommitted(i); count > 0 {
+			t.Fatalf("Index %d was committed before Start", i)
+		}
+		if index := c.one("command"+strconv.Itoa(i), 5); index != i {
+			t.Fatalf("Expected index %d, got %d", i, index)
+		}
+	}
+}
+
+func TestFailAgree(t *testing.T) {
+	c := newCluster(t, 3, false)
+	c.one("before", 3)
+
+	// A single disconnected follower does not stop the majority from committing
+	leader := c.checkOneLeader()
+	c.network.Disconnect((leader + 1) % 3)
+	c.one("during1", 2)
+	c.one("during2", 2)
+
+	// Once reconnected, the follower catches up
+	c.network.Connect((leader + 1) % 3)
+	c.one("after", 3)
+}
+
+func TestFailNoAgree(t *testing.T) {
+	c := newCluster(t, 5, false)
+	c.one("before", 5)
+
+	leader := c.checkOneLeader()
+	for i := 1; i <= 3; i++ {
+		c.network.Disconnect((leader + i) % 5)
+	}
+
+	index, _, isLeader := c.rafts[leader].Start([]byte("lost"))
+	if !isLeader {
+		t.Fatalf("Expected peer %d to still accept commands", leader)
+	}
+	time.Sleep(2 * time.Second)
+	if count, _ := c.nCommitted(index); count > 0 {
+		t.Fatalf("Expected no commit without a majority, %d peers applied index %d", count, index)
+	}
+
+	for i := 1; i <= 3; i++ {
+		c.network.Connect((leader + i) % 5)
+	}
+	c.one("after", 5)
+}
+
+func TestPersist(t *testing.T) {
+	c := newCluster(t, 3, false)
+	c.one("first", 3)
+
+	// Restarting every peer keeps the committed log
+	for i := range 3 {
+		c.crash(i)
+	}
+	for i := range 3 {
+		c.start(i)
+	}
+	c.one("second", 3)
+
+	// A restarted leader rejoins as a follower and catches up
+	leader := c.checkOneLeader()
+	c.crash(leader)
+	c.one("third", 2)
+	c.start(leader)
+	c.one("fourth", 3)
+}
+
+func TestPartitionedLeaderIsOverwritten(t *testing.T) {
+	c := newCluster(t, 5, false)
+	c.one("before", 5)
+
+	// The old leader keeps accepting commands in a minority partition, but none of them can commit
+	leader := c.checkOneLeader()
+	minority := []int{leader, (leader + 1) % 5}
+	majority := []int{(leader + 2) % 5, (leader + 3) % 5, (leader + 4) % 5}
+	c.network.Partition(minority, majority)
+	for i := range 10 {
+		c.rafts[leader].Start([]byte("stale" + strconv.Itoa(i)))
+	}
+	for i := range 10 {
+		c.one("fresh"+strconv.Itoa(i), 3)
+	}
+
+	// After healing, the minority's uncommitted entries are replaced by the majority's log
+	c.network.Heal()
+	index := c.one("after", 5)
+	for i := 2; i < index; i++ {
+		if count, command := c.nCommitted(i); count == 5 && len(command) > 5 && command[:5] == "stale" {
+			t.Errorf("Uncommitted command %q from the minority was applied at index %d", command, i)
+		}
+	}
+}
+
+func TestUnreliableAgree(t *testing.T) {
+	c := newCluster(t, 5, false)
+	c.network.SetReliable(false)
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.one("concurrent"+strconv.Itoa(i), 1)
+		}()
+	}
+	wg.Wait()
+
+	c.network.SetReliable(true)
+	c.one("final", 5)
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newCluster(t, 3, true)
+	c.one("start", 3)
+
+	// A follower that misses more entries than the leader keeps is sent a snapshot
+	leader := c.checkOneLeader()
+	lagging := (leader + 1) % 3
+	c.network.Disconnect(lagging)
+	for i := range 3 * snapshotEvery {
+		c.one("command"+strconv.Itoa(i), 2)
+	}
+	c.network.Connect(lagging)
+	c.one("caught-up", 3)
+	c.checkSameLog(lagging, leader, 2)
+
+	// Restarting from the persisted snapshot keeps every command
+	c.crash(lagging)
+	c.start(lagging)
+	c.one("restarted", 3)
+	c.checkSameLog(lagging, leader, 2)
+}
+
+// checkSameLog checks that two peers applied the same command at an index
+func (c *cluster) checkSameLog(i int, j int, index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.applied[i][index] == "" || c.applied[i][index] != c.applied[j][index] {
+		c.t.Errorf("Expected peers %d and %d to hold the same command at index %d, got %q and %q",
+			i, j, index, c.applied[i][index], c.applied[j][index])
+	}
+}
+
+func TestKillWithUnreadApplyChannel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// A single peer elects itself and commits on its own, and nobody reads what it applies
+	network := raft.NewNetwork()
+	rf := raft.Make(network.Peers(0, 1), 0, raft.NewMemoryPersister(), make(chan raft.ApplyMsg))
+	network.Register(0, rf)
+	deadline := time.Now().Add(5 * time.Second)
+	for _, isLeader := rf.GetState(); !isLeader; _, isLeader = rf.GetState() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the peer to elect itself")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	rf.Start([]byte("unread"))
+	time.Sleep(100 * time.Millisecond)
+
+	// Killing the peer stops the applier blocked on the channel along with every other loop
+	rf.Kill()
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the peer's goroutines to exit, %d are left over %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
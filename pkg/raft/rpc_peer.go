@@ -0,0 +1,109 @@
+// rpc_peer.go
+// This file contains the transport Raft peers in different processes use to reach each other over net/rpc
+// A service hosting Raft peers exposes RaftRequestVote, RaftAppendEntries, and RaftInstallSnapshot methods that take the group message types
+// Each method looks up the peer of the message's group and passes the message on to it
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// rpcCallTimeout bounds how long a peer waits for another peer over the network
+const rpcCallTimeout = time.Second
+
+// An RPCPeer reaches a Raft peer hosted by a net/rpc service in another process
+// The connection is opened on first use and reopened after a failure
+type RPCPeer struct {
+	socket  string
+	service string
+	group   int
+	client  *rpc.Client
+	mu      sync.Mutex
+}
+
+// NewRPCPeer returns a peer that sends messages for the given group to the named service listening on the socket
+func NewRPCPeer(socket string, service string, group int) *RPCPeer {
+	return &RPCPeer{socket: socket, service: service, group: group}
+}
+
+// RequestVote sends a RequestVote message to the remote peer
+func (peer *RPCPeer) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return peer.call("RaftRequestVote", &GroupRequestVoteArgs{Group: peer.group, Args: *args}, reply)
+}
+
+// AppendEntries sends an AppendEntries message to the remote peer
+func (peer *RPCPeer) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return peer.call("RaftAppendEntries", &GroupAppendEntriesArgs{Group: peer.group, Args: *args}, reply)
+}
+
+// InstallSnapshot sends an InstallSnapshot message to the remote peer
+func (peer *RPCPeer) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return peer.call("RaftInstallSnapshot", &GroupInstallSnapshotArgs{Group: peer.group, Args: *args}, reply)
+}
+
+// Close closes the connection to the remote peer
+func (peer *RPCPeer) Close() {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.client != nil {
+		peer.client.Close()
+		peer.client = nil
+	}
+}
+
+// call makes an RPC call to the remote service, giving up after the call timeout
+// Raft retries on its own, so a call that times out is simply reported as failed
+func (peer *RPCPeer) call(method string, args any, reply any) error {
+	client, err := peer.connect()
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(rpcCallTimeout)
+	defer timer.Stop()
+
+	call := client.Go(peer.service+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if errors.Is(call.Error, rpc.ErrShutdown) {
+			peer.reset(client)
+		}
+		return call.Error
+	case <-timer.C:
+		peer.reset(client)
+		return fmt.Errorf("raft call to %s group %d timed out", peer.socket, peer.group)
+	}
+}
+
+// connect returns the connection to the remote service, opening it if needed
+func (peer *RPCPeer) connect() (*rpc.Client, error) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.client != nil {
+		return peer.client, nil
+	}
+	conn, err := net.DialTimeout("tcp", peer.socket, rpcCallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	peer.client = rpc.NewClient(conn)
+	return peer.client, nil
+}
+
+// reset closes a broken connection so that the next call reconnects
+func (peer *RPCPeer) reset(client *rpc.Client) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.client == client {
+		peer.client.Close()
+		peer.client = nil
+	}
+}
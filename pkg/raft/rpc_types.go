@@ -0,0 +1,93 @@
+// rpc_types.go
+// This file contains the messages exchanged between Raft peers and between a peer and its service
+package raft
+
+// A LogEntry is a single command in the replicated log
+type LogEntry struct {
+	Index   int
+	Term    int
+	Command []byte
+}
+
+// An ApplyMsg is sent on the apply channel for every committed command and for every snapshot the service must install
+// Exactly one of CommandValid and SnapshotValid is set
+type ApplyMsg struct {
+	CommandValid bool
+	Command      []byte
+	CommandIndex int
+	CommandTerm  int
+
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotIndex int
+	SnapshotTerm  int
+}
+
+// The RequestVote RPC is sent by candidates to gather votes
+type RequestVoteArgs struct {
+	Term         int
+	CandidateID  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+// The AppendEntries RPC is sent by the leader to replicate log entries and as a heartbeat
+// On a mismatch the follower reports where the leader should retry from, so a lagging log is repaired a term at a time
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderID     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term          int
+	Success       bool
+	ConflictIndex int
+	ConflictTerm  int
+}
+
+// The InstallSnapshot RPC is sent by the leader to followers whose next entry has already been compacted
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderID          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Data              []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+// A Peer is the RPC interface of another member of a Raft group
+// A Raft instance serves this interface itself, and transports wrap it to reach remote peers
+type Peer interface {
+	RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error
+}
+
+// GroupRequestVoteArgs, GroupAppendEntriesArgs, and GroupInstallSnapshotArgs carry messages to services that host the peers of several Raft groups
+// The group tells the receiving service which of its peers the message is for
+type GroupRequestVoteArgs struct {
+	Group int
+	Args  RequestVoteArgs
+}
+
+type GroupAppendEntriesArgs struct {
+	Group int
+	Args  AppendEntriesArgs
+}
+
+type GroupInstallSnapshotArgs struct {
+	Group int
+	Args  InstallSnapshotArgs
+}
@@ -0,0 +1,357 @@
+// consensus.go
+// This file contains the replication of the route table across several routers with Raft
+// Every change to the routes or the registered servers is committed to the Raft log as the complete new table, and every router applies the committed tables in order
+// Only the leader changes the topology and fails over servers, the other routers answer route lookups from the last table they applied
+// With a data directory the log is persisted, so a restarted router recovers every registration
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"kvstore/pkg/raft"
+	"kvstore/pkg/server"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// routeCommitTimeout bounds how long a topology change waits for its table to be committed
+	routeCommitTimeout = 5 * time.Second
+	// routeSnapshotThreshold is the size of the persisted Raft state at which the router snapshots its table and compacts the log
+	routeSnapshotThreshold = 1 << 20
+)
+
+// ErrNotLeader is returned for topology changes sent to a router that is not the leader of the router group
+// net/rpc only transmits the error message, so callers should test for it with IsNotLeader and try another router
+var ErrNotLeader = errors.New("router is not the leader")
+
+// IsNotLeader reports whether an error returned by a router means the request should be sent to another router
+func IsNotLeader(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrNotLeader.Error())
+}
+
+// A routeTable is the replicated state of the router group
+// It holds every route and the number of own shards of every registered server
+// The epoch numbers the tables in the order they were committed
+type routeTable struct {
+	Epoch   int64
+	Routes  []*ShardRoute
+	Servers map[string]int
+}
+
+// A routeLog is a router's membership in the Raft group of the routers
+// Waiters are notified with the term of the entry committed at their log index
+type routeLog struct {
+	rf          *raft.Raft
+	persister   raft.Persister
+	peers       []*raft.RPCPeer
+	applyCh     chan raft.ApplyMsg
+	waiters     map[int]chan int
+	lastApplied int
+	mu          sync.Mutex
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// startConsensus makes the router a member of the Raft group of the routers listed in the config
+// A router without peers but with a data directory forms a group of its own, so that its table survives restarts
+func (r *StaticShardRouter) startConsensus(config *Config) error {
+	var persister raft.Persister = raft.NewMemoryPersister()
+	if config.DataDir != "" {
+		filePersister, err := raft.NewFilePersister(config.DataDir)
+		if err != nil {
+			return err
+		}
+		persister = filePersister
+	}
+
+	routeLog := &routeLog{
+		persister: persister,
+		applyCh:   make(chan raft.ApplyMsg),
+		waiters:   make(map[int]chan int),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	peers := make([]raft.Peer, max(len(config.Peers), 1))
+	for i, socket := range config.Peers {
+		if i == config.Me {
+			continue
+		}
+		peer := raft.NewRPCPeer(socket, "StaticShardRouter", 0)
+		routeLog.peers = append(routeLog.peers, peer)
+		peers[i] = peer
+	}
+
+	routeLog.rf = raft.Make(peers, config.Me, persister, routeLog.applyCh)
+	r.consensus = routeLog
+	go r.applyCommitted(routeLog)
+
+	return nil
+}
+
+// stopConsensus shuts down the router's Raft peer and its apply loop
+func (r *StaticShardRouter) stopConsensus() {
+	if r.consensus == nil {
+		return
+	}
+	r.consensus.rf.Kill()
+	close(r.consensus.stop)
+	<-r.consensus.done
+	for _, peer := range r.consensus.peers {
+		peer.Close()
+	}
+}
+
+// RaftRequestVote is an RPC method that passes a RequestVote message to the router's Raft peer
+func (r *StaticShardRouter) RaftRequestVote(args *raft.GroupRequestVoteArgs, reply *raft.RequestVoteReply) error {
+	if r.consensus == nil {
+		return fmt.Errorf("router is not replicated")
+	}
+	return r.consensus.rf.RequestVote(&args.Args, reply)
+}
+
+// RaftAppendEntries is an RPC method that passes an AppendEntries message to the router's Raft peer
+func (r *StaticShardRouter) RaftAppendEntries(args *raft.GroupAppendEntriesArgs, reply *raft.AppendEntriesReply) error {
+	if r.consensus == nil {
+		return fmt.Errorf("router is not replicated")
+	}
+	return r.consensus.rf.AppendEntries(&args.Args, reply)
+}
+
+// RaftInstallSnapshot is an RPC method that passes an InstallSnapshot message to the router's Raft peer
+func (r *StaticShardRouter) RaftInstallSnapshot(args *raft.GroupInstallSnapshotArgs, reply *raft.InstallSnapshotReply) error {
+	if r.consensus == nil {
+		return fmt.Errorf("router is not replicated")
+	}
+	return r.consensus.rf.InstallSnapshot(&args.Args, reply)
+}
+
+// isLeader reports whether the router may change the topology
+// Routers that are not replicated always may
+func (r *StaticShardRouter) isLeader() bool {
+	if r.consensus == nil {
+		return true
+	}
+	_, isLeader := r.consensus.rf.GetState()
+	return isLeader
+}
+
+// checkLeader returns ErrNotLeader if the router may not change the topology
+func (r *StaticShardRouter) checkLeader() error {
+	if !r.isLeader() {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// commitTable replaces the route table with the given routes and registered servers under a new epoch
+// Epochs follow the clock so that they keep increasing even across restarts of a router that keeps its table in memory
+// Replicated routers commit the table to the Raft log and return once it has been applied
+// A returned ErrNotLeader means the table was never committed, other errors leave it unknown whether it will be
+// Once the table is in place its epoch is announced to the servers
+func (r *StaticShardRouter) commitTable(routes []*ShardRoute, servers map[string]int) error {
+	r.mu.RLock()
+	epoch := max(r.epoch+1, time.Now().UnixNano())
+	r.mu.RUnlock()
+
+	table := &routeTable{Epoch: epoch, Routes: routes, Servers: servers}
+	if r.consensus == nil {
+		r.setTable(table)
+	} else {
+		command, err := encodeRouteTable(table)
+		if err != nil {
+			return err
+		}
+		if err := r.consensus.propose(command); err != nil {
+			return err
+		}
+	}
+
+	r.announceEpoch(epoch, servers)
+	return nil
+}
+
+// announceEpoch tells every registered server that is not down about a new route table epoch
+// Servers that miss the announcement keep accepting requests routed with older tables, which their ownership checks still reject if the route is wrong
+func (r *StaticShardRouter) announceEpoch(epoch int64, servers map[string]int) {
+	var wg sync.WaitGroup
+	now := time.Now()
+	for socket := range servers {
+		if r.detector.Status(socket, now) == StatusDown {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := callServer(socket, "KVServer.AdvanceEpoch", &server.AdvanceEpochArgs{Epoch: epoch}, &server.AdvanceEpochReply{}); err != nil {
+				log.Printf("Error announcing route table epoch %d to server %s: %v", epoch, socket, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// setTable installs a route table, rebuilding the hash ring from its routes
+// Servers that appear in the table start being tracked by the failure detector, and servers that disappear are forgotten
+func (r *StaticShardRouter) setTable(table *routeTable) {
+	ring := NewHashRing(r.virtualNodes)
+	for _, route := range table.Routes {
+		ring.Add(route)
+	}
+	servers := maps.Clone(table.Servers)
+	if servers == nil {
+		servers = make(map[string]int)
+	}
+
+	r.mu.Lock()
+	previous := r.servers
+	r.epoch = table.Epoch
+	r.Routes = table.Routes
+	r.ring = ring
+	r.servers = servers
+	r.mu.Unlock()
+
+	now := time.Now()
+	for socket := range servers {
+		if _, exists := previous[socket]; !exists {
+			r.detector.Track(socket, now)
+		}
+	}
+	for socket := range previous {
+		if _, exists := servers[socket]; !exists {
+			r.detector.Forget(socket)
+		}
+	}
+}
+
+// takeOver runs when the router becomes the leader
+// It commits an empty entry so that every table committed by earlier leaders is applied, then fails over servers that went down in the meantime
+func (r *StaticShardRouter) takeOver() {
+	if err := r.consensus.propose(nil); err != nil {
+		log.Printf("Error committing the route table as the new leader: %v", err)
+		return
+	}
+
+	r.topologyMu.Lock()
+	defer r.topologyMu.Unlock()
+
+	now := time.Now()
+	for socket := range r.registeredServers() {
+		if r.detector.Status(socket, now) == StatusDown {
+			r.evict(socket)
+		}
+	}
+	r.repair()
+	log.Println("Router became the leader")
+}
+
+// propose appends a command to the Raft log and waits until it has been applied
+// It returns ErrNotLeader if the router is not the leader or the command lost its log slot to another leader
+func (routeLog *routeLog) propose(command []byte) error {
+	routeLog.mu.Lock()
+	index, term, isLeader := routeLog.rf.Start(command)
+	if !isLeader {
+		routeLog.mu.Unlock()
+		return ErrNotLeader
+	}
+	result := make(chan int, 1)
+	routeLog.waiters[index] = result
+	routeLog.mu.Unlock()
+
+	timer := time.NewTimer(routeCommitTimeout)
+	defer timer.Stop()
+
+	select {
+	case appliedTerm := <-result:
+		if appliedTerm != term {
+			return ErrNotLeader
+		}
+		return nil
+	case <-timer.C:
+		routeLog.mu.Lock()
+		delete(routeLog.waiters, index)
+		routeLog.mu.Unlock()
+		return fmt.Errorf("timed out waiting for the route table to be committed")
+	}
+}
+
+// applyCommitted installs the tables and snapshots the router's Raft peer delivers, until the router is closed
+// Once the persisted Raft state grows past the threshold, the current table is snapshotted so that Raft can compact its log
+func (r *StaticShardRouter) applyCommitted(routeLog *routeLog) {
+	defer close(routeLog.done)
+
+	for {
+		var msg raft.ApplyMsg
+		select {
+		case msg = <-routeLog.applyCh:
+		case <-routeLog.stop:
+			return
+		}
+
+		if msg.SnapshotValid {
+			if msg.SnapshotIndex > routeLog.lastApplied {
+				if table, err := decodeRouteTable(msg.Snapshot); err != nil {
+					log.Printf("Failed to install route table snapshot: %v", err)
+				} else {
+					r.setTable(table)
+					routeLog.lastApplied = msg.SnapshotIndex
+				}
+			}
+			continue
+		}
+		if msg.CommandIndex <= routeLog.lastApplied {
+			continue
+		}
+
+		// Empty commands are committed by new leaders and do not change the table
+		if len(msg.Command) > 0 {
+			if table, err := decodeRouteTable(msg.Command); err != nil {
+				log.Printf("Skipping undecodable route table at index %d: %v", msg.CommandIndex, err)
+			} else {
+				r.setTable(table)
+			}
+		}
+		routeLog.lastApplied = msg.CommandIndex
+
+		routeLog.mu.Lock()
+		if waiter, exists := routeLog.waiters[msg.CommandIndex]; exists {
+			waiter <- msg.CommandTerm
+			delete(routeLog.waiters, msg.CommandIndex)
+		}
+		routeLog.mu.Unlock()
+
+		if routeLog.persister.StateSize() >= routeSnapshotThreshold {
+			r.mu.RLock()
+			snapshot, err := encodeRouteTable(&routeTable{Epoch: r.epoch, Routes: r.Routes, Servers: r.servers})
+			r.mu.RUnlock()
+			if err != nil {
+				log.Printf("Failed to snapshot route table: %v", err)
+				continue
+			}
+			routeLog.rf.Snapshot(msg.CommandIndex, snapshot)
+		}
+	}
+}
+
+// encodeRouteTable serializes a route table for the Raft log
+func encodeRouteTable(table *routeTable) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(table); err != nil {
+		return nil, fmt.Errorf("failed to encode route table: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRouteTable restores a route table from the Raft log
+func decodeRouteTable(data []byte) (*routeTable, error) {
+	table := &routeTable{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
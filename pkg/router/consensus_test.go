@@ -0,0 +1,100 @@
+package router_test
+
+import (
+	"kvstore/pkg/router"
+	"testing"
+	"time"
+)
+
+// newDurableRouter starts a router that persists its route table in the given directory
+func newDurableRouter(t *testing.T, dataDir string) *router.StaticShardRouter {
+	t.Helper()
+
+	r, err := router.NewRouter(&router.Config{
+		VirtualNodes:   16,
+		SuspectTimeout: 100 * time.Millisecond,
+		DownTimeout:    time.Minute,
+		DataDir:        dataDir,
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	return r
+}
+
+// registerOnLeader retries a registration until the router has been elected leader of its group
+func registerOnLeader(t *testing.T, r *router.StaticShardRouter, args *router.RegisterServerArgs) error {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := r.RegisterServer(args, &router.RegisterServerReply{})
+		if !router.IsNotLeader(err) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRouteTableSurvivesRestart(t *testing.T) {
+	dataDir := t.TempDir()
+
+	r := newDurableRouter(t, dataDir)
+	args := &router.RegisterServerArgs{Address: "server", Port: 8081, NumShards: 2}
+	if err := registerOnLeader(t, r, args); err != nil {
+		r.Close()
+		t.Fatalf("RegisterServer failed: %v", err)
+	}
+	before := &router.GetRouteReply{}
+	if err := r.GetRoute(&router.GetRouteArgs{Key: "key"}, before); err != nil {
+		r.Close()
+		t.Fatalf("GetRoute failed: %v", err)
+	}
+	r.Close()
+
+	// The restarted router replays its log once it has become the leader of its own group again
+	r = newDurableRouter(t, dataDir)
+	defer r.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	after := &router.GetRouteReply{}
+	for {
+		err := r.GetRoute(&router.GetRouteArgs{Key: "key"}, after)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Route table was not restored: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if after.Socket != before.Socket || after.ShardIdx != before.ShardIdx {
+		t.Errorf("Expected key to route to %s shard %d after restart, got %s shard %d", before.Socket, before.ShardIdx, after.Socket, after.ShardIdx)
+	}
+
+	// The restored registration is still known, so registering again with another shard count is rejected
+	args.NumShards = 3
+	if err := registerOnLeader(t, r, args); err == nil {
+		t.Errorf("Expected re-registration with a different shard count to fail")
+	}
+}
+
+func TestRouterFollowerRejectsTopologyChanges(t *testing.T) {
+	// The other router is never started, so this router cannot win an election
+	r, err := router.NewRouter(&router.Config{
+		VirtualNodes:   16,
+		SuspectTimeout: time.Second,
+		DownTimeout:    3 * time.Second,
+		Peers:          []string{"127.0.0.1:1", "127.0.0.1:2"},
+		Me:             0,
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	defer r.Close()
+
+	err = r.RegisterServer(&router.RegisterServerArgs{Address: "server", Port: 8081, NumShards: 1}, &router.RegisterServerReply{})
+	if !router.IsNotLeader(err) {
+		t.Errorf("Expected a router without a majority to reject registration as not leader, got %v", err)
+	}
+}
@@ -3,5 +3,11 @@
 // Routers are launched as RPC servers
 // Source code and compiled binaries are available in the cmd directory
 // The router is designed for high concurrency in both reading and writing operations
-// It uses a static routing mechanism based on the hash of the key to determine the appropriate shard
+// It uses a consistent hash ring with virtual nodes to map the hash of a key to the appropriate shard
+// When the set of shards changes, keys whose route changes are migrated live to their new shard before the routes switch
+// Registered servers send heartbeats, and a failure detector marks servers that stop sending them as suspect or down
+// Every shard can be replicated to backups on other servers, and a backup is promoted when its primary's server goes down
+// Several routers can replicate the route table with Raft, and the table can be persisted so that it survives restarts
+// The leader of a router group makes every topology change, and any router of the group answers route lookups
+// Every route table has an epoch that is announced to the servers, so that clients can cache the table until a server rejects its epoch
 package router
@@ -0,0 +1,162 @@
+// failure.go
+// This file contains the failure detector the router uses to learn which servers are still alive
+// Registered servers send periodic heartbeats, and a server that stays silent for too long is first suspected and then declared down
+// The detector is timeout based: a server is suspect after the suspect timeout and down after the down timeout
+package router
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ServerStatus is the liveness of a server as seen by the failure detector
+type ServerStatus int
+
+const (
+	// StatusAlive means a heartbeat arrived within the suspect timeout
+	StatusAlive ServerStatus = iota
+	// StatusSuspect means the server missed heartbeats but has not yet reached the down timeout
+	StatusSuspect
+	// StatusDown means no heartbeat arrived within the down timeout
+	StatusDown
+)
+
+// String returns the lowercase name of the status
+func (status ServerStatus) String() string {
+	switch status {
+	case StatusAlive:
+		return "alive"
+	case StatusSuspect:
+		return "suspect"
+	case StatusDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// A StatusChange records a server moving from one status to another
+type StatusChange struct {
+	Socket string
+	From   ServerStatus
+	To     ServerStatus
+}
+
+// The FailureDetector struct tracks the last heartbeat of every registered server
+// Statuses are derived from the time since the last heartbeat, and Update reports the servers whose status changed
+// Times are passed in by the caller so the detector can be driven by a fake clock
+type FailureDetector struct {
+	suspectTimeout time.Duration
+	downTimeout    time.Duration
+	lastHeartbeat  map[string]time.Time
+	statuses       map[string]ServerStatus
+	mu             sync.Mutex
+}
+
+// NewFailureDetector initializes a detector with no tracked servers
+func NewFailureDetector(suspectTimeout time.Duration, downTimeout time.Duration) *FailureDetector {
+	return &FailureDetector{
+		suspectTimeout: suspectTimeout,
+		downTimeout:    downTimeout,
+		lastHeartbeat:  make(map[string]time.Time),
+		statuses:       make(map[string]ServerStatus),
+	}
+}
+
+// Track starts tracking a server as alive, as if it had just sent a heartbeat
+func (detector *FailureDetector) Track(socket string, now time.Time) {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	detector.lastHeartbeat[socket] = now
+	detector.statuses[socket] = StatusAlive
+}
+
+// Forget stops tracking a server
+func (detector *FailureDetector) Forget(socket string) {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	delete(detector.lastHeartbeat, socket)
+	delete(detector.statuses, socket)
+}
+
+// Heartbeat records a heartbeat from a server
+// It returns false if the server is not tracked, which means it is not registered with the router
+func (detector *FailureDetector) Heartbeat(socket string, now time.Time) bool {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	if _, tracked := detector.lastHeartbeat[socket]; !tracked {
+		return false
+	}
+	detector.lastHeartbeat[socket] = now
+	return true
+}
+
+// Status returns the status of a server at the given time
+// Untracked servers are reported as down
+func (detector *FailureDetector) Status(socket string, now time.Time) ServerStatus {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	return detector.status(socket, now)
+}
+
+// Snapshot returns the status and last heartbeat of every tracked server, ordered by socket
+func (detector *FailureDetector) Snapshot(now time.Time) []ServerState {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	states := make([]ServerState, 0, len(detector.lastHeartbeat))
+	for socket, last := range detector.lastHeartbeat {
+		states = append(states, ServerState{
+			Socket:        socket,
+			Status:        detector.status(socket, now),
+			LastHeartbeat: last,
+		})
+	}
+	slices.SortFunc(states, func(a, b ServerState) int {
+		return cmp.Compare(a.Socket, b.Socket)
+	})
+
+	return states
+}
+
+// Update recomputes the status of every tracked server and returns the ones that changed since the last update
+func (detector *FailureDetector) Update(now time.Time) []StatusChange {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	changes := make([]StatusChange, 0)
+	for socket, previous := range detector.statuses {
+		current := detector.status(socket, now)
+		if current != previous {
+			detector.statuses[socket] = current
+			changes = append(changes, StatusChange{Socket: socket, From: previous, To: current})
+		}
+	}
+
+	return changes
+}
+
+// status derives a server's status from the time since its last heartbeat
+// The caller must hold the detector's mutex
+func (detector *FailureDetector) status(socket string, now time.Time) ServerStatus {
+	last, tracked := detector.lastHeartbeat[socket]
+	if !tracked {
+		return StatusDown
+	}
+
+	silence := now.Sub(last)
+	switch {
+	case silence >= detector.downTimeout:
+		return StatusDown
+	case silence >= detector.suspectTimeout:
+		return StatusSuspect
+	default:
+		return StatusAlive
+	}
+}
@@ -0,0 +1,55 @@
+package router_test
+
+import (
+	"kvstore/pkg/router"
+	"testing"
+	"time"
+)
+
+func TestFailureDetectorTransitions(t *testing.T) {
+	detector := router.NewFailureDetector(time.Second, 3*time.Second)
+	start := time.Now()
+	detector.Track("server:8081", start)
+
+	if status := detector.Status("server:8081", start.Add(500*time.Millisecond)); status != router.StatusAlive {
+		t.Errorf("Expected alive, got %v", status)
+	}
+	if status := detector.Status("server:8081", start.Add(2*time.Second)); status != router.StatusSuspect {
+		t.Errorf("Expected suspect, got %v", status)
+	}
+	if status := detector.Status("server:8081", start.Add(4*time.Second)); status != router.StatusDown {
+		t.Errorf("Expected down, got %v", status)
+	}
+
+	changes := detector.Update(start.Add(4 * time.Second))
+	if len(changes) != 1 || changes[0].From != router.StatusAlive || changes[0].To != router.StatusDown {
+		t.Errorf("Expected a single alive to down change, got %v", changes)
+	}
+
+	// A heartbeat brings the server back and the next update reports the recovery
+	detector.Heartbeat("server:8081", start.Add(5*time.Second))
+	changes = detector.Update(start.Add(5 * time.Second))
+	if len(changes) != 1 || changes[0].To != router.StatusAlive {
+		t.Errorf("Expected a single change to alive, got %v", changes)
+	}
+	if changes := detector.Update(start.Add(5 * time.Second)); len(changes) != 0 {
+		t.Errorf("Expected no changes without new information, got %v", changes)
+	}
+}
+
+func TestFailureDetectorUnknownServer(t *testing.T) {
+	detector := router.NewFailureDetector(time.Second, 3*time.Second)
+
+	if detector.Heartbeat("unknown:8081", time.Now()) {
+		t.Errorf("Expected heartbeat from an untracked server to be rejected")
+	}
+	if status := detector.Status("unknown:8081", time.Now()); status != router.StatusDown {
+		t.Errorf("Expected untracked server to be down, got %v", status)
+	}
+
+	detector.Track("server:8081", time.Now())
+	detector.Forget("server:8081")
+	if states := detector.Snapshot(time.Now()); len(states) != 0 {
+		t.Errorf("Expected no tracked servers, got %v", states)
+	}
+}
@@ -0,0 +1,182 @@
+// migration.go
+// This file contains the router side of live data migration
+// When servers register or deregister, the router compares the current hash ring with the next one
+// Every hash range that changes owner is streamed from its old shard to its new shard before the routes are switched
+// Until then requests keep going to the old owner, which forwards writes in the migrating ranges to the new owner
+package router
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"kvstore/pkg/server"
+	"log"
+	"math"
+	"net"
+	"net/rpc"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A rangeTransfer is a set of hash ranges moving from one shard to another
+type rangeTransfer struct {
+	From   ShardRoute
+	To     ShardRoute
+	Ranges []server.HashRange
+}
+
+// diffRings returns the hash ranges whose owner differs between two rings, grouped by old and new owner
+// Ranges owned by nobody on the current ring have no data and are not transferred
+func diffRings(current *HashRing, next *HashRing) []*rangeTransfer {
+	if current.Len() == 0 || next.Len() == 0 {
+		return nil
+	}
+
+	// Between two consecutive points of either ring, both rings have a single owner
+	hashes := make([]uint64, 0, current.Len()+next.Len())
+	for _, point := range current.points {
+		hashes = append(hashes, point.Hash)
+	}
+	for _, point := range next.points {
+		hashes = append(hashes, point.Hash)
+	}
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+
+	transfers := make(map[[2]string]*rangeTransfer)
+	order := make([]*rangeTransfer, 0)
+
+	for i, end := range hashes {
+		from := current.ownerOfHash(end)
+		to := next.ownerOfHash(end)
+		if from.GroupID() == to.GroupID() {
+			continue
+		}
+
+		pair := [2]string{from.GroupID(), to.GroupID()}
+		transfer, exists := transfers[pair]
+		if !exists {
+			transfer = &rangeTransfer{From: *from, To: *to}
+			transfers[pair] = transfer
+			order = append(order, transfer)
+		}
+
+		// Each point owns the hashes after the previous point up to and including itself
+		if i > 0 {
+			transfer.Ranges = append(transfer.Ranges, server.HashRange{Start: hashes[i-1] + 1, End: end})
+			continue
+		}
+		last := hashes[len(hashes)-1]
+		if last != math.MaxUint64 {
+			transfer.Ranges = append(transfer.Ranges, server.HashRange{Start: last + 1, End: math.MaxUint64})
+		}
+		transfer.Ranges = append(transfer.Ranges, server.HashRange{Start: 0, End: end})
+	}
+
+	slices.SortFunc(order, func(a, b *rangeTransfer) int {
+		return cmp.Or(compareRoutes(&a.From, &b.From), compareRoutes(&a.To, &b.To))
+	})
+	return order
+}
+
+// rebalance switches the router to the next hash ring, route list, and registered servers, migrating every affected range first
+// Transfers run in parallel, and if any of them fails all of them are rolled back and the current ring is kept
+// The ring is switched by committing the new route table, and the transfers are only rolled back if the table was certainly not committed
+// The caller must hold the topology mutex
+func (r *StaticShardRouter) rebalance(next *HashRing, routes []*ShardRoute, servers map[string]int) error {
+	transfers := diffRings(r.ring, next)
+
+	errs := make([]error, len(transfers))
+	var wg sync.WaitGroup
+	for i, transfer := range transfers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = startTransfer(transfer)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		for _, transfer := range transfers {
+			abortTransfer(transfer)
+		}
+		return err
+	}
+
+	if err := r.commitTable(routes, servers); err != nil {
+		if IsNotLeader(err) {
+			for _, transfer := range transfers {
+				abortTransfer(transfer)
+			}
+		}
+		return err
+	}
+
+	// The new owners are now serving the ranges, so the old owners can drop them
+	for _, transfer := range transfers {
+		args := &server.FinishMigrationArgs{
+			ShardIdx:     transfer.From.ShardIdx,
+			DestSocket:   transfer.To.Socket,
+			DestShardIdx: transfer.To.ShardIdx,
+		}
+		if err := callServer(transfer.From.Socket, "KVServer.FinishMigration", args, &server.FinishMigrationReply{}); err != nil {
+			log.Printf("Error finishing migration from %s shard %d: %v", transfer.From.Socket, transfer.From.ShardIdx, err)
+		}
+	}
+
+	return nil
+}
+
+// startTransfer streams a transfer's ranges from the old owner to the new owner
+func startTransfer(transfer *rangeTransfer) error {
+	args := &server.MigrateOutArgs{
+		ShardIdx:     transfer.From.ShardIdx,
+		Ranges:       transfer.Ranges,
+		DestSocket:   transfer.To.Socket,
+		DestShardIdx: transfer.To.ShardIdx,
+	}
+	reply := &server.MigrateOutReply{}
+	if err := callServer(transfer.From.Socket, "KVServer.MigrateOut", args, reply); err != nil {
+		return fmt.Errorf("migration from %s shard %d to %s shard %d failed: %v",
+			transfer.From.Socket, transfer.From.ShardIdx, transfer.To.Socket, transfer.To.ShardIdx, err)
+	}
+
+	log.Printf("Migrated %d keys from %s shard %d to %s shard %d",
+		reply.Moved, transfer.From.Socket, transfer.From.ShardIdx, transfer.To.Socket, transfer.To.ShardIdx)
+	return nil
+}
+
+// abortTransfer stops a transfer and removes anything it copied to the new owner
+// Errors are only logged since the old owner still holds every key
+func abortTransfer(transfer *rangeTransfer) {
+	abortArgs := &server.AbortMigrationArgs{
+		ShardIdx:     transfer.From.ShardIdx,
+		DestSocket:   transfer.To.Socket,
+		DestShardIdx: transfer.To.ShardIdx,
+	}
+	if err := callServer(transfer.From.Socket, "KVServer.AbortMigration", abortArgs, &server.AbortMigrationReply{}); err != nil {
+		log.Printf("Error aborting migration from %s shard %d: %v", transfer.From.Socket, transfer.From.ShardIdx, err)
+	}
+
+	dropArgs := &server.DropRangesArgs{ShardIdx: transfer.To.ShardIdx, Ranges: transfer.Ranges}
+	if err := callServer(transfer.To.Socket, "KVServer.DropRanges", dropArgs, &server.DropRangesReply{}); err != nil {
+		log.Printf("Error cleaning up aborted migration on %s shard %d: %v", transfer.To.Socket, transfer.To.ShardIdx, err)
+	}
+}
+
+// dialTimeout bounds how long the router waits to connect to a server, so that unreachable servers cannot stall failovers
+const dialTimeout = 5 * time.Second
+
+// callServer makes a single RPC call to a KVServer on a fresh connection
+func callServer(socket string, method string, args any, reply any) error {
+	conn, err := net.DialTimeout("tcp", socket, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to server at %s: %v", socket, err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	return client.Call(method, args, reply)
+}
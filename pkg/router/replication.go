@@ -0,0 +1,252 @@
+// replication.go
+// This file contains the router side of primary/backup replication
+// Every replica group has a primary shard that serves clients and backup shards on other servers that receive every write
+// The router places backups on the least loaded alive servers and promotes a backup when the primary's server is declared down
+package router
+
+import (
+	"cmp"
+	"kvstore/pkg/server"
+	"log"
+	"slices"
+	"time"
+)
+
+// failover hands the primaries of a server that was declared down to their backups and replaces its backups elsewhere
+func (r *StaticShardRouter) failover(socket string) {
+	r.topologyMu.Lock()
+	defer r.topologyMu.Unlock()
+
+	if _, exists := r.serverShards(socket); !exists || !r.isLeader() {
+		return
+	}
+	r.evict(socket)
+	r.repair()
+}
+
+// rejoin clears the shards a server lost while it was down and makes it available as a backup host again
+func (r *StaticShardRouter) rejoin(socket string) {
+	r.topologyMu.Lock()
+	defer r.topologyMu.Unlock()
+
+	if _, exists := r.serverShards(socket); !exists || !r.isLeader() {
+		return
+	}
+	r.reset(socket)
+	r.repair()
+}
+
+// runTask runs a topology change in the background, Close waits for it to finish
+func (r *StaticShardRouter) runTask(task func()) {
+	r.tasks.Add(1)
+	go func() {
+		defer r.tasks.Done()
+		task()
+	}()
+}
+
+// evict removes a server from every replica group
+// Each primary on the server is demoted and replaced by its first backup on an alive server, primaries without one stay where they are
+// The caller must hold the topology mutex
+func (r *StaticShardRouter) evict(socket string) {
+	for _, route := range r.currentRoutes() {
+		backups := slices.DeleteFunc(slices.Clone(route.Backups), func(location server.ShardLocation) bool {
+			return location.Socket == socket
+		})
+
+		if route.Socket != socket {
+			if len(backups) == len(route.Backups) {
+				continue
+			}
+			next := &ShardRoute{Socket: route.Socket, ShardIdx: route.ShardIdx, Group: route.Group, Backups: backups}
+			if err := configure(next); err != nil {
+				log.Printf("Error removing backup on %s from shard group %s: %v", socket, route.GroupID(), err)
+			}
+			r.replaceRoute(route, next)
+			continue
+		}
+
+		if !slices.ContainsFunc(backups, func(location server.ShardLocation) bool { return r.canHost(location.Socket) }) {
+			log.Printf("No backup available to take over shard group %s from %s", route.GroupID(), socket)
+			continue
+		}
+
+		// The old primary stops accepting writes first so that every acknowledged write is on the backups
+		demote := &server.ConfigureShardArgs{ShardIdx: route.ShardIdx, Primary: false}
+		if err := callServer(socket, "KVServer.ConfigureShard", demote, &server.ConfigureShardReply{}); err != nil {
+			log.Printf("Error demoting %s shard %d: %v", socket, route.ShardIdx, err)
+		}
+
+		promoted := false
+		for i, candidate := range backups {
+			if !r.canHost(candidate.Socket) {
+				continue
+			}
+			next := &ShardRoute{
+				Socket:   candidate.Socket,
+				ShardIdx: candidate.ShardIdx,
+				Group:    route.Group,
+				Backups:  slices.Delete(slices.Clone(backups), i, i+1),
+			}
+			if err := configure(next); err != nil {
+				log.Printf("Error promoting %s shard %d: %v", candidate.Socket, candidate.ShardIdx, err)
+				continue
+			}
+
+			r.replaceRoute(route, next)
+			log.Printf("Promoted %s shard %d to primary of shard group %s", candidate.Socket, candidate.ShardIdx, route.GroupID())
+			promoted = true
+			break
+		}
+
+		if !promoted {
+			if err := configure(route); err != nil {
+				log.Printf("Error restoring %s shard %d as primary: %v", socket, route.ShardIdx, err)
+			}
+		}
+	}
+}
+
+// reset clears every shard on a server that is not part of a replica group anymore
+// The caller must hold the topology mutex
+func (r *StaticShardRouter) reset(socket string) {
+	keep := make([]int, 0)
+	for _, route := range r.currentRoutes() {
+		if route.Socket == socket {
+			keep = append(keep, route.ShardIdx)
+		}
+		for _, location := range route.Backups {
+			if location.Socket == socket {
+				keep = append(keep, location.ShardIdx)
+			}
+		}
+	}
+
+	args := &server.ResetShardsArgs{Keep: keep}
+	if err := callServer(socket, "KVServer.ResetShards", args, &server.ResetShardsReply{}); err != nil {
+		log.Printf("Error resetting shards of %s: %v", socket, err)
+	}
+}
+
+// repair brings every replica group with an alive primary back to the replication factor
+// Backups on servers that cannot host them anymore are dropped, and new backups are added on the alive servers holding the fewest shards
+// The caller must hold the topology mutex
+func (r *StaticShardRouter) repair() {
+	routes := r.currentRoutes()
+
+	load := make(map[string]int)
+	for socket := range r.registeredServers() {
+		load[socket] = 0
+	}
+	for _, route := range routes {
+		load[route.Socket]++
+		for _, location := range route.Backups {
+			load[location.Socket]++
+		}
+	}
+
+	for _, route := range routes {
+		if !r.canHost(route.Socket) {
+			continue
+		}
+
+		kept := slices.DeleteFunc(slices.Clone(route.Backups), func(location server.ShardLocation) bool {
+			return !r.canHost(location.Socket)
+		})
+		dropped := slices.DeleteFunc(slices.Clone(route.Backups), func(location server.ShardLocation) bool {
+			return r.canHost(location.Socket)
+		})
+
+		added := make([]server.ShardLocation, 0)
+		for len(kept)+len(added) < r.replicationFactor-1 {
+			host := pickBackupHost(route, slices.Concat(kept, added), load, r.canHost)
+			if host == "" {
+				break
+			}
+			reply := &server.AddShardReply{}
+			if err := callServer(host, "KVServer.AddShard", &server.AddShardArgs{}, reply); err != nil {
+				log.Printf("Error adding backup shard on %s: %v", host, err)
+				break
+			}
+			added = append(added, server.ShardLocation{Socket: host, ShardIdx: reply.ShardIdx})
+			load[host]++
+		}
+		if len(dropped) == 0 && len(added) == 0 {
+			continue
+		}
+
+		next := &ShardRoute{Socket: route.Socket, ShardIdx: route.ShardIdx, Group: route.Group, Backups: slices.Concat(kept, added)}
+		if err := configure(next); err != nil {
+			// New backups that could not be synced must never be promoted, so they are dropped again
+			log.Printf("Error adding backups to shard group %s: %v", route.GroupID(), err)
+			next.Backups = kept
+			removeBackups(added)
+		}
+		r.replaceRoute(route, next)
+		removeBackups(dropped)
+	}
+}
+
+// canHost reports whether a server is registered and alive, and can therefore hold a primary or backup shard
+// The caller must hold the topology mutex
+func (r *StaticShardRouter) canHost(socket string) bool {
+	_, registered := r.serverShards(socket)
+	return registered && r.detector.Status(socket, time.Now()) == StatusAlive
+}
+
+// currentRoutes returns a copy of the route list
+func (r *StaticShardRouter) currentRoutes() []*ShardRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return slices.Clone(r.Routes)
+}
+
+// replaceRoute swaps a route for a new route of the same replica group and commits the new route table
+// Routes are matched by group since committing a table replaces every route with a copy
+// The caller must hold the topology mutex
+func (r *StaticShardRouter) replaceRoute(old *ShardRoute, next *ShardRoute) {
+	routes := r.currentRoutes()
+	idx := slices.IndexFunc(routes, func(route *ShardRoute) bool { return route.GroupID() == old.GroupID() })
+	if idx < 0 {
+		return
+	}
+	routes[idx] = next
+
+	if err := r.commitTable(routes, r.registeredServers()); err != nil {
+		log.Printf("Error committing route of shard group %s: %v", old.GroupID(), err)
+	}
+}
+
+// pickBackupHost returns the server with the fewest shards that can hold another backup of a route, or an empty string if there is none
+// Servers that already hold a replica of the route are skipped
+func pickBackupHost(route *ShardRoute, backups []server.ShardLocation, load map[string]int, canHost func(string) bool) string {
+	best := ""
+	for socket, count := range load {
+		if socket == route.Socket || !canHost(socket) {
+			continue
+		}
+		if slices.ContainsFunc(backups, func(location server.ShardLocation) bool { return location.Socket == socket }) {
+			continue
+		}
+		if best == "" || cmp.Or(cmp.Compare(count, load[best]), cmp.Compare(socket, best)) < 0 {
+			best = socket
+		}
+	}
+	return best
+}
+
+// configure tells a route's primary that it is the primary and which backups to replicate to
+func configure(route *ShardRoute) error {
+	args := &server.ConfigureShardArgs{ShardIdx: route.ShardIdx, Primary: true, Backups: route.Backups}
+	return callServer(route.Socket, "KVServer.ConfigureShard", args, &server.ConfigureShardReply{})
+}
+
+// removeBackups deletes backup shards that are no longer part of a replica group
+// Errors are ignored since the servers holding them are usually down, and they clear their shards when they rejoin
+func removeBackups(locations []server.ShardLocation) {
+	for _, location := range locations {
+		args := &server.RemoveShardArgs{ShardIdx: location.ShardIdx}
+		callServer(location.Socket, "KVServer.RemoveShard", args, &server.RemoveShardReply{})
+	}
+}
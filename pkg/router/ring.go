@@ -0,0 +1,129 @@
+// ring.go
+// This file contains the consistent hash ring used to map keys to shard routes
+// Every shard route is placed on the ring at several pseudo-random points called virtual nodes
+// A key belongs to the first virtual node at or after its hash, wrapping around at the end of the ring
+// Adding or removing a server therefore only moves the keys adjacent to that server's virtual nodes
+// Keys with a hash tag are hashed by the tag alone, so keys sharing a tag always map to the same route
+package router
+
+import (
+	"cmp"
+	"kvstore/pkg/server"
+	"slices"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// A ringPoint is a single virtual node on the ring
+type ringPoint struct {
+	Hash  uint64
+	Route *ShardRoute
+}
+
+// The HashRing struct holds the sorted virtual nodes of every registered shard route
+// It is not thread-safe, the router guards it with its own mutex
+type HashRing struct {
+	virtualNodes int
+	points       []ringPoint
+}
+
+// NewHashRing initializes an empty ring that places each route at the given number of virtual nodes
+func NewHashRing(virtualNodes int) *HashRing {
+	return &HashRing{
+		virtualNodes: virtualNodes,
+		points:       make([]ringPoint, 0),
+	}
+}
+
+// Add places a route on the ring at all of its virtual nodes
+func (ring *HashRing) Add(route *ShardRoute) {
+	for v := range ring.virtualNodes {
+		ring.points = append(ring.points, ringPoint{
+			Hash:  virtualNodeHash(route, v),
+			Route: route,
+		})
+	}
+
+	// Collisions are broken deterministically so that every ring with the same routes agrees
+	slices.SortFunc(ring.points, func(a, b ringPoint) int {
+		return cmp.Or(cmp.Compare(a.Hash, b.Hash), compareRoutes(a.Route, b.Route))
+	})
+}
+
+// Remove takes every route with the given socket off the ring
+func (ring *HashRing) Remove(socket string) {
+	ring.points = slices.DeleteFunc(ring.points, func(point ringPoint) bool {
+		return point.Route.Socket == socket
+	})
+}
+
+// Replace swaps a route for another route of the same replica group at all of its virtual nodes
+// It is used when a group's primary or backups change, which does not move any keys
+func (ring *HashRing) Replace(old *ShardRoute, next *ShardRoute) {
+	for i := range ring.points {
+		if ring.points[i].Route == old {
+			ring.points[i].Route = next
+		}
+	}
+}
+
+// Get returns the route that owns the given key, or nil if the ring is empty
+// Keys are hashed with the same function the servers use to decide which keys fall in a migrated range
+func (ring *HashRing) Get(key string) *ShardRoute {
+	return ring.ownerOfHash(server.KeyHash(key))
+}
+
+// Clone returns a copy of the ring that can be changed without affecting the original
+func (ring *HashRing) Clone() *HashRing {
+	return &HashRing{
+		virtualNodes: ring.virtualNodes,
+		points:       slices.Clone(ring.points),
+	}
+}
+
+// ownerOfHash returns the route owning the given hash, or nil if the ring is empty
+func (ring *HashRing) ownerOfHash(hash uint64) *ShardRoute {
+	if len(ring.points) == 0 {
+		return nil
+	}
+	return ring.points[ring.search(hash)].Route
+}
+
+// Routes returns every route on the ring once, in the order of their first virtual node
+func (ring *HashRing) Routes() []*ShardRoute {
+	var routes []*ShardRoute
+	for _, point := range ring.points {
+		if !slices.Contains(routes, point.Route) {
+			routes = append(routes, point.Route)
+		}
+	}
+	return routes
+}
+
+// Len returns the number of virtual nodes on the ring
+func (ring *HashRing) Len() int {
+	return len(ring.points)
+}
+
+// search returns the index of the first virtual node at or after the hash, wrapping around to the start of the ring
+func (ring *HashRing) search(hash uint64) int {
+	idx, _ := slices.BinarySearchFunc(ring.points, hash, func(point ringPoint, target uint64) int {
+		return cmp.Compare(point.Hash, target)
+	})
+	if idx == len(ring.points) {
+		return 0
+	}
+	return idx
+}
+
+// virtualNodeHash places a virtual node of a route on the ring
+// The position only depends on the route's replica group and virtual node number, so it is stable across restarts and failovers
+func virtualNodeHash(route *ShardRoute, v int) uint64 {
+	return xxhash.Sum64String(route.GroupID() + "#" + strconv.Itoa(v))
+}
+
+// compareRoutes orders routes by socket and then by shard index
+func compareRoutes(a, b *ShardRoute) int {
+	return cmp.Or(cmp.Compare(a.Socket, b.Socket), cmp.Compare(a.ShardIdx, b.ShardIdx))
+}
@@ -0,0 +1,96 @@
+package router_test
+
+import (
+	"kvstore/pkg/router"
+	"kvstore/pkg/server"
+	"strconv"
+	"testing"
+)
+
+func newRing(servers int, shardsPerServer int) *router.HashRing {
+	ring := router.NewHashRing(128)
+	for s := range servers {
+		for i := range shardsPerServer {
+			ring.Add(&router.ShardRoute{Socket: "server" + strconv.Itoa(s) + ":8081", ShardIdx: i})
+		}
+	}
+	return ring
+}
+
+func TestRingEmpty(t *testing.T) {
+	ring := router.NewHashRing(16)
+	if route := ring.Get("key"); route != nil {
+		t.Errorf("Expected no route on an empty ring, got %v", route)
+	}
+}
+
+func TestRingAddMovesFewKeys(t *testing.T) {
+	before := newRing(4, 4)
+	after := newRing(5, 4)
+
+	numKeys := 20000
+	moved := 0
+	for i := range numKeys {
+		key := "key" + strconv.Itoa(i)
+		if before.Get(key).GroupID() != after.Get(key).GroupID() {
+			moved++
+			if after.Get(key).Socket != "server4:8081" {
+				t.Fatalf("Key %s moved between existing servers", key)
+			}
+		}
+	}
+
+	// Roughly 1/5 of the keys should move to the new server
+	fraction := float64(moved) / float64(numKeys)
+	if fraction < 0.1 || fraction > 0.3 {
+		t.Errorf("Expected about 20%% of keys to move, got %.1f%%", fraction*100)
+	}
+}
+
+func TestRingRemove(t *testing.T) {
+	ring := newRing(3, 2)
+	ring.Remove("server1:8081")
+
+	if ring.Len() != 2*2*128 {
+		t.Errorf("Expected %d virtual nodes, got %d", 2*2*128, ring.Len())
+	}
+	for i := range 1000 {
+		if route := ring.Get("key" + strconv.Itoa(i)); route.Socket == "server1:8081" {
+			t.Fatalf("Key routed to removed server")
+		}
+	}
+}
+
+func TestRingBalance(t *testing.T) {
+	ring := newRing(4, 1)
+
+	counts := make(map[string]int)
+	numKeys := 40000
+	for i := range numKeys {
+		counts[ring.Get("key"+strconv.Itoa(i)).Socket]++
+	}
+
+	for socket, count := range counts {
+		share := float64(count) / float64(numKeys)
+		if share < 0.15 || share > 0.35 {
+			t.Errorf("Expected about 25%% of keys on %s, got %.1f%%", socket, share*100)
+		}
+	}
+}
+
+func TestRingHashTags(t *testing.T) {
+	ring := newRing(8, 4)
+
+	for i := range 100 {
+		tag := "{user:" + strconv.Itoa(i) + "}"
+		if ring.Get(tag+":profile") != ring.Get(tag+":settings") || ring.Get(tag+":profile") != ring.Get("user:"+strconv.Itoa(i)) {
+			t.Fatalf("Expected keys tagged %s to share a route", tag)
+		}
+	}
+
+	for key, want := range map[string]string{"{a}b": "a", "x{a}{b}": "a", "{}a": "{}a", "a{b": "a{b", "a}b{": "a}b{", "{a{b}": "a{b"} {
+		if got := server.HashTag(key); got != want {
+			t.Errorf("Expected hash tag %q for key %q, got %q", want, key, got)
+		}
+	}
+}
@@ -1,52 +1,143 @@
 // router.go
 // This file contains the implementation of a central shard router
 // It provides structs and methods to route requests to the appropriate shard based on a key
-// It uses a static routing mechanism based on the hash of the key
+// Keys are mapped to shards with a consistent hash ring so that registering a server only moves a fraction of the keys
 package router
 
 import (
 	"fmt"
+	"kvstore/pkg/server"
 	"log"
+	"maps"
 	"slices"
 	"strconv"
 	"sync"
-
-	"github.com/cespare/xxhash/v2"
+	"time"
 )
 
 // The ShardRoute struct contains the necessary information to route a request to a specific shard
 // The address and port are necessary for RPC communication with a shard server
 // The shard index is used to identify which shard on a server the request should be routed to
+// The socket and shard index point at the primary of a replica group, and the backups hold copies of the primary's keys
+// Routes are never changed in place, a new route replaces the old one when the group's replicas change
 type ShardRoute struct {
 	Socket   string
 	ShardIdx int
+	Group    string
+	Backups  []server.ShardLocation
+}
+
+// GroupID returns the identity of the route's replica group, which stays the same when a backup is promoted
+// Routes without a group are identified by their socket and shard index
+func (route *ShardRoute) GroupID() string {
+	if route.Group != "" {
+		return route.Group
+	}
+	return route.Socket + "/" + strconv.Itoa(route.ShardIdx)
 }
 
 // The StaticShardRouter struct contains the routing information for all shards
-// It holds a slice of routes to each shard and the total number of shards
+// It holds a slice of routes to each shard and the hash ring that maps keys onto them
+// The name is kept for compatibility with the RPC service name used by servers and clients
+// The topology mutex serializes changes to the set of shards, which can take a while because of data migration
+// The failure detector tracks the liveness of every registered server through their heartbeats
+// The servers map holds the number of own shards of every registered server
+// The routes, ring, and servers form the route table, which is replaced as a whole by committing a new table under a new epoch
+// Replicated routers commit tables to a Raft log shared with the other routers, and only the leader changes the topology
 type StaticShardRouter struct {
-	Routes []*ShardRoute
-	mu     sync.RWMutex
+	Routes            []*ShardRoute
+	ring              *HashRing
+	detector          *FailureDetector
+	servers           map[string]int
+	epoch             int64
+	replicationFactor int
+	virtualNodes      int
+	consensus         *routeLog
+	mu                sync.RWMutex
+	topologyMu        sync.Mutex
+	monitorStop       chan struct{}
+	monitorDone       chan struct{}
+	tasks             sync.WaitGroup
+}
+
+// Config holds the settings of a StaticShardRouter
+// Servers are suspected after missing heartbeats for SuspectTimeout and declared down after DownTimeout
+// Every shard is kept on ReplicationFactor servers, a zero ReplicationFactor keeps a single copy
+// Peers lists the sockets of every router in the router group in the same order on every router, and Me is this router's position in it
+// The route table is persisted in DataDir if it is set, and kept in memory only otherwise
+// A router without peers or a data directory keeps its table in memory and always acts as the leader
+type Config struct {
+	VirtualNodes      int
+	SuspectTimeout    time.Duration
+	DownTimeout       time.Duration
+	ReplicationFactor int
+	Peers             []string
+	Me                int
+	DataDir           string
 }
 
 // NewRouter initializes a new StaticShardRouter with an empty route list and zero shards
-func NewRouter() *StaticShardRouter {
-	return &StaticShardRouter{
-		Routes: make([]*ShardRoute, 0),
+// Each registered shard is placed on the hash ring at the configured number of virtual nodes
+// Replicated routers restore their persisted table and join the Raft group of their peers
+// A background loop checks the failure detector until the router is closed
+// On the leader it fails over the shards of servers that are declared down and takes servers that come back in again as backup hosts
+func NewRouter(config *Config) (*StaticShardRouter, error) {
+	if config.VirtualNodes <= 0 {
+		return nil, fmt.Errorf("number of virtual nodes must be greater than 0, got: %d", config.VirtualNodes)
+	}
+	if config.SuspectTimeout <= 0 {
+		return nil, fmt.Errorf("suspect timeout must be greater than 0, got: %v", config.SuspectTimeout)
+	}
+	if config.DownTimeout <= config.SuspectTimeout {
+		return nil, fmt.Errorf("down timeout must be greater than the suspect timeout, got: %v", config.DownTimeout)
+	}
+	if config.ReplicationFactor < 0 {
+		return nil, fmt.Errorf("replication factor must not be negative, got: %d", config.ReplicationFactor)
+	}
+	if len(config.Peers) > 0 && (config.Me < 0 || config.Me >= len(config.Peers)) {
+		return nil, fmt.Errorf("router index %d is out of range for %d peers", config.Me, len(config.Peers))
 	}
+	if len(config.Peers) == 0 && config.Me != 0 {
+		return nil, fmt.Errorf("router index must be 0 without peers, got: %d", config.Me)
+	}
+
+	r := &StaticShardRouter{
+		Routes:            make([]*ShardRoute, 0),
+		ring:              NewHashRing(config.VirtualNodes),
+		detector:          NewFailureDetector(config.SuspectTimeout, config.DownTimeout),
+		servers:           make(map[string]int),
+		replicationFactor: max(config.ReplicationFactor, 1),
+		virtualNodes:      config.VirtualNodes,
+		monitorStop:       make(chan struct{}),
+		monitorDone:       make(chan struct{}),
+	}
+	if len(config.Peers) > 0 || config.DataDir != "" {
+		if err := r.startConsensus(config); err != nil {
+			return nil, err
+		}
+	}
+	go r.monitor(config.SuspectTimeout / 2)
+
+	return r, nil
+}
+
+// Close stops the router's background failure monitoring and waits for running failovers to finish
+// Replicated routers then leave the router group
+func (r *StaticShardRouter) Close() {
+	close(r.monitorStop)
+	<-r.monitorDone
+	r.tasks.Wait()
+	r.stopConsensus()
 }
 
 // GetRoute is an RPC method that retrieves the route for a given key
-// It calculates the 64-bit hash of the key and determines the appropriate shard based on the hash
+// It looks up the owner of the key's 64-bit hash on the consistent hash ring
 // Thread-safe access is ensured using a read mutex
-// The reply contains the socket and shard index for the requested key
+// The reply contains the socket and shard index of the key's primary, the liveness of the primary's server, and every replica of the shard
 func (r *StaticShardRouter) GetRoute(args *GetRouteArgs, reply *GetRouteReply) error {
-	// xxhash is used for fast, non-cryptographic hashing of keys for simple and efficient routing
-	hash := xxhash.Sum64String(args.Key)
-	routeIdx := int(hash % uint64(len(r.Routes)))
-
 	r.mu.RLock()
-	route := r.Routes[routeIdx]
+	route := r.ring.Get(args.Key)
+	epoch := r.epoch
 	r.mu.RUnlock()
 	if route == nil {
 		return fmt.Errorf("no route found for key %s", args.Key)
@@ -54,6 +145,22 @@ func (r *StaticShardRouter) GetRoute(args *GetRouteArgs, reply *GetRouteReply) e
 
 	reply.Socket = route.Socket
 	reply.ShardIdx = route.ShardIdx
+	reply.Epoch = epoch
+	reply.Status = r.detector.Status(route.Socket, time.Now())
+	reply.Replicas = append([]server.ShardLocation{{Socket: route.Socket, ShardIdx: route.ShardIdx}}, route.Backups...)
+
+	return nil
+}
+
+// GetRouteTable is an RPC method that returns every route along with the epoch of the route table
+// Clients place the routes on a hash ring of their own to route keys without asking the router
+func (r *StaticShardRouter) GetRouteTable(args *GetRouteTableArgs, reply *GetRouteTableReply) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reply.Epoch = r.epoch
+	reply.VirtualNodes = r.virtualNodes
+	reply.Routes = slices.Clone(r.Routes)
 
 	return nil
 }
@@ -78,7 +185,10 @@ func (r *StaticShardRouter) GetAllSockets(args *GetAllSocketsArgs, reply *GetAll
 
 // RegisterServer is an RPC method that allows a new server to register itself with the router
 // It takes the address, port, and number of shards on the server as arguments
-// Thread-safe access is ensured using a write mutex
+// Keys whose route changes are migrated to the new shards before the call returns, so the server must already be serving
+// Topology changes are serialized, and backups are placed for the new shards once their keys have arrived
+// A server that registers again may have restarted and lost its backup shards, so its primaries fail over and it rejoins as a backup host
+// Only the leader of a router group accepts registrations, the others return ErrNotLeader
 func (r *StaticShardRouter) RegisterServer(args *RegisterServerArgs, reply *RegisterServerReply) error {
 	if args.Port < 0 || args.Port > 65535 {
 		return fmt.Errorf("valid port numbers are 0-65535, got: %d", args.Port)
@@ -87,25 +197,183 @@ func (r *StaticShardRouter) RegisterServer(args *RegisterServerArgs, reply *Regi
 		return fmt.Errorf("number of shards must be greater than 0, got: %d", args.NumShards)
 	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	if err := r.checkLeader(); err != nil {
+		return err
+	}
+
+	r.topologyMu.Lock()
+	defer r.topologyMu.Unlock()
 
+	socket := args.Address + ":" + strconv.Itoa(args.Port)
+	if registered, exists := r.serverShards(socket); exists {
+		if registered != args.NumShards {
+			return fmt.Errorf("server %s is already registered with %d shards", socket, registered)
+		}
+		log.Println("Server already registered:", socket)
+		r.detector.Track(socket, time.Now())
+		r.evict(socket)
+		r.reset(socket)
+		r.repair()
+		return nil
+	}
+
+	next := r.ring.Clone()
+	routes := slices.Clone(r.Routes)
 	for i := range args.NumShards {
 		route := &ShardRoute{
-			Socket:   args.Address + ":" + strconv.Itoa(args.Port),
+			Socket:   socket,
 			ShardIdx: i,
+			Group:    socket + "/" + strconv.Itoa(i),
 		}
 
-		r.Routes = append(r.Routes, route)
+		routes = append(routes, route)
+		next.Add(route)
+	}
+
+	servers := r.registeredServers()
+	servers[socket] = args.NumShards
+	if err := r.rebalance(next, routes, servers); err != nil {
+		return fmt.Errorf("failed to migrate keys to server %s: %v", socket, err)
 	}
+	r.repair()
 
 	log.Println(
 		"Registered new server:",
 		"\n\tAddress: ", args.Address,
 		"\n\tPort: ", args.Port,
 		"\n\tShards: ", args.NumShards,
-		"\n\tTotal Shards: ", len(r.Routes),
+		"\n\tTotal Shards: ", len(routes),
 	)
 
 	return nil
 }
+
+// DeregisterServer is an RPC method that removes a server and all of its shards from the router
+// Primaries on the server hand over to one of their backups, and the keys of primaries without backups are migrated to the shards that take over their hash ranges
+// Backups on the server are replaced by new backups on the remaining servers
+// The call only returns once the hand-off is complete, so the server can safely exit afterwards
+// Only the leader of a router group accepts deregistrations, the others return ErrNotLeader
+func (r *StaticShardRouter) DeregisterServer(args *DeregisterServerArgs, reply *DeregisterServerReply) error {
+	if err := r.checkLeader(); err != nil {
+		return err
+	}
+
+	r.topologyMu.Lock()
+	defer r.topologyMu.Unlock()
+
+	socket := args.Address + ":" + strconv.Itoa(args.Port)
+	servers := r.registeredServers()
+	registered, exists := servers[socket]
+	if !exists {
+		return fmt.Errorf("server %s is not registered", socket)
+	}
+	if len(servers) == 1 {
+		return fmt.Errorf("server %s is the last registered server and cannot be removed", socket)
+	}
+	delete(servers, socket)
+
+	r.evict(socket)
+
+	next := r.ring.Clone()
+	next.Remove(socket)
+	if next.Len() == 0 {
+		return fmt.Errorf("server %s holds the last primary shards and cannot be removed", socket)
+	}
+	routes := slices.Clone(r.Routes)
+	removed := slices.DeleteFunc(slices.Clone(routes), func(route *ShardRoute) bool {
+		return route.Socket != socket
+	})
+	routes = slices.DeleteFunc(routes, func(route *ShardRoute) bool {
+		return route.Socket == socket
+	})
+
+	if err := r.rebalance(next, routes, servers); err != nil {
+		return fmt.Errorf("failed to migrate keys off server %s: %v", socket, err)
+	}
+	for _, route := range removed {
+		removeBackups(route.Backups)
+	}
+	r.repair()
+
+	log.Println(
+		"Deregistered server:",
+		"\n\tAddress: ", args.Address,
+		"\n\tPort: ", args.Port,
+		"\n\tShards: ", registered,
+		"\n\tTotal Shards: ", len(routes),
+	)
+
+	return nil
+}
+
+// Heartbeat is an RPC method that registered servers call periodically to show they are alive
+// It returns an error for servers that are not registered
+// Every router of a group tracks heartbeats, so servers send them to all routers and a new leader knows which servers are alive
+func (r *StaticShardRouter) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	socket := args.Address + ":" + strconv.Itoa(args.Port)
+	if !r.detector.Heartbeat(socket, time.Now()) {
+		return fmt.Errorf("server %s is not registered", socket)
+	}
+	return nil
+}
+
+// GetServerStatus is an RPC method that reports the liveness of every registered server
+// Each entry holds the server's socket, its status, and the time of its last heartbeat
+func (r *StaticShardRouter) GetServerStatus(args *GetServerStatusArgs, reply *GetServerStatusReply) error {
+	reply.Servers = r.detector.Snapshot(time.Now())
+	return nil
+}
+
+// monitor periodically updates the failure detector and logs every server whose status changed
+// On the leader, servers that are declared down are failed over, and servers that come back are reset and used as backup hosts
+// A replicated router that becomes the leader first catches up with the table and fails over the servers that went down while it was a follower
+func (r *StaticShardRouter) monitor(interval time.Duration) {
+	defer close(r.monitorDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wasLeader := false
+	for {
+		select {
+		case now := <-ticker.C:
+			leader := r.isLeader()
+			if leader && !wasLeader && r.consensus != nil {
+				r.runTask(r.takeOver)
+			}
+			wasLeader = leader
+
+			for _, change := range r.detector.Update(now) {
+				log.Printf("Server %s changed status from %v to %v", change.Socket, change.From, change.To)
+				if !leader {
+					continue
+				}
+				switch {
+				case change.To == StatusDown:
+					r.runTask(func() { r.failover(change.Socket) })
+				case change.From == StatusDown && change.To == StatusAlive:
+					r.runTask(func() { r.rejoin(change.Socket) })
+				}
+			}
+		case <-r.monitorStop:
+			return
+		}
+	}
+}
+
+// serverShards returns the number of own shards of a registered server and whether it is registered
+func (r *StaticShardRouter) serverShards(socket string) (int, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	numShards, exists := r.servers[socket]
+	return numShards, exists
+}
+
+// registeredServers returns a copy of the number of own shards of every registered server
+func (r *StaticShardRouter) registeredServers() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return maps.Clone(r.servers)
+}
@@ -2,9 +2,16 @@
 // This file contains the RPC types used for communication between the router and clients
 package router
 
+import (
+	"kvstore/pkg/server"
+	"time"
+)
+
 // GetRouteArgs and GetRouteReply are used for the GetRoute RPC method
 // This method retrieves the route for a given key
 // This RPC is used for all routing operations
+// The socket and shard index point at the primary, and the replicas list the primary first followed by its backups
+// The epoch is the version of the route table the route was taken from
 type GetRouteArgs struct {
 	Key string
 }
@@ -12,6 +19,20 @@ type GetRouteArgs struct {
 type GetRouteReply struct {
 	Socket   string
 	ShardIdx int
+	Status   ServerStatus
+	Replicas []server.ShardLocation
+	Epoch    int64
+}
+
+// GetRouteTableArgs and GetRouteTableReply are used for the GetRouteTable RPC method
+// This method returns the whole route table so that clients can cache it and route keys themselves
+// Placing the routes on a hash ring with the given number of virtual nodes reproduces the router's ring
+type GetRouteTableArgs struct{}
+
+type GetRouteTableReply struct {
+	Epoch        int64
+	VirtualNodes int
+	Routes       []*ShardRoute
 }
 
 // GetAllSocketsArgs and GetAllSocketsReply are used for the GetAllSockets RPC method
@@ -33,3 +54,38 @@ type RegisterServerArgs struct {
 }
 
 type RegisterServerReply struct{}
+
+// DeregisterServerArgs and DeregisterServerReply are used for the DeregisterServer RPC method
+// This method removes a server from the router once its keys have been handed off to the remaining servers
+// It takes the address and port the server registered with as arguments
+type DeregisterServerArgs struct {
+	Address string
+	Port    int
+}
+
+type DeregisterServerReply struct{}
+
+// HeartbeatArgs and HeartbeatReply are used for the Heartbeat RPC method
+// Registered servers call this method periodically to show they are alive
+// It takes the address and port the server registered with as arguments
+type HeartbeatArgs struct {
+	Address string
+	Port    int
+}
+
+type HeartbeatReply struct{}
+
+// GetServerStatusArgs and GetServerStatusReply are used for the GetServerStatus RPC method
+// This method reports the liveness of every registered server as seen by the failure detector
+type GetServerStatusArgs struct{}
+
+type GetServerStatusReply struct {
+	Servers []ServerState
+}
+
+// A ServerState is the liveness of a single server and the time of its last heartbeat
+type ServerState struct {
+	Socket        string
+	Status        ServerStatus
+	LastHeartbeat time.Time
+}
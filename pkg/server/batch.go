@@ -0,0 +1,213 @@
+// batch.go
+// This file contains the batched RPC handlers, which read or write several keys of the server in a single call
+// Items are grouped by shard and every shard is locked once for all of its items, shards are handled in parallel
+// Every item gets its own result, so one key that has moved does not fail the others
+// The epoch and the deadline apply to the whole batch, a stale epoch rejects the call before any item is handled
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MultiGet is an RPC method that retrieves several keys, each from the shard given by its item
+// The results are in the order of the items
+func (store *KVServer) MultiGet(args *MultiGetArgs, reply *MultiGetReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	reply.Results = make([]BatchResult, len(args.Items))
+	store.forEachShard(args.Items, reply.Results, func(shard *Shard, items []BatchItem, results []*BatchResult) {
+		shard.getBatch(items, results, deadline)
+	})
+	return nil
+}
+
+// MultiSet is an RPC method that sets several key-value pairs, each in the shard given by its item
+// The writes to a shard are logged, applied, and forwarded together, like a single Set
+// Retried items the shard has already applied are acknowledged without applying them again
+// Items whose values are larger than the server's maximum value size fail with ErrValueTooLarge without failing the others
+func (store *KVServer) MultiSet(args *MultiSetArgs, reply *MultiSetReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	reply.Results = make([]BatchResult, len(args.Items))
+	store.forEachShard(args.Items, reply.Results, func(shard *Shard, items []BatchItem, results []*BatchResult) {
+		items, results = store.checkValueSizes(items, results)
+		if len(items) > 0 {
+			shard.writeBatch(walOpSet, items, results, deadline)
+		}
+	})
+	return nil
+}
+
+// MultiDelete is an RPC method that deletes several keys, each from the shard given by its item
+// Like Delete, missing keys are acknowledged without being logged
+func (store *KVServer) MultiDelete(args *MultiDeleteArgs, reply *MultiDeleteReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	reply.Results = make([]BatchResult, len(args.Items))
+	store.forEachShard(args.Items, reply.Results, func(shard *Shard, items []BatchItem, results []*BatchResult) {
+		shard.writeBatch(walOpDelete, items, results, deadline)
+	})
+	return nil
+}
+
+// forEachShard groups the items by shard index and calls handle once per shard, in parallel, with the shard's items and their results
+// Items of a shard that does not exist get an error result without handle being called
+func (store *KVServer) forEachShard(items []BatchItem, results []BatchResult, handle func(*Shard, []BatchItem, []*BatchResult)) {
+	positions := make(map[int][]int)
+	for i, item := range items {
+		positions[item.ShardIdx] = append(positions[item.ShardIdx], i)
+	}
+
+	var wg sync.WaitGroup
+	for shardIdx, indexes := range positions {
+		shardItems := make([]BatchItem, len(indexes))
+		shardResults := make([]*BatchResult, len(indexes))
+		for j, i := range indexes {
+			shardItems[j] = items[i]
+			shardResults[j] = &results[i]
+		}
+
+		shard, err := store.getShard(shardIdx)
+		if err != nil {
+			failAll(shardResults, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(shard, shardItems, shardResults)
+		}()
+	}
+	wg.Wait()
+}
+
+// failAll sets the same error on every result
+func failAll(results []*BatchResult, err error) {
+	for _, result := range results {
+		result.Err = err.Error()
+	}
+}
+
+// getBatch reads the items' keys from the shard into their results
+// On shards in a Raft group every read is ordered through the group's log, otherwise the shard is read under a single lock
+func (shard *Shard) getBatch(items []BatchItem, results []*BatchResult, deadline time.Time) {
+	if shard.isRaft() {
+		shard.proposeAll(items, results, deadline, func(item BatchItem) *walRecord {
+			return &walRecord{Op: walOpGet, Key: item.Key}
+		})
+		return
+	}
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if err := checkDeadline(deadline, items[0].Key); err != nil {
+		failAll(results, err)
+		return
+	}
+	for i, item := range items {
+		if err := shard.checkOwnership(item.Key); err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		results[i].Value, results[i].Exists = shard.lookup(item.Key)
+		if results[i].Exists {
+			results[i].Version = shard.versions[item.Key]
+		}
+	}
+}
+
+// proposeAll submits the record of every item to the shard's Raft group in parallel and stores each outcome in the item's result
+// Proposing in parallel lets the group commit the records together instead of one per round trip
+func (shard *Shard) proposeAll(items []BatchItem, results []*BatchResult, deadline time.Time, newRecord func(BatchItem) *walRecord) {
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record := newRecord(item)
+			record.RequestID = item.RequestID
+			applied, err := shard.propose(record, deadline)
+			if err != nil {
+				results[i].Err = fmt.Sprintf("failed to handle key %s: %v", item.Key, err)
+				return
+			}
+			results[i].Value, results[i].Exists, results[i].Version = applied.value, applied.exists, applied.version
+		}()
+	}
+	wg.Wait()
+}
+
+// writeBatch sets or deletes the items' keys in the shard, depending on the operation
+// On shards in a Raft group every write is committed through the group's log, otherwise the shard is locked once and the writes are committed together
+// If committing fails, every item that was part of the commit gets the error
+func (shard *Shard) writeBatch(op walOp, items []BatchItem, results []*BatchResult, deadline time.Time) {
+	newRecord := func(item BatchItem) *walRecord {
+		if op == walOpDelete {
+			return &walRecord{Op: walOpDelete, Key: item.Key}
+		}
+		return &walRecord{Op: walOpSet, Key: item.Key, Value: item.Value}
+	}
+
+	if shard.isRaft() {
+		shard.proposeAll(items, results, deadline, newRecord)
+		return
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := checkDeadline(deadline, items[0].Key); err != nil {
+		failAll(results, err)
+		return
+	}
+
+	var records []*walRecord
+	var committed []int
+	var requestIDs []string
+	for i, item := range items {
+		if err := shard.checkOwnership(item.Key); err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		if err := shard.checkUnlocked(item.Key); err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		if shard.applied(item.RequestID) {
+			continue
+		}
+		requestIDs = append(requestIDs, item.RequestID)
+		if _, exists := shard.lookup(item.Key); op == walOpDelete && !exists {
+			continue
+		}
+		records = append(records, newRecord(item))
+		committed = append(committed, i)
+	}
+
+	if err := shard.commitLocally(records...); err != nil {
+		for _, i := range committed {
+			results[i].Err = fmt.Sprintf("failed to write key %s: %v", items[i].Key, err)
+		}
+		return
+	}
+	for _, requestID := range requestIDs {
+		shard.remember(requestID)
+	}
+	if err := shard.forward(records); err != nil {
+		for _, i := range committed {
+			results[i].Err = fmt.Sprintf("failed to write key %s: %v", items[i].Key, err)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+// consensus.go
+// This file contains shards replicated with Raft for linearizable operations that survive minority failures
+// A shard joins a Raft group with StartRaft, after which every Set, Get, Delete, and Exists is proposed to the group's log
+// Handlers wait until their command has been committed and applied, and only the group's leader accepts commands
+// The Raft log and snapshots replace the shard's write-ahead log, so these shards are not migrated or replicated to backups
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/pkg/raft"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// raftCommitTimeout bounds how long a handler waits for its command to be applied before giving up
+	raftCommitTimeout = 2 * time.Second
+	// raftSnapshotThreshold is the size of the persisted Raft state at which a shard snapshots and compacts its log
+	raftSnapshotThreshold = 4 << 20
+	// raftConfigFile stores the group membership of a shard so that it rejoins its group after a restart
+	raftConfigFile = "raft.json"
+)
+
+// errRaftShard is returned for migration and replication requests on shards replicated with Raft
+var errRaftShard = errors.New("shard is replicated with raft")
+
+// A raftGroup is a shard's membership in a Raft group
+// Waiters are notified with the result of the command committed at their log index
+type raftGroup struct {
+	rf          *raft.Raft
+	persister   raft.Persister
+	applyCh     chan raft.ApplyMsg
+	waiters     map[int]chan raftResult
+	lastApplied int
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// A raftResult is the outcome of an applied command, returned to the handler that proposed it
+// The term lets the handler detect that a different command was committed at its index after a change of leader
+// Reads return the key's value, version, and expiry, conditional writes and expires whether their condition held and the key's version afterwards
+// Read-modify-writes return the key's previous value, whether it existed, and the new value, or the error that kept them from applying
+type raftResult struct {
+	term      int
+	value     []byte
+	exists    bool
+	version   uint64
+	expiresAt int64
+	succeeded bool
+	previous  []byte
+	err       error
+}
+
+// StartRaft is an RPC method that makes a shard a member of a Raft group
+// Peers lists every member of the group in the same order on every member, and Me is the position of this shard in it
+// The shard's existing keys are discarded, its contents are rebuilt from the group's log
+func (store *KVServer) StartRaft(args *StartRaftArgs, reply *StartRaftReply) error {
+	if args.Me < 0 || args.Me >= len(args.Peers) {
+		return fmt.Errorf("member index %d is out of range for %d peers", args.Me, len(args.Peers))
+	}
+
+	var persister raft.Persister = raft.NewMemoryPersister()
+	if store.dataDir != "" {
+		dir := store.shardDir(args.ShardIdx)
+		filePersister, err := raft.NewFilePersister(filepath.Join(dir, "raft"))
+		if err != nil {
+			return err
+		}
+		persister = filePersister
+	}
+
+	peers := make([]raft.Peer, len(args.Peers))
+	for i, location := range args.Peers {
+		peers[i] = raft.NewRPCPeer(location.Socket, "KVServer", location.ShardIdx)
+	}
+	if _, err := store.JoinRaft(args.ShardIdx, peers, args.Me, persister); err != nil {
+		return err
+	}
+
+	if store.dataDir != "" {
+		config, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(store.shardDir(args.ShardIdx), raftConfigFile), config, 0o644); err != nil {
+			return fmt.Errorf("failed to save raft membership of shard %d: %v", args.ShardIdx, err)
+		}
+	}
+	return nil
+}
+
+// JoinRaft makes a shard a member of a Raft group reached through the given peers and returns the shard's Raft peer
+// The shard stops using its write-ahead log and clears its keys and change feed, and the state saved in the persister is restored
+// Tests use it directly to connect shards through a simulated network
+func (store *KVServer) JoinRaft(shardIdx int, peers []raft.Peer, me int, persister raft.Persister) (*raft.Raft, error) {
+	shard, err := store.getShard(shardIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.group != nil {
+		return nil, fmt.Errorf("shard %d is already a member of a raft group", shardIdx)
+	}
+
+	shard.closeForwarders()
+	if shard.wal != nil {
+		if err := shard.wal.Close(); err != nil {
+			return nil, fmt.Errorf("failed to close log of shard %d: %v", shardIdx, err)
+		}
+		shard.wal = nil
+		if err := removeLogFiles(store.shardDir(shardIdx)); err != nil {
+			return nil, err
+		}
+	}
+	shard.data = make(map[string][]byte)
+	shard.keys = newSkipList()
+	shard.versions = make(map[string]uint64)
+	shard.revision = 0
+	shard.expiries = nil
+	shard.clearTxns()
+	shard.clearHistory()
+	shard.clock = 0
+	shard.resetFeed()
+	shard.requests = requestLog{}
+	shard.moved = nil
+	shard.primary = false
+
+	group := &raftGroup{
+		persister: persister,
+		applyCh:   make(chan raft.ApplyMsg),
+		waiters:   make(map[int]chan raftResult),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	group.rf = raft.Make(peers, me, persister, group.applyCh)
+	shard.group = group
+	go shard.applyCommitted(group)
+
+	return group.rf, nil
+}
+
+// RaftRequestVote is an RPC method that passes a RequestVote message to the Raft peer of a shard
+// The group of every Raft message is the index of the receiving shard
+func (store *KVServer) RaftRequestVote(args *raft.GroupRequestVoteArgs, reply *raft.RequestVoteReply) error {
+	rf, err := store.getRaft(args.Group)
+	if err != nil {
+		return err
+	}
+	return rf.RequestVote(&args.Args, reply)
+}
+
+// RaftAppendEntries is an RPC method that passes an AppendEntries message to the Raft peer of a shard
+func (store *KVServer) RaftAppendEntries(args *raft.GroupAppendEntriesArgs, reply *raft.AppendEntriesReply) error {
+	rf, err := store.getRaft(args.Group)
+	if err != nil {
+		return err
+	}
+	return rf.AppendEntries(&args.Args, reply)
+}
+
+// RaftInstallSnapshot is an RPC method that passes an InstallSnapshot message to the Raft peer of a shard
+func (store *KVServer) RaftInstallSnapshot(args *raft.GroupInstallSnapshotArgs, reply *raft.InstallSnapshotReply) error {
+	rf, err := store.getRaft(args.Group)
+	if err != nil {
+		return err
+	}
+	return rf.InstallSnapshot(&args.Args, reply)
+}
+
+// getRaft returns the Raft peer of a shard or an error if the shard is not a member of a group
+func (store *KVServer) getRaft(shardIdx int) (*raft.Raft, error) {
+	shard, err := store.getShard(shardIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if shard.group == nil {
+		return nil, fmt.Errorf("shard %d is not a member of a raft group", shardIdx)
+	}
+	return shard.group.rf, nil
+}
+
+// restoreRaft rejoins the Raft group a shard was a member of before the server restarted
+// It returns false if the shard was never a member of a group
+func (store *KVServer) restoreRaft(shardIdx int) (bool, error) {
+	contents, err := os.ReadFile(filepath.Join(store.shardDir(shardIdx), raftConfigFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read raft membership: %v", err)
+	}
+
+	args := &StartRaftArgs{}
+	if err := json.Unmarshal(contents, args); err != nil {
+		return false, fmt.Errorf("failed to parse raft membership: %v", err)
+	}
+	args.ShardIdx = shardIdx
+	return true, store.StartRaft(args, &StartRaftReply{})
+}
+
+// propose submits a command to the shard's Raft group and waits until it has been applied
+// Commands on followers, and commands that lose their log slot to another leader, fail with ErrNotPrimary so clients look elsewhere
+// The wait ends at the request's deadline if that comes before the commit timeout, in which case the command may still be applied later
+// Commands carry the time they were proposed, which applyCommitted turns into their commit time
+// The time is taken under the shard's lock, so that the leader's commands carry times in log order
+func (shard *Shard) propose(record *walRecord, deadline time.Time) (raftResult, error) {
+	if err := checkDeadline(deadline, record.Key); err != nil {
+		return raftResult{}, err
+	}
+
+	shard.mu.Lock()
+	record.CommittedAt = time.Now().UnixNano()
+	group := shard.group
+	index, term, isLeader := group.rf.Start(encodeWALRecord(record))
+	if !isLeader {
+		shard.mu.Unlock()
+		return raftResult{}, fmt.Errorf("%v: %s", ErrNotPrimary, record.Key)
+	}
+	result := make(chan raftResult, 1)
+	group.waiters[index] = result
+	shard.mu.Unlock()
+
+	timeout := raftCommitTimeout
+	if !deadline.IsZero() {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case applied := <-result:
+		if applied.term != term {
+			return raftResult{}, fmt.Errorf("%v: %s", ErrNotPrimary, record.Key)
+		}
+		return applied, nil
+	case <-timer.C:
+		shard.mu.Lock()
+		delete(group.waiters, index)
+		shard.mu.Unlock()
+		if err := checkDeadline(deadline, record.Key); err != nil {
+			return raftResult{}, err
+		}
+		return raftResult{}, fmt.Errorf("timed out waiting for raft to commit key %s", record.Key)
+	}
+}
+
+// applyCommitted applies the commands and snapshots a shard's Raft peer delivers, until the group is stopped
+// Every command, reads included, takes its commit time from the shard's clock when it is applied, the later of the time it was proposed and the time after the previous command's
+// Commands are applied in log order on every member, so they all give a command the same commit time, and commit times only increase even if leaders' clocks disagree
+// Once the persisted Raft state grows past the threshold, the shard's map is snapshotted so that Raft can compact its log
+func (shard *Shard) applyCommitted(group *raftGroup) {
+	defer close(group.done)
+
+	for {
+		var msg raft.ApplyMsg
+		select {
+		case msg = <-group.applyCh:
+		case <-group.stop:
+			return
+		}
+
+		shard.mu.Lock()
+		if msg.SnapshotValid {
+			if msg.SnapshotIndex > group.lastApplied {
+				if snapshot, err := decodeRaftSnapshot(msg.Snapshot); err != nil {
+					log.Printf("Failed to install raft snapshot: %v", err)
+				} else {
+					shard.data, shard.versions, shard.revision = snapshot.Data, snapshot.Versions, snapshot.Revision
+					shard.keys = newSkipList()
+					for key := range shard.data {
+						shard.keys.insert(key)
+					}
+					shard.expiries = snapshot.Expiries
+					shard.history, shard.horizon, shard.clock = snapshot.History, snapshot.Horizon, snapshot.Clock
+					shard.restoreRequests(snapshot.Requests)
+					shard.resetFeed()
+					shard.safe.notify()
+					group.lastApplied = msg.SnapshotIndex
+				}
+			}
+			shard.mu.Unlock()
+			continue
+		}
+		if msg.CommandIndex <= group.lastApplied {
+			shard.mu.Unlock()
+			continue
+		}
+
+		result := raftResult{term: msg.CommandTerm}
+		record, err := decodeWALRecord(msg.Command[walHeaderSize:])
+		if err == nil {
+			record.CommittedAt = shard.commitTime(record.CommittedAt)
+		}
+		if err != nil {
+			log.Printf("Skipping undecodable raft command at index %d: %v", msg.CommandIndex, err)
+		} else if record.Op == walOpGet {
+			result.value, result.exists = shard.lookup(record.Key)
+			if result.exists {
+				result.version, result.expiresAt = shard.versions[record.Key], shard.expiries[record.Key]
+			}
+		} else if modified, applied := shard.appliedResult(record.RequestID); applied {
+			result.previous, result.exists, result.value = modified.previous, modified.existed, modified.value
+			result.version, result.succeeded = shard.versions[record.Key], true
+		} else if record.Op == walOpExpire {
+			result.succeeded = shard.applyExpiry(record)
+		} else if record.Op == walOpTxn {
+			if writes, ok, err := shard.resolveTxn(record); err != nil {
+				result.err = err
+			} else if ok {
+				for _, write := range writes {
+					write.CommittedAt = record.CommittedAt
+					shard.apply(write)
+				}
+				shard.rememberAt(record.RequestID, time.Unix(0, record.CommittedAt), modification{})
+				result.succeeded = true
+			}
+		} else if record.Op == walOpIncr || record.Op == walOpAppend || record.Op == walOpGetAndSet {
+			if write, modified, err := shard.modify(record); err != nil {
+				result.err = err
+			} else {
+				write.CommittedAt = record.CommittedAt
+				shard.apply(write)
+				shard.rememberAt(record.RequestID, time.Unix(0, record.CommittedAt), modified)
+				result.previous, result.exists, result.value = modified.previous, modified.existed, modified.value
+				result.version = shard.versions[record.Key]
+			}
+		} else {
+			if write, ok := shard.resolve(record); ok {
+				write.CommittedAt = record.CommittedAt
+				shard.apply(write)
+				shard.rememberAt(record.RequestID, time.Unix(0, record.CommittedAt), modification{})
+				result.succeeded = true
+			}
+			result.version = shard.versions[record.Key]
+		}
+		group.lastApplied = msg.CommandIndex
+
+		if waiter, exists := group.waiters[msg.CommandIndex]; exists {
+			waiter <- result
+			delete(group.waiters, msg.CommandIndex)
+		}
+
+		var snapshot []byte
+		if group.persister.StateSize() >= raftSnapshotThreshold {
+			snapshot = encodeRaftSnapshot(&raftSnapshot{Data: shard.data, Versions: shard.versions, Revision: shard.revision, Expiries: shard.expiries, History: shard.history, Horizon: shard.horizon, Clock: shard.clock, Requests: shard.appliedRequests()})
+		}
+		shard.mu.Unlock()
+
+		if snapshot != nil {
+			group.rf.Snapshot(msg.CommandIndex, snapshot)
+		}
+	}
+}
+
+// stopRaft shuts down the shard's Raft peer and its apply loop
+// The caller must hold the shard's write lock, which is released while the apply loop exits
+func (shard *Shard) stopRaft() {
+	group := shard.group
+	if group == nil {
+		return
+	}
+	group.rf.Kill()
+	close(group.stop)
+
+	shard.mu.Unlock()
+	<-group.done
+	shard.mu.Lock()
+}
+
+// A raftSnapshot is the state of a shard in a Raft group, saved so that Raft can compact its log
+// Snapshots taken before keys had a history restore without one, and reads at a point in time see keys from their next write on
+// Clock is the shard's commit clock, so that members restored from the snapshot give later commands the same commit times as the others
+// Requests holds the IDs of the client writes applied within the request window, so that members restored from the snapshot still recognize their retries
+type raftSnapshot struct {
+	Data     map[string][]byte
+	Versions map[string]uint64
+	Revision uint64
+	Expiries map[string]int64
+	History  map[string][]keyVersion
+	Horizon  int64
+	Clock    int64
+	Requests []*appliedRequest
+}
+
+// encodeRaftSnapshot serializes a shard's map and versions for a Raft snapshot
+func encodeRaftSnapshot(snapshot *raftSnapshot) []byte {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(snapshot)
+	return buf.Bytes()
+}
+
+// decodeRaftSnapshot restores a shard's map and versions from a Raft snapshot
+func decodeRaftSnapshot(data []byte) (*raftSnapshot, error) {
+	snapshot := &raftSnapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Data == nil {
+		snapshot.Data = make(map[string][]byte)
+	}
+	if snapshot.Versions == nil {
+		snapshot.Versions = make(map[string]uint64)
+	}
+	return snapshot, nil
+}
+
+// removeLogFiles deletes every log segment and snapshot in a shard directory
+func removeLogFiles(dir string) error {
+	for _, ext := range []string{walExt, snapshotExt} {
+		seqs, err := listSeqs(dir, ext)
+		if err != nil {
+			return err
+		}
+		for _, seq := range seqs {
+			path := segmentPath(dir, seq)
+			if ext == snapshotExt {
+				path = snapshotPath(dir, seq)
+			}
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// raftLeader reports whether the shard is the leader of its Raft group
+// Shards outside a group report false
+// The caller must hold the shard's lock
+func (shard *Shard) raftLeader() bool {
+	if shard.group == nil {
+		return false
+	}
+	_, isLeader := shard.group.rf.GetState()
+	return isLeader
+}
+
+// isRaft reports whether a shard is a member of a Raft group
+func (shard *Shard) isRaft() bool {
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.group != nil
+}
+
+// checkNotRaft returns an error for shards replicated with Raft, which cannot take part in migrations or primary/backup replication
+// The caller must hold the shard's lock
+func (shard *Shard) checkNotRaft() error {
+	if shard.group != nil {
+		return errRaftShard
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package server_test
+
+import (
+	"kvstore/pkg/raft"
+	kvstore "kvstore/pkg/server"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startRaftGroup starts n single-shard servers whose shards form a Raft group on a simulated network
+func startRaftGroup(t *testing.T, n int) ([]*kvstore.KVServer, *raft.Network) {
+	network := raft.NewNetwork()
+	stores := make([]*kvstore.KVServer, n)
+	for i := range n {
+		store, err := kvstore.NewKVServer(1, nil)
+		if err != nil {
+			t.Fatalf("NewKVServer failed: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+
+		rf, err := store.JoinRaft(0, network.Peers(i, n), i, raft.NewMemoryPersister())
+		if err != nil {
+			t.Fatalf("JoinRaft failed: %v", err)
+		}
+		network.Register(i, rf)
+		stores[i] = store
+	}
+	return stores, network
+}
+
+// setOnLeader retries a Set on every connected server until the leader accepts it and returns the leader's index
+func setOnLeader(t *testing.T, stores []*kvstore.KVServer, skip int, key string, value string) int {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, store := range stores {
+			if i == skip {
+				continue
+			}
+			if err := store.Set(&kvstore.SetArgs{Key: key, Value: []byte(value)}, &kvstore.SetReply{}); err == nil {
+				return i
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("No leader accepted Set of key %s", key)
+	return -1
+}
+
+// getOnLeader retries a Get on every server until the leader answers it
+func getOnLeader(t *testing.T, stores []*kvstore.KVServer, key string) *kvstore.GetReply {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, store := range stores {
+			reply := &kvstore.GetReply{}
+			if err := store.Get(&kvstore.GetArgs{Key: key}, reply); err == nil {
+				return reply
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("No leader answered Get of key %s", key)
+	return nil
+}
+
+func TestRaftShardFailover(t *testing.T) {
+	stores, network := startRaftGroup(t, 3)
+
+	leader := setOnLeader(t, stores, -1, "key", "first")
+	for i, store := range stores {
+		if i == leader {
+			continue
+		}
+		err := store.Set(&kvstore.SetArgs{Key: "key", Value: []byte("rejected")}, &kvstore.SetReply{})
+		if !kvstore.IsStaleRoute(err) {
+			t.Errorf("Expected follower %d to reject writes as not primary, got %v", i, err)
+		}
+	}
+
+	// The disconnected leader cannot commit, and the remaining majority elects a new leader that accepts writes
+	network.Disconnect(leader)
+	if err := stores[leader].Set(&kvstore.SetArgs{Key: "key", Value: []byte("lost")}, &kvstore.SetReply{}); err == nil {
+		t.Errorf("Expected the disconnected leader to fail to commit a write")
+	}
+	newLeader := setOnLeader(t, stores, leader, "key", "second")
+	if newLeader == leader {
+		t.Fatalf("Expected a new leader after disconnecting server %d", leader)
+	}
+
+	// Once reconnected, the old leader follows the new one and reads see the latest write
+	network.Connect(leader)
+	if reply := getOnLeader(t, stores, "key"); !reply.Exists || string(reply.Value) != "second" {
+		t.Errorf("Expected value 'second', got %q (exists %v)", reply.Value, reply.Exists)
+	}
+
+	// Only the leader counts the group's keys
+	setOnLeader(t, stores, -1, "other", "value")
+	total := 0
+	for _, store := range stores {
+		reply := &kvstore.LengthReply{}
+		if err := store.Length(&kvstore.LengthArgs{}, reply); err != nil {
+			t.Fatalf("Length failed: %v", err)
+		}
+		total += reply.Length
+	}
+	if total != 2 {
+		t.Errorf("Expected the group to count 2 keys once, got %d", total)
+	}
+}
+
+func TestRaftShardUnreliableNetwork(t *testing.T) {
+	stores, network := startRaftGroup(t, 3)
+	network.SetReliable(false)
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setOnLeader(t, stores, -1, "key"+strconv.Itoa(i), strconv.Itoa(i))
+		}()
+	}
+	wg.Wait()
+
+	network.SetReliable(true)
+	for i := range 10 {
+		reply := getOnLeader(t, stores, "key"+strconv.Itoa(i))
+		if !reply.Exists || string(reply.Value) != strconv.Itoa(i) {
+			t.Errorf("Expected key%d to hold %d, got %q (exists %v)", i, i, reply.Value, reply.Exists)
+		}
+	}
+}
+
+func TestRaftCompareAndSwap(t *testing.T) {
+	stores, _ := startRaftGroup(t, 3)
+
+	setOnLeader(t, stores, -1, "counter", "1")
+	current := getOnLeader(t, stores, "counter")
+	if current.Version == 0 {
+		t.Fatalf("Expected the key to have a version")
+	}
+
+	// Every member compares the version when it applies the command, so only the first of two swaps from the same version succeeds
+	for i, want := range []bool{true, false} {
+		var reply *kvstore.CompareAndSwapReply
+		deadline := time.Now().Add(10 * time.Second)
+		for reply == nil && time.Now().Before(deadline) {
+			for _, store := range stores {
+				attempt := &kvstore.CompareAndSwapReply{}
+				args := &kvstore.CompareAndSwapArgs{Key: "counter", ExpectedVersion: current.Version, Value: []byte(strconv.Itoa(i + 2))}
+				if err := store.CompareAndSwap(args, attempt); err == nil {
+					reply = attempt
+					break
+				}
+			}
+			if reply == nil {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		if reply == nil || reply.Swapped != want {
+			t.Errorf("Expected swap %d to return swapped=%v, got %+v", i, want, reply)
+		}
+	}
+
+	if reply := getOnLeader(t, stores, "counter"); string(reply.Value) != "2" || reply.Version <= current.Version {
+		t.Errorf("Expected value '2' at a version above %d, got '%s' at version %d", current.Version, reply.Value, reply.Version)
+	}
+}
+
+func TestRaftIncr(t *testing.T) {
+	stores, _ := startRaftGroup(t, 3)
+	setOnLeader(t, stores, -1, "text", "abc")
+
+	// incrOnLeader retries an increment on every member until the leader applies it
+	incrOnLeader := func(key string, requestID string) (int64, error) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, store := range stores {
+				reply := &kvstore.IncrReply{}
+				err := store.Incr(&kvstore.IncrArgs{Key: key, Delta: 1, RequestID: requestID}, reply)
+				if !kvstore.IsStaleRoute(err) {
+					return reply.Value, err
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return 0, kvstore.ErrNotPrimary
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := incrOnLeader("counter", ""); err != nil {
+				t.Errorf("Incr failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reply := getOnLeader(t, stores, "counter"); string(reply.Value) != "10" {
+		t.Errorf("Expected every increment to be applied once, got '%s'", reply.Value)
+	}
+	if _, err := incrOnLeader("text", ""); !kvstore.IsNotInteger(err) {
+		t.Errorf("Expected ErrNotInteger from the group, got %v", err)
+	}
+
+	// A retry with the same request ID is recognized by every member when it is applied, so the increment counts once
+	for range 2 {
+		if value, err := incrOnLeader("retried", "incr-1"); err != nil || value != 1 {
+			t.Errorf("Expected the retried increment to return 1, got %d, %v", value, err)
+		}
+	}
+	if reply := getOnLeader(t, stores, "retried"); string(reply.Value) != "1" {
+		t.Errorf("Expected the retried increment to be applied once, got '%s'", reply.Value)
+	}
+}
+
+func TestRaftTxn(t *testing.T) {
+	stores, _ := startRaftGroup(t, 3)
+	setOnLeader(t, stores, -1, "{order:1}:status", "open")
+
+	compares := []kvstore.TxnCompare{{Key: "{order:1}:status", Target: kvstore.CompareValue, Value: []byte("open")}}
+	ops := []kvstore.TxnOp{{Key: "{order:1}:status", Value: []byte("paid")}, {Key: "{order:1}:receipt", Value: []byte("r1")}}
+
+	// Every member checks the compares when it applies the transaction, so only the first of two identical ones succeeds
+	for i, want := range []bool{true, false} {
+		var reply *kvstore.TxnReply
+		deadline := time.Now().Add(10 * time.Second)
+		for reply == nil && time.Now().Before(deadline) {
+			for _, store := range stores {
+				attempt := &kvstore.TxnReply{}
+				if err := store.Txn(&kvstore.TxnArgs{Compares: compares, Ops: ops}, attempt); err == nil {
+					reply = attempt
+					break
+				}
+			}
+			if reply == nil {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		if reply == nil || reply.Succeeded != want {
+			t.Errorf("Expected transaction %d to return succeeded=%v, got %+v", i, want, reply)
+		}
+	}
+
+	if reply := getOnLeader(t, stores, "{order:1}:receipt"); string(reply.Value) != "r1" {
+		t.Errorf("Expected the receipt 'r1', got '%s'", reply.Value)
+	}
+}
@@ -0,0 +1,141 @@
+// consistency.go
+// This file contains the server side of tunable consistency, where clients write to and read from every replica of a shard themselves
+// Each write carries the client's timestamp, and replicas keep the newest write of every key, with deletes kept as tombstones
+// Replicas do not forward these writes to each other, so a client decides per call how many replicas must acknowledge it
+package server
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ReplicaSet is an RPC method that applies a timestamped write sent by a client to one replica of a shard
+// It is accepted by primaries and backups, and writes older than the key's current write are acknowledged without being applied
+// The write is logged and forwarded to migrations like any other write, but not to backups since the client writes to them directly
+// Like Set, writes of keys locked by a prepared distributed transaction are rejected with ErrKeyLocked
+func (store *KVServer) ReplicaSet(args *ReplicaSetArgs, reply *ReplicaSetReply) error {
+	if args.Timestamp <= 0 {
+		return fmt.Errorf("timestamp of key %s must be greater than 0, got: %d", args.Key, args.Timestamp)
+	}
+	if err := store.checkValueSize(args.Key, args.Value); err != nil {
+		return err
+	}
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkReplica(args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkUnlocked(args.Key); err != nil {
+		return err
+	}
+
+	record := &walRecord{Op: walOpSet, Key: args.Key, Value: args.Value, Timestamp: args.Timestamp}
+	if args.Delete {
+		record = &walRecord{Op: walOpDelete, Key: args.Key, Timestamp: args.Timestamp}
+	}
+	if !shard.supersedes(record) {
+		return nil
+	}
+
+	if err := shard.commitReplica(record); err != nil {
+		return fmt.Errorf("failed to write key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	return nil
+}
+
+// ReplicaGet is an RPC method that reads a key from one replica of a shard along with the timestamp of its latest write
+// It is answered by primaries and backups, so the value may be older than the newest acknowledged write
+func (store *KVServer) ReplicaGet(args *ReplicaGetArgs, reply *ReplicaGetReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkReplica(args.Key); err != nil {
+		return err
+	}
+
+	*reply = shard.current(args.Key)
+	return nil
+}
+
+// Newer reports whether a reply holds a newer write of its key than another reply
+// Later timestamps win, and writes with equal timestamps are ordered so that every replica picks the same one
+// Deletes win over sets with the same timestamp, and between two sets the greater value wins
+func (reply *ReplicaGetReply) Newer(other *ReplicaGetReply) bool {
+	if reply.Timestamp != other.Timestamp {
+		return reply.Timestamp > other.Timestamp
+	}
+	if reply.Exists != other.Exists {
+		return !reply.Exists
+	}
+	return bytes.Compare(reply.Value, other.Value) > 0
+}
+
+// checkReplica returns ErrKeyMoved if the key's range has been migrated away from the shard
+// Unlike checkOwnership it accepts backups, which serve requests at a consistency level like their primary
+// The caller must hold the shard's lock
+func (shard *Shard) checkReplica(key string) error {
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	if len(shard.moved) > 0 && shard.moved.ContainsKey(key) {
+		return fmt.Errorf("%v: %s", ErrKeyMoved, key)
+	}
+	return nil
+}
+
+// current returns the shard's value of a key together with the timestamp of the write that produced it
+// The caller must hold the shard's lock
+func (shard *Shard) current(key string) ReplicaGetReply {
+	value, exists := shard.data[key]
+	return ReplicaGetReply{Value: value, Exists: exists, Timestamp: shard.stamps[key]}
+}
+
+// supersedes reports whether a timestamped write is newer than the shard's current write of its key
+// The caller must hold the shard's lock
+func (shard *Shard) supersedes(record *walRecord) bool {
+	incoming := ReplicaGetReply{Value: record.Value, Exists: record.Op == walOpSet, Timestamp: record.Timestamp}
+	current := shard.current(record.Key)
+	return !current.Newer(&incoming)
+}
+
+// commitReplica logs and applies a timestamped write and forwards it to migration destinations
+// The caller must hold the shard's write lock
+func (shard *Shard) commitReplica(record *walRecord) error {
+	if err := shard.resyncMigrations([]*walRecord{record}); err != nil {
+		return err
+	}
+	shard.assignVersion(record)
+	if err := shard.logMutation(record); err != nil {
+		return fmt.Errorf("failed to log write of key %s: %v", record.Key, err)
+	}
+	shard.apply(record)
+
+	return shard.forwardToMigrations([]*walRecord{record})
+}
@@ -0,0 +1,91 @@
+package server_test
+
+import (
+	"bytes"
+	kvstore "kvstore/pkg/server"
+	"math"
+	"testing"
+)
+
+func TestReplicaLastWriteWins(t *testing.T) {
+	config := &kvstore.Config{DataDir: t.TempDir(), SyncPolicy: kvstore.SyncAlways, SnapshotRetention: 1}
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+
+	writes := []kvstore.ReplicaSetArgs{
+		{Key: "a", Value: []byte("new"), Timestamp: 20},
+		{Key: "a", Value: []byte("old"), Timestamp: 10},
+		{Key: "b", Value: []byte("set"), Timestamp: 10},
+		{Key: "b", Delete: true, Timestamp: 30},
+		{Key: "b", Value: []byte("stale"), Timestamp: 25},
+		{Key: "c", Value: []byte("x"), Timestamp: 10},
+		{Key: "c", Value: []byte("y"), Timestamp: 10},
+	}
+	for _, args := range writes {
+		if err := store.ReplicaSet(&args, &kvstore.ReplicaSetReply{}); err != nil {
+			t.Fatalf("ReplicaSet failed: %v", err)
+		}
+	}
+
+	check := func(store *kvstore.KVServer, key string, want kvstore.ReplicaGetReply) {
+		t.Helper()
+		reply := &kvstore.ReplicaGetReply{}
+		if err := store.ReplicaGet(&kvstore.ReplicaGetArgs{Key: key}, reply); err != nil {
+			t.Fatalf("ReplicaGet failed: %v", err)
+		}
+		if !bytes.Equal(reply.Value, want.Value) || reply.Exists != want.Exists || reply.Timestamp != want.Timestamp {
+			t.Errorf("Expected %+v for key %s, got %+v", want, key, *reply)
+		}
+	}
+
+	// Older writes are ignored, deletes keep their timestamp, and ties are broken by value
+	check(store, "a", kvstore.ReplicaGetReply{Value: []byte("new"), Exists: true, Timestamp: 20})
+	check(store, "b", kvstore.ReplicaGetReply{Timestamp: 30})
+	check(store, "c", kvstore.ReplicaGetReply{Value: []byte("y"), Exists: true, Timestamp: 10})
+
+	// Timestamps and tombstones survive snapshots and recovery
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	store.Close()
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	recovered.ReplicaSet(&kvstore.ReplicaSetArgs{Key: "b", Value: []byte("stale"), Timestamp: 29}, &kvstore.ReplicaSetReply{})
+	check(recovered, "a", kvstore.ReplicaGetReply{Value: []byte("new"), Exists: true, Timestamp: 20})
+	check(recovered, "b", kvstore.ReplicaGetReply{Timestamp: 30})
+}
+
+func TestResyncKeepsReplicaWrites(t *testing.T) {
+	backup, _ := kvstore.NewKVServer(1, nil)
+
+	backup.Set(&kvstore.SetArgs{Key: "stale", Value: []byte("x")}, &kvstore.SetReply{})
+	backup.ReplicaSet(&kvstore.ReplicaSetArgs{Key: "quorum", Value: []byte("new"), Timestamp: 20}, &kvstore.ReplicaSetReply{})
+	backup.ReplicaSet(&kvstore.ReplicaSetArgs{Key: "deleted", Delete: true, Timestamp: 20}, &kvstore.ReplicaSetReply{})
+
+	// A primary clears its backup before syncing it, and the writes clients sent only to the backup survive its older copy
+	dropArgs := &kvstore.DropRangesArgs{Ranges: []kvstore.HashRange{{Start: 0, End: math.MaxUint64}}, KeepTimestamped: true}
+	if err := backup.DropRanges(dropArgs, &kvstore.DropRangesReply{}); err != nil {
+		t.Fatalf("DropRanges failed: %v", err)
+	}
+	copyArgs := &kvstore.ImportArgs{Entries: []kvstore.Entry{
+		{Key: "quorum", Value: []byte("old"), Timestamp: 10},
+		{Key: "deleted", Value: []byte("old"), Timestamp: 10},
+	}}
+	if err := backup.Import(copyArgs, &kvstore.ImportReply{}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	for key, want := range map[string]string{"stale": "", "quorum": "new", "deleted": ""} {
+		reply := &kvstore.GetReply{}
+		backup.Get(&kvstore.GetArgs{Key: key}, reply)
+		if reply.Exists != (want != "") || string(reply.Value) != want {
+			t.Errorf("Expected '%s' for key %s, got '%s' (exists=%v)", want, key, reply.Value, reply.Exists)
+		}
+	}
+}
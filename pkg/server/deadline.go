@@ -0,0 +1,38 @@
+// deadline.go
+// This file contains the deadlines of client requests
+// Clients send the time they are still willing to wait along with a request, and the server turns it into a deadline when the request arrives
+// Handlers check the deadline once they hold the shard's lock, so requests that waited too long behind other requests are dropped instead of applied
+// Requests without a timeout never expire
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrDeadlineExceeded is returned for requests whose caller stopped waiting before the server got to them
+// net/rpc only transmits the error message, so callers should test for it with IsDeadlineExceeded
+var ErrDeadlineExceeded = errors.New("request deadline exceeded")
+
+// IsDeadlineExceeded reports whether an error returned by a server means the request expired before it was handled
+func IsDeadlineExceeded(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrDeadlineExceeded.Error())
+}
+
+// requestDeadline returns the time by which a request with the given timeout has to be handled, or the zero time if it has none
+func requestDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// checkDeadline returns ErrDeadlineExceeded if a request's deadline has passed
+func checkDeadline(deadline time.Time, key string) error {
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return fmt.Errorf("%v: %s", ErrDeadlineExceeded, key)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// dedup.go
+// This file contains the deduplication of retried client writes
+// Clients give every Set and Delete a request ID and keep it when they retry, for example after a connection broke before the reply arrived
+// A shard remembers the IDs of the writes it applied for a while and acknowledges a retry without applying the write a second time
+// That way a retry cannot overwrite a newer write another client made in the meantime
+// Read-modify-writes also remember their outcome, so that a retry gets the reply the write had instead of one computed from the key's current value
+// The IDs are kept in memory on the shard that applied the write, so a retry that reaches another shard after a failover is applied again
+// Shards in a Raft group are the exception, every member remembers the IDs of the writes in the group's log when it applies them, and their snapshots carry the IDs along
+package server
+
+import (
+	"time"
+)
+
+// requestWindow is how long a shard remembers the ID of an applied write
+// Clients stop retrying long before it ends
+const requestWindow = 5 * time.Minute
+
+// An appliedRequest is the ID of an applied write, the time in Unix nanoseconds it was applied, and the outcome of read-modify-writes
+// Its fields are exported so that Raft snapshots can carry it
+type appliedRequest struct {
+	ID       string
+	Time     int64
+	Previous []byte
+	Existed  bool
+	Value    []byte
+}
+
+// A requestLog holds the writes a shard applied within the request window by their ID, and in the order they were applied
+type requestLog struct {
+	ids   map[string]*appliedRequest
+	order []*appliedRequest
+}
+
+// applied reports whether the shard has already applied the write with the given request ID
+// Writes without an ID are never considered applied
+// The caller must hold the shard's lock
+func (shard *Shard) applied(requestID string) bool {
+	_, applied := shard.appliedResult(requestID)
+	return applied
+}
+
+// appliedResult returns the outcome of the write with the given request ID if the shard has already applied it
+// The outcome is empty for writes other than read-modify-writes
+// The caller must hold the shard's lock
+func (shard *Shard) appliedResult(requestID string) (modification, bool) {
+	if requestID == "" || shard.requests.ids == nil {
+		return modification{}, false
+	}
+	request, exists := shard.requests.ids[requestID]
+	if !exists {
+		return modification{}, false
+	}
+	return modification{previous: request.Previous, existed: request.Existed, value: request.Value}, true
+}
+
+// remember records the request ID of an applied write and forgets the IDs that are older than the request window
+// The caller must hold the shard's write lock
+func (shard *Shard) remember(requestID string) {
+	shard.rememberAt(requestID, time.Now(), modification{})
+}
+
+// rememberAt is remember for a write applied at the given time with the given outcome
+// Members of a Raft group pass the write's commit time, so that they all forget the same IDs
+// The caller must hold the shard's write lock
+func (shard *Shard) rememberAt(requestID string, now time.Time, result modification) {
+	if requestID == "" {
+		return
+	}
+	shard.record(&appliedRequest{ID: requestID, Time: now.UnixNano(), Previous: result.previous, Existed: result.existed, Value: result.value})
+}
+
+// record adds an applied write to the request log and forgets the writes that are older than the request window
+// The caller must hold the shard's write lock
+func (shard *Shard) record(request *appliedRequest) {
+	if shard.requests.ids == nil {
+		shard.requests.ids = make(map[string]*appliedRequest)
+	}
+
+	expired := 0
+	for expired < len(shard.requests.order) && request.Time-shard.requests.order[expired].Time > int64(requestWindow) {
+		delete(shard.requests.ids, shard.requests.order[expired].ID)
+		expired++
+	}
+	shard.requests.order = append(shard.requests.order[expired:], request)
+	shard.requests.ids[request.ID] = request
+}
+
+// appliedRequests returns the writes in the request log in the order they were applied, for Raft snapshots
+// The caller must hold the shard's lock
+func (shard *Shard) appliedRequests() []*appliedRequest {
+	return append([]*appliedRequest(nil), shard.requests.order...)
+}
+
+// restoreRequests replaces the request log with the writes of a Raft snapshot
+// The caller must hold the shard's write lock
+func (shard *Shard) restoreRequests(requests []*appliedRequest) {
+	shard.requests = requestLog{}
+	for _, request := range requests {
+		shard.record(request)
+	}
+}
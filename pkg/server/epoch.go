@@ -0,0 +1,41 @@
+// epoch.go
+// This file contains the epoch check that lets clients cache the route table
+// The router numbers every version of its route table with an increasing epoch and announces each new epoch to the servers
+// Clients stamp their requests with the epoch of the table they routed them with, and servers reject requests stamped with an older epoch than the latest announced one
+// Requests without an epoch are not checked, the ownership checks of the shards still catch them if their route is stale
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrStaleEpoch is returned for requests routed with an older route table than the router's latest one
+// net/rpc only transmits the error message, so callers should test for it with IsStaleEpoch or IsStaleRoute
+var ErrStaleEpoch = errors.New("route table epoch is stale")
+
+// IsStaleEpoch reports whether an error returned by a server means the client's route table is out of date
+func IsStaleEpoch(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrStaleEpoch.Error())
+}
+
+// AdvanceEpoch is an RPC method that the router calls after every change of its route table
+// Epochs only ever increase, so announcements that arrive out of order are ignored
+func (store *KVServer) AdvanceEpoch(args *AdvanceEpochArgs, reply *AdvanceEpochReply) error {
+	for {
+		current := store.epoch.Load()
+		if args.Epoch <= current || store.epoch.CompareAndSwap(current, args.Epoch) {
+			return nil
+		}
+	}
+}
+
+// checkEpoch returns ErrStaleEpoch if a request was routed with an older route table than the latest one announced to the server
+// A zero epoch marks a request that was not routed with a cached table, which is always accepted
+func (store *KVServer) checkEpoch(epoch int64) error {
+	if current := store.epoch.Load(); epoch != 0 && epoch < current {
+		return fmt.Errorf("%v: got %d, current %d", ErrStaleEpoch, epoch, current)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+// expiry.go
+// This file contains key expiry, which lets keys set with a time to live disappear once it has passed
+// A key's expiry is stored as an absolute time, so it means the same on backups, after migrations, and after a restart
+// Expired keys are hidden from reads right away and deleted by a background reaper, which samples a bounded number of keys with an expiry per shard and tick
+// Reaped keys are deleted like any other write, so the deletes are logged and forwarded to backups and migrations
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// defaultReapInterval is how often the reaper runs if the config does not set it
+	defaultReapInterval = 100 * time.Millisecond
+	// defaultReapBatchSize is how many keys with an expiry the reaper samples per shard and tick if the config does not set it
+	// Each tick holds a shard's lock only for the time it takes to look at this many keys
+	defaultReapBatchSize = 20
+)
+
+// Expire is an RPC method that sets the time to live of an existing key, a zero TTL removes its expiry so that it persists
+// The reply reports whether the key exists, keys that do not are left alone
+func (store *KVServer) Expire(args *ExpireArgs, reply *ExpireReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	record := &walRecord{Op: walOpExpire, Key: args.Key, Timestamp: time.Now().UnixNano(), ExpiresAt: expiresAt(args.TTL)}
+	if shard.isRaft() {
+		result, err := shard.propose(record, deadline)
+		if err != nil {
+			return fmt.Errorf("failed to expire key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+		}
+		reply.Exists = result.succeeded
+		return nil
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkOwnership(args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkUnlocked(args.Key); err != nil {
+		return err
+	}
+	if _, exists := shard.lookup(args.Key); !exists {
+		return nil
+	}
+
+	if err := shard.commit(record); err != nil {
+		return fmt.Errorf("failed to expire key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	reply.Exists = true
+	return nil
+}
+
+// TTL is an RPC method that returns the time a key has left to live
+// The reply reports whether the key exists, and a zero TTL means that it never expires
+func (store *KVServer) TTL(args *TTLArgs, reply *TTLReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	var expiry int64
+	if shard.isRaft() {
+		result, err := shard.propose(&walRecord{Op: walOpGet, Key: args.Key}, deadline)
+		if err != nil {
+			return err
+		}
+		reply.Exists, expiry = result.exists, result.expiresAt
+	} else {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+
+		if err := checkDeadline(deadline, args.Key); err != nil {
+			return err
+		}
+		if err := shard.checkOwnership(args.Key); err != nil {
+			return err
+		}
+		_, reply.Exists = shard.lookup(args.Key)
+		expiry = shard.expiries[args.Key]
+	}
+
+	if reply.Exists && expiry != 0 {
+		reply.TTL = max(time.Until(time.Unix(0, expiry)), 1)
+	}
+	return nil
+}
+
+// expiresAt returns the expiry of a key written now with the given time to live, or zero if the TTL is not positive
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// expired reports whether a key has an expiry that has passed by the given time in Unix nanoseconds
+// The caller must hold the shard's lock
+func (shard *Shard) expired(key string, now int64) bool {
+	expiry, exists := shard.expiries[key]
+	return exists && expiry <= now
+}
+
+// lookup returns the value of a key unless it is missing or has expired
+// The caller must hold the shard's lock
+func (shard *Shard) lookup(key string) ([]byte, bool) {
+	value, exists := shard.data[key]
+	if !exists || shard.expired(key, time.Now().UnixNano()) {
+		return nil, false
+	}
+	return value, true
+}
+
+// liveLength returns the number of keys in the shard that have not expired
+// The caller must hold the shard's lock
+func (shard *Shard) liveLength() int {
+	now := time.Now().UnixNano()
+	length := len(shard.data)
+	for key := range shard.expiries {
+		if shard.expired(key, now) {
+			length--
+		}
+	}
+	return length
+}
+
+// applyExpiry sets or removes the expiry of a key as recorded by an expire record
+// Records that carry a timestamp leave keys alone that are missing or have expired by then, so that every replica of a Raft group decides the same way
+// The new expiry is added to the key's history as a version with the same value, so reads at earlier times keep the old expiry
+// The caller must hold the shard's write lock
+func (shard *Shard) applyExpiry(record *walRecord) bool {
+	value, exists := shard.data[record.Key]
+	if !exists {
+		return false
+	}
+	if record.Timestamp != 0 && shard.expired(record.Key, record.Timestamp) {
+		return false
+	}
+	shard.setExpiry(record.Key, record.ExpiresAt)
+
+	committedAt := record.CommittedAt
+	if committedAt == 0 {
+		committedAt = time.Now().UnixNano()
+	}
+	shard.recordVersion(record.Key, keyVersion{Value: value, Version: shard.versions[record.Key], ExpiresAt: record.ExpiresAt, CommittedAt: committedAt})
+	return true
+}
+
+// setExpiry sets the expiry of a key, or removes it if the expiry is zero
+// The caller must hold the shard's write lock
+func (shard *Shard) setExpiry(key string, expiry int64) {
+	if expiry == 0 {
+		delete(shard.expiries, key)
+		return
+	}
+	if shard.expiries == nil {
+		shard.expiries = make(map[string]int64)
+	}
+	shard.expiries[key] = expiry
+}
+
+// reapLoop deletes expired keys from every shard on a fixed interval until the server is closed
+func (store *KVServer) reapLoop(interval time.Duration, batchSize int) {
+	defer close(store.reapDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, shard := range store.allShards() {
+				if shard != nil {
+					shard.reap(batchSize)
+				}
+			}
+		case <-store.reapStop:
+			return
+		}
+	}
+}
+
+// reap samples up to batchSize keys with an expiry and deletes the ones that have expired
+// Sampling happens under the read lock, and the write lock is only taken if there is something to delete
+// Only primaries and Raft leaders reap, the other replicas receive the deletes through replication
+// Keys locked by a distributed transaction are left for a later tick
+func (shard *Shard) reap(batchSize int) {
+	now := time.Now().UnixNano()
+
+	shard.mu.RLock()
+	serving := shard.primary || shard.raftLeader()
+	raft := shard.group != nil
+	var keys []string
+	if serving {
+		sampled := 0
+		for key, expiry := range shard.expiries {
+			if sampled == batchSize {
+				break
+			}
+			sampled++
+			if expiry <= now {
+				keys = append(keys, key)
+			}
+		}
+	}
+	shard.mu.RUnlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	// Members of a Raft group check the expiry again when they apply the delete, against the time the leader sampled it
+	if raft {
+		for _, key := range keys {
+			if _, err := shard.propose(&walRecord{Op: walOpReap, Key: key, Timestamp: now}, time.Time{}); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if !shard.primary {
+		return
+	}
+	records := make([]*walRecord, 0, len(keys))
+	for _, key := range keys {
+		if shard.expired(key, now) && shard.checkUnlocked(key) == nil {
+			records = append(records, &walRecord{Op: walOpDelete, Key: key})
+		}
+	}
+	if err := shard.commit(records...); err != nil {
+		log.Printf("Error deleting expired keys: %v", err)
+	}
+}
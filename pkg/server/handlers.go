@@ -1,41 +1,124 @@
 // handlers.go
 // This file contains the implementation of the RPC handlers for the key-value store server
-// It provides methods to set, get, delete, check existence, and get the length of keys in the store
+// It provides methods to set, get, delete, check existence, and get the length of keys in the store, and a ping for connection health checks
+// Increments, appends, and get-and-sets read and write a key under the shard's lock, so that they are atomic without a compare-and-swap loop
 package server
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrNotInteger is returned by increments and decrements of keys whose value is not a base 10 integer, or whose result would overflow
+// net/rpc only transmits the error message, so callers should test for it with IsNotInteger
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+// IsNotInteger reports whether an error returned by a server means that a numeric operation was applied to a value that is not an integer
+func IsNotInteger(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrNotInteger.Error())
+}
+
 // Set is an RPC method that sets a key-value pair in the store based on the provided ShardIdx
+// The mutation is written to the shard's log before it becomes visible
+// If the key's range is being migrated, the write is also forwarded to the shard taking it over
+// The write is forwarded to every backup of the shard before the call returns
+// On shards in a Raft group, the write returns once it has been committed to the group's log and applied
+// A request whose timeout has passed by the time it gets the shard's lock is rejected without being applied
+// A retry of a write the shard has already applied, recognized by its request ID, is acknowledged without applying it again
+// A positive TTL makes the key expire once it has passed, and a write without one removes any earlier expiry
+// Values larger than the server's maximum value size are rejected with ErrValueTooLarge
+// Keys locked by a prepared distributed transaction are rejected with ErrKeyLocked until it commits or aborts
 func (store *KVServer) Set(args *SetArgs, reply *SetReply) error {
-	shard := store.shards[args.ShardIdx]
-	if shard == nil {
-		return fmt.Errorf("shard %d not found", args.ShardIdx)
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+	if err := store.checkValueSize(args.Key, args.Value); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	record := &walRecord{Op: walOpSet, Key: args.Key, Value: args.Value, ExpiresAt: expiresAt(args.TTL)}
+	if shard.isRaft() {
+		record.RequestID = args.RequestID
+		if _, err := shard.propose(record, deadline); err != nil {
+			return fmt.Errorf("failed to set key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+		}
+		return nil
 	}
 
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	shard.data[args.Key] = args.Value
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkOwnership(args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkUnlocked(args.Key); err != nil {
+		return err
+	}
+	if shard.applied(args.RequestID) {
+		return nil
+	}
+
+	if err := shard.commitLocally(record); err != nil {
+		return fmt.Errorf("failed to set key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	shard.remember(args.RequestID)
+	if err := shard.forward([]*walRecord{record}); err != nil {
+		return fmt.Errorf("failed to set key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
 
 	return nil
 }
 
 // Get is an RPC method that retrieves a value by its key from the store based on the provided ShardIdx
-// It returns the value and a boolean indicating if the key exists
+// It returns the value and a boolean indicating if the key exists, keys that have expired are reported as missing
+// On shards in a Raft group, the read is ordered through the group's log so that it never returns a stale value
 func (store *KVServer) Get(args *GetArgs, reply *GetReply) error {
-	shard := store.shards[args.ShardIdx]
-	if shard == nil {
-		return fmt.Errorf("shard %d not found", args.ShardIdx)
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	if shard.isRaft() {
+		result, err := shard.propose(&walRecord{Op: walOpGet, Key: args.Key}, deadline)
+		if err != nil {
+			return err
+		}
+		reply.Value, reply.Exists, reply.Version = result.value, result.exists, result.version
+		return nil
 	}
 
 	shard.mu.RLock()
 	defer shard.mu.RUnlock()
 
-	value, exists := shard.data[args.Key]
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkOwnership(args.Key); err != nil {
+		return err
+	}
+
+	value, exists := shard.lookup(args.Key)
 	if exists {
 		reply.Value = value
+		reply.Version = shard.versions[args.Key]
 	}
 	reply.Exists = exists
 
@@ -44,46 +127,309 @@ func (store *KVServer) Get(args *GetArgs, reply *GetReply) error {
 
 // Delete is an RPC method that deletes a key from the store based on the provided ShardIdx
 // It removes the key from the map if it is there
+// Deletes of missing keys are not logged since they do not change the shard
+// Like Set, retries of a delete the shard has already applied are acknowledged without applying them again
 func (store *KVServer) Delete(args *DeleteArgs, reply *DeleteReply) error {
-	shard := store.shards[args.ShardIdx]
-	if shard == nil {
-		return fmt.Errorf("shard %d not found", args.ShardIdx)
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	record := &walRecord{Op: walOpDelete, Key: args.Key}
+	if shard.isRaft() {
+		record.RequestID = args.RequestID
+		if _, err := shard.propose(record, deadline); err != nil {
+			return fmt.Errorf("failed to delete key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+		}
+		return nil
 	}
 
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	delete(shard.data, args.Key)
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkOwnership(args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkUnlocked(args.Key); err != nil {
+		return err
+	}
+	if shard.applied(args.RequestID) {
+		return nil
+	}
+	if _, exists := shard.lookup(args.Key); !exists {
+		shard.remember(args.RequestID)
+		return nil
+	}
+
+	if err := shard.commitLocally(record); err != nil {
+		return fmt.Errorf("failed to delete key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	shard.remember(args.RequestID)
+	if err := shard.forward([]*walRecord{record}); err != nil {
+		return fmt.Errorf("failed to delete key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
 
 	return nil
 }
 
 // Exists is an RPC method that checks if a key exists in the store based on the provided ShardIdx
 func (store *KVServer) Exists(args *ExistsArgs, reply *ExistsReply) error {
-	shard := store.shards[args.ShardIdx]
-	if shard == nil {
-		return fmt.Errorf("shard %d not found", args.ShardIdx)
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	if shard.isRaft() {
+		result, err := shard.propose(&walRecord{Op: walOpGet, Key: args.Key}, deadline)
+		if err != nil {
+			return err
+		}
+		reply.Exists = result.exists
+		return nil
 	}
 
 	shard.mu.RLock()
 	defer shard.mu.RUnlock()
 
-	_, exists := shard.data[args.Key]
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return err
+	}
+	if err := shard.checkOwnership(args.Key); err != nil {
+		return err
+	}
+
+	_, exists := shard.lookup(args.Key)
 	reply.Exists = exists
 
 	return nil
 }
 
-// Length is an RPC method that returns the total number of key-value pairs across all shards
-// It sums the lengths of all shards' maps
+// Incr is an RPC method that adds a delta to the integer value of a key and returns the new value
+// Missing keys count as zero, values that are not base 10 integers are rejected with ErrNotInteger, and so are results that overflow
+// The value is read and written under the shard's lock, so concurrent increments are never lost, and the key keeps its expiry
+// A retry of an increment the shard has already applied returns the value the increment produced without applying it again
+func (store *KVServer) Incr(args *IncrArgs, reply *IncrReply) error {
+	value, err := store.increment(args.Key, args.Delta, args.ShardIdx, args.Epoch, args.Timeout, args.RequestID)
+	if err != nil {
+		return err
+	}
+	reply.Value = value
+	return nil
+}
+
+// Decr is an RPC method that subtracts a delta from the integer value of a key and returns the new value
+// It is Incr with the negated delta
+func (store *KVServer) Decr(args *DecrArgs, reply *DecrReply) error {
+	if args.Delta == math.MinInt64 {
+		return fmt.Errorf("%v: decrement of key %s overflows", ErrNotInteger, args.Key)
+	}
+	value, err := store.increment(args.Key, -args.Delta, args.ShardIdx, args.Epoch, args.Timeout, args.RequestID)
+	if err != nil {
+		return err
+	}
+	reply.Value = value
+	return nil
+}
+
+// Append is an RPC method that appends a suffix to the value of a key and returns the length of the new value
+// Missing keys are created with the suffix as their value, and the key keeps its expiry
+// Values that would grow larger than the server's maximum value size are rejected with ErrValueTooLarge
+func (store *KVServer) Append(args *AppendArgs, reply *AppendReply) error {
+	if err := store.checkValueSize(args.Key, args.Value); err != nil {
+		return err
+	}
+	record := &walRecord{Op: walOpAppend, Key: args.Key, Value: args.Value, MaxSize: uint64(store.maxValueSize()), Timestamp: time.Now().UnixNano()}
+	result, err := store.readModifyWrite(record, args.ShardIdx, args.Epoch, args.Timeout, args.RequestID)
+	if err != nil {
+		return fmt.Errorf("failed to append to key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	reply.Length = len(result.value)
+	return nil
+}
+
+// GetAndSet is an RPC method that sets a key and returns the value it replaced, along with whether the key existed
+// Like Set, it removes any expiry of the key
+func (store *KVServer) GetAndSet(args *GetAndSetArgs, reply *GetAndSetReply) error {
+	if err := store.checkValueSize(args.Key, args.Value); err != nil {
+		return err
+	}
+	record := &walRecord{Op: walOpGetAndSet, Key: args.Key, Value: args.Value, Timestamp: time.Now().UnixNano()}
+	result, err := store.readModifyWrite(record, args.ShardIdx, args.Epoch, args.Timeout, args.RequestID)
+	if err != nil {
+		return fmt.Errorf("failed to set key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	reply.Value, reply.Exists = result.previous, result.existed
+	return nil
+}
+
+// increment adds a delta to the integer value of a key in a shard and returns the new value
+func (store *KVServer) increment(key string, delta int64, shardIdx int, epoch int64, timeout time.Duration, requestID string) (int64, error) {
+	record := &walRecord{Op: walOpIncr, Key: key, Value: strconv.AppendInt(nil, delta, 10), Timestamp: time.Now().UnixNano()}
+	result, err := store.readModifyWrite(record, shardIdx, epoch, timeout, requestID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment key %s in shard %d: %v", key, shardIdx, err)
+	}
+	value, err := strconv.ParseInt(string(result.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %s", ErrNotInteger, key)
+	}
+	return value, nil
+}
+
+// readModifyWrite applies an increment, append, or get-and-set to a shard and returns the key's value before and after it
+// On shards in a Raft group the write is resolved when it is applied, so every member computes the same value and recognizes the same retries
+// A retry of a write the shard has already applied reports the outcome it had when it was applied
+func (store *KVServer) readModifyWrite(record *walRecord, shardIdx int, epoch int64, timeout time.Duration, requestID string) (modification, error) {
+	deadline := requestDeadline(timeout)
+	if err := store.checkEpoch(epoch); err != nil {
+		return modification{}, err
+	}
+
+	shard, err := store.getShard(shardIdx)
+	if err != nil {
+		return modification{}, err
+	}
+
+	if shard.isRaft() {
+		record.RequestID = requestID
+		result, err := shard.propose(record, deadline)
+		if err != nil {
+			return modification{}, err
+		}
+		if result.err != nil {
+			return modification{}, result.err
+		}
+		return modification{previous: result.previous, existed: result.exists, value: result.value}, nil
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := checkDeadline(deadline, record.Key); err != nil {
+		return modification{}, err
+	}
+	if err := shard.checkOwnership(record.Key); err != nil {
+		return modification{}, err
+	}
+	if err := shard.checkUnlocked(record.Key); err != nil {
+		return modification{}, err
+	}
+	if result, applied := shard.appliedResult(requestID); applied {
+		return result, nil
+	}
+
+	write, result, err := shard.modify(record)
+	if err != nil {
+		return modification{}, err
+	}
+	if err := shard.commitLocally(write); err != nil {
+		return modification{}, err
+	}
+	shard.rememberAt(requestID, time.Now(), result)
+	if err := shard.forward([]*walRecord{write}); err != nil {
+		return modification{}, err
+	}
+	return result, nil
+}
+
+// A modification is the outcome of a read-modify-write, the key's value before it and the value it wrote
+type modification struct {
+	previous []byte
+	existed  bool
+	value    []byte
+}
+
+// modify turns a read-modify-write into the set it stands for, along with its outcome
+// Like conditional writes, keys that have expired by the record's timestamp count as missing
+// The new value is always a new slice, stored values are shared with replies and forwarded writes and are never changed in place
+// The caller must hold the shard's lock
+func (shard *Shard) modify(record *walRecord) (*walRecord, modification, error) {
+	previous, existed := shard.data[record.Key]
+	expiresAt := shard.expiries[record.Key]
+	if existed && shard.expired(record.Key, record.Timestamp) {
+		previous, existed, expiresAt = nil, false, 0
+	}
+
+	var value []byte
+	switch record.Op {
+	case walOpIncr:
+		delta, err := strconv.ParseInt(string(record.Value), 10, 64)
+		if err != nil {
+			return nil, modification{}, fmt.Errorf("invalid delta %q for key %s", record.Value, record.Key)
+		}
+		var current int64
+		if existed {
+			if current, err = strconv.ParseInt(string(previous), 10, 64); err != nil {
+				return nil, modification{}, fmt.Errorf("%v: %s", ErrNotInteger, record.Key)
+			}
+		}
+		sum := current + delta
+		if (delta > 0 && sum < current) || (delta < 0 && sum > current) {
+			return nil, modification{}, fmt.Errorf("%v: increment of key %s overflows", ErrNotInteger, record.Key)
+		}
+		value = strconv.AppendInt(nil, sum, 10)
+	case walOpAppend:
+		if record.MaxSize > 0 && uint64(len(previous)+len(record.Value)) > record.MaxSize {
+			return nil, modification{}, fmt.Errorf("%v: %s would have %d bytes, limit is %d", ErrValueTooLarge, record.Key, len(previous)+len(record.Value), record.MaxSize)
+		}
+		value = make([]byte, 0, len(previous)+len(record.Value))
+		value = append(append(value, previous...), record.Value...)
+	case walOpGetAndSet:
+		value, expiresAt = record.Value, 0
+	default:
+		return nil, modification{}, fmt.Errorf("operation %d is not a read-modify-write", record.Op)
+	}
+
+	write := &walRecord{Op: walOpSet, Key: record.Key, Value: value, ExpiresAt: expiresAt}
+	return write, modification{previous: previous, existed: existed, value: value}, nil
+}
+
+// Length is an RPC method that returns the total number of key-value pairs across all primary shards
+// It sums the lengths of the primary shards' maps, backups are skipped so that replicated keys are only counted once
+// Shards in a Raft group are counted on their leader only
 func (store *KVServer) Length(args *LengthArgs, reply *LengthReply) error {
 	reply.Length = 0
 
-	for _, shard := range store.shards {
+	for _, shard := range store.allShards() {
+		if shard == nil {
+			continue
+		}
 		shard.mu.RLock()
-		reply.Length += len(shard.data)
+		if shard.primary || shard.raftLeader() {
+			reply.Length += shard.liveLength()
+		}
 		shard.mu.RUnlock()
 	}
 
 	return nil
 }
+
+// Ping is an RPC method that does nothing
+// Clients call it to check that an idle connection still reaches the server
+func (store *KVServer) Ping(args *PingArgs, reply *PingReply) error {
+	return nil
+}
+
+// getShard returns the shard with the given index or an error if the index is out of range
+func (store *KVServer) getShard(shardIdx int) (*Shard, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if shardIdx < 0 || shardIdx >= len(store.shards) || store.shards[shardIdx] == nil {
+		return nil, fmt.Errorf("shard %d not found", shardIdx)
+	}
+	return store.shards[shardIdx], nil
+}
@@ -4,35 +4,440 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // A Shard in the key-value store is a thread-safe map
 type Shard struct {
-	data map[string]string
+	data map[string][]byte
+	// keys holds the keys of the map in order for range scans
+	keys *skipList
+	// stamps holds the timestamps of writes made at a consistency level, deletes keep theirs as tombstones
+	stamps map[string]int64
+	// versions holds the revision of the write that produced each key, and revision counts up with every applied write
+	versions map[string]uint64
+	revision uint64
+	// expiries holds when keys set with a time to live stop being visible to reads
+	expiries map[string]int64
+	// wal records every mutation if persistence is enabled
+	wal *WAL
+	// outgoing holds the migrations of ranges being handed over, and moved the ranges already handed over
+	outgoing []*forwarder
+	moved    RangeSet
+	// Only primary shards serve clients, and they forward every write to their backups before acknowledging it
+	primary bool
+	backups []*forwarder
+	// group is the Raft group the shard applies committed commands from, if it joined one
+	group *raftGroup
+	// requests holds the IDs of recently applied client writes, so that retries of them are not applied twice
+	requests requestLog
+	// prepared and locks hold the distributed transactions the shard has prepared and the keys they lock
+	prepared map[string]*preparedTxn
+	locks    map[string]string
+	// txnRecords holds the transactions the shard is the primary of
+	txnRecords map[string]*txnRecord
+	// history holds the versions of every key back to the horizon for reads at a point in time
+	history map[string][]keyVersion
+	horizon int64
+	// clock only moves forward and gives commit times, safe wakes reads at a point in time when it moves or a transaction resolves
+	clock int64
+	safe  signal
+	// feed holds the latest changes for the clients watching the shard's keys
+	feed *changeFeed
 	mu   sync.RWMutex
 }
 
 // The KVServer is a list of shards
+// The server's own primaries come first, followed by the backup shards the router adds for other servers' shards
 type KVServer struct {
-	shards []*Shard
+	// Removed shards leave an empty slot so that the indexes of the other shards never change
+	shards            []*Shard
+	numShards         int
+	config            Config
+	dataDir           string
+	snapshotRetention int
+	// epoch is the latest route table epoch the router has announced, requests routed with an older table are rejected
+	epoch        atomic.Int64
+	snapshotMu   sync.Mutex
+	snapshotStop chan struct{}
+	snapshotDone chan struct{}
+	reapStop     chan struct{}
+	reapDone     chan struct{}
+	txnStop      chan struct{}
+	txnDone      chan struct{}
+	compactStop  chan struct{}
+	compactDone  chan struct{}
+	mu           sync.RWMutex
+}
+
+// Config holds the optional settings of a KVServer
+// A nil Config or an empty DataDir runs the server purely in memory, and zero values select the defaults
+type Config struct {
+	DataDir       string
+	SyncPolicy    SyncPolicy
+	SyncBatchSize int
+	SyncInterval  time.Duration
+	// A zero SnapshotInterval disables snapshots, in which case the logs are never truncated
+	SnapshotInterval  time.Duration
+	SnapshotRetention int
+	// Expired keys are reaped every ReapInterval, sampling at most ReapBatchSize keys per shard
+	ReapInterval  time.Duration
+	ReapBatchSize int
+	// Writes of values larger than MaxValueSize bytes are rejected, the default is 1 MiB and a negative size removes the limit
+	MaxValueSize int
+	// Distributed transactions prepared for longer than TxnTimeout are resolved without their coordinator, checked every TxnRecoveryInterval
+	TxnTimeout          time.Duration
+	TxnRecoveryInterval time.Duration
+	// Versions of keys replaced more than HistoryRetention ago are collected, the default is one minute
+	HistoryRetention time.Duration
+	// The change feed of every shard keeps its latest WatchBufferSize changes, the default is 1024
+	WatchBufferSize int
 }
 
 // NewShard initializes an empty Shard instance
 func NewShard() *Shard {
 	return &Shard{
-		data: make(map[string]string),
+		data:     make(map[string][]byte),
+		keys:     newSkipList(),
+		versions: make(map[string]uint64),
 	}
 }
 
 // NewKVServer initializes a new KVServer with the specified number of shards
-func NewKVServer(numShards int) *KVServer {
-	shards := make([]*Shard, numShards)
+// If a data directory is configured, each shard is restored from its latest snapshot and log before the server is returned
+func NewKVServer(numShards int, config *Config) (*KVServer, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.DataDir != "" {
+		if err := validatePersistence(config); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(config.DataDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory %s: %v", config.DataDir, err)
+		}
+	}
+
+	store := &KVServer{
+		shards:            make([]*Shard, numShards),
+		numShards:         numShards,
+		config:            *config,
+		dataDir:           config.DataDir,
+		snapshotRetention: max(config.SnapshotRetention, 1),
+	}
 	for i := range numShards {
-		shards[i] = NewShard()
+		store.shards[i] = store.newShard()
+		store.shards[i].primary = true
+	}
+
+	if config.DataDir != "" {
+		// Backup shards added by the router are restored as backups after the server's own shards
+		backupIdxs, err := store.listBackupDirs(numShards)
+		if err != nil {
+			return nil, err
+		}
+		for _, idx := range backupIdxs {
+			for len(store.shards) <= idx {
+				store.shards = append(store.shards, nil)
+			}
+			store.shards[idx] = store.newShard()
+		}
+
+		for i, shard := range store.shards {
+			if shard == nil {
+				continue
+			}
+			// Shards that joined a Raft group are rebuilt from the group's log instead of their own
+			joined, err := store.restoreRaft(i)
+			if err != nil {
+				store.Close()
+				return nil, fmt.Errorf("failed to rejoin raft group of shard %d: %v", i, err)
+			}
+			if joined {
+				continue
+			}
+			if err := store.openShard(i, shard); err != nil {
+				store.Close()
+				return nil, fmt.Errorf("failed to recover shard %d: %v", i, err)
+			}
+		}
+
+		if config.SnapshotInterval > 0 {
+			store.snapshotStop = make(chan struct{})
+			store.snapshotDone = make(chan struct{})
+			go store.snapshotLoop(config.SnapshotInterval)
+		}
+	}
+
+	reapInterval, reapBatchSize := config.ReapInterval, config.ReapBatchSize
+	if reapInterval <= 0 {
+		reapInterval = defaultReapInterval
+	}
+	if reapBatchSize <= 0 {
+		reapBatchSize = defaultReapBatchSize
+	}
+	store.reapStop = make(chan struct{})
+	store.reapDone = make(chan struct{})
+	go store.reapLoop(reapInterval, reapBatchSize)
+
+	txnRecoveryInterval := config.TxnRecoveryInterval
+	if txnRecoveryInterval <= 0 {
+		txnRecoveryInterval = defaultTxnRecoveryInterval
+	}
+	store.txnStop = make(chan struct{})
+	store.txnDone = make(chan struct{})
+	go store.txnLoop(txnRecoveryInterval)
+
+	store.compactStop = make(chan struct{})
+	store.compactDone = make(chan struct{})
+	go store.compactLoop(max(store.historyRetention()/2, time.Millisecond))
+
+	return store, nil
+}
+
+// Snapshot immediately snapshots every shard and truncates their logs
+// It is safe to call while the server is serving requests
+// Shards are snapshotted one at a time so that only one shard's state is copied in memory at once
+func (store *KVServer) Snapshot() error {
+	if store.dataDir == "" {
+		return fmt.Errorf("snapshots require a data directory")
+	}
+
+	store.snapshotMu.Lock()
+	defer store.snapshotMu.Unlock()
+
+	horizon := time.Now().Add(-store.historyRetention()).UnixNano()
+	var errs []error
+	for i, shard := range store.allShards() {
+		if shard == nil {
+			continue
+		}
+		if err := shard.snapshot(store.shardDir(i), store.snapshotRetention, horizon); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %v", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the snapshot, reaper, transaction recovery, and history compaction loops, then flushes and closes the write-ahead log of every shard
+// Errors are aggregated so that one failing shard does not prevent the others from closing
+func (store *KVServer) Close() error {
+	if store.snapshotStop != nil {
+		close(store.snapshotStop)
+		<-store.snapshotDone
+		store.snapshotStop = nil
+	}
+	if store.reapStop != nil {
+		close(store.reapStop)
+		<-store.reapDone
+		store.reapStop = nil
+	}
+	if store.txnStop != nil {
+		close(store.txnStop)
+		<-store.txnDone
+		store.txnStop = nil
+	}
+	if store.compactStop != nil {
+		close(store.compactStop)
+		<-store.compactDone
+		store.compactStop = nil
+	}
+
+	var errs []error
+	for i, shard := range store.allShards() {
+		if shard == nil {
+			continue
+		}
+		shard.mu.Lock()
+		shard.closeForwarders()
+		shard.stopRaft()
+		if shard.wal != nil {
+			if err := shard.wal.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %v", i, err))
+			}
+			shard.wal = nil
+		}
+		shard.mu.Unlock()
 	}
+	return errors.Join(errs...)
+}
+
+// allShards returns a copy of the shard list, including the empty slots of removed shards
+func (store *KVServer) allShards() []*Shard {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return slices.Clone(store.shards)
+}
+
+// openShard restores a shard from its snapshot and log and attaches the log to it
+// The change feed starts at the snapshot, so the changes replayed from the log are in it and watchers can resume across a restart
+func (store *KVServer) openShard(shardIdx int, shard *Shard) error {
+	dir := store.shardDir(shardIdx)
+	snapshotSeq, err := shard.restoreSnapshot(dir)
+	if err != nil {
+		return err
+	}
+	shard.resetFeed()
+	wal, err := OpenWAL(dir, &store.config, snapshotSeq, shard.apply)
+	if err != nil {
+		return err
+	}
+	shard.wal = wal
+	return nil
+}
+
+// listBackupDirs returns the indexes of the shard directories beyond the server's own shards in ascending order
+func (store *KVServer) listBackupDirs(numShards int) ([]int, error) {
+	entries, err := os.ReadDir(store.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list data directory %s: %v", store.dataDir, err)
+	}
+
+	idxs := make([]int, 0)
+	for _, entry := range entries {
+		name, found := strings.CutPrefix(entry.Name(), "shard-")
+		if !found || !entry.IsDir() {
+			continue
+		}
+		idx, err := strconv.Atoi(name)
+		if err == nil && idx >= numShards {
+			idxs = append(idxs, idx)
+		}
+	}
+	slices.Sort(idxs)
+	return idxs, nil
+}
+
+// shardDir returns the directory holding the log segments and snapshots of a shard
+func (store *KVServer) shardDir(shardIdx int) string {
+	return filepath.Join(store.dataDir, "shard-"+strconv.Itoa(shardIdx))
+}
+
+// validatePersistence checks that the sync and snapshot settings are usable
+func validatePersistence(config *Config) error {
+	if config.SnapshotInterval < 0 {
+		return fmt.Errorf("snapshot interval must not be negative, got: %v", config.SnapshotInterval)
+	}
+	if config.SnapshotInterval > 0 && config.SnapshotRetention <= 0 {
+		return fmt.Errorf("snapshot retention must be greater than 0, got: %d", config.SnapshotRetention)
+	}
+
+	switch config.SyncPolicy {
+	case SyncAlways:
+	case SyncBatch:
+		if config.SyncBatchSize <= 0 {
+			return fmt.Errorf("sync batch size must be greater than 0, got: %d", config.SyncBatchSize)
+		}
+	case SyncInterval:
+		if config.SyncInterval <= 0 {
+			return fmt.Errorf("sync interval must be greater than 0, got: %v", config.SyncInterval)
+		}
+	default:
+		return fmt.Errorf("unknown sync policy: %d", config.SyncPolicy)
+	}
+	return nil
+}
+
+// logMutation appends a record to the shard's write-ahead log if persistence is enabled
+// The caller must hold the shard's write lock
+func (shard *Shard) logMutation(record *walRecord) error {
+	if shard.wal == nil {
+		return nil
+	}
+	return shard.wal.Append(record)
+}
+
+// apply replays a single logged mutation against the in-memory map
+// Timestamped writes only replace older ones, and untimestamped writes always apply and clear the key's timestamp
+// Applied writes advance the shard's revision and set the key's version
+// Transactions apply each of their writes in order, and the state of distributed transactions is applied by applyTxnState
+// Every applied write adds a version to the key's history at the write's commit time, records logged without one get the time they are applied
+// Sets and deletes of existing keys are also published to the shard's change feed
+func (shard *Shard) apply(record *walRecord) {
+	switch record.Op {
+	case walOpRevision:
+		shard.revision = max(shard.revision, record.Version)
+		return
+	case walOpHistory:
+		shard.recordVersion(record.Key, keyVersion{Value: record.Value, Version: record.Version, ExpiresAt: record.ExpiresAt, CommittedAt: record.CommittedAt})
+		shard.advanceClock(record.CommittedAt)
+		return
+	case walOpHorizon:
+		shard.horizon = max(shard.horizon, record.Timestamp)
+		return
+	case walOpExpire:
+		shard.applyExpiry(record)
+		return
+	case walOpTxn, walOpCommitPrepared:
+		writes, err := decodeRecords(record.Value)
+		if err != nil {
+			log.Printf("Skipping undecodable transaction on key %s: %v", record.Key, err)
+			return
+		}
+		for _, write := range writes {
+			shard.apply(write)
+		}
+		shard.applyTxnState(record)
+		return
+	case walOpPrepare, walOpAbortPrepared, walOpTxnRecord:
+		shard.applyTxnState(record)
+		return
+	}
+	if record.Timestamp != 0 {
+		if !shard.supersedes(record) {
+			return
+		}
+		if shard.stamps == nil {
+			shard.stamps = make(map[string]int64)
+		}
+		shard.stamps[record.Key] = record.Timestamp
+	} else {
+		delete(shard.stamps, record.Key)
+	}
+
+	version := record.Version
+	if version == 0 {
+		version = shard.revision + 1
+	}
+	shard.revision = max(shard.revision, version)
+	committedAt := record.CommittedAt
+	if committedAt == 0 {
+		committedAt = time.Now().UnixNano()
+	}
+	shard.advanceClock(committedAt)
+
+	prevValue, prevExists := shard.data[record.Key]
+	prevVersion := shard.versions[record.Key]
 
-	return &KVServer{
-		shards: shards,
+	switch record.Op {
+	case walOpSet:
+		if !prevExists {
+			shard.keys.insert(record.Key)
+		}
+		shard.data[record.Key] = record.Value
+		shard.versions[record.Key] = version
+		shard.setExpiry(record.Key, record.ExpiresAt)
+		shard.recordVersion(record.Key, keyVersion{Value: record.Value, Version: version, ExpiresAt: record.ExpiresAt, CommittedAt: committedAt})
+		shard.publish(ChangeEvent{Key: record.Key, Value: record.Value, Version: version, PrevValue: prevValue, PrevVersion: prevVersion})
+	case walOpDelete:
+		if prevExists {
+			shard.recordVersion(record.Key, keyVersion{CommittedAt: committedAt})
+			shard.publish(ChangeEvent{Key: record.Key, Delete: true, Version: version, PrevValue: prevValue, PrevVersion: prevVersion})
+		}
+		shard.keys.delete(record.Key)
+		delete(shard.data, record.Key)
+		delete(shard.versions, record.Key)
+		delete(shard.expiries, record.Key)
 	}
 }
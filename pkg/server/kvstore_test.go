@@ -1,21 +1,32 @@
 package server_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	kvstore "kvstore/pkg/server"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewKVStore(t *testing.T) {
-	store := kvstore.NewKVServer(4)
+	store, err := kvstore.NewKVServer(4, nil)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
 	if store == nil {
 		t.Fatalf("Expected non-nil KVStore instance")
 	}
 }
 
 func TestSetAndGet(t *testing.T) {
-	store := kvstore.NewKVServer(4)
+	store, _ := kvstore.NewKVServer(4, nil)
 
-	setArgs := &kvstore.SetArgs{Key: "foo", Value: "bar"}
+	setArgs := &kvstore.SetArgs{Key: "foo", Value: []byte("bar")}
 	setReply := &kvstore.SetReply{}
 	if err := store.Set(setArgs, setReply); err != nil {
 		t.Fatalf("Set failed: %v", err)
@@ -30,15 +41,15 @@ func TestSetAndGet(t *testing.T) {
 	if !getReply.Exists {
 		t.Errorf("Expected key to exist")
 	}
-	if getReply.Value != "bar" {
+	if string(getReply.Value) != "bar" {
 		t.Errorf("Expected value 'bar', got '%s'", getReply.Value)
 	}
 }
 
 func TestDelete(t *testing.T) {
-	store := kvstore.NewKVServer(4)
+	store, _ := kvstore.NewKVServer(4, nil)
 
-	_ = store.Set(&kvstore.SetArgs{Key: "temp", Value: "123"}, &kvstore.SetReply{})
+	_ = store.Set(&kvstore.SetArgs{Key: "temp", Value: []byte("123")}, &kvstore.SetReply{})
 
 	delArgs := &kvstore.DeleteArgs{Key: "temp"}
 	delReply := &kvstore.DeleteReply{}
@@ -55,9 +66,9 @@ func TestDelete(t *testing.T) {
 }
 
 func TestExists(t *testing.T) {
-	store := kvstore.NewKVServer(4)
+	store, _ := kvstore.NewKVServer(4, nil)
 
-	_ = store.Set(&kvstore.SetArgs{Key: "present", Value: "yes"}, &kvstore.SetReply{})
+	_ = store.Set(&kvstore.SetArgs{Key: "present", Value: []byte("yes")}, &kvstore.SetReply{})
 
 	existsArgs := &kvstore.ExistsArgs{Key: "present"}
 	existsReply := &kvstore.ExistsReply{}
@@ -79,10 +90,10 @@ func TestExists(t *testing.T) {
 }
 
 func TestLength(t *testing.T) {
-	store := kvstore.NewKVServer(4)
+	store, _ := kvstore.NewKVServer(4, nil)
 
-	store.Set(&kvstore.SetArgs{Key: "a", Value: "1"}, &kvstore.SetReply{})
-	store.Set(&kvstore.SetArgs{Key: "b", Value: "2"}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "a", Value: []byte("1")}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "b", Value: []byte("2")}, &kvstore.SetReply{})
 
 	lengthReply := &kvstore.LengthReply{}
 	if err := store.Length(&kvstore.LengthArgs{}, lengthReply); err != nil {
@@ -92,3 +103,409 @@ func TestLength(t *testing.T) {
 		t.Errorf("Expected length 2, got %d", lengthReply.Length)
 	}
 }
+
+func TestStaleEpoch(t *testing.T) {
+	store, _ := kvstore.NewKVServer(4, nil)
+
+	if err := store.AdvanceEpoch(&kvstore.AdvanceEpochArgs{Epoch: 5}, &kvstore.AdvanceEpochReply{}); err != nil {
+		t.Fatalf("AdvanceEpoch failed: %v", err)
+	}
+	// An older announcement arriving late does not move the epoch back
+	if err := store.AdvanceEpoch(&kvstore.AdvanceEpochArgs{Epoch: 3}, &kvstore.AdvanceEpochReply{}); err != nil {
+		t.Fatalf("AdvanceEpoch failed: %v", err)
+	}
+
+	err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("bar"), Epoch: 4}, &kvstore.SetReply{})
+	if !kvstore.IsStaleEpoch(err) || !kvstore.IsStaleRoute(err) {
+		t.Errorf("Expected a stale epoch error, got %v", err)
+	}
+	if err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("bar"), Epoch: 5}, &kvstore.SetReply{}); err != nil {
+		t.Errorf("Expected the current epoch to be accepted, got %v", err)
+	}
+	if err := store.Get(&kvstore.GetArgs{Key: "foo"}, &kvstore.GetReply{}); err != nil {
+		t.Errorf("Expected a request without an epoch to be accepted, got %v", err)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	store, _ := kvstore.NewKVServer(4, nil)
+
+	// A timeout that has run out by the time the request is handled is rejected without applying the write
+	err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("bar"), Timeout: time.Nanosecond}, &kvstore.SetReply{})
+	if !kvstore.IsDeadlineExceeded(err) {
+		t.Errorf("Expected a deadline exceeded error, got %v", err)
+	}
+	getReply := &kvstore.GetReply{}
+	if err := store.Get(&kvstore.GetArgs{Key: "foo"}, getReply); err != nil || getReply.Exists {
+		t.Errorf("Expected the expired write not to be applied, got exists=%v err=%v", getReply.Exists, err)
+	}
+
+	if err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("bar"), Timeout: time.Minute}, &kvstore.SetReply{}); err != nil {
+		t.Errorf("Expected a request within its timeout to succeed, got %v", err)
+	}
+}
+
+func TestRetriedWriteAppliedOnce(t *testing.T) {
+	store, _ := kvstore.NewKVServer(4, nil)
+
+	if err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("first"), RequestID: "a"}, &kvstore.SetReply{}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("second"), RequestID: "b"}, &kvstore.SetReply{}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	// A late retry of the first write is acknowledged but does not overwrite the second
+	if err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("first"), RequestID: "a"}, &kvstore.SetReply{}); err != nil {
+		t.Errorf("Expected the retry to be acknowledged, got %v", err)
+	}
+	getReply := &kvstore.GetReply{}
+	if err := store.Get(&kvstore.GetArgs{Key: "foo"}, getReply); err != nil || string(getReply.Value) != "second" {
+		t.Errorf("Expected value 'second', got '%s' (err=%v)", getReply.Value, err)
+	}
+
+	if err := store.Delete(&kvstore.DeleteArgs{Key: "foo", RequestID: "c"}, &kvstore.DeleteReply{}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Set(&kvstore.SetArgs{Key: "foo", Value: []byte("third"), RequestID: "d"}, &kvstore.SetReply{}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Delete(&kvstore.DeleteArgs{Key: "foo", RequestID: "c"}, &kvstore.DeleteReply{}); err != nil {
+		t.Errorf("Expected the retried delete to be acknowledged, got %v", err)
+	}
+	if err := store.Get(&kvstore.GetArgs{Key: "foo"}, getReply); err != nil || string(getReply.Value) != "third" {
+		t.Errorf("Expected value 'third', got '%s' (err=%v)", getReply.Value, err)
+	}
+}
+
+func TestBatchOperations(t *testing.T) {
+	store, _ := kvstore.NewKVServer(4, nil)
+
+	items := []kvstore.BatchItem{
+		{Key: "a", Value: []byte("1"), ShardIdx: 0},
+		{Key: "b", Value: []byte("2"), ShardIdx: 1},
+		{Key: "c", Value: []byte("3"), ShardIdx: 1},
+		{Key: "d", Value: []byte("4"), ShardIdx: 9},
+	}
+	setReply := &kvstore.MultiSetReply{}
+	if err := store.MultiSet(&kvstore.MultiSetArgs{Items: items}, setReply); err != nil {
+		t.Fatalf("MultiSet failed: %v", err)
+	}
+	// Only the item addressed to a missing shard fails
+	for i, result := range setReply.Results {
+		if failed := result.Err != ""; failed != (i == 3) {
+			t.Errorf("Unexpected result for item %d: %+v", i, result)
+		}
+	}
+
+	getReply := &kvstore.MultiGetReply{}
+	if err := store.MultiGet(&kvstore.MultiGetArgs{Items: items[:3]}, getReply); err != nil {
+		t.Fatalf("MultiGet failed: %v", err)
+	}
+	for i, result := range getReply.Results {
+		if result.Err != "" || !result.Exists || !bytes.Equal(result.Value, items[i].Value) {
+			t.Errorf("Expected value '%s' for key %s, got %+v", items[i].Value, items[i].Key, result)
+		}
+	}
+
+	deleteReply := &kvstore.MultiDeleteReply{}
+	if err := store.MultiDelete(&kvstore.MultiDeleteArgs{Items: items[1:3]}, deleteReply); err != nil {
+		t.Fatalf("MultiDelete failed: %v", err)
+	}
+	lengthReply := &kvstore.LengthReply{}
+	store.Length(&kvstore.LengthArgs{}, lengthReply)
+	if lengthReply.Length != 1 {
+		t.Errorf("Expected 1 key after the batched delete, got %d", lengthReply.Length)
+	}
+
+	err := store.MultiGet(&kvstore.MultiGetArgs{Items: items[:1], Timeout: time.Nanosecond}, getReply)
+	if err != nil || !kvstore.IsDeadlineExceeded(errors.New(getReply.Results[0].Err)) {
+		t.Errorf("Expected the expired batch to fail with a deadline error, got %v and %+v", err, getReply.Results)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	store, _ := kvstore.NewKVServer(1, nil)
+
+	// A zero expected version only matches a missing key
+	swapReply := &kvstore.CompareAndSwapReply{}
+	if err := store.CompareAndSwap(&kvstore.CompareAndSwapArgs{Key: "lock", Value: []byte("owner1")}, swapReply); err != nil || !swapReply.Swapped {
+		t.Fatalf("Expected the missing key to be set, got swapped=%v err=%v", swapReply.Swapped, err)
+	}
+	first := swapReply.Version
+	if err := store.CompareAndSwap(&kvstore.CompareAndSwapArgs{Key: "lock", Value: []byte("owner2")}, swapReply); err != nil || swapReply.Swapped {
+		t.Errorf("Expected the existing key not to be set, got swapped=%v err=%v", swapReply.Swapped, err)
+	}
+
+	getReply := &kvstore.GetReply{}
+	store.Get(&kvstore.GetArgs{Key: "lock"}, getReply)
+	if getReply.Version != first || string(getReply.Value) != "owner1" {
+		t.Fatalf("Expected value 'owner1' at version %d, got '%s' at version %d", first, getReply.Value, getReply.Version)
+	}
+
+	if err := store.CompareAndSwap(&kvstore.CompareAndSwapArgs{Key: "lock", ExpectedVersion: first, Value: []byte("owner2")}, swapReply); err != nil || !swapReply.Swapped {
+		t.Fatalf("Expected the swap at the current version to succeed, got swapped=%v err=%v", swapReply.Swapped, err)
+	}
+	second := swapReply.Version
+	if second <= first {
+		t.Errorf("Expected the version to grow past %d, got %d", first, second)
+	}
+
+	deleteReply := &kvstore.DeleteIfVersionReply{}
+	if err := store.DeleteIfVersion(&kvstore.DeleteIfVersionArgs{Key: "lock", Version: first}, deleteReply); err != nil || deleteReply.Deleted {
+		t.Errorf("Expected the delete at a stale version to fail, got deleted=%v err=%v", deleteReply.Deleted, err)
+	}
+	if err := store.DeleteIfVersion(&kvstore.DeleteIfVersionArgs{Key: "lock", Version: second}, deleteReply); err != nil || !deleteReply.Deleted {
+		t.Errorf("Expected the delete at the current version to succeed, got deleted=%v err=%v", deleteReply.Deleted, err)
+	}
+
+	// A key set again after a delete never gets back an old version
+	store.Set(&kvstore.SetArgs{Key: "lock", Value: []byte("owner3")}, &kvstore.SetReply{})
+	store.Get(&kvstore.GetArgs{Key: "lock"}, getReply)
+	if getReply.Version <= second {
+		t.Errorf("Expected a version above %d after the key was set again, got %d", second, getReply.Version)
+	}
+}
+
+func TestKeyExpiry(t *testing.T) {
+	store, _ := kvstore.NewKVServer(1, &kvstore.Config{ReapInterval: 10 * time.Millisecond})
+	defer store.Close()
+
+	store.Set(&kvstore.SetArgs{Key: "session", Value: []byte("data"), TTL: 100 * time.Millisecond}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "cache", Value: []byte("data"), TTL: 100 * time.Millisecond}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "config", Value: []byte("data")}, &kvstore.SetReply{})
+
+	ttlReply := &kvstore.TTLReply{}
+	store.TTL(&kvstore.TTLArgs{Key: "session"}, ttlReply)
+	if !ttlReply.Exists || ttlReply.TTL <= 0 || ttlReply.TTL > 100*time.Millisecond {
+		t.Errorf("Expected a TTL of at most 100ms, got %v (exists=%v)", ttlReply.TTL, ttlReply.Exists)
+	}
+	ttlReply = &kvstore.TTLReply{}
+	store.TTL(&kvstore.TTLArgs{Key: "config"}, ttlReply)
+	if !ttlReply.Exists || ttlReply.TTL != 0 {
+		t.Errorf("Expected a key without expiry to have no TTL, got %v (exists=%v)", ttlReply.TTL, ttlReply.Exists)
+	}
+
+	// Persisting a key removes its expiry, and expiring a missing key does nothing
+	expireReply := &kvstore.ExpireReply{}
+	if store.Expire(&kvstore.ExpireArgs{Key: "cache"}, expireReply); !expireReply.Exists {
+		t.Errorf("Expected the key to be persisted")
+	}
+	expireReply = &kvstore.ExpireReply{}
+	if store.Expire(&kvstore.ExpireArgs{Key: "missing", TTL: time.Second}, expireReply); expireReply.Exists {
+		t.Errorf("Expected expiring a missing key to report that it does not exist")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	getReply := &kvstore.GetReply{}
+	store.Get(&kvstore.GetArgs{Key: "session"}, getReply)
+	if getReply.Exists {
+		t.Errorf("Expected the expired key to be missing")
+	}
+	lengthReply := &kvstore.LengthReply{}
+	store.Length(&kvstore.LengthArgs{}, lengthReply)
+	if lengthReply.Length != 2 {
+		t.Errorf("Expected 2 keys that did not expire, got %d", lengthReply.Length)
+	}
+
+	// The reaper deletes the expired key itself, which replicas read without checking expiries
+	replicaReply := &kvstore.ReplicaGetReply{}
+	store.ReplicaGet(&kvstore.ReplicaGetArgs{Key: "session"}, replicaReply)
+	if replicaReply.Exists {
+		t.Errorf("Expected the reaper to have deleted the expired key")
+	}
+}
+
+func TestDeleteExpiredKey(t *testing.T) {
+	store, _ := kvstore.NewKVServer(1, &kvstore.Config{ReapInterval: time.Hour})
+	defer store.Close()
+
+	store.Set(&kvstore.SetArgs{Key: "session", Value: []byte("data"), TTL: 10 * time.Millisecond}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "cache", Value: []byte("data"), TTL: 10 * time.Millisecond}, &kvstore.SetReply{})
+	time.Sleep(20 * time.Millisecond)
+
+	// Keys that expired but were not reaped yet are already missing, so deleting them changes nothing
+	store.Delete(&kvstore.DeleteArgs{Key: "session"}, &kvstore.DeleteReply{})
+	store.MultiDelete(&kvstore.MultiDeleteArgs{Items: []kvstore.BatchItem{{Key: "cache"}}}, &kvstore.MultiDeleteReply{})
+
+	store.Set(&kvstore.SetArgs{Key: "after", Value: []byte("data")}, &kvstore.SetReply{})
+	reply := &kvstore.GetReply{}
+	if store.Get(&kvstore.GetArgs{Key: "after"}, reply); reply.Version != 3 {
+		t.Errorf("Expected no writes from deleting expired keys and version 3, got %d", reply.Version)
+	}
+}
+
+func TestScan(t *testing.T) {
+	store, _ := kvstore.NewKVServer(4, nil)
+
+	for i := range 100 {
+		key := fmt.Sprintf("key%03d", i)
+		store.Set(&kvstore.SetArgs{Key: key, Value: []byte(strconv.Itoa(i)), ShardIdx: i % 4}, &kvstore.SetReply{})
+	}
+	for i := 10; i < 20; i++ {
+		store.Delete(&kvstore.DeleteArgs{Key: fmt.Sprintf("key%03d", i), ShardIdx: i % 4}, &kvstore.DeleteReply{})
+	}
+
+	// Keys of every shard are merged in order, and deleted keys are skipped
+	reply := &kvstore.ScanReply{}
+	if err := store.Scan(&kvstore.ScanArgs{Start: "key005", End: "key030", Limit: 8}, reply); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	want := []string{"key005", "key006", "key007", "key008", "key009", "key020", "key021", "key022"}
+	if len(reply.Entries) != len(want) || !reply.More {
+		t.Fatalf("Expected %d keys and more to follow, got %d (more=%v)", len(want), len(reply.Entries), reply.More)
+	}
+	for i, entry := range reply.Entries {
+		if entry.Key != want[i] || string(entry.Value) != strings.TrimLeft(entry.Key[3:], "0") {
+			t.Errorf("Expected key %s at position %d, got %s = %s", want[i], i, entry.Key, entry.Value)
+		}
+	}
+
+	reply = &kvstore.ScanReply{}
+	store.Scan(&kvstore.ScanArgs{Start: "key095"}, reply)
+	if len(reply.Entries) != 5 || reply.More {
+		t.Errorf("Expected the last 5 keys and nothing more, got %d (more=%v)", len(reply.Entries), reply.More)
+	}
+	if err := store.Scan(&kvstore.ScanArgs{Start: "b", End: "a"}, &kvstore.ScanReply{}); err == nil {
+		t.Errorf("Expected a range ending before its start to be rejected")
+	}
+}
+
+func TestAtomicOperations(t *testing.T) {
+	store, _ := kvstore.NewKVServer(1, &kvstore.Config{MaxValueSize: 8})
+
+	// Concurrent increments are applied under the shard's lock, so none is lost
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Incr(&kvstore.IncrArgs{Key: "counter", Delta: 2}, &kvstore.IncrReply{})
+		}()
+	}
+	wg.Wait()
+	decrReply := &kvstore.DecrReply{}
+	if err := store.Decr(&kvstore.DecrArgs{Key: "counter", Delta: 1}, decrReply); err != nil || decrReply.Value != 99 {
+		t.Errorf("Expected 99 after the decrement, got %d (err=%v)", decrReply.Value, err)
+	}
+
+	// A retried increment is not applied twice
+	incrReply := &kvstore.IncrReply{}
+	store.Incr(&kvstore.IncrArgs{Key: "counter", Delta: 1, RequestID: "a"}, incrReply)
+	incrReply = &kvstore.IncrReply{}
+	if err := store.Incr(&kvstore.IncrArgs{Key: "counter", Delta: 1, RequestID: "a"}, incrReply); err != nil || incrReply.Value != 100 {
+		t.Errorf("Expected the retry to return 100, got %d (err=%v)", incrReply.Value, err)
+	}
+
+	store.Set(&kvstore.SetArgs{Key: "text", Value: []byte("abc")}, &kvstore.SetReply{})
+	if err := store.Incr(&kvstore.IncrArgs{Key: "text", Delta: 1}, &kvstore.IncrReply{}); !kvstore.IsNotInteger(err) {
+		t.Errorf("Expected ErrNotInteger for a non-numeric value, got %v", err)
+	}
+	store.Incr(&kvstore.IncrArgs{Key: "max", Delta: math.MaxInt64}, &kvstore.IncrReply{})
+	if err := store.Incr(&kvstore.IncrArgs{Key: "max", Delta: 1}, &kvstore.IncrReply{}); !kvstore.IsNotInteger(err) {
+		t.Errorf("Expected ErrNotInteger for an overflow, got %v", err)
+	}
+
+	// Appends keep the key's expiry and cannot grow a value past the maximum size
+	store.Set(&kvstore.SetArgs{Key: "log", Value: []byte("ab"), TTL: time.Minute}, &kvstore.SetReply{})
+	appendReply := &kvstore.AppendReply{}
+	if err := store.Append(&kvstore.AppendArgs{Key: "log", Value: []byte("cd")}, appendReply); err != nil || appendReply.Length != 4 {
+		t.Errorf("Expected a length of 4, got %d (err=%v)", appendReply.Length, err)
+	}
+	ttlReply := &kvstore.TTLReply{}
+	if store.TTL(&kvstore.TTLArgs{Key: "log"}, ttlReply); ttlReply.TTL <= 0 {
+		t.Errorf("Expected the append to keep the expiry, got TTL %v", ttlReply.TTL)
+	}
+	if err := store.Append(&kvstore.AppendArgs{Key: "log", Value: []byte("efghi")}, &kvstore.AppendReply{}); !kvstore.IsValueTooLarge(err) {
+		t.Errorf("Expected ErrValueTooLarge for an append past the limit, got %v", err)
+	}
+
+	swapReply := &kvstore.GetAndSetReply{}
+	if err := store.GetAndSet(&kvstore.GetAndSetArgs{Key: "log", Value: []byte("new")}, swapReply); err != nil || !swapReply.Exists || string(swapReply.Value) != "abcd" {
+		t.Errorf("Expected the previous value 'abcd', got '%s' (exists=%v, err=%v)", swapReply.Value, swapReply.Exists, err)
+	}
+	swapReply = &kvstore.GetAndSetReply{}
+	store.GetAndSet(&kvstore.GetAndSetArgs{Key: "fresh", Value: []byte("x")}, swapReply)
+	if swapReply.Exists {
+		t.Errorf("Expected a missing key to be reported as missing, got '%s'", swapReply.Value)
+	}
+
+	// Retries get the reply of the original write, even after the key changed in the meantime
+	store.GetAndSet(&kvstore.GetAndSetArgs{Key: "fresh", Value: []byte("y"), RequestID: "b"}, &kvstore.GetAndSetReply{})
+	store.Set(&kvstore.SetArgs{Key: "fresh", Value: []byte("z")}, &kvstore.SetReply{})
+	swapReply = &kvstore.GetAndSetReply{}
+	if err := store.GetAndSet(&kvstore.GetAndSetArgs{Key: "fresh", Value: []byte("y"), RequestID: "b"}, swapReply); err != nil || !swapReply.Exists || string(swapReply.Value) != "x" {
+		t.Errorf("Expected the retry to return the previous value 'x', got '%s' (exists=%v, err=%v)", swapReply.Value, swapReply.Exists, err)
+	}
+	store.Incr(&kvstore.IncrArgs{Key: "counter", Delta: 5}, &kvstore.IncrReply{})
+	incrReply = &kvstore.IncrReply{}
+	if err := store.Incr(&kvstore.IncrArgs{Key: "counter", Delta: 1, RequestID: "a"}, incrReply); err != nil || incrReply.Value != 100 {
+		t.Errorf("Expected the late retry to return 100, got %d (err=%v)", incrReply.Value, err)
+	}
+	store.Append(&kvstore.AppendArgs{Key: "tail", Value: []byte("ab"), RequestID: "c"}, &kvstore.AppendReply{})
+	store.Append(&kvstore.AppendArgs{Key: "tail", Value: []byte("cd")}, &kvstore.AppendReply{})
+	appendReply = &kvstore.AppendReply{}
+	if err := store.Append(&kvstore.AppendArgs{Key: "tail", Value: []byte("ab"), RequestID: "c"}, appendReply); err != nil || appendReply.Length != 2 {
+		t.Errorf("Expected the retry to return a length of 2, got %d (err=%v)", appendReply.Length, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	config := &kvstore.Config{DataDir: t.TempDir(), SyncPolicy: kvstore.SyncAlways, WatchBufferSize: 4}
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+
+	start := &kvstore.WatchReply{}
+	if err := store.Watch(&kvstore.WatchArgs{Key: "app:", Latest: true}, start); err != nil || len(start.Events) != 0 {
+		t.Fatalf("Expected the current revision without changes, got %v (err=%v)", start.Events, err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "app:color", Value: []byte("red")}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "other", Value: []byte("1")}, &kvstore.SetReply{})
+	store.Delete(&kvstore.DeleteArgs{Key: "app:color"}, &kvstore.DeleteReply{})
+
+	reply := &kvstore.WatchReply{}
+	if err := store.Watch(&kvstore.WatchArgs{Key: "app:", Prefix: true, Revision: start.Revision}, reply); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if len(reply.Events) != 2 || reply.Events[0].Delete || string(reply.Events[0].Value) != "red" || reply.Events[0].PrevVersion != 0 ||
+		!reply.Events[1].Delete || string(reply.Events[1].PrevValue) != "red" || reply.Events[1].PrevVersion != reply.Events[0].Version {
+		t.Errorf("Expected a put and a delete of app:color, got %+v", reply.Events)
+	}
+
+	// A watch without changes waits for the next one
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		store.Set(&kvstore.SetArgs{Key: "app:size", Value: []byte("large")}, &kvstore.SetReply{})
+	}()
+	next := &kvstore.WatchReply{}
+	if err := store.Watch(&kvstore.WatchArgs{Key: "app:size", Revision: reply.Revision, Wait: 5 * time.Second}, next); err != nil || len(next.Events) != 1 {
+		t.Fatalf("Expected the waiting watch to return the next change, got %+v (err=%v)", next.Events, err)
+	}
+	idle := &kvstore.WatchReply{}
+	if err := store.Watch(&kvstore.WatchArgs{Key: "app:size", Revision: next.Revision, Wait: 20 * time.Millisecond}, idle); err != nil || len(idle.Events) != 0 || idle.Revision != next.Revision {
+		t.Errorf("Expected the watch to time out without changes, got %+v at %d (err=%v)", idle.Events, idle.Revision, err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Changes replayed from the log after a restart can still be watched, until they fall out of the feed
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	resumed := &kvstore.WatchReply{}
+	if err := recovered.Watch(&kvstore.WatchArgs{Key: "app:size", Revision: reply.Revision}, resumed); err != nil || len(resumed.Events) != 1 {
+		t.Errorf("Expected the watch to resume after a restart, got %+v (err=%v)", resumed.Events, err)
+	}
+	for i := range 4 {
+		recovered.Set(&kvstore.SetArgs{Key: "other", Value: []byte(strconv.Itoa(i))}, &kvstore.SetReply{})
+	}
+	err = recovered.Watch(&kvstore.WatchArgs{Key: "app:size", Revision: reply.Revision}, &kvstore.WatchReply{})
+	if !kvstore.IsRevisionCompacted(err) {
+		t.Errorf("Expected ErrRevisionCompacted for a revision older than the feed, got %v", err)
+	}
+}
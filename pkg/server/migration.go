@@ -0,0 +1,434 @@
+// migration.go
+// This file contains the server side of live data migration between shards
+// When the router's hash ring changes, it asks the current owner of each affected hash range to stream the range to its new owner
+// While a range is being streamed, the old owner keeps serving it and forwards every write in it to the new owner
+// If forwarding fails, the old owner rejects writes in the range until it has reconnected and sent the new owner the keys it missed
+// Once the router has switched its routes, the old owner drops the range and rejects requests for it so that stale routes are retried
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrKeyMoved is returned for requests on keys whose range has been migrated to another shard
+// net/rpc only transmits the error message, so clients should test for it with IsKeyMoved
+var ErrKeyMoved = errors.New("key has moved to another shard")
+
+// IsKeyMoved reports whether an error returned by a shard means the key's route is stale
+func IsKeyMoved(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrKeyMoved.Error())
+}
+
+const (
+	// migrationBatchSize is the number of entries sent to the new owner per Import call
+	// The source shard is locked while a batch is sent, so batches are kept small
+	migrationBatchSize = 256
+	// forwardTimeout bounds how long a shard waits to connect to or hear back from a migration destination or backup
+	// Shards wait for them while holding their write lock, so a destination that does not answer in time is treated as failed rather than stalling the shard
+	forwardTimeout = 5 * time.Second
+)
+
+// A forwarder sends the writes a shard applies in a set of hash ranges to another shard
+// Migrations forward the ranges being handed over, while backups receive every write of their primary
+// A migration that failed to forward writes keeps the keys they changed, which are sent again once it reconnects
+type forwarder struct {
+	ranges       RangeSet
+	destSocket   string
+	destShardIdx int
+	dest         *rpc.Client
+	failed       bool
+	missed       []string
+}
+
+// MigrateOut is an RPC method that streams every key in the given ranges to another shard
+// Writes to the ranges are forwarded to the destination from the moment the migration starts until it is finished or aborted
+// It returns once every key that existed at the start of the migration has been copied
+func (store *KVServer) MigrateOut(args *MigrateOutArgs, reply *MigrateOutReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+	if shard.isRaft() {
+		return errRaftShard
+	}
+
+	dest, err := dialForwarder(args.DestSocket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to migration destination %s: %v", args.DestSocket, err)
+	}
+
+	// The destination must accept requests for the ranges again if they were moved away from it in the past
+	claim := &ImportArgs{ShardIdx: args.DestShardIdx, Claim: args.Ranges}
+	if err := callForwarder(dest, "KVServer.Import", claim, &ImportReply{}); err != nil {
+		dest.Close()
+		return fmt.Errorf("failed to claim ranges on %s shard %d: %v", args.DestSocket, args.DestShardIdx, err)
+	}
+
+	migration := &forwarder{
+		ranges:       RangeSet(nil).Union(args.Ranges),
+		destSocket:   args.DestSocket,
+		destShardIdx: args.DestShardIdx,
+		dest:         dest,
+	}
+
+	// Start forwarding and take the list of keys to copy atomically, so every key is either copied or forwarded
+	shard.mu.Lock()
+	if findForwarder(shard.outgoing, args.DestSocket, args.DestShardIdx) >= 0 {
+		shard.mu.Unlock()
+		dest.Close()
+		return fmt.Errorf("shard %d is already migrating to %s shard %d", args.ShardIdx, args.DestSocket, args.DestShardIdx)
+	}
+	shard.outgoing = append(shard.outgoing, migration)
+	keys := shard.keysIn(migration.ranges)
+	shard.mu.Unlock()
+
+	moved, err := shard.copyKeys(migration, keys)
+	reply.Moved = moved
+	return err
+}
+
+// copyKeys copies a list of keys to a forwarder's destination in batches
+// The forwarder must already be registered on the shard so that writes made during the copy are not lost
+// It returns the number of keys copied
+func (shard *Shard) copyKeys(f *forwarder, keys []string) (int, error) {
+	copied := 0
+	for start := 0; start < len(keys); start += migrationBatchSize {
+		batch := keys[start:min(start+migrationBatchSize, len(keys))]
+
+		shard.mu.Lock()
+		n, err := shard.copyBatch(f, batch)
+		shard.mu.Unlock()
+		if err != nil {
+			return copied, err
+		}
+		copied += n
+	}
+	return copied, nil
+}
+
+// copyBatch sends the current values of a batch of keys to a forwarder's destination
+// The caller must hold the shard's write lock until the destination has applied the batch, so a forwarded write can never be overtaken by an older copy
+// Keys deleted since the list was taken are skipped since their deletion has already been forwarded
+func (shard *Shard) copyBatch(migration *forwarder, keys []string) (int, error) {
+	args := &ImportArgs{ShardIdx: migration.destShardIdx, Entries: make([]Entry, 0, len(keys))}
+	for _, key := range keys {
+		if value, exists := shard.data[key]; exists {
+			args.Entries = append(args.Entries, Entry{Key: key, Value: value, Timestamp: shard.stamps[key], Version: shard.versions[key], ExpiresAt: shard.expiries[key], CommittedAt: shard.currentCommit(key)})
+		}
+	}
+	if len(args.Entries) == 0 {
+		return 0, nil
+	}
+
+	if err := callForwarder(migration.dest, "KVServer.Import", args, &ImportReply{}); err != nil {
+		return 0, fmt.Errorf("failed to copy keys to %s shard %d: %v", migration.destSocket, migration.destShardIdx, err)
+	}
+	return len(args.Entries), nil
+}
+
+// FinishMigration is an RPC method that completes a migration once the router routes the ranges to their new owner
+// Forwarding stops, the migrated keys are deleted, and later requests for them are rejected with ErrKeyMoved
+// If the new owner missed writes that cannot be sent to it now, the keys are kept and the call fails, so that it can be retried
+func (store *KVServer) FinishMigration(args *FinishMigrationArgs, reply *FinishMigrationReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	idx := findForwarder(shard.outgoing, args.DestSocket, args.DestShardIdx)
+	if idx < 0 {
+		return fmt.Errorf("shard %d has no migration to %s shard %d", args.ShardIdx, args.DestSocket, args.DestShardIdx)
+	}
+	migration := shard.outgoing[idx]
+
+	shard.moved = shard.moved.Union(migration.ranges)
+	if migration.failed {
+		if err := shard.resyncMigration(migration); err != nil {
+			return fmt.Errorf("migration to %s shard %d is out of sync, keeping its keys: %v", args.DestSocket, args.DestShardIdx, err)
+		}
+	}
+
+	shard.removeMigration(args.DestSocket, args.DestShardIdx)
+	return shard.dropRanges(migration.ranges)
+}
+
+// AbortMigration is an RPC method that cancels a migration, keeping every key on the source shard
+func (store *KVServer) AbortMigration(args *AbortMigrationArgs, reply *AbortMigrationReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.removeMigration(args.DestSocket, args.DestShardIdx)
+	return nil
+}
+
+// Import is an RPC method that applies entries streamed or forwarded from another shard during a migration
+// Claimed ranges are accepted by the shard again even if they were migrated away from it before
+func (store *KVServer) Import(args *ImportArgs, reply *ImportReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if len(args.Claim) > 0 {
+		shard.moved = shard.moved.Subtract(args.Claim)
+	}
+
+	records := make([]*walRecord, 0, len(args.Entries)+len(args.Deletes)+len(args.Tombstones)+len(args.Expiries))
+	for _, entry := range args.Entries {
+		records = append(records, &walRecord{Op: walOpSet, Key: entry.Key, Value: entry.Value, Timestamp: entry.Timestamp, Version: entry.Version, ExpiresAt: entry.ExpiresAt, CommittedAt: entry.CommittedAt})
+	}
+	for _, key := range args.Deletes {
+		if _, exists := shard.data[key]; exists {
+			records = append(records, &walRecord{Op: walOpDelete, Key: key})
+		}
+	}
+	for _, tombstone := range args.Tombstones {
+		records = append(records, &walRecord{Op: walOpDelete, Key: tombstone.Key, Timestamp: tombstone.Timestamp, Version: tombstone.Version})
+	}
+	for _, expiry := range args.Expiries {
+		records = append(records, &walRecord{Op: walOpExpire, Key: expiry.Key, ExpiresAt: expiry.ExpiresAt})
+	}
+
+	return shard.commit(records...)
+}
+
+// DropRanges is an RPC method that deletes every key in the given ranges
+// The router uses it to clean up a destination shard after an aborted migration, and primaries use it to clear a backup before syncing it
+// Backups keep their timestamped writes, which clients may have sent them without going through the primary, and the primary's copy only replaces the ones it has a newer write of
+// Neither removes keys clients changed, so the shard's change feed starts over instead of reporting the deletes
+func (store *KVServer) DropRanges(args *DropRangesArgs, reply *DropRangesReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	keys := shard.keysIn(RangeSet(nil).Union(args.Ranges))
+	if args.KeepTimestamped {
+		keys = slices.DeleteFunc(keys, func(key string) bool { return shard.stamps[key] != 0 })
+	}
+	if err := shard.dropKeys(keys); err != nil {
+		return err
+	}
+	shard.resetFeed()
+	return nil
+}
+
+// checkOwnership returns ErrNotPrimary if the shard is a backup and ErrKeyMoved if the key's range has been migrated away from the shard
+// The caller must hold the shard's lock
+func (shard *Shard) checkOwnership(key string) error {
+	if !shard.primary {
+		return fmt.Errorf("%v: %s", ErrNotPrimary, key)
+	}
+	if len(shard.moved) > 0 && shard.moved.ContainsKey(key) {
+		return fmt.Errorf("%v: %s", ErrKeyMoved, key)
+	}
+	return nil
+}
+
+// forward sends logged writes to every shard that is taking over their range and to every backup
+// Each destination receives the writes in its ranges as a single batch
+// The caller must hold the shard's write lock so that forwarded writes arrive in the order they were applied
+// A backup that fails to apply the writes is marked as failed and resynced before the next write
+func (shard *Shard) forward(records []*walRecord) error {
+	if err := shard.forwardToMigrations(records); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, backup := range shard.backups {
+		if backup.failed {
+			continue
+		}
+		if err := backup.send(records); err != nil {
+			backup.failed = true
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forwardToMigrations sends logged writes to every shard that is taking over their range
+// A migration that fails to apply the writes is marked as failed and remembers their keys, which are resent before the next write in its ranges
+// The caller must hold the shard's write lock
+func (shard *Shard) forwardToMigrations(records []*walRecord) error {
+	var errs []error
+	for _, migration := range shard.outgoing {
+		if err := migration.send(records); err != nil {
+			migration.failed = true
+			for _, record := range records {
+				if migration.ranges.ContainsKey(record.Key) {
+					migration.missed = append(migration.missed, record.Key)
+				}
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resyncMigrations brings every failed migration whose ranges hold one of the writes back in sync before the writes are applied
+// Writes are rejected if that is not possible, since the new owner would not see them
+// The caller must hold the shard's write lock
+func (shard *Shard) resyncMigrations(records []*walRecord) error {
+	for _, migration := range shard.outgoing {
+		if !migration.failed || !slices.ContainsFunc(records, func(record *walRecord) bool { return migration.ranges.ContainsKey(record.Key) }) {
+			continue
+		}
+		if err := shard.resyncMigration(migration); err != nil {
+			return fmt.Errorf("migration to %s shard %d is out of sync: %v", migration.destSocket, migration.destShardIdx, err)
+		}
+	}
+	return nil
+}
+
+// resyncMigration reconnects to a failed migration's destination and sends it the current state of every key it missed
+// The caller must hold the shard's write lock
+func (shard *Shard) resyncMigration(migration *forwarder) error {
+	dest, err := dialForwarder(migration.destSocket)
+	if err != nil {
+		return err
+	}
+	migration.dest.Close()
+	migration.dest = dest
+
+	args := &ImportArgs{ShardIdx: migration.destShardIdx}
+	for _, key := range migration.missed {
+		if value, exists := shard.data[key]; exists {
+			args.Entries = append(args.Entries, Entry{Key: key, Value: value, Timestamp: shard.stamps[key], Version: shard.versions[key], ExpiresAt: shard.expiries[key], CommittedAt: shard.currentCommit(key)})
+		} else if stamp := shard.stamps[key]; stamp != 0 {
+			args.Tombstones = append(args.Tombstones, Entry{Key: key, Timestamp: stamp})
+		} else {
+			args.Deletes = append(args.Deletes, key)
+		}
+	}
+	if err := callForwarder(dest, "KVServer.Import", args, &ImportReply{}); err != nil {
+		return err
+	}
+	migration.failed = false
+	migration.missed = nil
+	return nil
+}
+
+// send forwards the writes in the forwarder's ranges to its destination in a single Import call
+func (f *forwarder) send(records []*walRecord) error {
+	args := &ImportArgs{ShardIdx: f.destShardIdx}
+	for _, record := range records {
+		if !f.ranges.ContainsKey(record.Key) {
+			continue
+		}
+		switch {
+		case record.Op == walOpSet:
+			args.Entries = append(args.Entries, Entry{Key: record.Key, Value: record.Value, Timestamp: record.Timestamp, Version: record.Version, ExpiresAt: record.ExpiresAt, CommittedAt: record.CommittedAt})
+		case record.Op == walOpDelete && record.Timestamp != 0:
+			args.Tombstones = append(args.Tombstones, Entry{Key: record.Key, Timestamp: record.Timestamp, Version: record.Version})
+		case record.Op == walOpDelete:
+			args.Deletes = append(args.Deletes, record.Key)
+		case record.Op == walOpExpire:
+			args.Expiries = append(args.Expiries, Entry{Key: record.Key, ExpiresAt: record.ExpiresAt})
+		}
+	}
+	if len(args.Entries) == 0 && len(args.Deletes) == 0 && len(args.Tombstones) == 0 && len(args.Expiries) == 0 {
+		return nil
+	}
+
+	if err := callForwarder(f.dest, "KVServer.Import", args, &ImportReply{}); err != nil {
+		return fmt.Errorf("failed to forward writes to %s shard %d: %v", f.destSocket, f.destShardIdx, err)
+	}
+	return nil
+}
+
+// dropRanges deletes every key in the ranges from the shard
+// The caller must hold the shard's write lock
+func (shard *Shard) dropRanges(ranges RangeSet) error {
+	return shard.dropKeys(shard.keysIn(ranges))
+}
+
+// dropKeys deletes the keys from the shard
+// The caller must hold the shard's write lock
+func (shard *Shard) dropKeys(keys []string) error {
+	records := make([]*walRecord, len(keys))
+	for i, key := range keys {
+		records[i] = &walRecord{Op: walOpDelete, Key: key}
+	}
+	return shard.commit(records...)
+}
+
+// keysIn returns the keys of the shard that fall in the ranges
+// The caller must hold the shard's lock
+func (shard *Shard) keysIn(ranges RangeSet) []string {
+	keys := make([]string, 0)
+	for key := range shard.data {
+		if ranges.ContainsKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// findForwarder returns the index of the forwarder to the given shard, or -1 if there is none
+func findForwarder(forwarders []*forwarder, destSocket string, destShardIdx int) int {
+	for i, f := range forwarders {
+		if f.destSocket == destSocket && f.destShardIdx == destShardIdx {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeMigration stops forwarding to the given shard and returns the removed migration, or nil if there was none
+func (shard *Shard) removeMigration(destSocket string, destShardIdx int) *forwarder {
+	idx := findForwarder(shard.outgoing, destSocket, destShardIdx)
+	if idx < 0 {
+		return nil
+	}
+
+	migration := shard.outgoing[idx]
+	shard.outgoing = append(shard.outgoing[:idx], shard.outgoing[idx+1:]...)
+	migration.dest.Close()
+	return migration
+}
+
+// dialForwarder connects to a migration destination or backup, giving up after forwardTimeout
+func dialForwarder(socket string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", socket, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// callForwarder calls a method on a migration destination or backup and waits at most forwardTimeout for the reply
+// The connection is closed if the reply does not arrive in time, so the forwarder fails like one whose destination went away and is reconnected before it is used again
+func callForwarder(dest *rpc.Client, method string, args any, reply any) error {
+	timer := time.NewTimer(forwardTimeout)
+	defer timer.Stop()
+
+	call := dest.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		dest.Close()
+		return fmt.Errorf("%s did not answer within %v", method, forwardTimeout)
+	}
+}
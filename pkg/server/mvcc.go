@@ -0,0 +1,311 @@
+// mvcc.go
+// This file contains the version history of keys, which serves reads of the value a key had at a point in time
+// Every write a shard applies is kept as a version of its key, stamped with the time the shard committed it
+// Commit times come from the shard's clock, which is the wall clock unless a commit time it has already given out is later, so commit times only increase
+// Reading every key at the same time gives a consistent view across keys and shards, which clients use for snapshots
+// Versions that were replaced before the history horizon are collected in the background, and reads before the horizon fail with ErrCompacted
+// Only the current version of a key moves with a migration or a backup sync, older versions stay on the shard that wrote them
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHistoryRetention is how long replaced versions are kept if the config does not set it
+	defaultHistoryRetention = time.Minute
+	// maxReadAhead bounds how far past the shard's safe time a timestamped read may be, such reads wait until the safe time has passed theirs
+	maxReadAhead = time.Second
+	// maxLockWait bounds how long a read at a point in time waits for a prepared transaction holding its key to resolve
+	maxLockWait = 10 * time.Second
+)
+
+// ErrCompacted is returned for reads at a time before the history horizon, whose versions may have been collected
+// net/rpc only transmits the error message, so callers should test for it with IsCompacted
+var ErrCompacted = errors.New("requested time is before the history horizon")
+
+// IsCompacted reports whether an error returned by a server means that a read asked for a time whose versions have been collected
+func IsCompacted(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrCompacted.Error())
+}
+
+// A keyVersion is a version of a key in its history, valid from its commit time until the commit time of the next one
+// Deletes are kept as versions with a version number of zero
+type keyVersion struct {
+	Value       []byte
+	Version     uint64
+	ExpiresAt   int64
+	CommittedAt int64
+}
+
+// GetAt is an RPC method that retrieves the value a key had at a point in time
+// It returns the value, a boolean indicating if the key existed then, and the version it had, keys that had expired by then are reported as missing
+// Reads wait until the shard's safe time has passed their time, after which no write at or before it can be committed, so the read cannot miss one
+// Reads of a key locked by a distributed transaction that prepared at or before their time also wait until it resolves, since it may commit at their time
+// On shards in a Raft group, the read is ordered through the group's log like Get, and proposed again once its time has passed on the server if the read was applied before
+func (store *KVServer) GetAt(args *GetAtArgs, reply *GetAtReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	wait := maxLockWait
+	if !deadline.IsZero() {
+		wait = min(wait, time.Until(deadline))
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var passed <-chan time.Time
+	if ahead := time.Until(time.Unix(0, args.Timestamp)); ahead >= 0 {
+		passed = time.After(ahead + time.Nanosecond)
+	}
+
+	propose := shard.isRaft()
+	for {
+		if propose {
+			if _, err := shard.propose(&walRecord{Op: walOpGet, Key: args.Key}, deadline); err != nil {
+				return err
+			}
+			propose = false
+		}
+		safe, err := shard.readAt(args, deadline, reply)
+		if err != nil || safe == nil {
+			return err
+		}
+		select {
+		case <-safe:
+		case <-passed:
+			passed = nil
+			propose = shard.isRaft()
+		case <-timer.C:
+			if err := checkDeadline(deadline, args.Key); err != nil {
+				return err
+			}
+			return fmt.Errorf("%v: %s at %v", ErrKeyLocked, args.Key, time.Unix(0, args.Timestamp))
+		}
+	}
+}
+
+// readAt fills the reply with the version a key had at the requested time
+// If the shard's safe time has not yet passed that time, or a distributed transaction that prepared at or before it holds the key, it returns a channel that is closed once that may have changed instead
+func (shard *Shard) readAt(args *GetAtArgs, deadline time.Time, reply *GetAtReply) (<-chan struct{}, error) {
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if err := checkDeadline(deadline, args.Key); err != nil {
+		return nil, err
+	}
+	if shard.group == nil {
+		if err := shard.checkOwnership(args.Key); err != nil {
+			return nil, err
+		}
+	}
+	if args.Timestamp < shard.horizon {
+		return nil, fmt.Errorf("%v: %s at %v", ErrCompacted, args.Key, time.Unix(0, args.Timestamp))
+	}
+	safeTime := shard.safeTime()
+	if args.Timestamp > safeTime+int64(maxReadAhead) {
+		return nil, fmt.Errorf("time %v of key %s is more than %v after the shard's safe time", time.Unix(0, args.Timestamp), args.Key, maxReadAhead)
+	}
+	if args.Timestamp > safeTime {
+		return shard.safe.wait(), nil
+	}
+	if txnID, locked := shard.locks[args.Key]; locked && shard.prepared[txnID].PreparedAt <= args.Timestamp {
+		return shard.safe.wait(), nil
+	}
+
+	version, exists := shard.versionAt(args.Key, args.Timestamp)
+	if exists {
+		reply.Value, reply.Exists, reply.Version = version.Value, true, version.Version
+	}
+	return nil, nil
+}
+
+// safeTime returns the latest time no write the shard has yet to commit can be committed at, apart from prepared distributed transactions
+// Writes are committed after the shard's clock, and outside a Raft group also at or after the wall clock, so the safe time is the later of the clock and the time just before now
+// In a Raft group a command's commit time comes from the time the leader proposed it, so only the clock counts, which reads advance as they are applied
+// The caller must hold the shard's lock
+func (shard *Shard) safeTime() int64 {
+	if shard.group != nil {
+		return shard.clock
+	}
+	return max(shard.clock, time.Now().UnixNano()-1)
+}
+
+// commitTime returns the commit time of a write the shard commits at the given time, and advances the shard's clock to it
+// It is the later of that time and the time just after the latest commit time the shard has given out or applied
+// The caller must hold the shard's write lock
+func (shard *Shard) commitTime(at int64) int64 {
+	shard.advanceClock(max(shard.clock+1, at))
+	return shard.clock
+}
+
+// advanceClock moves the shard's clock forward to a commit time, and wakes the reads waiting for their time to become safe
+// The caller must hold the shard's write lock
+func (shard *Shard) advanceClock(at int64) {
+	if at > shard.clock {
+		shard.clock = at
+		shard.safe.notify()
+	}
+}
+
+// A signal wakes the goroutines waiting for a shard's state to change
+// Waiters take the channel while they hold the shard's lock and the next change closes it, so no change is missed between checking the state and waiting
+// The mutex guards the channel, since waiters may only hold the shard's read lock
+type signal struct {
+	ch chan struct{}
+	mu sync.Mutex
+}
+
+// wait returns a channel that is closed by the next notify
+// The caller must hold the shard's lock
+func (s *signal) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+// notify wakes every goroutine waiting for the signal
+func (s *signal) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
+
+// versionAt returns the version of a key that was current at a time, and false if the key did not exist or had expired then
+// The caller must hold the shard's lock
+func (shard *Shard) versionAt(key string, timestamp int64) (keyVersion, bool) {
+	versions := shard.history[key]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].CommittedAt > timestamp })
+	if i == 0 {
+		return keyVersion{}, false
+	}
+	version := versions[i-1]
+	if version.Version == 0 || (version.ExpiresAt != 0 && version.ExpiresAt <= timestamp) {
+		return keyVersion{}, false
+	}
+	return version, true
+}
+
+// recordVersion adds a version to the history of a key
+// Versions are kept in commit order, a commit time before the key's newest version, which a clock that went backwards produces, is moved up to it
+// The caller must hold the shard's write lock
+func (shard *Shard) recordVersion(key string, version keyVersion) {
+	if shard.history == nil {
+		shard.history = make(map[string][]keyVersion)
+	}
+	versions := shard.history[key]
+	if n := len(versions); n > 0 {
+		version.CommittedAt = max(version.CommittedAt, versions[n-1].CommittedAt)
+	}
+	shard.history[key] = append(versions, version)
+}
+
+// compactHistory collects the versions that were replaced before the horizon, a time in Unix nanoseconds
+// The version that was current at the horizon is kept so that reads at the horizon and later are unaffected, unless it is a delete
+// The caller must hold the shard's write lock
+func (shard *Shard) compactHistory(horizon int64) {
+	if horizon <= shard.horizon {
+		return
+	}
+	shard.horizon = horizon
+	for key, versions := range shard.history {
+		start := sort.Search(len(versions), func(i int) bool { return versions[i].CommittedAt > horizon }) - 1
+		if start < 0 {
+			continue
+		}
+		if versions[start].Version == 0 {
+			start++
+		}
+		switch {
+		case start == len(versions):
+			delete(shard.history, key)
+		case start > 0:
+			shard.history[key] = append([]keyVersion(nil), versions[start:]...)
+		}
+	}
+}
+
+// clearHistory drops every version and the horizon of the shard
+// The caller must hold the shard's write lock
+func (shard *Shard) clearHistory() {
+	shard.history = nil
+	shard.horizon = 0
+}
+
+// historyRecords returns the records that restore the history of the shard from a snapshot, in front of the records of its keys
+// The newest version of an existing key is left out, since restoring the key itself adds it
+// The caller must hold the shard's lock
+func (shard *Shard) historyRecords() []*walRecord {
+	records := []*walRecord{{Op: walOpHorizon, Timestamp: shard.horizon}}
+	for key, versions := range shard.history {
+		if _, exists := shard.data[key]; exists {
+			versions = versions[:len(versions)-1]
+		}
+		for _, version := range versions {
+			records = append(records, &walRecord{Op: walOpHistory, Key: key, Value: version.Value, Version: version.Version, ExpiresAt: version.ExpiresAt, CommittedAt: version.CommittedAt})
+		}
+	}
+	return records
+}
+
+// currentCommit returns the commit time of the current version of a key, which is sent along with it when it is copied to another shard
+// The caller must hold the shard's lock
+func (shard *Shard) currentCommit(key string) int64 {
+	versions := shard.history[key]
+	if len(versions) == 0 {
+		return 0
+	}
+	return versions[len(versions)-1].CommittedAt
+}
+
+// historyRetention returns how long replaced versions are kept
+func (store *KVServer) historyRetention() time.Duration {
+	if store.config.HistoryRetention <= 0 {
+		return defaultHistoryRetention
+	}
+	return store.config.HistoryRetention
+}
+
+// compactLoop collects the versions older than the history horizon from every shard on a fixed interval until the server is closed
+func (store *KVServer) compactLoop(interval time.Duration) {
+	defer close(store.compactDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			horizon := time.Now().Add(-store.historyRetention()).UnixNano()
+			for _, shard := range store.allShards() {
+				if shard != nil {
+					shard.mu.Lock()
+					shard.compactHistory(horizon)
+					shard.mu.Unlock()
+				}
+			}
+		case <-store.compactStop:
+			return
+		}
+	}
+}
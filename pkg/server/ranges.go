@@ -0,0 +1,112 @@
+// ranges.go
+// This file contains the hash ranges used to describe which keys are moved between shards
+// Keys are placed by the 64-bit xxhash of the key, the same hash the router uses on its hash ring
+// Keys with a hash tag are placed by the hash of the tag alone, so that keys sharing a tag are always on the same shard
+package server
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// HashRange is an inclusive range of key hashes
+// Ranges never wrap around, a range crossing zero on the hash ring is split in two
+type HashRange struct {
+	Start uint64
+	End   uint64
+}
+
+// KeyHash returns the position of a key on the hash ring
+func KeyHash(key string) uint64 {
+	return xxhash.Sum64String(HashTag(key))
+}
+
+// HashTag returns the part of a key that decides its position on the hash ring
+// If the key has a non-empty section between its first '{' and the next '}', only that section is hashed, as in "{user:42}:profile"
+// Otherwise the whole key is hashed
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// A RangeSet is a sorted list of non-overlapping, non-adjacent hash ranges
+// The zero value is an empty set
+type RangeSet []HashRange
+
+// Contains reports whether the hash falls in any range of the set
+func (set RangeSet) Contains(hash uint64) bool {
+	idx, found := slices.BinarySearchFunc(set, hash, func(r HashRange, target uint64) int {
+		return cmp.Compare(r.Start, target)
+	})
+	if found {
+		return true
+	}
+	return idx > 0 && set[idx-1].End >= hash
+}
+
+// ContainsKey reports whether the key's hash falls in any range of the set
+func (set RangeSet) ContainsKey(key string) bool {
+	return set.Contains(KeyHash(key))
+}
+
+// Union returns a new set containing every hash in the set or in the given ranges
+func (set RangeSet) Union(ranges []HashRange) RangeSet {
+	all := append(slices.Clone(set), ranges...)
+	slices.SortFunc(all, func(a, b HashRange) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	merged := make(RangeSet, 0, len(all))
+	for _, r := range all {
+		if r.Start > r.End {
+			continue
+		}
+		last := len(merged) - 1
+		if last >= 0 && (merged[last].End == math.MaxUint64 || merged[last].End+1 >= r.Start) {
+			merged[last].End = max(merged[last].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// Subtract returns a new set containing every hash in the set that is not in the given ranges
+func (set RangeSet) Subtract(ranges []HashRange) RangeSet {
+	remove := RangeSet(nil).Union(ranges)
+	result := make(RangeSet, 0, len(set))
+
+	for _, r := range set {
+		covered := false
+		for _, cut := range remove {
+			if cut.End < r.Start || cut.Start > r.End {
+				continue
+			}
+			if cut.Start > r.Start {
+				result = append(result, HashRange{Start: r.Start, End: cut.Start - 1})
+			}
+			if cut.End >= r.End {
+				covered = true
+				break
+			}
+			r.Start = cut.End + 1
+		}
+		if !covered {
+			result = append(result, r)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,283 @@
+// replication.go
+// This file contains the server side of primary/backup replication
+// The router places a copy of every shard on other servers as backup shards and tells each primary where its backups are
+// Primaries apply every write locally and then forward it to their backups synchronously before acknowledging it
+// When a primary fails, the router promotes one of its backups, which already holds every acknowledged write
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ErrNotPrimary is returned for client requests on backup shards
+// net/rpc only transmits the error message, so clients should test for it with IsStaleRoute
+var ErrNotPrimary = errors.New("shard is not the primary for its keys")
+
+// IsStaleRoute reports whether an error returned by a shard means the client should look up the key's route again
+// This is the case when the key has moved to another shard, when the shard is no longer the primary, or when the route table is out of date
+func IsStaleRoute(err error) bool {
+	return IsKeyMoved(err) || IsStaleEpoch(err) || (err != nil && strings.Contains(err.Error(), ErrNotPrimary.Error()))
+}
+
+// fullRange covers every key hash, backups replicate all of their primary's keys
+var fullRange = RangeSet{{Start: 0, End: math.MaxUint64}}
+
+// AddShard is an RPC method that adds an empty backup shard to the server and returns its index
+// The router adds backup shards to hold copies of other servers' shards
+func (store *KVServer) AddShard(args *AddShardArgs, reply *AddShardReply) error {
+	shard := store.newShard()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	idx := len(store.shards)
+	if store.dataDir != "" {
+		if err := store.openShard(idx, shard); err != nil {
+			return fmt.Errorf("failed to create shard %d: %v", idx, err)
+		}
+	}
+	store.shards = append(store.shards, shard)
+	reply.ShardIdx = idx
+
+	return nil
+}
+
+// RemoveShard is an RPC method that deletes a backup shard along with its log and snapshots
+// The server's own shards and primary shards cannot be removed
+func (store *KVServer) RemoveShard(args *RemoveShardArgs, reply *RemoveShardReply) error {
+	if args.ShardIdx < store.numShards {
+		return fmt.Errorf("shard %d is one of the server's own shards and cannot be removed", args.ShardIdx)
+	}
+	return store.removeShard(args.ShardIdx)
+}
+
+// ConfigureShard is an RPC method that sets the role of a shard and the list of its backups
+// Backups that are no longer listed stop receiving writes, and new backups are cleared and then sent a full copy of the shard
+// Writes made while a new backup is copied are forwarded to it, so it is in sync once the call returns
+func (store *KVServer) ConfigureShard(args *ConfigureShardArgs, reply *ConfigureShardReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	if err := shard.checkNotRaft(); err != nil {
+		shard.mu.Unlock()
+		return err
+	}
+	shard.primary = args.Primary
+	shard.backups = slices.DeleteFunc(shard.backups, func(backup *forwarder) bool {
+		listed := slices.ContainsFunc(args.Backups, func(location ShardLocation) bool {
+			return location.Socket == backup.destSocket && location.ShardIdx == backup.destShardIdx
+		})
+		if !listed {
+			backup.dest.Close()
+		}
+		return !listed
+	})
+	shard.mu.Unlock()
+
+	var errs []error
+	for _, location := range args.Backups {
+		if err := shard.addBackup(location); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ResetShards is an RPC method that clears every shard except the ones listed
+// The router calls it when a server rejoins after being declared down, since its other shards were taken over while it was away
+// Cleared shards of the server itself become empty backups that serve no clients, and backup shards are removed
+func (store *KVServer) ResetShards(args *ResetShardsArgs, reply *ResetShardsReply) error {
+	var errs []error
+	for i, shard := range store.allShards() {
+		if shard == nil || slices.Contains(args.Keep, i) {
+			continue
+		}
+		if i >= store.numShards {
+			if err := store.removeShard(i); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		shard.mu.Lock()
+		shard.primary = false
+		shard.moved = nil
+		shard.closeForwarders()
+		shard.clearTxns()
+		if err := shard.dropRanges(fullRange); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %v", i, err))
+		}
+		shard.clearHistory()
+		shard.resetFeed()
+		shard.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// removeShard empties the shard's slot and deletes its files
+func (store *KVServer) removeShard(shardIdx int) error {
+	store.snapshotMu.Lock()
+	defer store.snapshotMu.Unlock()
+
+	store.mu.Lock()
+	if shardIdx < 0 || shardIdx >= len(store.shards) || store.shards[shardIdx] == nil {
+		store.mu.Unlock()
+		return fmt.Errorf("shard %d not found", shardIdx)
+	}
+	shard := store.shards[shardIdx]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.primary {
+		store.mu.Unlock()
+		return fmt.Errorf("shard %d is a primary and cannot be removed", shardIdx)
+	}
+	store.shards[shardIdx] = nil
+	store.mu.Unlock()
+
+	shard.closeForwarders()
+	if shard.wal == nil {
+		return nil
+	}
+	if err := shard.wal.Close(); err != nil {
+		return fmt.Errorf("failed to close log of shard %d: %v", shardIdx, err)
+	}
+	shard.wal = nil
+	if err := os.RemoveAll(store.shardDir(shardIdx)); err != nil {
+		return fmt.Errorf("failed to delete files of shard %d: %v", shardIdx, err)
+	}
+	return nil
+}
+
+// commit logs and applies writes to the shard, then forwards them to migration destinations and backups
+// Backups and migrations that failed to apply an earlier write are resynced first, and the writes are rejected if that is not possible
+// The caller must hold the shard's write lock
+func (shard *Shard) commit(records ...*walRecord) error {
+	if err := shard.commitLocally(records...); err != nil {
+		return err
+	}
+	return shard.forward(records)
+}
+
+// commitLocally is the part of commit that logs and applies the writes, the caller forwards them afterwards
+// Writes of client requests are applied once it returns without an error, even if forwarding them fails, so that is when their request IDs are remembered
+// The caller must hold the shard's write lock
+func (shard *Shard) commitLocally(records ...*walRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	if err := shard.resyncBackups(); err != nil {
+		return err
+	}
+	if err := shard.resyncMigrations(records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		shard.assignVersion(record)
+		if err := shard.logMutation(record); err != nil {
+			return fmt.Errorf("failed to log write of key %s: %v", record.Key, err)
+		}
+		shard.apply(record)
+	}
+	return nil
+}
+
+// addBackup starts replicating the shard to a backup shard that is not yet one of its backups
+// The backup is cleared, registered as a forwarder, and then sent every key in batches, like a migration of the full hash range
+func (shard *Shard) addBackup(location ShardLocation) error {
+	shard.mu.RLock()
+	exists := findForwarder(shard.backups, location.Socket, location.ShardIdx) >= 0
+	shard.mu.RUnlock()
+	if exists {
+		return nil
+	}
+
+	dest, err := dialForwarder(location.Socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to backup %s: %v", location.Socket, err)
+	}
+
+	// The backup may hold stale keys from an earlier role, but its timestamped writes may be ones the primary never saw
+	dropArgs := &DropRangesArgs{ShardIdx: location.ShardIdx, Ranges: fullRange, KeepTimestamped: true}
+	if err := callForwarder(dest, "KVServer.DropRanges", dropArgs, &DropRangesReply{}); err != nil {
+		dest.Close()
+		return fmt.Errorf("failed to clear backup %s shard %d: %v", location.Socket, location.ShardIdx, err)
+	}
+
+	backup := &forwarder{
+		ranges:       fullRange,
+		destSocket:   location.Socket,
+		destShardIdx: location.ShardIdx,
+		dest:         dest,
+	}
+
+	shard.mu.Lock()
+	if findForwarder(shard.backups, location.Socket, location.ShardIdx) >= 0 {
+		shard.mu.Unlock()
+		dest.Close()
+		return nil
+	}
+	shard.backups = append(shard.backups, backup)
+	keys := shard.keysIn(fullRange)
+	shard.mu.Unlock()
+
+	if _, err := shard.copyKeys(backup, keys); err != nil {
+		shard.mu.Lock()
+		backup.failed = true
+		shard.mu.Unlock()
+		return fmt.Errorf("failed to sync backup %s shard %d: %v", location.Socket, location.ShardIdx, err)
+	}
+	return nil
+}
+
+// resyncBackups reconnects to every backup that failed to apply a write and sends it a full copy of the shard
+// The caller must hold the shard's write lock, so writes stay blocked until the backups are in sync again
+func (shard *Shard) resyncBackups() error {
+	for _, backup := range shard.backups {
+		if !backup.failed {
+			continue
+		}
+
+		dest, err := dialForwarder(backup.destSocket)
+		if err != nil {
+			return fmt.Errorf("backup %s shard %d is out of sync: %v", backup.destSocket, backup.destShardIdx, err)
+		}
+		backup.dest.Close()
+		backup.dest = dest
+
+		dropArgs := &DropRangesArgs{ShardIdx: backup.destShardIdx, Ranges: fullRange, KeepTimestamped: true}
+		if err := callForwarder(dest, "KVServer.DropRanges", dropArgs, &DropRangesReply{}); err != nil {
+			return fmt.Errorf("backup %s shard %d is out of sync: %v", backup.destSocket, backup.destShardIdx, err)
+		}
+
+		keys := shard.keysIn(fullRange)
+		for start := 0; start < len(keys); start += migrationBatchSize {
+			if _, err := shard.copyBatch(backup, keys[start:min(start+migrationBatchSize, len(keys))]); err != nil {
+				return fmt.Errorf("backup %s shard %d is out of sync: %v", backup.destSocket, backup.destShardIdx, err)
+			}
+		}
+		backup.failed = false
+	}
+	return nil
+}
+
+// closeForwarders stops every migration and backup of the shard
+// The caller must hold the shard's write lock
+func (shard *Shard) closeForwarders() {
+	for _, f := range slices.Concat(shard.outgoing, shard.backups) {
+		f.dest.Close()
+	}
+	shard.outgoing = nil
+	shard.backups = nil
+}
@@ -1,13 +1,24 @@
 // rpc_types.go
 // This file contains the RPC types used for the key-value store server
 // The shard index provided by the router is used to determine which shard to access
+// Requests routed with a cached route table carry the table's epoch, which is zero otherwise
+// Client requests carry the time the client is still willing to wait for them, which is zero if it waits indefinitely
+// Writes carry a request ID that stays the same when the client retries them, so that a shard applies each write once
+// Keys and values are arbitrary bytes, values are sent as byte slices so that they reach the shards without being converted
 package server
 
+import "time"
+
 // The Set RPC method is used to set a key-value pair in the store
+// A positive TTL makes the key expire once it has passed, otherwise the key never expires
 type SetArgs struct {
-	Key      string
-	Value    string
-	ShardIdx int
+	Key       string
+	Value     []byte
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
+	TTL       time.Duration
 }
 
 type SetReply struct{}
@@ -16,17 +27,40 @@ type SetReply struct{}
 type GetArgs struct {
 	Key      string
 	ShardIdx int
+	Epoch    int64
+	Timeout  time.Duration
 }
 
+// The version is the key's current version, which is zero if it does not exist
 type GetReply struct {
-	Value  string
-	Exists bool
+	Value   []byte
+	Exists  bool
+	Version uint64
+}
+
+// The GetAt RPC method retrieves the value a key had at a point in time, given in Unix nanoseconds
+type GetAtArgs struct {
+	Key       string
+	Timestamp int64
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+}
+
+// The version is the version the key had at that time, which is zero if it did not exist
+type GetAtReply struct {
+	Value   []byte
+	Exists  bool
+	Version uint64
 }
 
 // The Delete RPC method is used to delete a key from the store
 type DeleteArgs struct {
-	Key      string
-	ShardIdx int
+	Key       string
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
 }
 
 type DeleteReply struct{}
@@ -35,15 +69,501 @@ type DeleteReply struct{}
 type ExistsArgs struct {
 	Key      string
 	ShardIdx int
+	Epoch    int64
+	Timeout  time.Duration
 }
 
 type ExistsReply struct {
 	Exists bool
 }
 
+// The Expire RPC method sets the time to live of an existing key, a zero TTL makes the key persist
+type ExpireArgs struct {
+	Key      string
+	TTL      time.Duration
+	ShardIdx int
+	Epoch    int64
+	Timeout  time.Duration
+}
+
+type ExpireReply struct {
+	Exists bool
+}
+
+// The TTL RPC method returns the time a key has left to live, which is zero if it never expires
+type TTLArgs struct {
+	Key      string
+	ShardIdx int
+	Epoch    int64
+	Timeout  time.Duration
+}
+
+type TTLReply struct {
+	Exists bool
+	TTL    time.Duration
+}
+
+// The Scan RPC method returns the keys of a server from Start up to but excluding End in ascending order, an empty End leaves the range unbounded
+// More reports that the server holds further keys in the range, which a scan starting after the last returned key will find
+type ScanArgs struct {
+	Start   string
+	End     string
+	Limit   int
+	Epoch   int64
+	Timeout time.Duration
+}
+
+type ScanReply struct {
+	Entries []Entry
+	More    bool
+}
+
+// The Watch RPC method returns the changes of a key, or of every key with the prefix if Prefix is set, applied after the given revision of a shard
+// It waits up to Wait for a change if there is none yet, and if Latest is set it returns the shard's current revision without any changes or waiting
+// The revision of the reply is the one to pass to the next call
+type WatchArgs struct {
+	Key      string
+	Prefix   bool
+	Revision uint64
+	Latest   bool
+	Wait     time.Duration
+	ShardIdx int
+	Epoch    int64
+	Timeout  time.Duration
+}
+
+type WatchReply struct {
+	Events   []ChangeEvent
+	Revision uint64
+}
+
+// A ChangeEvent is a write a shard applied to a key, either a set or a delete
+// The version is the revision of the shard the write was applied at, and the previous version is zero if the key did not exist before
+type ChangeEvent struct {
+	Key         string
+	Delete      bool
+	Value       []byte
+	Version     uint64
+	PrevValue   []byte
+	PrevVersion uint64
+}
+
+// The CompareAndSwap RPC method sets a key only if its version is the expected one, zero meaning that it must not exist
+type CompareAndSwapArgs struct {
+	Key             string
+	ExpectedVersion uint64
+	Value           []byte
+	ShardIdx        int
+	Epoch           int64
+	Timeout         time.Duration
+	RequestID       string
+}
+
+type CompareAndSwapReply struct {
+	Swapped bool
+	Version uint64
+}
+
+// The DeleteIfVersion RPC method deletes a key only if it exists with the given version
+type DeleteIfVersionArgs struct {
+	Key       string
+	Version   uint64
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
+}
+
+type DeleteIfVersionReply struct {
+	Deleted bool
+	Version uint64
+}
+
+// The Incr RPC method adds a delta to the integer value of a key and returns the new value
+type IncrArgs struct {
+	Key       string
+	Delta     int64
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
+}
+
+type IncrReply struct {
+	Value int64
+}
+
+// The Decr RPC method subtracts a delta from the integer value of a key and returns the new value
+type DecrArgs struct {
+	Key       string
+	Delta     int64
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
+}
+
+type DecrReply struct {
+	Value int64
+}
+
+// The Append RPC method appends a suffix to the value of a key and returns the length of the new value
+type AppendArgs struct {
+	Key       string
+	Value     []byte
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
+}
+
+type AppendReply struct {
+	Length int
+}
+
+// The GetAndSet RPC method sets a key and returns the value it replaced
+type GetAndSetArgs struct {
+	Key       string
+	Value     []byte
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
+}
+
+type GetAndSetReply struct {
+	Value  []byte
+	Exists bool
+}
+
+// The Txn RPC method applies the operations of a transaction if all of its compares hold, and none of them otherwise
+// Every key of a transaction must have the same hash tag, so that they all belong to the shard the transaction is sent to
+type TxnArgs struct {
+	Compares  []TxnCompare
+	Ops       []TxnOp
+	ShardIdx  int
+	Epoch     int64
+	Timeout   time.Duration
+	RequestID string
+}
+
+type TxnReply struct {
+	Succeeded bool
+}
+
+// A CompareTarget is the property of a key a transaction compare checks
+type CompareTarget int
+
+const (
+	// CompareVersion holds if the key has the given version, zero meaning that it must not exist
+	CompareVersion CompareTarget = iota
+	// CompareValue holds if the key exists with the given value
+	CompareValue
+)
+
+// A TxnCompare is a condition of a transaction on one key
+type TxnCompare struct {
+	Key     string
+	Target  CompareTarget
+	Version uint64
+	Value   []byte
+}
+
+// A TxnOp is a write of a transaction, which sets the key to the value unless it deletes the key
+type TxnOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// The PrepareTxn RPC method is the first phase of a two-phase commit on one participant shard
+// The shard checks the compares and locks the keys of the operations it is given, and Prepared reports whether the compares held
+// Self is the participant's own location and Primary the location of the shard holding the transaction record
+// The primary is prepared first and is the only participant given the list of all participants, itself included
+type PrepareTxnArgs struct {
+	TxnID        string
+	Compares     []TxnCompare
+	Ops          []TxnOp
+	ShardIdx     int
+	Self         ShardLocation
+	Primary      ShardLocation
+	Participants []ShardLocation
+	Epoch        int64
+	Timeout      time.Duration
+}
+
+// PreparedAt is the time of the shard's clock when it prepared, the transaction commits at that time or later
+type PrepareTxnReply struct {
+	Prepared   bool
+	PreparedAt int64
+}
+
+// The CommitTxn RPC method applies the prepared operations of a transaction and releases their locks
+// Committing on the primary is the point at which the transaction commits, and fails if the transaction has already been aborted
+// The commit time is chosen by the coordinator as the latest time any participant prepared at, so that every participant gives the writes the same commit time
+// The primary records it, and a retry or a participant that resolves the transaction later commits at the recorded time
+type CommitTxnArgs struct {
+	TxnID       string
+	ShardIdx    int
+	CommittedAt int64
+}
+
+type CommitTxnReply struct{}
+
+// The AbortTxn RPC method drops the prepared operations of a transaction and releases their locks
+// Primary is set when it is sent to the primary, which then records the abort even if the transaction was never prepared there
+type AbortTxnArgs struct {
+	TxnID    string
+	ShardIdx int
+	Primary  bool
+}
+
+type AbortTxnReply struct{}
+
+// The TxnStatus RPC method returns the state of a transaction from its record on the primary
+// Transactions the primary does not know, and pending ones that have timed out, are aborted
+type TxnStatusArgs struct {
+	TxnID    string
+	ShardIdx int
+}
+
+// CommittedAt is the commit time of committed transactions
+type TxnStatusReply struct {
+	State       TxnState
+	CommittedAt int64
+}
+
+// The ForgetTxn RPC method tells the primary that participants have resolved a transaction
+// The record is dropped once every participant has resolved it
+type ForgetTxnArgs struct {
+	TxnID        string
+	ShardIdx     int
+	Participants []ShardLocation
+}
+
+type ForgetTxnReply struct{}
+
+// A TxnState is the state of a distributed transaction in its record
+type TxnState int
+
+const (
+	// TxnPending is a transaction that has neither committed nor aborted
+	TxnPending TxnState = iota
+	// TxnCommitted is a transaction whose operations are applied on every participant
+	TxnCommitted
+	// TxnAborted is a transaction whose operations are dropped on every participant
+	TxnAborted
+)
+
 // The Length RPC method returns the number of keys in the store
 type LengthArgs struct{}
 
 type LengthReply struct {
 	Length int
 }
+
+// A BatchItem is a single key of a batched request along with the index of the shard that owns it
+// The value is only used by MultiSet, and the request ID only by writes
+type BatchItem struct {
+	Key       string
+	Value     []byte
+	ShardIdx  int
+	RequestID string
+}
+
+// A BatchResult is the outcome of a single key of a batched request
+// The error is empty if the key succeeded, net/rpc cannot transmit error values so it holds the message
+type BatchResult struct {
+	Value   []byte
+	Exists  bool
+	Version uint64
+	Err     string
+}
+
+// The MultiGet RPC method retrieves several keys at once
+type MultiGetArgs struct {
+	Items   []BatchItem
+	Epoch   int64
+	Timeout time.Duration
+}
+
+type MultiGetReply struct {
+	Results []BatchResult
+}
+
+// The MultiSet RPC method sets several key-value pairs at once
+type MultiSetArgs struct {
+	Items   []BatchItem
+	Epoch   int64
+	Timeout time.Duration
+}
+
+type MultiSetReply struct {
+	Results []BatchResult
+}
+
+// The MultiDelete RPC method deletes several keys at once
+type MultiDeleteArgs struct {
+	Items   []BatchItem
+	Epoch   int64
+	Timeout time.Duration
+}
+
+type MultiDeleteReply struct {
+	Results []BatchResult
+}
+
+// The Ping RPC method does nothing and lets clients check that a connection still reaches the server
+type PingArgs struct{}
+
+type PingReply struct{}
+
+// An Entry is a single key-value pair transferred between shards
+// The timestamp is set for writes coordinated by clients at a consistency level, and the version is the key's version on the sending shard
+// The expiry is the time in Unix nanoseconds at which the key expires, zero if it never does, and the commit time is when the sending shard committed the value
+type Entry struct {
+	Key         string
+	Value       []byte
+	Timestamp   int64
+	Version     uint64
+	ExpiresAt   int64
+	CommittedAt int64
+}
+
+// The MigrateOut RPC method streams every key in the given hash ranges to another shard
+// Writes to the ranges are forwarded to the destination until the migration is finished or aborted
+type MigrateOutArgs struct {
+	ShardIdx     int
+	Ranges       []HashRange
+	DestSocket   string
+	DestShardIdx int
+}
+
+type MigrateOutReply struct {
+	Moved int
+}
+
+// The FinishMigration RPC method drops the migrated ranges from the source shard once the routes have switched
+type FinishMigrationArgs struct {
+	ShardIdx     int
+	DestSocket   string
+	DestShardIdx int
+}
+
+type FinishMigrationReply struct{}
+
+// The AbortMigration RPC method stops a migration and keeps the ranges on the source shard
+type AbortMigrationArgs struct {
+	ShardIdx     int
+	DestSocket   string
+	DestShardIdx int
+}
+
+type AbortMigrationReply struct{}
+
+// The Import RPC method applies entries and deletes sent by a shard that is migrating ranges to this shard
+// Claimed ranges are accepted again by this shard if they were previously migrated away from it
+// Tombstones are timestamped deletes, which are applied even if the key is missing so that older writes cannot bring it back
+// Expiries change the expiry of existing keys without changing their values
+type ImportArgs struct {
+	ShardIdx   int
+	Claim      []HashRange
+	Entries    []Entry
+	Deletes    []string
+	Tombstones []Entry
+	Expiries   []Entry
+}
+
+type ImportReply struct{}
+
+// The DropRanges RPC method deletes every key in the given hash ranges from a shard
+// If KeepTimestamped is set, keys last written with a timestamp are kept along with timestamped deletes
+type DropRangesArgs struct {
+	ShardIdx        int
+	Ranges          []HashRange
+	KeepTimestamped bool
+}
+
+type DropRangesReply struct{}
+
+// A ShardLocation identifies a shard on a specific server
+type ShardLocation struct {
+	Socket   string
+	ShardIdx int
+}
+
+// The AddShard RPC method adds an empty backup shard to a server and returns its index
+type AddShardArgs struct{}
+
+type AddShardReply struct {
+	ShardIdx int
+}
+
+// The RemoveShard RPC method deletes a backup shard from a server
+type RemoveShardArgs struct {
+	ShardIdx int
+}
+
+type RemoveShardReply struct{}
+
+// The ConfigureShard RPC method sets whether a shard is a primary and which shards it replicates its writes to
+type ConfigureShardArgs struct {
+	ShardIdx int
+	Primary  bool
+	Backups  []ShardLocation
+}
+
+type ConfigureShardReply struct{}
+
+// The ResetShards RPC method clears every shard of a server except the ones listed
+type ResetShardsArgs struct {
+	Keep []int
+}
+
+type ResetShardsReply struct{}
+
+// The StartRaft RPC method makes a shard a member of a Raft group
+// Every member is sent the same list of peers along with its own position in it
+type StartRaftArgs struct {
+	ShardIdx int
+	Peers    []ShardLocation
+	Me       int
+}
+
+type StartRaftReply struct{}
+
+// The ReplicaSet RPC method applies a timestamped write sent by a client to every replica of a shard
+// Primaries and backups both accept it, and it is ignored if the replica already holds a newer write of the key
+type ReplicaSetArgs struct {
+	ShardIdx  int
+	Key       string
+	Value     []byte
+	Delete    bool
+	Timestamp int64
+	Epoch     int64
+	Timeout   time.Duration
+}
+
+type ReplicaSetReply struct{}
+
+// The ReplicaGet RPC method reads a key from any replica of a shard along with the timestamp of the write that produced it
+// Deleted keys are reported as missing with the timestamp of their delete
+type ReplicaGetArgs struct {
+	ShardIdx int
+	Key      string
+	Epoch    int64
+	Timeout  time.Duration
+}
+
+type ReplicaGetReply struct {
+	Value     []byte
+	Exists    bool
+	Timestamp int64
+}
+
+// The AdvanceEpoch RPC method tells a server the epoch of the router's latest route table
+type AdvanceEpochArgs struct {
+	Epoch int64
+}
+
+type AdvanceEpochReply struct{}
@@ -0,0 +1,80 @@
+// scan.go
+// This file contains range scans, which list the keys of a server in order
+// Keys are spread over every server by their hash, so a scan of a key range asks every server and the client merges the sorted replies
+// Each serving shard is read under its own lock for at most the requested number of keys, and the shards' keys are merged in order
+// Scans read the current state of each shard, on shards in a Raft group that is the leader's state without ordering through the log
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxScanLimit bounds the number of keys a single scan returns, requests without a limit get this many
+const maxScanLimit = 1000
+
+// Scan is an RPC method that returns the keys from Start up to but excluding End in ascending order along with their values
+// An empty End means that the range is unbounded, and at most Limit keys are returned
+// Only primaries and Raft leaders are scanned so that replicated keys are returned once, and keys that have expired are skipped
+// The reply reports whether the server holds more keys in the range than it returned
+func (store *KVServer) Scan(args *ScanArgs, reply *ScanReply) error {
+	if args.End != "" && args.End <= args.Start {
+		return fmt.Errorf("scan end %q must be after its start %q", args.End, args.Start)
+	}
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+	limit := args.Limit
+	if limit <= 0 || limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	var entries []Entry
+	for _, shard := range store.allShards() {
+		if shard == nil {
+			continue
+		}
+		if err := checkDeadline(deadline, args.Start); err != nil {
+			return err
+		}
+		// One more key than the limit tells whether the range holds more keys
+		entries = append(entries, shard.scan(args.Start, args.End, limit+1)...)
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+		reply.More = true
+	}
+	reply.Entries = entries
+	return nil
+}
+
+// scan returns up to limit keys of the shard in the range along with their values and versions, in ascending order
+// Shards that do not serve clients return nothing
+func (shard *Shard) scan(start string, end string, limit int) []Entry {
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if !shard.primary && !shard.raftLeader() {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	var entries []Entry
+	for node := shard.keys.seek(start); node != nil && len(entries) < limit; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		if shard.expired(node.key, now) || (len(shard.moved) > 0 && shard.moved.ContainsKey(node.key)) {
+			continue
+		}
+		entries = append(entries, Entry{Key: node.key, Value: shard.data[node.key], Version: shard.versions[node.key]})
+	}
+	return entries
+}
@@ -0,0 +1,101 @@
+// skiplist.go
+// This file contains the skip list that keeps the keys of a shard in order
+// The shard's map stays the authority for values, the skip list only answers which keys come after a given one
+// Insertions, deletions, and seeks take logarithmic time on average, and iterating from a seek point visits keys in ascending order
+package server
+
+import (
+	"math/rand/v2"
+)
+
+const (
+	// skipListMaxLevel bounds the height of the skip list, which comfortably indexes billions of keys
+	skipListMaxLevel = 24
+	// skipListBranching is the inverse of the probability that a node reaches the next level
+	skipListBranching = 4
+)
+
+// A skipListNode is a key together with its successor on every level the node reaches
+type skipListNode struct {
+	key  string
+	next []*skipListNode
+}
+
+// A skipList is a sorted set of keys
+// It is not safe for concurrent use, shards guard it with their lock
+type skipList struct {
+	head   *skipListNode
+	level  int
+	length int
+}
+
+// newSkipList returns an empty skip list
+func newSkipList() *skipList {
+	return &skipList{head: &skipListNode{next: make([]*skipListNode, skipListMaxLevel)}, level: 1}
+}
+
+// randomLevel picks the height of a new node, each level being reached with probability 1 / skipListBranching
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.IntN(skipListBranching) == 0 {
+		level++
+	}
+	return level
+}
+
+// predecessors returns the last node before the key on every level
+func (list *skipList) predecessors(key string) []*skipListNode {
+	update := make([]*skipListNode, skipListMaxLevel)
+	node := list.head
+	for level := list.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		update[level] = node
+	}
+	return update
+}
+
+// insert adds a key to the list, keys already in it are left alone
+func (list *skipList) insert(key string) {
+	update := list.predecessors(key)
+	if next := update[0].next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := randomLevel()
+	for l := list.level; l < level; l++ {
+		update[l] = list.head
+	}
+	list.level = max(list.level, level)
+
+	node := &skipListNode{key: key, next: make([]*skipListNode, level)}
+	for l := range level {
+		node.next[l] = update[l].next[l]
+		update[l].next[l] = node
+	}
+	list.length++
+}
+
+// delete removes a key from the list if it is in it
+func (list *skipList) delete(key string) {
+	update := list.predecessors(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	for l := range len(node.next) {
+		update[l].next[l] = node.next[l]
+	}
+	for list.level > 1 && list.head.next[list.level-1] == nil {
+		list.level--
+	}
+	list.length--
+}
+
+// seek returns the node of the first key at or after the given one, or nil if there is none
+// Following next[0] from it visits the remaining keys in ascending order
+func (list *skipList) seek(key string) *skipListNode {
+	return list.predecessors(key)[0].next[0]
+}
@@ -0,0 +1,233 @@
+// snapshot.go
+// This file contains the periodic snapshotting of shards and the truncation of their write-ahead logs
+// A snapshot is built in the background by folding the sealed log segments into the previous snapshot
+// Writers are only blocked while the log is rotated, and the result is the shard's map exactly as it was at that moment
+// Recovery loads the newest readable snapshot and replays the log segments written after it
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotPath returns the path of a numbered snapshot
+// Snapshot N contains every record from the log segments numbered below N
+func snapshotPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seq, snapshotExt))
+}
+
+// restoreSnapshot rebuilds the shard from the newest readable snapshot in the directory
+// It returns the number of the snapshot used, or zero if the shard has to be rebuilt from the log alone
+// Unreadable snapshots are skipped in favour of older ones, which is why older log segments are retained alongside them
+func (shard *Shard) restoreSnapshot(dir string) (uint64, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, fmt.Errorf("failed to create log directory %s: %v", dir, err)
+	}
+
+	seqs, err := listSeqs(dir, snapshotExt)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(seqs) - 1; i >= 0; i-- {
+		path := snapshotPath(dir, seqs[i])
+		err := loadSnapshot(path, shard.apply)
+		if err == nil {
+			return seqs[i], nil
+		}
+
+		log.Printf("Skipping unreadable snapshot %s: %v", path, err)
+		clear(shard.data)
+		shard.keys = newSkipList()
+		clear(shard.versions)
+		clear(shard.expiries)
+		shard.clearTxns()
+		shard.clearHistory()
+		shard.revision = 0
+	}
+
+	return 0, nil
+}
+
+// loadSnapshot passes every entry of a snapshot file to apply
+// Snapshots are written atomically, so anything short of a complete file is reported as an error
+func loadSnapshot(path string, apply func(*walRecord)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	validSize, err := replaySegment(path, apply)
+	if err != nil {
+		return err
+	}
+	if validSize != info.Size() {
+		return fmt.Errorf("corrupt record at offset %d", validSize)
+	}
+
+	return nil
+}
+
+// writeSnapshot writes every entry of the shard to a new snapshot file
+// The file is written under a temporary name and renamed once it is durable, so a crash never leaves a partial snapshot
+func writeSnapshot(dir string, seq uint64, shard *Shard) error {
+	path := snapshotPath(dir, seq)
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot %s: %v", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(file)
+	// Older versions come first, so that each key's own record adds its newest version after them
+	for _, record := range shard.historyRecords() {
+		if _, err := writer.Write(encodeWALRecord(record)); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write snapshot %s: %v", tmpPath, err)
+		}
+	}
+	for key, value := range shard.data {
+		record := &walRecord{Op: walOpSet, Key: key, Value: value, Timestamp: shard.stamps[key], Version: shard.versions[key], ExpiresAt: shard.expiries[key], CommittedAt: shard.currentCommit(key)}
+		if _, err := writer.Write(encodeWALRecord(record)); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write snapshot %s: %v", tmpPath, err)
+		}
+	}
+	// Tombstones are kept so that older timestamped writes stay deleted after a restore
+	for key, timestamp := range shard.stamps {
+		if _, exists := shard.data[key]; exists {
+			continue
+		}
+		if _, err := writer.Write(encodeWALRecord(&walRecord{Op: walOpDelete, Key: key, Timestamp: timestamp})); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write snapshot %s: %v", tmpPath, err)
+		}
+	}
+	for _, record := range shard.txnStateRecords() {
+		if _, err := writer.Write(encodeWALRecord(record)); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write snapshot %s: %v", tmpPath, err)
+		}
+	}
+	if _, err := writer.Write(encodeWALRecord(&walRecord{Op: walOpRevision, Version: shard.revision})); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write snapshot %s: %v", tmpPath, err)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write snapshot %s: %v", tmpPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync snapshot %s: %v", tmpPath, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot %s: %v", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install snapshot %s: %v", path, err)
+	}
+	return syncDir(dir)
+}
+
+// snapshot rotates the shard's log and writes a snapshot of everything logged before the rotation
+// Only the rotation happens under the shard's lock, the snapshot itself is built from files that are no longer written to
+// Afterwards the oldest snapshots beyond the retention count and the log segments they cover are removed
+// Versions replaced before the history horizon, a time in Unix nanoseconds, are left out of the snapshot
+// Shards that have not changed since the last snapshot are skipped
+func (shard *Shard) snapshot(dir string, retention int, horizon int64) error {
+	shard.mu.Lock()
+	if shard.wal == nil || shard.wal.Size() == 0 {
+		shard.mu.Unlock()
+		return nil
+	}
+	seq, err := shard.wal.Rotate()
+	shard.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the state at the rotation point in a scratch shard
+	scratch := NewShard()
+	baseSeq, err := scratch.restoreSnapshot(dir)
+	if err != nil {
+		return err
+	}
+	segments, err := listSeqs(dir, walExt)
+	if err != nil {
+		return err
+	}
+	for _, segmentSeq := range segments {
+		if segmentSeq < baseSeq || segmentSeq >= seq {
+			continue
+		}
+		if _, err := replaySegment(segmentPath(dir, segmentSeq), scratch.apply); err != nil {
+			return err
+		}
+	}
+
+	scratch.compactHistory(horizon)
+	if err := writeSnapshot(dir, seq, scratch); err != nil {
+		return err
+	}
+	return pruneLog(dir, retention)
+}
+
+// pruneLog removes all but the newest snapshots and every log segment that precedes the oldest remaining snapshot
+func pruneLog(dir string, retention int) error {
+	snapshots, err := listSeqs(dir, snapshotExt)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	for len(snapshots) > retention {
+		if err := os.Remove(snapshotPath(dir, snapshots[0])); err != nil {
+			return fmt.Errorf("failed to remove snapshot: %v", err)
+		}
+		snapshots = snapshots[1:]
+	}
+
+	segments, err := listSeqs(dir, walExt)
+	if err != nil {
+		return err
+	}
+	for _, segmentSeq := range segments {
+		if segmentSeq >= snapshots[0] {
+			break
+		}
+		if err := os.Remove(segmentPath(dir, segmentSeq)); err != nil {
+			return fmt.Errorf("failed to remove log segment: %v", err)
+		}
+	}
+
+	return syncDir(dir)
+}
+
+// snapshotLoop snapshots every shard on a fixed interval until the server is closed
+func (store *KVServer) snapshotLoop(interval time.Duration) {
+	defer close(store.snapshotDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.Snapshot(); err != nil {
+				log.Println("Error snapshotting shards:", err)
+			}
+		case <-store.snapshotStop:
+			return
+		}
+	}
+}
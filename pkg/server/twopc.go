@@ -0,0 +1,551 @@
+// twopc.go
+// This file contains the participant side of distributed transactions, whose keys live on several shards and are committed with two-phase commit
+// The client coordinates a transaction: it prepares every participant shard, which checks the compares and locks the keys, and then commits or aborts all of them
+// One participant is the transaction's primary and holds its record, committing the primary is the point at which the whole transaction commits
+// Prepared operations, locks, and records are logged, so they survive a restart of the server
+// Every participant prepares at a time of its clock, and the transaction commits on all of them at the latest of those times, so a read at a point in time sees all of its writes or none
+// Reads at or after the time a key was prepared at wait for the transaction to resolve, since it may still commit at their time
+// Participants that stay prepared for longer than the transaction timeout ask the primary for the outcome, which resolves transactions whose coordinator crashed
+// The primary aborts transactions it does not know and pending ones that have timed out, so a transaction that has not reached its commit point never blocks its keys for long
+// Transaction state is kept on the primary shard of each participant and is not replicated to backups or Raft groups, which cannot take part
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net/rpc"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTxnTimeout is how long a distributed transaction may stay prepared before it is resolved without its coordinator, if the config does not set it
+	defaultTxnTimeout = 10 * time.Second
+	// defaultTxnRecoveryInterval is how often shards look for prepared transactions to resolve, if the config does not set it
+	defaultTxnRecoveryInterval = time.Second
+)
+
+// ErrKeyLocked is returned for writes of keys that are locked by a prepared distributed transaction
+// The lock is released once the transaction commits or aborts, so callers may retry
+// net/rpc only transmits the error message, so callers should test for it with IsKeyLocked
+var ErrKeyLocked = errors.New("key is locked by a distributed transaction")
+
+// ErrTxnAborted is returned for commits of distributed transactions that have already been aborted
+// net/rpc only transmits the error message, so callers should test for it with IsTxnAborted
+var ErrTxnAborted = errors.New("distributed transaction has been aborted")
+
+// IsKeyLocked reports whether an error returned by a server means that a key was locked by a distributed transaction
+func IsKeyLocked(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrKeyLocked.Error())
+}
+
+// IsTxnAborted reports whether an error returned by a server means that a distributed transaction was aborted before it could commit
+func IsTxnAborted(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrTxnAborted.Error())
+}
+
+// A preparedTxn is a distributed transaction a shard has prepared, it is logged gob-encoded as the value of a prepare record
+// Keys are every key the transaction compares or writes, which stay locked until it commits or aborts
+// Prepared is the wall clock time the transaction timeout counts from, and PreparedAt the time of the shard's clock the transaction commits at or after
+type preparedTxn struct {
+	Keys       []string
+	Ops        []TxnOp
+	Self       ShardLocation
+	Primary    ShardLocation
+	Prepared   int64
+	PreparedAt int64
+}
+
+// A txnRecord is the state of a distributed transaction on its primary, it is logged gob-encoded as the value of a record
+// Remaining lists the participants that may still hold the transaction prepared, the record is dropped once none do
+// Committed transactions record the commit time their coordinator chose, which every participant commits at
+type txnRecord struct {
+	State       TxnState
+	Created     int64
+	Updated     int64
+	Remaining   []ShardLocation
+	CommittedAt int64
+}
+
+// PrepareTxn is an RPC method that prepares a shard's part of a distributed transaction
+// The reply reports whether the compares held, in which case the keys are locked and the operations are logged, and nothing is changed otherwise
+// Keys locked by another transaction fail the prepare with ErrKeyLocked, and so does a primary that has already aborted the transaction
+// A retry of a prepare the shard has already made is acknowledged as prepared at the same time
+func (store *KVServer) PrepareTxn(args *PrepareTxnArgs, reply *PrepareTxnReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+	if args.TxnID == "" {
+		return errors.New("distributed transaction has no ID")
+	}
+
+	var keys []string
+	for _, compare := range args.Compares {
+		keys = append(keys, compare.Key)
+	}
+	for _, op := range args.Ops {
+		if !op.Delete {
+			if err := store.checkValueSize(op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+		keys = append(keys, op.Key)
+	}
+	if len(keys) == 0 {
+		return errors.New("transaction has no compares or operations")
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	if err := checkDeadline(deadline, keys[0]); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := shard.checkOwnership(key); err != nil {
+			return err
+		}
+	}
+	if prepared, exists := shard.prepared[args.TxnID]; exists {
+		reply.Prepared, reply.PreparedAt = true, prepared.PreparedAt
+		return nil
+	}
+	if record := shard.txnRecords[args.TxnID]; record != nil {
+		if record.State == TxnAborted {
+			return fmt.Errorf("%v: %s", ErrTxnAborted, args.TxnID)
+		}
+		reply.Prepared = true
+		return nil
+	}
+	for _, key := range keys {
+		if err := shard.checkUnlocked(key); err != nil {
+			return err
+		}
+	}
+
+	_, ok, err := shard.resolveTxn(&walRecord{Value: encodeTxn(args.Compares, args.Ops), Timestamp: time.Now().UnixNano()})
+	if err != nil {
+		return fmt.Errorf("failed to prepare transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+	}
+	if !ok {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	var records []*walRecord
+	if len(args.Participants) > 0 {
+		records = append(records, newTxnRecord(args.TxnID, &txnRecord{State: TxnPending, Created: now, Updated: now, Remaining: args.Participants}))
+	}
+	prepared := &preparedTxn{Keys: keys, Ops: args.Ops, Self: args.Self, Primary: args.Primary, Prepared: now, PreparedAt: shard.commitTime(now)}
+	records = append(records, &walRecord{Op: walOpPrepare, Key: args.TxnID, Value: encodeGob(prepared)})
+	if err := shard.persist(records...); err != nil {
+		return fmt.Errorf("failed to prepare transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+	}
+	reply.Prepared, reply.PreparedAt = true, prepared.PreparedAt
+	return nil
+}
+
+// CommitTxn is an RPC method that commits a shard's part of a distributed transaction
+// On the primary the transaction's record is marked as committed at the coordinator's commit time first, which fails with ErrTxnAborted if it has been aborted
+// Committing a transaction the shard does not hold prepared does nothing, so retries are acknowledged
+func (store *KVServer) CommitTxn(args *CommitTxnArgs, reply *CommitTxnReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	committedAt := args.CommittedAt
+	if record := shard.txnRecords[args.TxnID]; record != nil {
+		switch record.State {
+		case TxnAborted:
+			return fmt.Errorf("%v: %s", ErrTxnAborted, args.TxnID)
+		case TxnPending:
+			if err := shard.setTxnState(args.TxnID, TxnCommitted, committedAt); err != nil {
+				return fmt.Errorf("failed to commit transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+			}
+		case TxnCommitted:
+			committedAt = record.CommittedAt
+		}
+	}
+	if err := shard.finishTxn(args.TxnID, true, committedAt); err != nil {
+		return fmt.Errorf("failed to commit transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+	}
+	return nil
+}
+
+// AbortTxn is an RPC method that aborts a shard's part of a distributed transaction
+// On the primary the transaction's record is marked as aborted, and created as aborted if the primary never prepared it, so that a late prepare fails
+// Transactions that have already committed cannot be aborted
+func (store *KVServer) AbortTxn(args *AbortTxnArgs, reply *AbortTxnReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	record := shard.txnRecords[args.TxnID]
+	switch {
+	case record != nil && record.State == TxnCommitted:
+		return fmt.Errorf("distributed transaction %s has already committed", args.TxnID)
+	case record != nil && record.State == TxnPending:
+		if err := shard.setTxnState(args.TxnID, TxnAborted, 0); err != nil {
+			return fmt.Errorf("failed to abort transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+		}
+	case record == nil && args.Primary:
+		now := time.Now().UnixNano()
+		if err := shard.persist(newTxnRecord(args.TxnID, &txnRecord{State: TxnAborted, Created: now, Updated: now})); err != nil {
+			return fmt.Errorf("failed to abort transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+		}
+	}
+	if err := shard.finishTxn(args.TxnID, false, 0); err != nil {
+		return fmt.Errorf("failed to abort transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+	}
+	return nil
+}
+
+// TxnStatus is an RPC method that returns the state of a distributed transaction whose primary is the shard, along with its commit time if it committed
+// Transactions the shard does not know are recorded as aborted, and so are pending ones older than the transaction timeout
+func (store *KVServer) TxnStatus(args *TxnStatusArgs, reply *TxnStatusReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	state, committedAt, err := shard.txnState(args.TxnID, store.txnTimeout())
+	if err != nil {
+		return fmt.Errorf("failed to look up transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+	}
+	reply.State, reply.CommittedAt = state, committedAt
+	return nil
+}
+
+// ForgetTxn is an RPC method that removes participants that have resolved a distributed transaction from its record on the primary
+func (store *KVServer) ForgetTxn(args *ForgetTxnArgs, reply *ForgetTxnReply) error {
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	if err := shard.forgetParticipants(args.TxnID, args.Participants); err != nil {
+		return fmt.Errorf("failed to update transaction %s in shard %d: %v", args.TxnID, args.ShardIdx, err)
+	}
+	return nil
+}
+
+// checkUnlocked returns ErrKeyLocked if a prepared distributed transaction holds the key
+// The caller must hold the shard's lock
+func (shard *Shard) checkUnlocked(key string) error {
+	if txnID, exists := shard.locks[key]; exists {
+		return fmt.Errorf("%v: %s by %s", ErrKeyLocked, key, txnID)
+	}
+	return nil
+}
+
+// txnState returns the state and commit time of a transaction from its record, aborting unknown transactions and pending ones older than the timeout
+// A primary that does not know a transaction either never prepared it or has forgotten it after it was aborted, so it can never commit
+// The caller must hold the shard's write lock
+func (shard *Shard) txnState(txnID string, timeout time.Duration) (TxnState, int64, error) {
+	record := shard.txnRecords[txnID]
+	if record == nil {
+		now := time.Now().UnixNano()
+		return TxnAborted, 0, shard.persist(newTxnRecord(txnID, &txnRecord{State: TxnAborted, Created: now, Updated: now}))
+	}
+	if record.State == TxnPending && time.Since(time.Unix(0, record.Created)) > timeout {
+		return TxnAborted, 0, shard.setTxnState(txnID, TxnAborted, 0)
+	}
+	return record.State, record.CommittedAt, nil
+}
+
+// setTxnState logs a new state for the record of a transaction, along with the commit time of committed ones
+// The caller must hold the shard's write lock
+func (shard *Shard) setTxnState(txnID string, state TxnState, committedAt int64) error {
+	record := *shard.txnRecords[txnID]
+	record.State, record.Updated, record.CommittedAt = state, time.Now().UnixNano(), committedAt
+	return shard.persist(newTxnRecord(txnID, &record))
+}
+
+// forgetParticipants logs the record of a transaction without the given participants
+// The caller must hold the shard's write lock
+func (shard *Shard) forgetParticipants(txnID string, participants []ShardLocation) error {
+	current := shard.txnRecords[txnID]
+	if current == nil {
+		return nil
+	}
+	record := *current
+	record.Remaining = slices.DeleteFunc(slices.Clone(record.Remaining), func(location ShardLocation) bool {
+		return slices.Contains(participants, location)
+	})
+	if len(record.Remaining) == len(current.Remaining) {
+		return nil
+	}
+	record.Updated = time.Now().UnixNano()
+	return shard.persist(newTxnRecord(txnID, &record))
+}
+
+// finishTxn commits or aborts a transaction the shard holds prepared and releases its locks
+// Committed operations are logged as a single record at the given commit time and forwarded like the writes of a single-shard transaction
+// The commit time is never before the time the shard prepared at, which is used if the coordinator did not choose one
+// On the primary the shard then removes itself from the transaction's record
+// The caller must hold the shard's write lock
+func (shard *Shard) finishTxn(txnID string, commit bool, committedAt int64) error {
+	prepared, exists := shard.prepared[txnID]
+	if !exists {
+		return nil
+	}
+
+	if commit {
+		writes := make([]*walRecord, 0, len(prepared.Ops))
+		for _, op := range prepared.Ops {
+			if op.Delete {
+				writes = append(writes, &walRecord{Op: walOpDelete, Key: op.Key})
+			} else {
+				writes = append(writes, &walRecord{Op: walOpSet, Key: op.Key, Value: op.Value})
+			}
+		}
+		if err := shard.commitTxn(walOpCommitPrepared, txnID, writes, max(committedAt, prepared.PreparedAt)); err != nil {
+			return err
+		}
+	} else if err := shard.persist(&walRecord{Op: walOpAbortPrepared, Key: txnID}); err != nil {
+		return err
+	}
+
+	return shard.forgetParticipants(txnID, []ShardLocation{prepared.Self})
+}
+
+// persist logs and applies records that change the transaction state of the shard
+// The caller must hold the shard's write lock
+func (shard *Shard) persist(records ...*walRecord) error {
+	for _, record := range records {
+		if err := shard.logMutation(record); err != nil {
+			return fmt.Errorf("failed to log transaction %s: %v", record.Key, err)
+		}
+		shard.apply(record)
+	}
+	return nil
+}
+
+// applyTxnState applies a prepare, abort, or record of a distributed transaction, committed writes are applied by apply
+// Records that cannot be decoded are skipped like undecodable transactions
+// The caller must hold the shard's write lock
+func (shard *Shard) applyTxnState(record *walRecord) {
+	switch record.Op {
+	case walOpPrepare:
+		prepared := &preparedTxn{}
+		if err := decodeGob(record.Value, prepared); err != nil {
+			log.Printf("Skipping undecodable prepare of transaction %s: %v", record.Key, err)
+			return
+		}
+		if shard.prepared == nil {
+			shard.prepared = make(map[string]*preparedTxn)
+			shard.locks = make(map[string]string)
+		}
+		shard.prepared[record.Key] = prepared
+		for _, key := range prepared.Keys {
+			shard.locks[key] = record.Key
+		}
+		shard.advanceClock(prepared.PreparedAt)
+	case walOpCommitPrepared, walOpAbortPrepared:
+		if prepared, exists := shard.prepared[record.Key]; exists {
+			for _, key := range prepared.Keys {
+				delete(shard.locks, key)
+			}
+			delete(shard.prepared, record.Key)
+			shard.safe.notify()
+		}
+	case walOpTxnRecord:
+		if len(record.Value) == 0 {
+			delete(shard.txnRecords, record.Key)
+			return
+		}
+		state := &txnRecord{}
+		if err := decodeGob(record.Value, state); err != nil {
+			log.Printf("Skipping undecodable record of transaction %s: %v", record.Key, err)
+			return
+		}
+		if shard.txnRecords == nil {
+			shard.txnRecords = make(map[string]*txnRecord)
+		}
+		shard.txnRecords[record.Key] = state
+	}
+}
+
+// clearTxns drops every prepared transaction, lock, and record of the shard
+// The caller must hold the shard's write lock
+func (shard *Shard) clearTxns() {
+	shard.prepared = nil
+	shard.locks = nil
+	shard.txnRecords = nil
+	shard.safe.notify()
+}
+
+// txnStateRecords returns the records that restore the prepared transactions and transaction records of the shard
+// The caller must hold the shard's lock
+func (shard *Shard) txnStateRecords() []*walRecord {
+	var records []*walRecord
+	for txnID, record := range shard.txnRecords {
+		records = append(records, newTxnRecord(txnID, record))
+	}
+	for txnID, prepared := range shard.prepared {
+		records = append(records, &walRecord{Op: walOpPrepare, Key: txnID, Value: encodeGob(prepared)})
+	}
+	return records
+}
+
+// newTxnRecord returns the log record that stores the record of a transaction
+func newTxnRecord(txnID string, record *txnRecord) *walRecord {
+	return &walRecord{Op: walOpTxnRecord, Key: txnID, Value: encodeGob(record)}
+}
+
+// encodeGob encodes transaction state for the log, which only fails for types gob cannot encode
+func encodeGob(value any) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		panic(fmt.Sprintf("failed to encode transaction state: %v", err))
+	}
+	return buf.Bytes()
+}
+
+// decodeGob decodes transaction state from the log
+func decodeGob(data []byte, value any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// txnTimeout returns how long a distributed transaction may stay prepared before it is resolved without its coordinator
+func (store *KVServer) txnTimeout() time.Duration {
+	if store.config.TxnTimeout <= 0 {
+		return defaultTxnTimeout
+	}
+	return store.config.TxnTimeout
+}
+
+// txnLoop resolves the timed out prepared transactions of every shard on a fixed interval until the server is closed
+func (store *KVServer) txnLoop(interval time.Duration) {
+	defer close(store.txnDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, shard := range store.allShards() {
+				if shard != nil {
+					shard.recoverTxns(store.txnTimeout())
+				}
+			}
+		case <-store.txnStop:
+			return
+		}
+	}
+}
+
+// recoverTxns resolves the transactions the shard has held prepared for longer than the timeout and drops records that are no longer needed
+// The outcome is asked from each transaction's primary without holding the shard's lock, pending transactions are left for a later run
+// Aborted records are dropped after the request window, since an unknown transaction counts as aborted, and committed ones once every participant has resolved them
+func (shard *Shard) recoverTxns(timeout time.Duration) {
+	now := time.Now()
+
+	shard.mu.Lock()
+	if !shard.primary || shard.group != nil {
+		shard.mu.Unlock()
+		return
+	}
+	stale := make(map[string]preparedTxn)
+	for txnID, prepared := range shard.prepared {
+		if now.Sub(time.Unix(0, prepared.Prepared)) > timeout {
+			stale[txnID] = *prepared
+		}
+	}
+	for txnID, record := range shard.txnRecords {
+		if record.State == TxnPending || now.Sub(time.Unix(0, record.Updated)) <= requestWindow {
+			continue
+		}
+		if record.State == TxnAborted || len(record.Remaining) == 0 {
+			if err := shard.persist(&walRecord{Op: walOpTxnRecord, Key: txnID}); err != nil {
+				log.Printf("Error dropping record of transaction %s: %v", txnID, err)
+			}
+		}
+	}
+	shard.mu.Unlock()
+
+	for txnID, prepared := range stale {
+		if err := shard.recoverTxn(txnID, prepared, timeout); err != nil {
+			log.Printf("Error recovering transaction %s: %v", txnID, err)
+		}
+	}
+}
+
+// recoverTxn asks the primary of a prepared transaction for its outcome and commits or aborts the shard's part of it accordingly
+// The primary is then told that the shard has resolved the transaction
+func (shard *Shard) recoverTxn(txnID string, prepared preparedTxn, timeout time.Duration) error {
+	if prepared.Primary == prepared.Self {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		state, committedAt, err := shard.txnState(txnID, timeout)
+		if err != nil || state == TxnPending {
+			return err
+		}
+		return shard.finishTxn(txnID, state == TxnCommitted, committedAt)
+	}
+
+	primary, err := rpc.Dial("tcp", prepared.Primary.Socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to primary %s: %v", prepared.Primary.Socket, err)
+	}
+	defer primary.Close()
+
+	reply := &TxnStatusReply{}
+	if err := primary.Call("KVServer.TxnStatus", &TxnStatusArgs{TxnID: txnID, ShardIdx: prepared.Primary.ShardIdx}, reply); err != nil {
+		return err
+	}
+	if reply.State == TxnPending {
+		return nil
+	}
+
+	shard.mu.Lock()
+	err = shard.finishTxn(txnID, reply.State == TxnCommitted, reply.CommittedAt)
+	shard.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	forgetArgs := &ForgetTxnArgs{TxnID: txnID, ShardIdx: prepared.Primary.ShardIdx, Participants: []ShardLocation{prepared.Self}}
+	return primary.Call("KVServer.ForgetTxn", forgetArgs, &ForgetTxnReply{})
+}
@@ -0,0 +1,249 @@
+// txn.go
+// This file contains single-shard transactions, which compare and write several keys as one step
+// A transaction's keys share a hash tag, which places them on the same shard, so the shard's lock is enough to apply them together
+// Either every compare holds and every write is applied, or nothing is applied
+// The writes are logged as a single record, so a crash never leaves part of a transaction in the shard's log
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrCrossShardTxn is returned for transactions whose keys do not share a hash tag
+// net/rpc only transmits the error message, so callers should test for it with IsCrossShardTxn
+var ErrCrossShardTxn = errors.New("transaction keys do not share a hash tag")
+
+// IsCrossShardTxn reports whether an error returned by a server means that a transaction spanned more than one hash tag
+func IsCrossShardTxn(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrCrossShardTxn.Error())
+}
+
+// Txn is an RPC method that applies the operations of a transaction if all of its compares hold
+// The reply reports whether they held, in which case every operation was applied
+// Like conditional writes, keys that have expired by the time the transaction arrived count as missing, and sets remove the expiry of their key
+// A retry of a transaction the shard has already applied is acknowledged as successful without applying it again
+func (store *KVServer) Txn(args *TxnArgs, reply *TxnReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+	keys, err := store.checkTxn(args)
+	if err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	record := &walRecord{Op: walOpTxn, Key: keys[0], Value: encodeTxn(args.Compares, args.Ops), Timestamp: time.Now().UnixNano()}
+	if shard.isRaft() {
+		record.RequestID = args.RequestID
+		result, err := shard.propose(record, deadline)
+		if err != nil {
+			return fmt.Errorf("failed to apply transaction in shard %d: %v", args.ShardIdx, err)
+		}
+		if result.err != nil {
+			return fmt.Errorf("failed to apply transaction in shard %d: %v", args.ShardIdx, result.err)
+		}
+		reply.Succeeded = result.succeeded
+		return nil
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := checkDeadline(deadline, keys[0]); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := shard.checkOwnership(key); err != nil {
+			return err
+		}
+		if err := shard.checkUnlocked(key); err != nil {
+			return err
+		}
+	}
+	if shard.applied(args.RequestID) {
+		reply.Succeeded = true
+		return nil
+	}
+
+	writes, ok, err := shard.resolveTxn(record)
+	if err != nil {
+		return fmt.Errorf("failed to apply transaction in shard %d: %v", args.ShardIdx, err)
+	}
+	if !ok {
+		return nil
+	}
+	if len(writes) == 0 {
+		reply.Succeeded = true
+		return nil
+	}
+	if err := shard.commitTxnLocally(walOpTxn, writes[0].Key, writes, 0); err != nil {
+		return fmt.Errorf("failed to apply transaction in shard %d: %v", args.ShardIdx, err)
+	}
+	shard.remember(args.RequestID)
+	if err := shard.forward(writes); err != nil {
+		return fmt.Errorf("failed to apply transaction in shard %d: %v", args.ShardIdx, err)
+	}
+	reply.Succeeded = true
+	return nil
+}
+
+// checkTxn returns the keys of a transaction after checking that they share a hash tag and that its values are not too large
+func (store *KVServer) checkTxn(args *TxnArgs) ([]string, error) {
+	var keys []string
+	for _, compare := range args.Compares {
+		keys = append(keys, compare.Key)
+	}
+	for _, op := range args.Ops {
+		if !op.Delete {
+			if err := store.checkValueSize(op.Key, op.Value); err != nil {
+				return nil, err
+			}
+		}
+		keys = append(keys, op.Key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("transaction has no compares or operations")
+	}
+	for _, key := range keys[1:] {
+		if HashTag(key) != HashTag(keys[0]) {
+			return nil, fmt.Errorf("%v: %s and %s", ErrCrossShardTxn, keys[0], key)
+		}
+	}
+	return keys, nil
+}
+
+// encodeTxn encodes the compares and operations of a transaction as the value of a transaction record
+func encodeTxn(compares []TxnCompare, ops []TxnOp) []byte {
+	var records []*walRecord
+	for _, compare := range compares {
+		if compare.Target == CompareValue {
+			records = append(records, &walRecord{Op: walOpCompareValue, Key: compare.Key, Value: compare.Value})
+		} else {
+			records = append(records, &walRecord{Op: walOpCompareVersion, Key: compare.Key, Version: compare.Version})
+		}
+	}
+	for _, op := range ops {
+		if op.Delete {
+			records = append(records, &walRecord{Op: walOpDelete, Key: op.Key})
+		} else {
+			records = append(records, &walRecord{Op: walOpSet, Key: op.Key, Value: op.Value})
+		}
+	}
+	return encodeRecords(records)
+}
+
+// encodeRecords concatenates the frames of several records
+func encodeRecords(records []*walRecord) []byte {
+	var buf []byte
+	for _, record := range records {
+		buf = append(buf, encodeWALRecord(record)...)
+	}
+	return buf
+}
+
+// decodeRecords splits the value of a transaction record back into its records
+func decodeRecords(buf []byte) ([]*walRecord, error) {
+	var records []*walRecord
+	for len(buf) > 0 {
+		if len(buf) < walHeaderSize {
+			return nil, errors.New("truncated transaction record")
+		}
+		length := int(binary.LittleEndian.Uint32(buf[0:4]))
+		if len(buf) < walHeaderSize+length {
+			return nil, errors.New("truncated transaction record")
+		}
+		record, err := decodeWALRecord(buf[walHeaderSize : walHeaderSize+length])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		buf = buf[walHeaderSize+length:]
+	}
+	return records, nil
+}
+
+// resolveTxn checks the compares of a transaction and returns its writes, along with whether every compare held
+// Keys that have expired by the record's timestamp count as missing, so every member of a Raft group decides the same way
+// The caller must hold the shard's lock
+func (shard *Shard) resolveTxn(record *walRecord) ([]*walRecord, bool, error) {
+	records, err := decodeRecords(record.Value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var writes []*walRecord
+	for _, sub := range records {
+		value, exists := shard.data[sub.Key]
+		if exists && shard.expired(sub.Key, record.Timestamp) {
+			value, exists = nil, false
+		}
+		switch sub.Op {
+		case walOpCompareVersion:
+			version := uint64(0)
+			if exists {
+				version = shard.versions[sub.Key]
+			}
+			if version != sub.Version {
+				return nil, false, nil
+			}
+		case walOpCompareValue:
+			if !exists || string(value) != string(sub.Value) {
+				return nil, false, nil
+			}
+		case walOpSet, walOpDelete:
+			writes = append(writes, sub)
+		default:
+			return nil, false, fmt.Errorf("unexpected operation %d in transaction", sub.Op)
+		}
+	}
+	return writes, true, nil
+}
+
+// commitTxn logs writes as a single record with the given operation and key, applies them, and forwards them like commit
+// Every write takes its own revision, which is assigned before the record is logged, and they all share the same commit time
+// Distributed transactions pass the commit time their coordinator chose, other transactions pass zero and take the next time of the shard's clock
+// The record is applied the same way it is when the log is replayed, which applies every write in order
+// The caller must hold the shard's write lock
+func (shard *Shard) commitTxn(op walOp, key string, writes []*walRecord, committedAt int64) error {
+	if err := shard.commitTxnLocally(op, key, writes, committedAt); err != nil {
+		return err
+	}
+	return shard.forward(writes)
+}
+
+// commitTxnLocally is the part of commitTxn that logs and applies the writes, like commitLocally
+// The caller must hold the shard's write lock
+func (shard *Shard) commitTxnLocally(op walOp, key string, writes []*walRecord, committedAt int64) error {
+	if err := shard.checkNotRaft(); err != nil {
+		return err
+	}
+	if err := shard.resyncBackups(); err != nil {
+		return err
+	}
+	if err := shard.resyncMigrations(writes); err != nil {
+		return err
+	}
+
+	if committedAt == 0 {
+		committedAt = shard.commitTime(time.Now().UnixNano())
+	}
+	for i, write := range writes {
+		write.Version = shard.revision + uint64(i) + 1
+		write.CommittedAt = committedAt
+	}
+	record := &walRecord{Op: op, Key: key, Value: encodeRecords(writes), CommittedAt: committedAt}
+	if err := shard.logMutation(record); err != nil {
+		return fmt.Errorf("failed to log transaction on key %s: %v", key, err)
+	}
+	shard.apply(record)
+	return nil
+}
@@ -0,0 +1,59 @@
+// values.go
+// This file contains the limit on the size of the values clients write
+// Values are arbitrary bytes, and every value is held in memory, written to the log, and forwarded to backups and migrations
+// The limit keeps a single write from doing all of that with an unbounded amount of data, and is checked before a write takes a shard's lock
+// Writes between shards, such as migrations, carry values that were already accepted and are not checked again
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// defaultMaxValueSize is the largest value in bytes the server accepts if the config does not set a limit
+const defaultMaxValueSize = 1 << 20
+
+// ErrValueTooLarge is returned for writes whose value is larger than the server's maximum value size
+// net/rpc only transmits the error message, so callers should test for it with IsValueTooLarge
+var ErrValueTooLarge = errors.New("value exceeds maximum size")
+
+// IsValueTooLarge reports whether an error returned by a server means a write was rejected because of the size of its value
+func IsValueTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrValueTooLarge.Error())
+}
+
+// maxValueSize returns the largest value in bytes the server accepts, or zero if values are unlimited
+func (store *KVServer) maxValueSize() int {
+	switch {
+	case store.config.MaxValueSize < 0:
+		return 0
+	case store.config.MaxValueSize == 0:
+		return defaultMaxValueSize
+	default:
+		return store.config.MaxValueSize
+	}
+}
+
+// checkValueSize returns ErrValueTooLarge if a value written to a key is larger than the server accepts
+func (store *KVServer) checkValueSize(key string, value []byte) error {
+	if limit := store.maxValueSize(); limit > 0 && len(value) > limit {
+		return fmt.Errorf("%v: %s has %d bytes, limit is %d", ErrValueTooLarge, key, len(value), limit)
+	}
+	return nil
+}
+
+// checkValueSizes fails the results of the items whose values are too large and returns the remaining items with their results
+func (store *KVServer) checkValueSizes(items []BatchItem, results []*BatchResult) ([]BatchItem, []*BatchResult) {
+	var keptItems []BatchItem
+	var keptResults []*BatchResult
+	for i, item := range items {
+		if err := store.checkValueSize(item.Key, item.Value); err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		keptItems = append(keptItems, item)
+		keptResults = append(keptResults, results[i])
+	}
+	return keptItems, keptResults
+}
@@ -0,0 +1,135 @@
+// versions.go
+// This file contains per-key versions and the conditional writes built on them
+// Every applied write takes the next revision of its shard, and a key's version is the revision of the write that produced it
+// Versions only grow, so a key that is deleted and set again never gets back a version a client may still hold
+// Conditional writes only apply if the key still has the version the client expects, which lets clients build counters, locks, and optimistic concurrency
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// CompareAndSwap is an RPC method that sets a key only if its current version is the expected one
+// An expected version of zero means that the key must not exist, which is how SetIfNotExists is built
+// The reply reports whether the value was swapped along with the key's version afterwards
+// On shards in a Raft group the version is compared when the command is applied, so every member decides the same way
+func (store *KVServer) CompareAndSwap(args *CompareAndSwapArgs, reply *CompareAndSwapReply) error {
+	if err := store.checkValueSize(args.Key, args.Value); err != nil {
+		return err
+	}
+	record := &walRecord{Op: walOpCompareAndSwap, Key: args.Key, Value: args.Value, Version: args.ExpectedVersion, Timestamp: time.Now().UnixNano()}
+	swapped, version, err := store.writeConditional(record, args.ShardIdx, args.Epoch, args.Timeout, args.RequestID)
+	if err != nil {
+		return fmt.Errorf("failed to swap key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	reply.Swapped, reply.Version = swapped, version
+	return nil
+}
+
+// DeleteIfVersion is an RPC method that deletes a key only if it exists with the given version
+// The reply reports whether the key was deleted along with its version, which is zero once it is deleted
+func (store *KVServer) DeleteIfVersion(args *DeleteIfVersionArgs, reply *DeleteIfVersionReply) error {
+	record := &walRecord{Op: walOpDeleteIfVersion, Key: args.Key, Version: args.Version, Timestamp: time.Now().UnixNano()}
+	deleted, version, err := store.writeConditional(record, args.ShardIdx, args.Epoch, args.Timeout, args.RequestID)
+	if err != nil {
+		return fmt.Errorf("failed to delete key %s in shard %d: %v", args.Key, args.ShardIdx, err)
+	}
+	reply.Deleted, reply.Version = deleted, version
+	return nil
+}
+
+// writeConditional applies a conditional write to a shard and reports whether its condition held along with the key's version afterwards
+// Like Set, a retry of a write the shard has already applied is acknowledged as successful without applying it again
+func (store *KVServer) writeConditional(record *walRecord, shardIdx int, epoch int64, timeout time.Duration, requestID string) (bool, uint64, error) {
+	deadline := requestDeadline(timeout)
+	if err := store.checkEpoch(epoch); err != nil {
+		return false, 0, err
+	}
+
+	shard, err := store.getShard(shardIdx)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if shard.isRaft() {
+		record.RequestID = requestID
+		result, err := shard.propose(record, deadline)
+		if err != nil {
+			return false, 0, err
+		}
+		return result.succeeded, result.version, nil
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := checkDeadline(deadline, record.Key); err != nil {
+		return false, 0, err
+	}
+	if err := shard.checkOwnership(record.Key); err != nil {
+		return false, 0, err
+	}
+	if err := shard.checkUnlocked(record.Key); err != nil {
+		return false, 0, err
+	}
+	if shard.applied(requestID) {
+		return true, shard.versions[record.Key], nil
+	}
+
+	write, ok := shard.resolve(record)
+	if !ok {
+		return false, shard.versions[record.Key], nil
+	}
+	if err := shard.commitLocally(write); err != nil {
+		return false, 0, err
+	}
+	shard.remember(requestID)
+	if err := shard.forward([]*walRecord{write}); err != nil {
+		return false, 0, err
+	}
+	return true, shard.versions[record.Key], nil
+}
+
+// resolve turns a conditional write into the plain write it stands for, and reports whether its condition holds
+// Conditional writes carry the time they were made as their timestamp, and keys that have expired by then count as missing
+// That way every member of a Raft group decides the same way, however late it applies the write
+// The caller must hold the shard's lock
+func (shard *Shard) resolve(record *walRecord) (*walRecord, bool) {
+	version, exists := shard.versions[record.Key]
+	if exists && shard.expired(record.Key, record.Timestamp) {
+		version, exists = 0, false
+	}
+	switch record.Op {
+	case walOpCompareAndSwap:
+		if version != record.Version {
+			return nil, false
+		}
+		return &walRecord{Op: walOpSet, Key: record.Key, Value: record.Value}, true
+	case walOpDeleteIfVersion:
+		if !exists || version != record.Version {
+			return nil, false
+		}
+		return &walRecord{Op: walOpDelete, Key: record.Key}, true
+	case walOpReap:
+		if !shard.expired(record.Key, record.Timestamp) {
+			return nil, false
+		}
+		return &walRecord{Op: walOpDelete, Key: record.Key}, true
+	default:
+		return record, true
+	}
+}
+
+// assignVersion gives a write that has no version yet the shard's next revision, so that its log record and its forwarded copies carry the same version
+// Writes without a commit time are stamped with the next time of the shard's clock the same way
+// The caller must hold the shard's write lock
+// Expire records do not change the key's value and get no version
+func (shard *Shard) assignVersion(record *walRecord) {
+	if record.Version == 0 && record.Op != walOpExpire {
+		record.Version = shard.revision + 1
+	}
+	if record.CommittedAt == 0 {
+		record.CommittedAt = shard.commitTime(time.Now().UnixNano())
+	}
+}
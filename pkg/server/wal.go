@@ -0,0 +1,596 @@
+// wal.go
+// This file contains the write-ahead log used to make shards durable across restarts
+// Every mutation of a shard is appended to the shard's log before it is applied to the in-memory map
+// On startup the log is replayed to rebuild the shard exactly as it was before the process stopped
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when the write-ahead log is flushed to stable storage
+// Records are always written to the operating system before a write returns, so a process crash never loses data
+// The policy only decides how much data can be lost if the whole machine goes down
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the log after every record
+	SyncAlways SyncPolicy = iota
+	// SyncBatch flushes the log once a configured number of records have been written
+	SyncBatch
+	// SyncInterval flushes the log in the background on a fixed interval
+	SyncInterval
+)
+
+// ParseSyncPolicy converts a command-line policy name into a SyncPolicy
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "interval":
+		return SyncInterval, nil
+	default:
+		return 0, fmt.Errorf("unknown sync policy %q, expected always, batch, or interval", name)
+	}
+}
+
+// walOp identifies the mutation stored in a log record
+type walOp byte
+
+const (
+	walOpSet    walOp = 1
+	walOpDelete walOp = 2
+	// walOpGet orders reads in the Raft log of shards replicated with Raft, it is never written to a shard's log
+	walOpGet walOp = 3
+	// walOpRevision records a shard's revision in snapshots, so that versions of deleted keys are not reused after a restore
+	walOpRevision walOp = 4
+	// walOpCompareAndSwap and walOpDeleteIfVersion are conditional writes in the Raft log, whose version is the one the key must have
+	// They are resolved into plain writes when they are applied and are never written to a shard's log
+	walOpCompareAndSwap  walOp = 5
+	walOpDeleteIfVersion walOp = 6
+	// walOpExpire sets the expiry of an existing key, or removes it if the record's expiry is zero
+	walOpExpire walOp = 7
+	// walOpReap deletes a key in the Raft log if it has expired by the record's timestamp, it is never written to a shard's log
+	walOpReap walOp = 8
+	// walOpIncr, walOpAppend, and walOpGetAndSet are read-modify-writes in the Raft log, they are resolved into sets when they are applied and are never written to a shard's log
+	// The value of an increment is its delta in decimal
+	walOpIncr      walOp = 9
+	walOpAppend    walOp = 10
+	walOpGetAndSet walOp = 11
+	// walOpTxn is a transaction, whose value holds the encoded records of its compares and writes
+	// In the Raft log it is resolved when it is applied, in a shard's log it holds only the writes, which are replayed together
+	walOpTxn walOp = 12
+	// walOpCompareVersion and walOpCompareValue are the compares of a transaction, they only appear inside its value
+	walOpCompareVersion walOp = 13
+	walOpCompareValue   walOp = 14
+	// walOpPrepare holds the prepared operations of a distributed transaction, whose ID is the record's key
+	// walOpCommitPrepared holds the writes that commit them, and walOpAbortPrepared drops them
+	walOpPrepare        walOp = 15
+	walOpCommitPrepared walOp = 16
+	walOpAbortPrepared  walOp = 17
+	// walOpTxnRecord holds the record of a distributed transaction on its primary, an empty value drops the record
+	walOpTxnRecord walOp = 18
+	// walOpHistory holds an older version of a key in snapshots, a version of zero marks a delete
+	// walOpHorizon records in snapshots the time before which older versions have been collected, as the record's timestamp
+	walOpHistory walOp = 19
+	walOpHorizon walOp = 20
+)
+
+// A walRecord is a single mutation of a shard
+// Writes coordinated by clients at a consistency level carry the client's timestamp, other writes leave it at zero
+// The version is the shard revision the write gives the key, records without one get the next revision when they are applied
+// The expiry is the time in Unix nanoseconds at which the key expires, zero if it never does
+// The commit time is the time in Unix nanoseconds at which the shard committed the write, which orders the key's versions in its history
+// Client writes in the Raft log carry the client's request ID, so that every member of the group recognizes a retry when it applies it
+// Appends carry the largest value they may produce as their maximum size, zero if there is no limit
+type walRecord struct {
+	Op          walOp
+	Key         string
+	Value       []byte
+	Timestamp   int64
+	Version     uint64
+	ExpiresAt   int64
+	CommittedAt int64
+	RequestID   string
+	MaxSize     uint64
+}
+
+// Each record is framed by a fixed-size header holding the payload length, its CRC-32 checksum and a checksum of the header itself
+// The payload checksum lets replay detect a record that was only partially written when the process died
+// The header checksum lets replay trust the length of a damaged record and find where the next one starts
+const walHeaderSize = 12
+
+// The WAL struct is the append-only log of a single shard
+// The log is split into numbered segment files inside the shard's directory
+// Records are appended to the newest segment, older segments are sealed and only read during recovery and snapshotting
+type WAL struct {
+	dir       string
+	file      *os.File
+	seq       uint64
+	size      int64
+	policy    SyncPolicy
+	batchSize int
+	pending   int
+	mu        sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// OpenWAL opens the log in the given directory, creating the directory and first segment if they do not exist
+// Records in segments numbered fromSeq and above are passed to apply in the order they were written
+// A torn record at the end of the newest segment is truncated so that new records are appended after the last intact one
+func OpenWAL(dir string, config *Config, fromSeq uint64, apply func(*walRecord)) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory %s: %v", dir, err)
+	}
+
+	seqs, err := listSeqs(dir, walExt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replay every sealed segment in full, the newest segment is replayed below so that its torn tail can be truncated
+	seq := max(fromSeq, 1)
+	for i, segmentSeq := range seqs {
+		if segmentSeq < fromSeq || i == len(seqs)-1 {
+			continue
+		}
+		if _, err := replaySegment(segmentPath(dir, segmentSeq), apply); err != nil {
+			return nil, err
+		}
+	}
+	if len(seqs) > 0 && seqs[len(seqs)-1] >= seq {
+		seq = seqs[len(seqs)-1]
+	}
+
+	path := segmentPath(dir, seq)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log %s: %v", path, err)
+	}
+
+	validSize, err := replayWAL(file, apply)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to replay log %s: %v", path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat log %s: %v", path, err)
+	}
+	if info.Size() != validSize {
+		log.Printf("Truncating log %s from %d to %d bytes after a torn record", path, info.Size(), validSize)
+		if err := file.Truncate(validSize); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to truncate log %s: %v", path, err)
+		}
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek log %s: %v", path, err)
+	}
+
+	wal := &WAL{
+		dir:       dir,
+		file:      file,
+		seq:       seq,
+		size:      validSize,
+		policy:    config.SyncPolicy,
+		batchSize: config.SyncBatchSize,
+	}
+	if wal.policy == SyncInterval {
+		wal.stop = make(chan struct{})
+		wal.done = make(chan struct{})
+		go wal.syncLoop(config.SyncInterval)
+	}
+
+	return wal, nil
+}
+
+// Rotate seals the current segment and starts appending to a new one
+// It returns the number of the new segment, every record before it is in a sealed segment
+// The caller must hold the shard's write lock so that no record straddles the rotation
+func (wal *WAL) Rotate() (uint64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if err := wal.file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync log before rotation: %v", err)
+	}
+
+	path := segmentPath(wal.dir, wal.seq+1)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create log %s: %v", path, err)
+	}
+	if err := syncDir(wal.dir); err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	wal.file.Close()
+	wal.file = file
+	wal.seq++
+	wal.size = 0
+	wal.pending = 0
+
+	return wal.seq, nil
+}
+
+// Append writes a record to the end of the log and flushes it according to the sync policy
+// The caller must hold the shard's write lock so that the log order matches the order of the in-memory updates
+func (wal *WAL) Append(record *walRecord) error {
+	frame := encodeWALRecord(record)
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if _, err := wal.file.Write(frame); err != nil {
+		return fmt.Errorf("failed to append to log: %v", err)
+	}
+	wal.size += int64(len(frame))
+
+	switch wal.policy {
+	case SyncAlways:
+		return wal.file.Sync()
+	case SyncBatch:
+		wal.pending++
+		if wal.pending >= wal.batchSize {
+			wal.pending = 0
+			return wal.file.Sync()
+		}
+	}
+
+	return nil
+}
+
+// Size returns the number of bytes in the current segment
+func (wal *WAL) Size() int64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.size
+}
+
+// Close flushes any unsynced records and closes the log file
+func (wal *WAL) Close() error {
+	if wal.stop != nil {
+		close(wal.stop)
+		<-wal.done
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if err := wal.file.Sync(); err != nil {
+		wal.file.Close()
+		return fmt.Errorf("failed to sync log: %v", err)
+	}
+	return wal.file.Close()
+}
+
+// syncLoop flushes the log on a fixed interval until the log is closed
+func (wal *WAL) syncLoop(interval time.Duration) {
+	defer close(wal.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			wal.mu.Lock()
+			if err := wal.file.Sync(); err != nil {
+				log.Println("Error syncing log:", err)
+			}
+			wal.mu.Unlock()
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// The log directory of a shard holds segments and snapshots named by zero-padded sequence numbers
+// Zero padding keeps the lexical and numeric order of the files identical
+const (
+	walExt      = ".wal"
+	snapshotExt = ".snap"
+)
+
+// segmentPath returns the path of a numbered log segment
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seq, walExt))
+}
+
+// listSeqs returns the sorted sequence numbers of all files in the directory with the given extension
+func listSeqs(dir string, ext string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+
+	seqs := make([]uint64, 0)
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), ext)
+		if !found || entry.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+
+	return seqs, nil
+}
+
+// syncDir flushes a directory so that newly created, renamed, or removed files survive a machine crash
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %v", dir, err)
+	}
+	defer file.Close()
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %v", dir, err)
+	}
+	return nil
+}
+
+// replaySegment passes every intact record of a sealed segment or snapshot file to apply
+// It returns the offset just past the last intact record
+func replaySegment(path string, apply func(*walRecord)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	validSize, err := replayWAL(file, apply)
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay %s: %v", path, err)
+	}
+	return validSize, nil
+}
+
+// encodeWALRecord serializes a record into a length-prefixed, checksummed frame
+// The payload is the operation byte followed by the length-prefixed key and value
+// A nonzero timestamp is appended as a varint, so records written before timestamps existed still decode
+// A nonzero version follows the timestamp as a uvarint, a nonzero expiry follows the version as a varint, a nonzero commit time follows the expiry as a varint, a request ID follows the commit time as a length-prefixed string, and a nonzero maximum size follows the request ID as a uvarint
+// Every field before the last nonzero one is written even if it is zero
+func encodeWALRecord(record *walRecord) []byte {
+	payload := make([]byte, 0, 1+8*binary.MaxVarintLen64+len(record.Key)+len(record.Value)+len(record.RequestID))
+	payload = append(payload, byte(record.Op))
+	payload = binary.AppendUvarint(payload, uint64(len(record.Key)))
+	payload = append(payload, record.Key...)
+	payload = binary.AppendUvarint(payload, uint64(len(record.Value)))
+	payload = append(payload, record.Value...)
+	if record.Timestamp != 0 || record.Version != 0 || record.ExpiresAt != 0 || record.CommittedAt != 0 || record.RequestID != "" || record.MaxSize != 0 {
+		payload = binary.AppendVarint(payload, record.Timestamp)
+	}
+	if record.Version != 0 || record.ExpiresAt != 0 || record.CommittedAt != 0 || record.RequestID != "" || record.MaxSize != 0 {
+		payload = binary.AppendUvarint(payload, record.Version)
+	}
+	if record.ExpiresAt != 0 || record.CommittedAt != 0 || record.RequestID != "" || record.MaxSize != 0 {
+		payload = binary.AppendVarint(payload, record.ExpiresAt)
+	}
+	if record.CommittedAt != 0 || record.RequestID != "" || record.MaxSize != 0 {
+		payload = binary.AppendVarint(payload, record.CommittedAt)
+	}
+	if record.RequestID != "" || record.MaxSize != 0 {
+		payload = binary.AppendUvarint(payload, uint64(len(record.RequestID)))
+		payload = append(payload, record.RequestID...)
+	}
+	if record.MaxSize != 0 {
+		payload = binary.AppendUvarint(payload, record.MaxSize)
+	}
+
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(frame[8:12], crc32.ChecksumIEEE(frame[0:8]))
+	return append(frame, payload...)
+}
+
+// decodeWALRecord parses the payload of a frame back into a record
+func decodeWALRecord(payload []byte) (*walRecord, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty record")
+	}
+	record := &walRecord{Op: walOp(payload[0])}
+	rest := payload[1:]
+
+	key, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	value, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value: %v", err)
+	}
+	if len(rest) > 0 {
+		timestamp, n := binary.Varint(rest)
+		if n <= 0 {
+			return nil, errors.New("invalid timestamp")
+		}
+		record.Timestamp = timestamp
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		version, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, errors.New("invalid version")
+		}
+		record.Version = version
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		expiresAt, n := binary.Varint(rest)
+		if n <= 0 {
+			return nil, errors.New("invalid expiry")
+		}
+		record.ExpiresAt = expiresAt
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		committedAt, n := binary.Varint(rest)
+		if n <= 0 {
+			return nil, errors.New("invalid commit time")
+		}
+		record.CommittedAt = committedAt
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		requestID, remainder, err := readLengthPrefixed(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request ID: %v", err)
+		}
+		record.RequestID = string(requestID)
+		rest = remainder
+	}
+	if len(rest) > 0 {
+		maxSize, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, errors.New("invalid maximum size")
+		}
+		record.MaxSize = maxSize
+	}
+
+	record.Key = string(key)
+	record.Value = value
+	return record, nil
+}
+
+// readLengthPrefixed reads a uvarint length followed by that many bytes
+// It returns the bytes read and the remainder of the buffer
+func readLengthPrefixed(buf []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, nil, errors.New("malformed length")
+	}
+	buf = buf[n:]
+	if uint64(len(buf)) < length {
+		return nil, nil, errors.New("length exceeds record")
+	}
+	return buf[:length], buf[length:], nil
+}
+
+// replayWAL reads every intact record from the start of the file and passes it to apply
+// It returns the offset just past the last intact record
+// Reading stops at the first short or corrupt frame, which is the torn tail of an interrupted write unless checkTail finds records after it
+// A log damaged in the middle is reported as an error instead of dropping the records after the damage
+func replayWAL(file *os.File, apply func(*walRecord)) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, nil
+			}
+			return 0, err
+		}
+		if !validHeader(header) {
+			return checkTail(file, offset, info.Size(), header)
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if offset+int64(walHeaderSize)+int64(length) > info.Size() {
+			return offset, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, nil
+			}
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return checkTail(file, offset, info.Size(), header)
+		}
+
+		record, err := decodeWALRecord(payload)
+		if err != nil {
+			return checkTail(file, offset, info.Size(), header)
+		}
+		apply(record)
+
+		offset += int64(walHeaderSize) + int64(length)
+	}
+}
+
+// validHeader reports whether a frame header matches its own checksum
+func validHeader(header []byte) bool {
+	return crc32.ChecksumIEEE(header[0:8]) == binary.LittleEndian.Uint32(header[8:12])
+}
+
+// checkTail decides whether the bad frame at the offset is the torn tail of the file
+// It returns the offset if the frame is torn, and an error if records were written after it
+// A frame with an intact header is followed by a record only if an intact header starts right where the frame ends
+// A frame with a damaged header has no trustworthy end, so it is torn only if the header or everything after it was never written
+func checkTail(file *os.File, offset int64, size int64, header []byte) (int64, error) {
+	if validHeader(header) {
+		next := offset + int64(walHeaderSize) + int64(binary.LittleEndian.Uint32(header[0:4]))
+		if next+int64(walHeaderSize) > size {
+			return offset, nil
+		}
+		following := make([]byte, walHeaderSize)
+		if _, err := file.ReadAt(following, next); err != nil {
+			return 0, err
+		}
+		if validHeader(following) {
+			return 0, fmt.Errorf("corrupt record at offset %d is followed by an intact record at offset %d", offset, next)
+		}
+		return offset, nil
+	}
+
+	rest := make([]byte, size-offset-int64(walHeaderSize))
+	if _, err := file.ReadAt(rest, offset+int64(walHeaderSize)); err != nil && err != io.EOF {
+		return 0, err
+	}
+	if isZero(header) || isZero(rest) {
+		return offset, nil
+	}
+	return 0, fmt.Errorf("corrupt record header at offset %d is followed by %d bytes of data", offset, len(rest))
+}
+
+// isZero reports whether every byte of the slice is zero, which is how a filesystem fills space that was never written
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
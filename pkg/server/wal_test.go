@@ -0,0 +1,566 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	kvstore "kvstore/pkg/server"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecoverFromLog(t *testing.T) {
+	dir := t.TempDir()
+	config := &kvstore.Config{DataDir: dir, SyncPolicy: kvstore.SyncAlways}
+
+	store, err := kvstore.NewKVServer(2, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "a", Value: []byte("1"), ShardIdx: 0}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "b", Value: []byte("2"), ShardIdx: 1}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "a", Value: []byte("3"), ShardIdx: 0}, &kvstore.SetReply{})
+	store.Delete(&kvstore.DeleteArgs{Key: "b", ShardIdx: 1}, &kvstore.DeleteReply{})
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	recovered, err := kvstore.NewKVServer(2, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	getReply := &kvstore.GetReply{}
+	recovered.Get(&kvstore.GetArgs{Key: "a", ShardIdx: 0}, getReply)
+	if !getReply.Exists || string(getReply.Value) != "3" {
+		t.Errorf("Expected recovered value '3', got '%s' (exists=%v)", getReply.Value, getReply.Exists)
+	}
+
+	existsReply := &kvstore.ExistsReply{}
+	recovered.Exists(&kvstore.ExistsArgs{Key: "b", ShardIdx: 1}, existsReply)
+	if existsReply.Exists {
+		t.Errorf("Expected deleted key to stay deleted after recovery")
+	}
+}
+
+func TestRecoverFromTornLog(t *testing.T) {
+	dir := t.TempDir()
+	config := &kvstore.Config{DataDir: dir, SyncPolicy: kvstore.SyncInterval, SyncInterval: time.Millisecond}
+
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "kept", Value: []byte("yes")}, &kvstore.SetReply{})
+	store.Close()
+
+	// Simulate a crash in the middle of appending a record
+	file, err := os.OpenFile(filepath.Join(dir, "shard-0", "0000000000000001.wal"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	file.Write([]byte{42, 0, 0, 0, 1, 2})
+	file.Close()
+
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	recovered.Set(&kvstore.SetArgs{Key: "after", Value: []byte("crash")}, &kvstore.SetReply{})
+	recovered.Close()
+
+	// Records written after the torn one must survive another restart
+	reopened, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on second recovery: %v", err)
+	}
+	defer reopened.Close()
+
+	lengthReply := &kvstore.LengthReply{}
+	reopened.Length(&kvstore.LengthArgs{}, lengthReply)
+	if lengthReply.Length != 2 {
+		t.Errorf("Expected length 2, got %d", lengthReply.Length)
+	}
+}
+
+func TestRecoverFromCorruptLog(t *testing.T) {
+	dir := t.TempDir()
+	config := &kvstore.Config{DataDir: dir, SyncPolicy: kvstore.SyncAlways}
+
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	for _, key := range []string{"first", "middle", "last"} {
+		store.Set(&kvstore.SetArgs{Key: key, Value: []byte("value")}, &kvstore.SetReply{})
+	}
+	store.Close()
+
+	// Damage a record that intact records follow, which no interrupted write can cause
+	path := filepath.Join(dir, "shard-0", "0000000000000001.wal")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	idx := bytes.Index(data, []byte("middle"))
+	if idx < 0 {
+		t.Fatalf("Expected the log to hold the middle record")
+	}
+	data[idx] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	if _, err := kvstore.NewKVServer(1, config); err == nil {
+		t.Fatalf("Expected recovery to fail instead of dropping the records after the corrupt one")
+	}
+	if after, _ := os.ReadFile(path); len(after) != len(data) {
+		t.Errorf("Expected the log to be left as it was, got %d bytes instead of %d", len(after), len(data))
+	}
+}
+
+func TestRecoverFromTornLogWithEmbeddedRecord(t *testing.T) {
+	dir := t.TempDir()
+	config := &kvstore.Config{DataDir: dir, SyncPolicy: kvstore.SyncAlways}
+
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "kept", Value: []byte("yes")}, &kvstore.SetReply{})
+
+	// Store a copy of the log as a value, so the next record holds an intact frame
+	path := filepath.Join(dir, "shard-0", "0000000000000001.wal")
+	embedded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "torn", Value: append(embedded, []byte("padding")...)}, &kvstore.SetReply{})
+	store.Close()
+
+	// Simulate a crash in the middle of appending that record
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat log: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatalf("Failed to truncate log: %v", err)
+	}
+
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	lengthReply := &kvstore.LengthReply{}
+	recovered.Length(&kvstore.LengthArgs{}, lengthReply)
+	if lengthReply.Length != 1 {
+		t.Errorf("Expected length 1, got %d", lengthReply.Length)
+	}
+}
+
+func TestInvalidSyncPolicy(t *testing.T) {
+	if _, err := kvstore.ParseSyncPolicy("sometimes"); err == nil {
+		t.Errorf("Expected error for unknown sync policy")
+	}
+
+	config := &kvstore.Config{DataDir: t.TempDir(), SyncPolicy: kvstore.SyncBatch}
+	if _, err := kvstore.NewKVServer(1, config); err == nil {
+		t.Errorf("Expected error for batch policy without a batch size")
+	}
+}
+
+func TestRecoverFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	config := &kvstore.Config{DataDir: dir, SyncPolicy: kvstore.SyncAlways, SnapshotRetention: 1}
+
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "a", Value: []byte("1")}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "b", Value: []byte("2")}, &kvstore.SetReply{})
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "c", Value: []byte("3")}, &kvstore.SetReply{})
+	store.Delete(&kvstore.DeleteArgs{Key: "a"}, &kvstore.DeleteReply{})
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "d", Value: []byte("4")}, &kvstore.SetReply{})
+	store.Close()
+
+	// Only the newest snapshot and the log tail written after it should remain
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "shard-0", "*.snap"))
+	segments, _ := filepath.Glob(filepath.Join(dir, "shard-0", "*.wal"))
+	if len(snapshots) != 1 || len(segments) != 1 {
+		t.Errorf("Expected 1 snapshot and 1 log segment, got %d and %d", len(snapshots), len(segments))
+	}
+
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	for key, want := range map[string]string{"b": "2", "c": "3", "d": "4"} {
+		getReply := &kvstore.GetReply{}
+		recovered.Get(&kvstore.GetArgs{Key: key}, getReply)
+		if !getReply.Exists || string(getReply.Value) != want {
+			t.Errorf("Expected value '%s' for key %s, got '%s' (exists=%v)", want, key, getReply.Value, getReply.Exists)
+		}
+	}
+
+	existsReply := &kvstore.ExistsReply{}
+	recovered.Exists(&kvstore.ExistsArgs{Key: "a"}, existsReply)
+	if existsReply.Exists {
+		t.Errorf("Expected deleted key to stay deleted after recovery")
+	}
+}
+
+func TestRecoverVersions(t *testing.T) {
+	dir := t.TempDir()
+	config := &kvstore.Config{DataDir: dir, SyncPolicy: kvstore.SyncAlways}
+
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "a", Value: []byte("1")}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "b", Value: []byte("2")}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "b", Value: []byte("3")}, &kvstore.SetReply{})
+	before := &kvstore.GetReply{}
+	store.Get(&kvstore.GetArgs{Key: "b"}, before)
+	store.Delete(&kvstore.DeleteArgs{Key: "b"}, &kvstore.DeleteReply{})
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	store.Close()
+
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	// The snapshot keeps the revision, so the deleted key's version is not handed out again
+	recovered.Set(&kvstore.SetArgs{Key: "b", Value: []byte("4")}, &kvstore.SetReply{})
+	after := &kvstore.GetReply{}
+	recovered.Get(&kvstore.GetArgs{Key: "b"}, after)
+	if after.Version <= before.Version {
+		t.Errorf("Expected a version above %d after recovery, got %d", before.Version, after.Version)
+	}
+	swapReply := &kvstore.CompareAndSwapReply{}
+	recovered.CompareAndSwap(&kvstore.CompareAndSwapArgs{Key: "b", ExpectedVersion: before.Version, Value: []byte("5")}, swapReply)
+	if swapReply.Swapped {
+		t.Errorf("Expected a swap at the version from before the delete to fail")
+	}
+}
+
+func TestRecoverBinaryValues(t *testing.T) {
+	config := &kvstore.Config{DataDir: t.TempDir(), SyncPolicy: kvstore.SyncAlways, MaxValueSize: 8}
+
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	binary := []byte{0, 0xff, '\n', 0x80, 0}
+	if err := store.Set(&kvstore.SetArgs{Key: "bin\x00key", Value: binary}, &kvstore.SetReply{}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Set(&kvstore.SetArgs{Key: "empty", Value: []byte{}}, &kvstore.SetReply{}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Values over the limit are rejected by every write, and only the oversized items of a batch fail
+	err = store.Set(&kvstore.SetArgs{Key: "large", Value: make([]byte, 9)}, &kvstore.SetReply{})
+	if !kvstore.IsValueTooLarge(err) {
+		t.Errorf("Expected ErrValueTooLarge from Set, got %v", err)
+	}
+	err = store.CompareAndSwap(&kvstore.CompareAndSwapArgs{Key: "large", Value: make([]byte, 9)}, &kvstore.CompareAndSwapReply{})
+	if !kvstore.IsValueTooLarge(err) {
+		t.Errorf("Expected ErrValueTooLarge from CompareAndSwap, got %v", err)
+	}
+	multiReply := &kvstore.MultiSetReply{}
+	store.MultiSet(&kvstore.MultiSetArgs{Items: []kvstore.BatchItem{{Key: "small", Value: []byte("ok")}, {Key: "large", Value: make([]byte, 9)}}}, multiReply)
+	if multiReply.Results[0].Err != "" || !kvstore.IsValueTooLarge(errors.New(multiReply.Results[1].Err)) {
+		t.Errorf("Expected only the large item to fail, got %+v", multiReply.Results)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	want := map[string][]byte{"bin\x00key": binary, "empty": {}, "small": []byte("ok")}
+	for key, value := range want {
+		getReply := &kvstore.GetReply{}
+		recovered.Get(&kvstore.GetArgs{Key: key}, getReply)
+		if !getReply.Exists || !bytes.Equal(getReply.Value, value) {
+			t.Errorf("Expected recovered value %x for key %q, got %x (exists=%v)", value, key, getReply.Value, getReply.Exists)
+		}
+	}
+	existsReply := &kvstore.ExistsReply{}
+	recovered.Exists(&kvstore.ExistsArgs{Key: "large"}, existsReply)
+	if existsReply.Exists {
+		t.Errorf("Expected the rejected key to be missing after recovery")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	config := &kvstore.Config{DataDir: t.TempDir(), SyncPolicy: kvstore.SyncAlways}
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "{user:42}:profile", Value: []byte("v1")}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "{user:42}:session", Value: []byte("token")}, &kvstore.SetReply{})
+
+	// A failed compare applies nothing
+	ops := []kvstore.TxnOp{
+		{Key: "{user:42}:profile", Value: []byte("v2")},
+		{Key: "{user:42}:settings", Value: []byte("dark")},
+		{Key: "{user:42}:session", Delete: true},
+	}
+	reply := &kvstore.TxnReply{}
+	compares := []kvstore.TxnCompare{{Key: "{user:42}:profile", Target: kvstore.CompareValue, Value: []byte("v0")}}
+	if err := store.Txn(&kvstore.TxnArgs{Compares: compares, Ops: ops}, reply); err != nil || reply.Succeeded {
+		t.Fatalf("Expected the transaction to fail its compare, got succeeded=%v err=%v", reply.Succeeded, err)
+	}
+	existsReply := &kvstore.ExistsReply{}
+	if store.Exists(&kvstore.ExistsArgs{Key: "{user:42}:settings"}, existsReply); existsReply.Exists {
+		t.Errorf("Expected a failed transaction to write nothing")
+	}
+
+	reply = &kvstore.TxnReply{}
+	compares = []kvstore.TxnCompare{
+		{Key: "{user:42}:profile", Target: kvstore.CompareValue, Value: []byte("v1")},
+		{Key: "{user:42}:settings", Target: kvstore.CompareVersion, Version: 0},
+	}
+	if err := store.Txn(&kvstore.TxnArgs{Compares: compares, Ops: ops}, reply); err != nil || !reply.Succeeded {
+		t.Fatalf("Expected the transaction to apply, got succeeded=%v err=%v", reply.Succeeded, err)
+	}
+
+	err = store.Txn(&kvstore.TxnArgs{Ops: []kvstore.TxnOp{{Key: "{user:42}:a"}, {Key: "{user:7}:a"}}}, &kvstore.TxnReply{})
+	if !kvstore.IsCrossShardTxn(err) {
+		t.Errorf("Expected ErrCrossShardTxn for keys with different hash tags, got %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The writes of the transaction are replayed together
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	want := map[string]string{"{user:42}:profile": "v2", "{user:42}:settings": "dark"}
+	for key, value := range want {
+		getReply := &kvstore.GetReply{}
+		recovered.Get(&kvstore.GetArgs{Key: key}, getReply)
+		if string(getReply.Value) != value {
+			t.Errorf("Expected recovered value '%s' for key %s, got '%s'", value, key, getReply.Value)
+		}
+	}
+	existsReply = &kvstore.ExistsReply{}
+	if recovered.Exists(&kvstore.ExistsArgs{Key: "{user:42}:session"}, existsReply); existsReply.Exists {
+		t.Errorf("Expected the deleted key to stay deleted after recovery")
+	}
+}
+
+func TestRecoverPreparedTxn(t *testing.T) {
+	config := &kvstore.Config{DataDir: t.TempDir(), SyncPolicy: kvstore.SyncAlways}
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	store.Set(&kvstore.SetArgs{Key: "alice", Value: []byte("100")}, &kvstore.SetReply{})
+
+	self := kvstore.ShardLocation{Socket: "localhost:0"}
+	prepare := &kvstore.PrepareTxnArgs{
+		TxnID:        "t1",
+		Compares:     []kvstore.TxnCompare{{Key: "alice", Target: kvstore.CompareValue, Value: []byte("100")}},
+		Ops:          []kvstore.TxnOp{{Key: "alice", Value: []byte("70")}, {Key: "bob", Value: []byte("30")}},
+		Self:         self,
+		Primary:      self,
+		Participants: []kvstore.ShardLocation{self},
+	}
+	reply := &kvstore.PrepareTxnReply{}
+	if err := store.PrepareTxn(prepare, reply); err != nil || !reply.Prepared {
+		t.Fatalf("Expected the transaction to prepare, got prepared=%v err=%v", reply.Prepared, err)
+	}
+
+	// Prepared keys are locked against other transactions and plain writes
+	conflicting := &kvstore.PrepareTxnArgs{TxnID: "t2", Ops: []kvstore.TxnOp{{Key: "bob", Delete: true}}, Self: self, Primary: self, Participants: []kvstore.ShardLocation{self}}
+	if err := store.PrepareTxn(conflicting, &kvstore.PrepareTxnReply{}); !kvstore.IsKeyLocked(err) {
+		t.Errorf("Expected ErrKeyLocked for a conflicting prepare, got %v", err)
+	}
+	if err := store.Set(&kvstore.SetArgs{Key: "alice", Value: []byte("0")}, &kvstore.SetReply{}); !kvstore.IsKeyLocked(err) {
+		t.Errorf("Expected ErrKeyLocked for a write of a prepared key, got %v", err)
+	}
+	if err := store.ReplicaSet(&kvstore.ReplicaSetArgs{Key: "bob", Value: []byte("0"), Timestamp: time.Now().UnixNano()}, &kvstore.ReplicaSetReply{}); !kvstore.IsKeyLocked(err) {
+		t.Errorf("Expected ErrKeyLocked for a replica write of a prepared key, got %v", err)
+	}
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The prepared transaction and its record survive a restart
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	if err := recovered.Set(&kvstore.SetArgs{Key: "bob", Value: []byte("0")}, &kvstore.SetReply{}); !kvstore.IsKeyLocked(err) {
+		t.Errorf("Expected the prepared key to stay locked after recovery, got %v", err)
+	}
+	if err := recovered.CommitTxn(&kvstore.CommitTxnArgs{TxnID: "t1"}, &kvstore.CommitTxnReply{}); err != nil {
+		t.Fatalf("CommitTxn failed: %v", err)
+	}
+	for key, value := range map[string]string{"alice": "70", "bob": "30"} {
+		getReply := &kvstore.GetReply{}
+		recovered.Get(&kvstore.GetArgs{Key: key}, getReply)
+		if string(getReply.Value) != value {
+			t.Errorf("Expected committed value '%s' for key %s, got '%s'", value, key, getReply.Value)
+		}
+	}
+	if err := recovered.Set(&kvstore.SetArgs{Key: "bob", Value: []byte("0")}, &kvstore.SetReply{}); err != nil {
+		t.Errorf("Expected the commit to release the lock, got %v", err)
+	}
+
+	statusReply := &kvstore.TxnStatusReply{}
+	if err := recovered.TxnStatus(&kvstore.TxnStatusArgs{TxnID: "t1"}, statusReply); err != nil || statusReply.State != kvstore.TxnCommitted {
+		t.Errorf("Expected the transaction to be committed, got state=%v err=%v", statusReply.State, err)
+	}
+
+	// A transaction the primary does not know is aborted, so a late prepare of it fails
+	statusReply = &kvstore.TxnStatusReply{}
+	if err := recovered.TxnStatus(&kvstore.TxnStatusArgs{TxnID: "t3"}, statusReply); err != nil || statusReply.State != kvstore.TxnAborted {
+		t.Errorf("Expected an unknown transaction to be aborted, got state=%v err=%v", statusReply.State, err)
+	}
+	late := &kvstore.PrepareTxnArgs{TxnID: "t3", Ops: []kvstore.TxnOp{{Key: "carol", Value: []byte("1")}}, Self: self, Primary: self, Participants: []kvstore.ShardLocation{self}}
+	if err := recovered.PrepareTxn(late, &kvstore.PrepareTxnReply{}); !kvstore.IsTxnAborted(err) {
+		t.Errorf("Expected ErrTxnAborted for a late prepare, got %v", err)
+	}
+}
+
+func TestRecoverHistory(t *testing.T) {
+	config := &kvstore.Config{DataDir: t.TempDir(), SyncPolicy: kvstore.SyncAlways, HistoryRetention: time.Hour}
+	store, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+
+	var times []int64
+	write := func(key string, value string) {
+		if value == "" {
+			store.Delete(&kvstore.DeleteArgs{Key: key}, &kvstore.DeleteReply{})
+		} else {
+			store.Set(&kvstore.SetArgs{Key: key, Value: []byte(value)}, &kvstore.SetReply{})
+		}
+		time.Sleep(time.Millisecond)
+		times = append(times, time.Now().UnixNano())
+	}
+	write("color", "red")
+	write("color", "green")
+	write("color", "")
+	write("shape", "circle")
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	write("color", "blue")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Versions from both the snapshot and the log survive a restart
+	recovered, err := kvstore.NewKVServer(1, config)
+	if err != nil {
+		t.Fatalf("NewKVServer failed on recovery: %v", err)
+	}
+	defer recovered.Close()
+
+	expected := []string{"red", "green", "", "", "blue"}
+	for i, value := range expected {
+		reply := &kvstore.GetAtReply{}
+		if err := recovered.GetAt(&kvstore.GetAtArgs{Key: "color", Timestamp: times[i]}, reply); err != nil {
+			t.Fatalf("GetAt failed: %v", err)
+		}
+		if reply.Exists != (value != "") || string(reply.Value) != value {
+			t.Errorf("Expected '%s' at the time of write %d, got '%s' (exists=%v)", value, i, reply.Value, reply.Exists)
+		}
+	}
+	reply := &kvstore.GetAtReply{}
+	if recovered.GetAt(&kvstore.GetAtArgs{Key: "shape", Timestamp: times[2]}, reply); reply.Exists {
+		t.Errorf("Expected shape to be missing before it was written")
+	}
+	future := time.Now().Add(time.Minute).UnixNano()
+	if err := recovered.GetAt(&kvstore.GetAtArgs{Key: "color", Timestamp: future}, &kvstore.GetAtReply{}); err == nil {
+		t.Errorf("Expected a read too far in the future to be rejected")
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	store, err := kvstore.NewKVServer(1, &kvstore.Config{HistoryRetention: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Set(&kvstore.SetArgs{Key: "color", Value: []byte("red")}, &kvstore.SetReply{})
+	store.Set(&kvstore.SetArgs{Key: "color", Value: []byte("green")}, &kvstore.SetReply{})
+	before := time.Now().UnixNano()
+	time.Sleep(200 * time.Millisecond)
+
+	err = store.GetAt(&kvstore.GetAtArgs{Key: "color", Timestamp: before}, &kvstore.GetAtReply{})
+	if !kvstore.IsCompacted(err) {
+		t.Errorf("Expected ErrCompacted for a read before the horizon, got %v", err)
+	}
+	reply := &kvstore.GetAtReply{}
+	if err := store.GetAt(&kvstore.GetAtArgs{Key: "color", Timestamp: time.Now().UnixNano()}, reply); err != nil || string(reply.Value) != "green" {
+		t.Errorf("Expected the current version to outlive compaction, got '%s' (err=%v)", reply.Value, err)
+	}
+}
+
+func TestReadAtFutureTime(t *testing.T) {
+	store, err := kvstore.NewKVServer(1, &kvstore.Config{HistoryRetention: time.Hour})
+	if err != nil {
+		t.Fatalf("NewKVServer failed: %v", err)
+	}
+	defer store.Close()
+
+	// A read at a time that has not yet come waits for it, and sees the writes committed before it
+	at := time.Now().Add(100 * time.Millisecond)
+	done := make(chan *kvstore.GetAtReply, 1)
+	go func() {
+		reply := &kvstore.GetAtReply{}
+		if err := store.GetAt(&kvstore.GetAtArgs{Key: "color", Timestamp: at.UnixNano()}, reply); err != nil {
+			t.Errorf("GetAt failed: %v", err)
+		}
+		done <- reply
+	}()
+	time.Sleep(20 * time.Millisecond)
+	store.Set(&kvstore.SetArgs{Key: "color", Value: []byte("red")}, &kvstore.SetReply{})
+
+	reply := <-done
+	if time.Now().Before(at) {
+		t.Errorf("Expected the read to wait until its time was safe")
+	}
+	if string(reply.Value) != "red" {
+		t.Errorf("Expected the write before the read's time to be seen, got '%s'", reply.Value)
+	}
+}
@@ -0,0 +1,181 @@
+// watch.go
+// This file contains the change feeds of the shards, which let clients watch keys instead of polling them
+// Every shard keeps its most recent applied writes in a bounded feed, each one tagged with the revision it was applied at
+// Watchers long-poll a shard for the changes after the last revision they saw, so a watcher that reconnects resumes where it stopped
+// Changes that fell out of the feed are gone, and watchers that are that far behind are told so with ErrRevisionCompacted
+// Keys deleted because their range was migrated away are not reported, since they moved rather than changed
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultWatchBufferSize is the number of changes every shard's feed keeps if the config does not set it
+	defaultWatchBufferSize = 1024
+	// maxWatchWait bounds how long a single watch call waits for a change
+	maxWatchWait = time.Minute
+)
+
+// ErrRevisionCompacted is returned for watches that resume from a revision whose later changes are no longer in the shard's feed
+// net/rpc only transmits the error message, so callers should test for it with IsRevisionCompacted
+var ErrRevisionCompacted = errors.New("requested revision is older than the change feed")
+
+// IsRevisionCompacted reports whether an error returned by a server means that a watch fell too far behind to resume
+func IsRevisionCompacted(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrRevisionCompacted.Error())
+}
+
+// A changeFeed holds the latest changes of a shard in the order they were applied
+// Every change after the start revision is still in the feed, older ones have been dropped to keep at most size changes
+// Watchers waiting for a change wait for the changed signal, which the next change raises
+type changeFeed struct {
+	events  []ChangeEvent
+	size    int
+	start   uint64
+	changed signal
+}
+
+// newChangeFeed returns an empty feed that keeps at most size changes
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{size: size}
+}
+
+// append adds a change to the feed, dropping the oldest one if the feed is full, and wakes the waiting watchers
+// Writes imported from another shard keep the version they had there, which may be behind the feed, and they are left out so that the feed stays in revision order
+// The caller must hold the shard's write lock
+func (feed *changeFeed) append(event ChangeEvent) {
+	if event.Version <= feed.latest() {
+		return
+	}
+	if len(feed.events) == feed.size {
+		feed.start = max(feed.start, feed.events[0].Version)
+		feed.events = feed.events[1:]
+	}
+	feed.events = append(feed.events, event)
+	feed.changed.notify()
+}
+
+// latest returns the revision of the newest change in the feed, or its start revision if it is empty
+func (feed *changeFeed) latest() uint64 {
+	if len(feed.events) == 0 {
+		return feed.start
+	}
+	return feed.events[len(feed.events)-1].Version
+}
+
+// reset drops every change and starts the feed over at a revision, which makes watchers that are behind it fail with ErrRevisionCompacted
+// Shards reset their feed when their keys are replaced other than by applying writes, since the feed does not tell what changed then
+// The caller must hold the shard's write lock
+func (feed *changeFeed) reset(revision uint64) {
+	feed.events = nil
+	feed.start = revision
+	feed.changed.notify()
+}
+
+// Watch is an RPC method that returns the changes of a key or prefix a shard applied after a revision
+// If there are none yet, it waits until there are or until the requested wait or the request's deadline has passed, and then returns no changes
+// Watches of a key check that the shard owns it, and watches of a prefix that the shard serves clients, on shards in a Raft group every member answers
+func (store *KVServer) Watch(args *WatchArgs, reply *WatchReply) error {
+	deadline := requestDeadline(args.Timeout)
+	if err := store.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+
+	shard, err := store.getShard(args.ShardIdx)
+	if err != nil {
+		return err
+	}
+
+	wait := args.Wait
+	if wait <= 0 || wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+	if !deadline.IsZero() {
+		wait = min(wait, time.Until(deadline))
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		changed, err := shard.changes(args, reply)
+		if err != nil || changed == nil || len(reply.Events) > 0 {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// changes fills the reply with the changes of the watched keys after the requested revision and the revision to continue from
+// It returns a channel that is closed by the next change, or nil if the watch asked for the latest revision and there is nothing to wait for
+func (shard *Shard) changes(args *WatchArgs, reply *WatchReply) (<-chan struct{}, error) {
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if shard.group == nil {
+		if !args.Prefix {
+			if err := shard.checkOwnership(args.Key); err != nil {
+				return nil, err
+			}
+		} else if !shard.primary {
+			return nil, fmt.Errorf("%v: %s", ErrNotPrimary, args.Key)
+		}
+	}
+
+	reply.Revision = max(args.Revision, shard.revision)
+	if args.Latest {
+		return nil, nil
+	}
+	if args.Revision < shard.feed.start {
+		return nil, fmt.Errorf("%v: revision %d of %s, the feed starts after %d", ErrRevisionCompacted, args.Revision, args.Key, shard.feed.start)
+	}
+
+	for _, event := range shard.feed.events {
+		if event.Version <= args.Revision {
+			continue
+		}
+		if event.Key == args.Key || (args.Prefix && strings.HasPrefix(event.Key, args.Key)) {
+			reply.Events = append(reply.Events, event)
+		}
+	}
+	return shard.feed.changed.wait(), nil
+}
+
+// publish adds an applied write to the shard's change feed, shards that are not served by the server, such as scratch shards, have none
+// The caller must hold the shard's write lock
+func (shard *Shard) publish(event ChangeEvent) {
+	if shard.feed == nil || (len(shard.moved) > 0 && shard.moved.ContainsKey(event.Key)) {
+		return
+	}
+	shard.feed.append(event)
+}
+
+// resetFeed starts the shard's change feed over at its current revision
+// The caller must hold the shard's write lock
+func (shard *Shard) resetFeed() {
+	if shard.feed != nil {
+		shard.feed.reset(shard.revision)
+	}
+}
+
+// newShard initializes an empty shard that is served by the server, along with its change feed
+func (store *KVServer) newShard() *Shard {
+	shard := NewShard()
+	shard.feed = newChangeFeed(store.watchBufferSize())
+	return shard
+}
+
+// watchBufferSize returns the number of changes every shard's feed keeps
+func (store *KVServer) watchBufferSize() int {
+	if store.config.WatchBufferSize <= 0 {
+		return defaultWatchBufferSize
+	}
+	return store.config.WatchBufferSize
+}